@@ -0,0 +1,381 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 账户健康状态
+const (
+	AccountHealthy     AccountHealthState = "healthy"      // 正常
+	AccountDegraded    AccountHealthState = "degraded"     // 最近失败过，仍可使用但排在健康账户之后
+	AccountCoolingDown AccountHealthState = "cooling-down" // 连续失败，冷却期内不分配请求
+	AccountExhausted   AccountHealthState = "exhausted"    // 配额用完，冷却期内不分配请求
+	AccountDisabled    AccountHealthState = "disabled"     // 管理员停用或静态JWT已过期
+)
+
+// maxAccountHealthEvents 保留的最近状态变化事件数
+const maxAccountHealthEvents = 200
+
+// healthMutex 保护所有账户的健康状态、调度状态 (停用、退出、排空和权重) 字段和事件列表
+var (
+	healthMutex         sync.Mutex
+	accountHealthEvents []AccountHealthEvent
+)
+
+// 健康检查参数，可通过环境变量配置
+var (
+	accountFailureThreshold  = 3
+	accountCooldownBase      = 30 * time.Second
+	accountCooldownMax       = 30 * time.Minute
+	accountExhaustedCooldown = 10 * time.Minute
+)
+
+// loadAccountHealthConfig loads the failure threshold and cooldowns from environment variables
+func loadAccountHealthConfig() {
+	value := getEnvWithDefault("ACCOUNT_FAILURE_THRESHOLD", strconv.Itoa(accountFailureThreshold))
+	if threshold, err := strconv.Atoi(value); err == nil && threshold > 0 {
+		accountFailureThreshold = threshold
+	} else {
+		Warn("Invalid ACCOUNT_FAILURE_THRESHOLD=%q, using %d", value, accountFailureThreshold)
+	}
+	accountCooldownBase = parseDurationEnv("ACCOUNT_COOLDOWN_BASE", accountCooldownBase)
+	accountCooldownMax = parseDurationEnv("ACCOUNT_COOLDOWN_MAX", accountCooldownMax)
+	accountExhaustedCooldown = parseDurationEnv("ACCOUNT_EXHAUSTED_COOLDOWN", accountExhaustedCooldown)
+}
+
+// parseDurationEnv parses a positive duration, invalid values keep the default
+func parseDurationEnv(name string, defaultValue time.Duration) time.Duration {
+	value := getEnvWithDefault(name, "")
+	if value == "" {
+		return defaultValue
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration <= 0 {
+		Warn("Invalid %s=%q, using %s", name, value, defaultValue)
+		return defaultValue
+	}
+	return duration
+}
+
+// accountHealthState 返回账户的健康状态 (调用方持有 healthMutex)
+// 停用和已退出的账户总是 disabled
+func accountHealthState(account *JetbrainsAccount) AccountHealthState {
+	if account.Disabled || account.Retired {
+		return AccountDisabled
+	}
+	if account.Health == "" || account.Health == AccountDisabled {
+		return AccountHealthy
+	}
+	return account.Health
+}
+
+// getAccountHealth 返回账户的健康状态
+func getAccountHealth(account *JetbrainsAccount) AccountHealthState {
+	healthMutex.Lock()
+	defer healthMutex.Unlock()
+	return accountHealthState(account)
+}
+
+// transitionAccount 切换账户状态并记录事件 (调用方持有 healthMutex)
+func transitionAccount(account *JetbrainsAccount, to AccountHealthState, reason string) {
+	from := accountHealthState(account)
+	account.Health = to
+	recordHealthEvent(account, from, accountHealthState(account), reason)
+}
+
+// recordHealthEvent 记录状态变化事件并写日志，状态未变化时忽略 (调用方持有 healthMutex)
+func recordHealthEvent(account *JetbrainsAccount, from, to AccountHealthState, reason string) {
+	if from == to {
+		return
+	}
+	account.HealthChangedAt = time.Now()
+
+	event := AccountHealthEvent{
+		Time:    account.HealthChangedAt,
+		Account: getTokenDisplayName(account),
+		From:    from,
+		To:      to,
+		Reason:  reason,
+	}
+	accountHealthEvents = append(accountHealthEvents, event)
+	if len(accountHealthEvents) > maxAccountHealthEvents {
+		accountHealthEvents = accountHealthEvents[len(accountHealthEvents)-maxAccountHealthEvents:]
+	}
+
+	if to == AccountHealthy {
+		Info("Account %s: %s -> %s (%s)", event.Account, from, to, reason)
+	} else {
+		Warn("Account %s: %s -> %s (%s)", event.Account, from, to, reason)
+	}
+}
+
+// cooldownFor 指数退避的冷却时间：base * 2^level，不超过上限
+func cooldownFor(base time.Duration, level int) time.Duration {
+	cooldown := base
+	for i := 0; i < level && cooldown < accountCooldownMax; i++ {
+		cooldown *= 2
+	}
+	return min(cooldown, max(accountCooldownMax, base))
+}
+
+// accountEligible 检查账户是否可以分配给新请求，只读取本地状态，不访问网络
+// 冷却期结束的账户处于半开状态：同一时间只允许一个探测请求
+func accountEligible(account *JetbrainsAccount, now time.Time) bool {
+	healthMutex.Lock()
+	defer healthMutex.Unlock()
+	// 与 accountLeasable 相同的检查，这里已经持有 healthMutex
+	if account.Retired || account.Disabled || account.Draining {
+		return false
+	}
+	switch accountHealthState(account) {
+	case AccountCoolingDown, AccountExhausted:
+		return !now.Before(account.CooldownUntil) && !account.Probing
+	default:
+		return true
+	}
+}
+
+// accountHealthRank 选择账户时的优先级：健康账户优先，其次是降级账户，最后是半开探测
+func accountHealthRank(account *JetbrainsAccount) int {
+	healthMutex.Lock()
+	defer healthMutex.Unlock()
+	switch accountHealthState(account) {
+	case AccountHealthy:
+		return 0
+	case AccountDegraded:
+		return 1
+	default:
+		return 2
+	}
+}
+
+// beginAccountAttempt 在访问网络之前确认账户仍然可用，处于半开状态的账户在此占用探测名额
+func beginAccountAttempt(account *JetbrainsAccount) bool {
+	healthMutex.Lock()
+	defer healthMutex.Unlock()
+	switch accountHealthState(account) {
+	case AccountDisabled:
+		return false
+	case AccountCoolingDown, AccountExhausted:
+		if time.Now().Before(account.CooldownUntil) || account.Probing {
+			return false
+		}
+		account.Probing = true
+		Info("Account %s cooldown ended, probing (%s)", getTokenDisplayName(account), accountHealthState(account))
+	}
+	return true
+}
+
+// endAccountProbe 释放探测名额 (请求结束时没有记录结果的情况)，下一个请求可以再次探测
+func endAccountProbe(account *JetbrainsAccount) {
+	healthMutex.Lock()
+	defer healthMutex.Unlock()
+	account.Probing = false
+}
+
+// recordAccountSuccess 请求成功，账户恢复健康并重置退避
+func recordAccountSuccess(account *JetbrainsAccount) {
+	healthMutex.Lock()
+	defer healthMutex.Unlock()
+	account.Probing = false
+	account.ConsecutiveFailures = 0
+	account.CooldownLevel = 0
+	if state := accountHealthState(account); state != AccountHealthy && state != AccountDisabled {
+		transitionAccount(account, AccountHealthy, "request succeeded")
+	}
+}
+
+// recordAccountFailure 记录一次失败 (连接错误、超时、JWT 刷新失败、401/5xx)
+// 连续失败达到阈值或探测失败时进入冷却，冷却时间指数增长
+func recordAccountFailure(account *JetbrainsAccount, reason string) {
+	healthMutex.Lock()
+	defer healthMutex.Unlock()
+	account.ConsecutiveFailures++
+	account.LastError = reason
+	probing := account.Probing
+	account.Probing = false
+
+	state := accountHealthState(account)
+	if state == AccountDisabled {
+		return
+	}
+	if probing || account.ConsecutiveFailures >= accountFailureThreshold {
+		cooldown := cooldownFor(accountCooldownBase, account.CooldownLevel)
+		account.CooldownLevel++
+		account.CooldownUntil = time.Now().Add(cooldown)
+		transitionAccount(account, AccountCoolingDown,
+			fmt.Sprintf("%s; %d consecutive failures, cooling down for %s", reason, account.ConsecutiveFailures, cooldown))
+		return
+	}
+	if state == AccountHealthy {
+		transitionAccount(account, AccountDegraded, reason)
+	}
+}
+
+// markAccountExhausted 配额用完 (477 或配额接口显示没有余量)，冷却期内不再分配请求
+// 配额接口报告了重置时间时冷却到重置时间为止，否则按指数退避，已经处于冷却期内时不重复延长
+func markAccountExhausted(account *JetbrainsAccount, reason string) {
+	now := time.Now()
+	account.stateMu.Lock()
+	account.HasQuota = false
+	account.LastQuotaCheck = float64(now.Unix())
+	resetAt := account.QuotaResetAt
+	account.stateMu.Unlock()
+
+	healthMutex.Lock()
+	defer healthMutex.Unlock()
+	account.LastError = reason
+	probing := account.Probing
+	account.Probing = false
+
+	state := accountHealthState(account)
+	if state == AccountDisabled {
+		return
+	}
+	if resetAt.After(now) {
+		account.CooldownUntil = resetAt
+		transitionAccount(account, AccountExhausted,
+			fmt.Sprintf("%s, quota resets at %s", reason, resetAt.Format(time.RFC3339)))
+		return
+	}
+	if state == AccountExhausted && !probing && now.Before(account.CooldownUntil) {
+		return
+	}
+	cooldown := cooldownFor(accountExhaustedCooldown, account.CooldownLevel)
+	account.CooldownLevel++
+	account.CooldownUntil = time.Now().Add(cooldown)
+	transitionAccount(account, AccountExhausted, fmt.Sprintf("%s, retrying in %s", reason, cooldown))
+}
+
+// markAccountQuotaAvailable 配额检查显示有余量，配额用完的账户恢复健康
+func markAccountQuotaAvailable(account *JetbrainsAccount) {
+	healthMutex.Lock()
+	defer healthMutex.Unlock()
+	if accountHealthState(account) == AccountExhausted {
+		// 退避级别在请求成功后才重置，配额接口与聊天接口不一致时 (仍然返回 477) 冷却时间继续增长
+		account.Probing = false
+		transitionAccount(account, AccountHealthy, "quota available")
+	}
+}
+
+// setAccountDisabled 停用或启用账户，启用时清除失败记录和冷却
+func setAccountDisabled(account *JetbrainsAccount, disabled bool, reason string) {
+	healthMutex.Lock()
+	defer healthMutex.Unlock()
+	from := accountHealthState(account)
+	account.Disabled = disabled
+	if !disabled {
+		account.Health = AccountHealthy
+		account.ConsecutiveFailures = 0
+		account.CooldownLevel = 0
+		account.CooldownUntil = time.Time{}
+		account.Probing = false
+	}
+	recordHealthEvent(account, from, accountHealthState(account), reason)
+}
+
+// setAccountDraining 设置或取消账户的排空状态
+func setAccountDraining(account *JetbrainsAccount, draining bool) {
+	healthMutex.Lock()
+	defer healthMutex.Unlock()
+	account.Draining = draining
+}
+
+// accountFlagsState 返回账户调度状态的快照
+func accountFlagsState(account *JetbrainsAccount) accountFlags {
+	healthMutex.Lock()
+	defer healthMutex.Unlock()
+	return accountFlags{Retired: account.Retired, Disabled: account.Disabled, Draining: account.Draining}
+}
+
+// setAccountRetired 静态JWT过期后永久退出账户池
+func setAccountRetired(account *JetbrainsAccount, reason string) {
+	account.stateMu.Lock()
+	account.HasQuota = false
+	account.stateMu.Unlock()
+
+	healthMutex.Lock()
+	defer healthMutex.Unlock()
+	from := accountHealthState(account)
+	account.Retired = true
+	recordHealthEvent(account, from, accountHealthState(account), reason)
+}
+
+// recordUpstreamStatus 根据上游响应状态更新账户健康状态
+// DRY: 所有上游聊天请求共用，代替各处理器中单独设置 HasQuota
+func recordUpstreamStatus(account *JetbrainsAccount, statusCode int) {
+	switch {
+	case statusCode == 477:
+		markAccountExhausted(account, "received 477")
+	case statusCode == http.StatusUnauthorized:
+		// JWT 可能已失效，让后台监控尽快刷新
+		recordAccountFailure(account, fmt.Sprintf("upstream returned %d", statusCode))
+		requestAccountRefresh(account)
+	case statusCode == http.StatusForbidden || statusCode == http.StatusTooManyRequests || statusCode >= 500:
+		recordAccountFailure(account, fmt.Sprintf("upstream returned %d", statusCode))
+	default:
+		// 其他 4xx 是请求本身的问题，账户工作正常
+		recordAccountSuccess(account)
+	}
+}
+
+// nextAccountAvailableAt 最早结束冷却或重置配额的账户的时间，没有可以预期的恢复时间时返回零值
+func nextAccountAvailableAt(accounts []*JetbrainsAccount) time.Time {
+	now := time.Now()
+	var next time.Time
+	for _, account := range leasableAccounts(accounts) {
+		quota := accountQuotaState(account)
+		healthMutex.Lock()
+		var availableAt time.Time
+		switch accountHealthState(account) {
+		case AccountCoolingDown, AccountExhausted:
+			availableAt = account.CooldownUntil
+		default:
+			if !quota.HasQuota {
+				availableAt = quota.ResetAt
+			}
+		}
+		healthMutex.Unlock()
+		if availableAt.After(now) && (next.IsZero() || availableAt.Before(next)) {
+			next = availableAt
+		}
+	}
+	return next
+}
+
+// getAccountHealthStats 返回所有账户的健康状态和最近的状态变化事件
+func getAccountHealthStats(accounts []*JetbrainsAccount) ([]AccountHealthInfo, []AccountHealthEvent) {
+	healthMutex.Lock()
+	defer healthMutex.Unlock()
+
+	infos := make([]AccountHealthInfo, 0, len(accounts))
+	for _, account := range accounts {
+		info := AccountHealthInfo{
+			Name:                getTokenDisplayName(account),
+			State:               accountHealthState(account),
+			ConsecutiveFailures: account.ConsecutiveFailures,
+			LastError:           account.LastError,
+			Probing:             account.Probing,
+			InFlight:            atomic.LoadInt32(&account.InFlight),
+		}
+		if !account.CooldownUntil.IsZero() && time.Now().Before(account.CooldownUntil) {
+			info.CooldownUntil = account.CooldownUntil.Format("2006-01-02 15:04:05")
+		}
+		if !account.HealthChangedAt.IsZero() {
+			info.Since = account.HealthChangedAt.Format("2006-01-02 15:04:05")
+		}
+		infos = append(infos, info)
+	}
+
+	events := make([]AccountHealthEvent, len(accountHealthEvents))
+	// 最新的事件在前
+	for i, event := range accountHealthEvents {
+		events[len(accountHealthEvents)-1-i] = event
+	}
+	return infos, events
+}
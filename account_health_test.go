@@ -0,0 +1,119 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bytedance/sonic"
+)
+
+// countingTransport counts requests sent to the upstream
+type countingTransport struct {
+	next  http.RoundTripper
+	count atomic.Int32
+}
+
+func (t *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.count.Add(1)
+	return t.next.RoundTrip(req)
+}
+
+func TestAccountHealth_CooldownAndHalfOpenProbe(t *testing.T) {
+	oldThreshold, oldBase, oldMax := accountFailureThreshold, accountCooldownBase, accountCooldownMax
+	t.Cleanup(func() {
+		accountFailureThreshold, accountCooldownBase, accountCooldownMax = oldThreshold, oldBase, oldMax
+	})
+	accountFailureThreshold, accountCooldownBase, accountCooldownMax = 2, time.Minute, time.Hour
+
+	account := testAccounts("a")[0]
+	recordAccountFailure(account, "boom")
+	if state := getAccountHealth(account); state != AccountDegraded {
+		t.Fatalf("expected degraded after one failure, got %s", state)
+	}
+	recordAccountFailure(account, "boom")
+	if state := getAccountHealth(account); state != AccountCoolingDown {
+		t.Fatalf("expected cooling-down after reaching the threshold, got %s", state)
+	}
+	if accountEligible(account, time.Now()) {
+		t.Error("account should not be eligible while cooling down")
+	}
+
+	// 冷却结束后只允许一个探测请求
+	firstCooldown := account.CooldownUntil
+	account.CooldownUntil = time.Now().Add(-time.Second)
+	if !accountEligible(account, time.Now()) || !beginAccountAttempt(account) {
+		t.Fatal("account should accept a probe after the cooldown")
+	}
+	if beginAccountAttempt(account) || accountEligible(account, time.Now()) {
+		t.Error("only one probe should be allowed at a time")
+	}
+
+	// 探测失败，冷却时间翻倍
+	start := time.Now()
+	recordAccountFailure(account, "still broken")
+	if got := account.CooldownUntil.Sub(start); got < 2*time.Minute-time.Second || got > 2*time.Minute+time.Second {
+		t.Errorf("expected the cooldown to double to 2m, got %s (first cooldown ended %s)", got, firstCooldown)
+	}
+
+	account.CooldownUntil = time.Now().Add(-time.Second)
+	beginAccountAttempt(account)
+	recordAccountSuccess(account)
+	if state := getAccountHealth(account); state != AccountHealthy || account.CooldownLevel != 0 {
+		t.Errorf("expected healthy with reset backoff after success, got %s (level %d)", state, account.CooldownLevel)
+	}
+
+	setAccountDisabled(account, true, "test")
+	if state := getAccountHealth(account); state != AccountDisabled {
+		t.Errorf("expected disabled, got %s", state)
+	}
+}
+
+func TestAccountHealth_ExhaustedAccountSkippedWithoutNetwork(t *testing.T) {
+	_, router := setupFakeUpstream(t, DefaultFakeGrazieOptions())
+	healthMutex.Lock()
+	accountHealthEvents = nil
+	healthMutex.Unlock()
+
+	w := doProxyRequest(router, "/v1/chat/completions",
+		`{"model":"test-model","messages":[{"role":"user","content":"[fake:477] hi"}]}`)
+	if w.Code != 477 {
+		t.Fatalf("expected 477, got %d: %s", w.Code, w.Body.String())
+	}
+	account := jetbrainsAccounts[0]
+	if state := getAccountHealth(account); state != AccountExhausted {
+		t.Fatalf("expected exhausted after 477, got %s", state)
+	}
+
+	transport := &countingTransport{next: httpClient.Transport}
+	httpClient = &http.Client{Transport: transport}
+	if _, err := getNextJetbrainsAccount(); err == nil || !strings.Contains(err.Error(), "exhausted") {
+		t.Errorf("expected no eligible accounts, got %v", err)
+	}
+	if n := transport.count.Load(); n != 0 {
+		t.Errorf("ineligible accounts should be skipped without network calls, got %d requests", n)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/stats", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	var stats struct {
+		AccountHealth []AccountHealthInfo  `json:"accountHealth"`
+		AccountEvents []AccountHealthEvent `json:"accountEvents"`
+	}
+	if err := sonic.Unmarshal(w.Body.Bytes(), &stats); err != nil {
+		t.Fatalf("invalid stats response: %v", err)
+	}
+	if len(stats.AccountHealth) != 1 || stats.AccountHealth[0].State != AccountExhausted {
+		t.Errorf("stats should report the exhausted account, got %+v", stats.AccountHealth)
+	}
+	if len(stats.AccountEvents) == 0 || stats.AccountEvents[0].To != AccountExhausted {
+		t.Errorf("stats should include the transition event, got %+v", stats.AccountEvents)
+	}
+	if n := transport.count.Load(); n != 0 {
+		t.Errorf("/api/stats should read cached quota without network calls, got %d requests", n)
+	}
+}
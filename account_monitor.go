@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+// 后台监控参数，可通过环境变量配置
+var (
+	quotaRefreshInterval = 10 * time.Minute
+	quotaRefreshJitter   = time.Minute
+)
+
+// accountMonitorTick 后台监控检查到期账户的间隔
+const accountMonitorTick = time.Second
+
+// accountRefreshDue 每个账户下一次刷新的时间，没有记录的账户立即刷新
+// accountRefreshTrigger 通知监控立即检查 (不阻塞发送方)
+var (
+	monitorMutex          sync.Mutex
+	monitorRunMutex       sync.Mutex // 同一时间只进行一轮刷新
+	accountRefreshDue     = make(map[*JetbrainsAccount]time.Time)
+	accountRefreshTrigger = make(chan struct{}, 1)
+)
+
+// loadAccountMonitorConfig loads the quota refresh interval and jitter from environment variables
+func loadAccountMonitorConfig() {
+	quotaRefreshInterval = parseDurationEnv("QUOTA_REFRESH_INTERVAL", quotaRefreshInterval)
+	quotaRefreshJitter = parseDurationEnv("QUOTA_REFRESH_JITTER", quotaRefreshJitter)
+}
+
+// startAccountMonitor 在后台按计划刷新 JWT 和配额
+// 每个账户的刷新时间加上随机抖动，避免所有账户同时访问上游
+func startAccountMonitor() {
+	Info("Refreshing account quota every %s (jitter up to %s)", quotaRefreshInterval, quotaRefreshJitter)
+	go func() {
+		ticker := time.NewTicker(accountMonitorTick)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-accountRefreshTrigger:
+			}
+			refreshDueAccounts(false)
+		}
+	}()
+}
+
+// requestAccountRefresh 让监控尽快刷新账户 (例如 JWT 缺失或上游返回 401)
+func requestAccountRefresh(account *JetbrainsAccount) {
+	monitorMutex.Lock()
+	delete(accountRefreshDue, account)
+	monitorMutex.Unlock()
+
+	select {
+	case accountRefreshTrigger <- struct{}{}:
+	default:
+	}
+}
+
+// refreshAccountsNow 立即刷新所有账户并等待完成 (启动时和管理接口使用)
+func refreshAccountsNow() {
+	refreshDueAccounts(true)
+}
+
+// refreshDueAccounts 并发刷新到期的账户，all 为 true 时刷新所有账户
+func refreshDueAccounts(all bool) {
+	monitorRunMutex.Lock()
+	defer monitorRunMutex.Unlock()
+
+	accounts := accountsSnapshot()
+	now := time.Now()
+
+	monitorMutex.Lock()
+	current := make(map[*JetbrainsAccount]bool, len(accounts))
+	var due []*JetbrainsAccount
+	for _, account := range accounts {
+		current[account] = true
+		if next, ok := accountRefreshDue[account]; all || !ok || !now.Before(next) {
+			due = append(due, account)
+		}
+	}
+	// 删除已经不在账户列表中的账户
+	for account := range accountRefreshDue {
+		if !current[account] {
+			delete(accountRefreshDue, account)
+		}
+	}
+	monitorMutex.Unlock()
+	pruneQuotaCache(current)
+
+	var wg sync.WaitGroup
+	for _, account := range due {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := refreshAccount(account, false); err != nil {
+				Warn("Background refresh of account %s failed: %v", getTokenDisplayName(account), err)
+			}
+			monitorMutex.Lock()
+			accountRefreshDue[account] = nextRefreshAt(account, time.Now())
+			monitorMutex.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	if len(due) > 0 {
+		saveAccountStates()
+	}
+}
+
+// nextRefreshAt 账户下一次刷新的时间
+// 配额用完且上游报告了重置时间的账户在重置时唤醒，期间不再查询配额；其他账户按间隔加抖动
+func nextRefreshAt(account *JetbrainsAccount, from time.Time) time.Time {
+	if quota := accountQuotaState(account); !quota.HasQuota && quota.ResetAt.After(time.Now()) {
+		return quota.ResetAt
+	}
+	return from.Add(nextRefreshDelay())
+}
+
+// nextRefreshDelay 刷新间隔加上随机抖动
+func nextRefreshDelay() time.Duration {
+	if quotaRefreshJitter <= 0 {
+		return quotaRefreshInterval
+	}
+	return quotaRefreshInterval + rand.N(quotaRefreshJitter)
+}
+
+// refreshAccount 刷新账户的 JWT (即将过期或 forceJWT 时) 并查询配额
+// 失败计入账户健康状态，停用的账户不访问上游
+func refreshAccount(account *JetbrainsAccount, forceJWT bool) (err error) {
+	if flags := accountFlagsState(account); flags.Disabled || flags.Retired {
+		return nil
+	}
+	_, span := startSpan(context.Background(), "account.refresh", attrAccount.String(getTokenDisplayName(account)))
+	defer func() { endSpan(span, err) }()
+
+	if isStaticJWTAccount(account) {
+		// 静态JWT无法刷新，过期后退出账户池
+		if isStaticJWTExpired(account) {
+			retireAccount(account)
+			return fmt.Errorf("static JWT expired at %s", account.ExpiryTime.Format(time.RFC3339))
+		}
+	} else if account.LicenseID != "" {
+		if err := refreshLicenseJWT(account, forceJWT); err != nil {
+			RecordAccountPoolError()
+			recordAccountFailure(account, fmt.Sprintf("JWT refresh failed: %v", err))
+			return err
+		}
+	}
+
+	if err := checkQuota(account); err != nil {
+		RecordAccountPoolError()
+		recordAccountFailure(account, fmt.Sprintf("quota check failed: %v", err))
+		return err
+	}
+	return nil
+}
+
+// refreshLicenseJWT 在 JWT 缺失、即将过期或强制刷新时获取新的 JWT
+func refreshLicenseJWT(account *JetbrainsAccount, force bool) error {
+	jwtRefreshMutex.Lock()
+	defer jwtRefreshMutex.Unlock()
+	if jwt, expiry := accountJWT(account); !force && jwt != "" && time.Now().Before(expiry.Add(-JWTRefreshTime)) {
+		return nil
+	}
+	return refreshJetbrainsJWT(account)
+}
+
+// pruneQuotaCache 删除已经不在账户列表中的账户的配额缓存
+func pruneQuotaCache(current map[*JetbrainsAccount]bool) {
+	quotaCacheMutex.Lock()
+	defer quotaCacheMutex.Unlock()
+	for account := range accountQuotaCache {
+		if !current[account] {
+			delete(accountQuotaCache, account)
+		}
+	}
+}
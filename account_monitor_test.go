@@ -0,0 +1,178 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bytedance/sonic"
+)
+
+func TestAccountMonitor_SelectionWaitsForBackgroundRefresh(t *testing.T) {
+	fake, _ := setupFakeUpstream(t, DefaultFakeGrazieOptions())
+	jetbrainsAccounts = licenseAccounts("license-2")
+	account := jetbrainsAccounts[0]
+
+	// 选择账户时不访问网络，没有 JWT 的账户交给后台监控
+	transport := &countingTransport{next: httpClient.Transport}
+	httpClient = &http.Client{Transport: transport}
+	if _, err := getNextJetbrainsAccount(); err == nil || !strings.Contains(err.Error(), "waiting for a JWT refresh") {
+		t.Fatalf("expected the account to wait for a refresh, got %v", err)
+	}
+	if n := transport.count.Load(); n != 0 {
+		t.Fatalf("account selection should not call the upstream, got %d requests", n)
+	}
+
+	refreshDueAccounts(false)
+	if account.JWT == "" || getCachedQuota(account) == nil {
+		t.Fatal("background refresh should fetch the JWT and quota")
+	}
+	if _, err := getNextJetbrainsAccount(); err != nil {
+		t.Fatalf("expected the refreshed account to be selected, got %v", err)
+	}
+	if used := fake.Usage("license-2"); used != 0 {
+		t.Errorf("refresh should not consume quota, got usage %v", used)
+	}
+
+	// 下一次刷新按间隔加抖动安排
+	monitorMutex.Lock()
+	next := accountRefreshDue[account]
+	monitorMutex.Unlock()
+	if delay := time.Until(next); delay < quotaRefreshInterval-time.Second || delay > quotaRefreshInterval+quotaRefreshJitter {
+		t.Errorf("next refresh should be scheduled within interval+jitter, got %s", delay)
+	}
+	before := transport.count.Load()
+	refreshDueAccounts(false)
+	if transport.count.Load() != before {
+		t.Error("accounts that are not due should not be refreshed")
+	}
+}
+
+func TestAdminRefreshAccounts(t *testing.T) {
+	fake, router := setupFakeUpstream(t, DefaultFakeGrazieOptions())
+	currentConfig().AdminAPIKey = testAdminKey
+	account := jetbrainsAccounts[0]
+
+	// 消耗配额后缓存仍是旧数据，手动刷新后更新
+	if w := doProxyRequest(router, "/v1/chat/completions",
+		`{"model":"test-model","messages":[{"role":"user","content":"hi"}]}`); w.Code != http.StatusOK {
+		t.Fatalf("request failed: %d %s", w.Code, w.Body.String())
+	}
+	if account.QuotaUsed != 0 {
+		t.Fatalf("quota should not be re-checked on the request path, got %v", account.QuotaUsed)
+	}
+
+	w := doAdminRequest(router, http.MethodPost, "/admin/accounts/refresh", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var resp struct {
+		Accounts []AdminAccountView `json:"accounts"`
+	}
+	if err := sonic.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("invalid response: %v", err)
+	}
+	if len(resp.Accounts) != 1 || resp.Accounts[0].QuotaUsed != fake.Usage("license-1") {
+		t.Errorf("refresh should report the current usage %v, got %+v", fake.Usage("license-1"), resp.Accounts)
+	}
+}
+
+func TestAccountMonitor_ExhaustedAccountSleepsUntilQuotaReset(t *testing.T) {
+	opts := DefaultFakeGrazieOptions()
+	opts.QuotaMaximum = opts.RequestCost
+	_, router := setupFakeUpstream(t, opts)
+	account := jetbrainsAccounts[0]
+
+	// 用完配额后，配额检查返回的 until 决定冷却和下一次刷新的时间
+	body := `{"model":"test-model","messages":[{"role":"user","content":"hi"}]}`
+	if w := doProxyRequest(router, "/v1/chat/completions", body); w.Code != http.StatusOK {
+		t.Fatalf("request failed: %d %s", w.Code, w.Body.String())
+	}
+	refreshAccountsNow()
+	resetAt := nextQuotaReset(time.Now())
+	if getAccountHealth(account) != AccountExhausted || !account.CooldownUntil.Equal(resetAt) {
+		t.Fatalf("expected exhausted until %s, got %s until %s", resetAt, getAccountHealth(account), account.CooldownUntil)
+	}
+	monitorMutex.Lock()
+	next := accountRefreshDue[account]
+	monitorMutex.Unlock()
+	if !next.Equal(resetAt) {
+		t.Errorf("exhausted account should wake up at the quota reset %s, got %s", resetAt, next)
+	}
+
+	transport := &countingTransport{next: httpClient.Transport}
+	httpClient = &http.Client{Transport: transport}
+	refreshDueAccounts(false)
+
+	// 账户池用完时 429 返回下一个账户可用的时间
+	w := doProxyRequest(router, "/v1/chat/completions", body)
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected 429, got %d: %s", w.Code, w.Body.String())
+	}
+	if !strings.Contains(w.Body.String(), "next account available at "+resetAt.Format(time.RFC3339)) {
+		t.Errorf("429 should report the next available time, got %s", w.Body.String())
+	}
+	if retryAfter := w.Header().Get("Retry-After"); retryAfter == "" || retryAfter == "0" {
+		t.Errorf("429 should set Retry-After, got %q", retryAfter)
+	}
+	if n := transport.count.Load(); n != 0 {
+		t.Errorf("exhausted accounts should not be re-checked before the reset, got %d requests", n)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/stats", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	var stats struct {
+		TokensInfo []struct {
+			QuotaResetAt string `json:"quotaResetAt"`
+		} `json:"tokensInfo"`
+	}
+	if err := sonic.Unmarshal(w.Body.Bytes(), &stats); err != nil {
+		t.Fatalf("invalid stats response: %v", err)
+	}
+	if len(stats.TokensInfo) != 1 || stats.TokensInfo[0].QuotaResetAt != resetAt.Format(time.RFC3339) {
+		t.Errorf("stats should report the quota reset time, got %+v", stats.TokensInfo)
+	}
+}
+
+// 用 -race 运行：后台刷新写入 JWT 和配额时，请求并发选择账户和转发
+func TestAccountMonitor_RefreshConcurrentWithSelection(t *testing.T) {
+	_, router := setupFakeUpstream(t, DefaultFakeGrazieOptions())
+	account := jetbrainsAccounts[0]
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for range 20 {
+			if err := refreshAccount(account, true); err != nil {
+				t.Errorf("refresh failed: %v", err)
+				return
+			}
+		}
+	}()
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 20 {
+				if selected, err := getNextJetbrainsAccount(); err == nil {
+					getTokenDisplayName(selected)
+					releaseJetbrainsAccount(selected)
+				}
+				doProxyRequest(router, "/v1/chat/completions", `{"model":"test-model","messages":[{"role":"user","content":"hi"}]}`)
+				newAdminAccountView(account, nil)
+				getLicenseDisplayName(account)
+				knownSecrets()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if !accountHasValidJWT(account) || !accountQuotaState(account).HasQuota {
+		t.Errorf("account should stay usable after concurrent refreshes, got %+v", account)
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// 账户选择策略名称 (ACCOUNT_SELECTION_STRATEGY)
+const (
+	StrategyRoundRobin     = "round-robin"
+	StrategyLeastQuotaUsed = "least-quota-used"
+	StrategyWeighted       = "weighted"
+	StrategyRandom         = "random"
+	StrategyLeastInFlight  = "least-in-flight"
+)
+
+// AccountSelector 账户选择策略
+// Order 返回候选账户的尝试顺序，getNextJetbrainsAccount 按顺序检查 JWT 和配额，选中第一个可用的账户
+type AccountSelector interface {
+	Name() string
+	Order(candidates []*JetbrainsAccount) []*JetbrainsAccount
+}
+
+// defaultAccountSelector 未配置策略 (或配置无效) 时使用轮询
+var defaultAccountSelector AccountSelector = &roundRobinSelector{}
+
+// newAccountSelector 根据策略名称创建选择器，空名称使用轮询
+func newAccountSelector(name string) (AccountSelector, error) {
+	switch name {
+	case "", StrategyRoundRobin:
+		return &roundRobinSelector{}, nil
+	case StrategyLeastQuotaUsed:
+		return leastQuotaUsedSelector{}, nil
+	case StrategyWeighted:
+		return weightedSelector{}, nil
+	case StrategyRandom:
+		return randomSelector{}, nil
+	case StrategyLeastInFlight:
+		return &leastInFlightSelector{}, nil
+	default:
+		return nil, fmt.Errorf("unknown account selection strategy %q (supported: %s, %s, %s, %s, %s)", name,
+			StrategyRoundRobin, StrategyLeastQuotaUsed, StrategyWeighted, StrategyRandom, StrategyLeastInFlight)
+	}
+}
+
+// roundRobinSelector 依次从下一个账户开始尝试
+type roundRobinSelector struct {
+	next atomic.Uint64
+}
+
+func (s *roundRobinSelector) Name() string { return StrategyRoundRobin }
+
+func (s *roundRobinSelector) Order(candidates []*JetbrainsAccount) []*JetbrainsAccount {
+	if len(candidates) == 0 {
+		return nil
+	}
+	start := int((s.next.Add(1) - 1) % uint64(len(candidates)))
+	return append(slices.Clone(candidates[start:]), candidates[:start]...)
+}
+
+// leastQuotaUsedSelector 优先使用每日配额使用比例最低的账户
+// 按比例而不是绝对用量排序，配额大的账户承担更多请求；尚未检查过配额的账户视为未使用
+type leastQuotaUsedSelector struct{}
+
+func (leastQuotaUsedSelector) Name() string { return StrategyLeastQuotaUsed }
+
+func (leastQuotaUsedSelector) Order(candidates []*JetbrainsAccount) []*JetbrainsAccount {
+	ordered := slices.Clone(candidates)
+	slices.SortStableFunc(ordered, func(a, b *JetbrainsAccount) int {
+		if ra, rb := quotaUsageRatio(a), quotaUsageRatio(b); ra != rb {
+			if ra < rb {
+				return -1
+			}
+			return 1
+		}
+		// 比例相同时剩余额度多的优先
+		qa, qb := accountQuotaState(a), accountQuotaState(b)
+		if ra, rb := qa.Total-qa.Used, qb.Total-qb.Used; ra != rb {
+			if ra > rb {
+				return -1
+			}
+			return 1
+		}
+		return 0
+	})
+	return ordered
+}
+
+// quotaUsageRatio 账户每日配额的使用比例
+func quotaUsageRatio(account *JetbrainsAccount) float64 {
+	quota := accountQuotaState(account)
+	if quota.Total <= 0 {
+		return 0
+	}
+	return quota.Used / quota.Total
+}
+
+// weightedSelector 按配置的权重加权随机排序 (Efraimidis-Spirakis 不放回抽样)
+// 权重为 0 的账户只在其他账户都不可用时使用
+type weightedSelector struct{}
+
+func (weightedSelector) Name() string { return StrategyWeighted }
+
+func (weightedSelector) Order(candidates []*JetbrainsAccount) []*JetbrainsAccount {
+	keys := make(map[*JetbrainsAccount]float64, len(candidates))
+	for _, account := range candidates {
+		weight := accountWeight(account)
+		if weight == 0 {
+			keys[account] = -1 - rand.Float64()
+			continue
+		}
+		keys[account] = math.Pow(rand.Float64(), 1/float64(weight))
+	}
+
+	ordered := slices.Clone(candidates)
+	slices.SortFunc(ordered, func(a, b *JetbrainsAccount) int {
+		if keys[a] > keys[b] {
+			return -1
+		}
+		if keys[a] < keys[b] {
+			return 1
+		}
+		return 0
+	})
+	return ordered
+}
+
+// accountWeight 账户的权重，未配置时为 1
+func accountWeight(account *JetbrainsAccount) int {
+	healthMutex.Lock()
+	defer healthMutex.Unlock()
+	if account.Weight == nil {
+		return 1
+	}
+	return *account.Weight
+}
+
+// setAccountWeight 修改账户的权重，nil 表示恢复默认值
+func setAccountWeight(account *JetbrainsAccount, weight *int) {
+	healthMutex.Lock()
+	defer healthMutex.Unlock()
+	account.Weight = weight
+}
+
+// randomSelector 随机排序
+type randomSelector struct{}
+
+func (randomSelector) Name() string { return StrategyRandom }
+
+func (randomSelector) Order(candidates []*JetbrainsAccount) []*JetbrainsAccount {
+	ordered := slices.Clone(candidates)
+	rand.Shuffle(len(ordered), func(i, j int) { ordered[i], ordered[j] = ordered[j], ordered[i] })
+	return ordered
+}
+
+// leastInFlightSelector 优先使用正在处理的请求最少的账户，数量相同时轮询
+type leastInFlightSelector struct {
+	roundRobin roundRobinSelector
+}
+
+func (s *leastInFlightSelector) Name() string { return StrategyLeastInFlight }
+
+func (s *leastInFlightSelector) Order(candidates []*JetbrainsAccount) []*JetbrainsAccount {
+	ordered := s.roundRobin.Order(candidates)
+	slices.SortStableFunc(ordered, func(a, b *JetbrainsAccount) int {
+		return int(atomic.LoadInt32(&a.InFlight)) - int(atomic.LoadInt32(&b.InFlight))
+	})
+	return ordered
+}
+
+// parseAccountWeights 解析与账户列表一一对应的权重列表 (逗号分隔)，空项表示未配置
+func parseAccountWeights(name, value string, count int) []*int {
+	weights := make([]*int, count)
+	if value == "" {
+		return weights
+	}
+	for i, item := range strings.Split(value, ",") {
+		if i >= count {
+			Warn("%s has more entries than accounts, ignoring the rest", name)
+			break
+		}
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		weight, err := strconv.Atoi(item)
+		if err != nil || weight < 0 {
+			Warn("Invalid weight %q in %s, using the default weight", item, name)
+			continue
+		}
+		weights[i] = &weight
+	}
+	return weights
+}
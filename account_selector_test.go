@@ -0,0 +1,112 @@
+package main
+
+import (
+	"testing"
+)
+
+func testAccounts(names ...string) []*JetbrainsAccount {
+	accounts := make([]*JetbrainsAccount, len(names))
+	for i, name := range names {
+		accounts[i] = &JetbrainsAccount{LicenseID: name, HasQuota: true}
+	}
+	return accounts
+}
+
+func accountNames(accounts []*JetbrainsAccount) string {
+	var names string
+	for _, account := range accounts {
+		names += account.LicenseID
+	}
+	return names
+}
+
+func TestAccountSelectors_Order(t *testing.T) {
+	accounts := testAccounts("a", "b", "c")
+
+	roundRobin, _ := newAccountSelector(StrategyRoundRobin)
+	for _, want := range []string{"abc", "bca", "cab", "abc"} {
+		if got := accountNames(roundRobin.Order(accounts)); got != want {
+			t.Errorf("round-robin: expected %s, got %s", want, got)
+		}
+	}
+
+	// 按使用比例排序：b 的额度大，虽然绝对用量多但比例最低
+	accounts[0].QuotaUsed, accounts[0].QuotaTotal = 50, 100
+	accounts[1].QuotaUsed, accounts[1].QuotaTotal = 100, 1000
+	accounts[2].QuotaUsed, accounts[2].QuotaTotal = 90, 100
+	leastQuota, _ := newAccountSelector(StrategyLeastQuotaUsed)
+	if got := accountNames(leastQuota.Order(accounts)); got != "bac" {
+		t.Errorf("least-quota-used: expected bac, got %s", got)
+	}
+
+	accounts[0].InFlight, accounts[1].InFlight, accounts[2].InFlight = 2, 1, 0
+	leastInFlight, _ := newAccountSelector(StrategyLeastInFlight)
+	if got := accountNames(leastInFlight.Order(accounts)); got != "cba" {
+		t.Errorf("least-in-flight: expected cba, got %s", got)
+	}
+
+	random, _ := newAccountSelector(StrategyRandom)
+	if got := random.Order(accounts); len(got) != 3 {
+		t.Errorf("random should return every candidate, got %d", len(got))
+	}
+
+	if _, err := newAccountSelector("fastest"); err == nil {
+		t.Error("unknown strategy should be rejected")
+	}
+}
+
+func TestWeightedSelector_Distribution(t *testing.T) {
+	accounts := testAccounts("a", "b", "c")
+	heavy, none := 9, 0
+	accounts[0].Weight = &heavy
+	accounts[2].Weight = &none
+
+	selector, _ := newAccountSelector(StrategyWeighted)
+	first := map[string]int{}
+	for range 2000 {
+		order := selector.Order(accounts)
+		first[order[0].LicenseID]++
+		if order[2].LicenseID != "c" {
+			t.Fatalf("zero-weight account should always be tried last, got %s", accountNames(order))
+		}
+	}
+	// 期望 a:b ≈ 9:1
+	if first["a"] < 1600 || first["b"] < 100 {
+		t.Errorf("unexpected weighted distribution: %v", first)
+	}
+}
+
+func TestParseAccountWeights(t *testing.T) {
+	weights := parseAccountWeights("TEST_WEIGHTS", "3, ,x,-1,2", 4)
+	if *weights[0] != 3 || weights[1] != nil || weights[2] != nil || weights[3] != nil {
+		t.Errorf("unexpected weights: %v", weights)
+	}
+}
+
+func TestGetNextJetbrainsAccount_UsesStrategy(t *testing.T) {
+	setupFakeUpstream(t, DefaultFakeGrazieOptions())
+	jetbrainsAccounts = testAccounts("license-1", "license-2")
+	for _, account := range jetbrainsAccounts {
+		account.Authorization = "auth"
+	}
+	refreshAccountsNow()
+	selector, _ := newAccountSelector(StrategyLeastInFlight)
+	currentConfig().AccountSelector = selector
+
+	// 每次都选择正在处理的请求最少的账户
+	first, err := getNextJetbrainsAccount()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	second, err := getNextJetbrainsAccount()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if first == second || first.InFlight != 1 || second.InFlight != 1 {
+		t.Errorf("least-in-flight should spread leases, got %s and %s", first.LicenseID, second.LicenseID)
+	}
+	releaseJetbrainsAccount(first)
+	if next, _ := getNextJetbrainsAccount(); next != first {
+		t.Errorf("released account should be selected next, got %s", next.LicenseID)
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// accountStateFilePath 使用文件存储时保存账户运行状态的文件
+const accountStateFilePath = "account_state.json"
+
+// stateEncryptionKey 加密持久化 JWT 的 AES-256 密钥 (由 STATE_ENCRYPTION_KEY 派生)，为空时不保存 JWT
+var stateEncryptionKey []byte
+
+// loadAccountStateConfig loads the encryption key for persisted JWTs from STATE_ENCRYPTION_KEY
+func loadAccountStateConfig() {
+	secret := os.Getenv("STATE_ENCRYPTION_KEY")
+	if secret == "" {
+		stateEncryptionKey = nil
+		Warn("STATE_ENCRYPTION_KEY is not set, JWTs will not be persisted across restarts")
+		return
+	}
+	sum := sha256.Sum256([]byte(secret))
+	stateEncryptionKey = sum[:]
+}
+
+// accountStateKey 持久化时标识账户的键，不暴露许可证ID或静态JWT
+func accountStateKey(account *JetbrainsAccount) string {
+	sum := sha256.Sum256([]byte(accountIdentity(account)))
+	return hex.EncodeToString(sum[:])
+}
+
+// encryptSecret 使用 AES-GCM 加密，账户键作为附加数据，防止密文被挪用到其他账户
+func encryptSecret(plaintext, key string) (string, error) {
+	gcm, err := newStateCipher()
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := gcm.Seal(nonce, nonce, []byte(plaintext), []byte(key))
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// decryptSecret 解密 encryptSecret 的结果，密钥错误或数据被篡改时返回错误
+func decryptSecret(ciphertext, key string) (string, error) {
+	gcm, err := newStateCipher()
+	if err != nil {
+		return "", err
+	}
+	data, err := base64.StdEncoding.DecodeString(ciphertext)
+	if err != nil {
+		return "", err
+	}
+	if len(data) < gcm.NonceSize() {
+		return "", errors.New("ciphertext too short")
+	}
+	plaintext, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], []byte(key))
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+// newStateCipher 使用 stateEncryptionKey 创建 AES-GCM
+func newStateCipher() (cipher.AEAD, error) {
+	if len(stateEncryptionKey) == 0 {
+		return nil, errors.New("STATE_ENCRYPTION_KEY is not set")
+	}
+	block, err := aes.NewCipher(stateEncryptionKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// collectAccountStates 收集需要持久化的账户状态
+// 只保存许可证账户获取的 JWT，静态JWT来自配置，无需保存
+func collectAccountStates(accounts []*JetbrainsAccount) []PersistedAccountState {
+	now := time.Now()
+	states := make([]PersistedAccountState, 0, len(accounts))
+	for _, account := range accounts {
+		account.stateMu.RLock()
+		jwt := account.JWT
+		state := PersistedAccountState{
+			Key:            accountStateKey(account),
+			ExpiryTime:     account.ExpiryTime,
+			LastUpdated:    account.LastUpdated,
+			HasQuota:       account.HasQuota,
+			LastQuotaCheck: account.LastQuotaCheck,
+			QuotaUsed:      account.QuotaUsed,
+			QuotaTotal:     account.QuotaTotal,
+			QuotaResetAt:   account.QuotaResetAt,
+			SavedAt:        now,
+		}
+		account.stateMu.RUnlock()
+		if account.LicenseID != "" && jwt != "" && len(stateEncryptionKey) > 0 {
+			encrypted, err := encryptSecret(jwt, state.Key)
+			if err != nil {
+				Warn("Failed to encrypt JWT for %s: %v", getTokenDisplayName(account), err)
+			} else {
+				state.EncryptedJWT = encrypted
+			}
+		}
+		if cached := getCachedQuota(account); cached != nil {
+			state.Quota = cached.QuotaData
+			state.QuotaFetchedAt = cached.FetchedAt
+		}
+
+		healthMutex.Lock()
+		state.Health = account.Health
+		state.HealthChangedAt = account.HealthChangedAt
+		state.ConsecutiveFailures = account.ConsecutiveFailures
+		state.CooldownLevel = account.CooldownLevel
+		state.CooldownUntil = account.CooldownUntil
+		state.LastError = account.LastError
+		healthMutex.Unlock()
+
+		states = append(states, state)
+	}
+	return states
+}
+
+// saveAccountStates 持久化当前所有账户的运行状态
+func saveAccountStates() {
+	if storage == nil {
+		return
+	}
+	if err := storage.SaveAccountStates(collectAccountStates(accountsSnapshot())); err != nil {
+		Error("Error saving account state: %v", err)
+	}
+}
+
+// restoreAccountStates 启动时恢复账户的 JWT、配额和健康状态，返回恢复的账户数
+// 恢复了配额的账户按上次查询的时间安排下一次后台刷新，其余账户由监控立即刷新
+func restoreAccountStates(accounts []*JetbrainsAccount) int {
+	if storage == nil {
+		return 0
+	}
+	states, err := storage.LoadAccountStates()
+	if err != nil {
+		Error("Error loading account state: %v", err)
+		return 0
+	}
+	saved := make(map[string]PersistedAccountState, len(states))
+	for _, state := range states {
+		saved[state.Key] = state
+	}
+
+	restored := 0
+	for _, account := range accounts {
+		state, ok := saved[accountStateKey(account)]
+		if !ok {
+			continue
+		}
+		if err := restoreAccountState(account, state); err != nil {
+			Warn("Could not restore the JWT for %s: %v", getTokenDisplayName(account), err)
+		}
+		restored++
+	}
+	if restored > 0 {
+		Info("Restored runtime state for %d of %d accounts", restored, len(accounts))
+	}
+	return restored
+}
+
+// restoreAccountState 将保存的状态应用到账户，JWT 解密失败或已过期时只恢复其他状态
+func restoreAccountState(account *JetbrainsAccount, state PersistedAccountState) error {
+	var jwtErr error
+	account.stateMu.Lock()
+	if account.LicenseID != "" && state.EncryptedJWT != "" {
+		if !state.ExpiryTime.After(time.Now()) {
+			jwtErr = fmt.Errorf("saved JWT expired at %s", state.ExpiryTime.Format(time.RFC3339))
+		} else if token, err := decryptSecret(state.EncryptedJWT, state.Key); err != nil {
+			jwtErr = fmt.Errorf("failed to decrypt saved JWT: %w", err)
+		} else {
+			account.JWT = token
+			account.ExpiryTime = state.ExpiryTime
+			account.LastUpdated = state.LastUpdated
+		}
+	}
+
+	account.HasQuota = state.HasQuota
+	account.LastQuotaCheck = state.LastQuotaCheck
+	account.QuotaUsed = state.QuotaUsed
+	account.QuotaTotal = state.QuotaTotal
+	account.QuotaResetAt = state.QuotaResetAt
+	hasJWT := account.JWT != ""
+	account.stateMu.Unlock()
+
+	if state.Quota != nil {
+		quotaCacheMutex.Lock()
+		accountQuotaCache[account] = &CachedQuotaInfo{QuotaData: state.Quota, FetchedAt: state.QuotaFetchedAt}
+		quotaCacheMutex.Unlock()
+
+		// 许可证账户没有恢复 JWT 时仍需立即刷新
+		if account.LicenseID == "" || hasJWT {
+			monitorMutex.Lock()
+			accountRefreshDue[account] = nextRefreshAt(account, state.QuotaFetchedAt)
+			monitorMutex.Unlock()
+		}
+	}
+
+	healthMutex.Lock()
+	account.Health = state.Health
+	account.HealthChangedAt = state.HealthChangedAt
+	account.ConsecutiveFailures = state.ConsecutiveFailures
+	account.CooldownLevel = state.CooldownLevel
+	account.CooldownUntil = state.CooldownUntil
+	account.LastError = state.LastError
+	healthMutex.Unlock()
+	return jwtErr
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// setupAccountStateStorage stores account state in a temporary directory with the given encryption key
+func setupAccountStateStorage(t *testing.T, key string) {
+	t.Helper()
+	wd, _ := os.Getwd()
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	oldStorage, oldKey := storage, stateEncryptionKey
+	t.Cleanup(func() {
+		os.Chdir(wd)
+		storage, stateEncryptionKey = oldStorage, oldKey
+	})
+	storage = &FileStorage{}
+	t.Setenv("STATE_ENCRYPTION_KEY", key)
+	loadAccountStateConfig()
+}
+
+func TestAccountState_PersistAndRestore(t *testing.T) {
+	setupFakeUpstream(t, DefaultFakeGrazieOptions())
+	setupAccountStateStorage(t, "state-secret")
+
+	account := jetbrainsAccounts[0]
+	recordAccountFailure(account, "upstream returned 502")
+	saveAccountStates()
+
+	data, err := os.ReadFile(accountStateFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), account.JWT) || strings.Contains(string(data), account.LicenseID) {
+		t.Fatal("persisted state should not contain the JWT or license ID in clear text")
+	}
+
+	// 模拟重启：新的账户对象没有 JWT
+	restarted := licenseAccounts("license-1")[0]
+	if n := restoreAccountStates([]*JetbrainsAccount{restarted}); n != 1 {
+		t.Fatalf("expected 1 restored account, got %d", n)
+	}
+	if restarted.JWT != account.JWT || !restarted.ExpiryTime.Equal(account.ExpiryTime) {
+		t.Error("JWT and expiry should be restored")
+	}
+	if getAccountHealth(restarted) != AccountDegraded || restarted.LastError != "upstream returned 502" {
+		t.Errorf("health should be restored, got %s (%s)", getAccountHealth(restarted), restarted.LastError)
+	}
+	if getCachedQuota(restarted) == nil || restarted.QuotaTotal != account.QuotaTotal {
+		t.Error("quota snapshot should be restored")
+	}
+	monitorMutex.Lock()
+	next, scheduled := accountRefreshDue[restarted]
+	monitorMutex.Unlock()
+	if !scheduled || !next.After(time.Now()) {
+		t.Error("restored accounts should not be refreshed again on boot")
+	}
+
+	// 密钥错误时不恢复 JWT，其他状态仍然恢复
+	t.Setenv("STATE_ENCRYPTION_KEY", "wrong-secret")
+	loadAccountStateConfig()
+	other := licenseAccounts("license-1")[0]
+	restoreAccountStates([]*JetbrainsAccount{other})
+	if other.JWT != "" || other.QuotaTotal != account.QuotaTotal {
+		t.Errorf("wrong key should only skip the JWT, got JWT %q quota %v", other.JWT, other.QuotaTotal)
+	}
+}
+
+func TestAccountState_NoKeySkipsJWT(t *testing.T) {
+	setupFakeUpstream(t, DefaultFakeGrazieOptions())
+	setupAccountStateStorage(t, "")
+
+	saveAccountStates()
+	states, err := storage.LoadAccountStates()
+	if err != nil || len(states) != 1 {
+		t.Fatalf("expected 1 saved account, got %d (%v)", len(states), err)
+	}
+	if states[0].EncryptedJWT != "" {
+		t.Error("JWT should not be persisted without STATE_ENCRYPTION_KEY")
+	}
+	if !states[0].HasQuota || states[0].Quota == nil {
+		t.Error("quota snapshot should still be persisted")
+	}
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// authenticateAdmin 管理接口认证中间件，使用 ADMIN_API_KEY (Bearer 或 x-api-key)
+// 未配置管理密钥时管理接口不可用
+func authenticateAdmin(c *gin.Context) {
+	adminKey := currentConfig().AdminAPIKey
+	if adminKey == "" {
+		respondWithError(c, http.StatusServiceUnavailable, "Admin API disabled: ADMIN_API_KEY is not configured")
+		c.Abort()
+		return
+	}
+
+	key := c.GetHeader("x-api-key")
+	if key == "" {
+		key = strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+	}
+	if key == "" {
+		respondWithError(c, http.StatusUnauthorized, "Admin API key required in Authorization header (Bearer) or x-api-key")
+		c.Abort()
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(key), []byte(adminKey)) != 1 {
+		respondWithError(c, http.StatusForbidden, "Invalid admin API key")
+		c.Abort()
+		return
+	}
+}
+
+// reloadConfig 重新加载 models.json、客户端密钥和账户配置
+func reloadConfig(c *gin.Context) {
+	changes, err := reloadRuntimeConfig("admin API")
+	if err != nil {
+		respondWithError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	if changes == nil {
+		changes = []string{}
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "reloaded", "changes": changes})
+}
+
+var (
+	errAccountNotFound = errors.New("account not found")
+	errAccountExists   = errors.New("account already exists")
+)
+
+// accountID 账户的稳定 ID (标识的哈希)，管理接口使用它定位账户而不暴露许可证授权信息
+func accountID(account *JetbrainsAccount) string {
+	sum := sha256.Sum256([]byte(accountIdentity(account)))
+	return hex.EncodeToString(sum[:6])
+}
+
+// findAccount 返回 ID 对应账户的下标，不存在时返回 -1
+func findAccount(accounts []*JetbrainsAccount, id string) int {
+	return slices.IndexFunc(accounts, func(account *JetbrainsAccount) bool {
+		return accountID(account) == id
+	})
+}
+
+// accountAdminStatus 账户在管理接口中的状态
+func accountAdminStatus(account *JetbrainsAccount) string {
+	flags := accountFlagsState(account)
+	switch {
+	case flags.Retired:
+		return "retired"
+	case flags.Disabled:
+		return "disabled"
+	case flags.Draining && atomic.LoadInt32(&account.InFlight) > 0:
+		return "draining"
+	case flags.Draining:
+		return "drained"
+	case !accountQuotaState(account).HasQuota:
+		return "no_quota"
+	default:
+		return "active"
+	}
+}
+
+// newAdminAccountView 构造管理接口返回的账户信息
+func newAdminAccountView(account *JetbrainsAccount, refreshErr error) AdminAccountView {
+	jwt, expiry := accountJWT(account)
+	quota := accountQuotaState(account)
+	flags := accountFlagsState(account)
+	view := AdminAccountView{
+		ID:         accountID(account),
+		Name:       getTokenDisplayName(account),
+		Type:       getAccountTypeName(account),
+		LicenseID:  account.LicenseID,
+		Status:     accountAdminStatus(account),
+		HasJWT:     jwt != "",
+		HasQuota:   quota.HasQuota,
+		InFlight:   atomic.LoadInt32(&account.InFlight),
+		Weight:     accountWeight(account),
+		QuotaUsed:  quota.Used,
+		QuotaTotal: quota.Total,
+		Disabled:   flags.Disabled,
+		Draining:   flags.Draining,
+	}
+	if !expiry.IsZero() {
+		view.ExpiryTime = expiry.Format(time.RFC3339)
+	}
+	if quota.LastCheck > 0 {
+		view.LastQuotaCheck = time.Unix(int64(quota.LastCheck), 0).Format(time.RFC3339)
+	}
+	if !quota.ResetAt.IsZero() {
+		view.QuotaResetAt = quota.ResetAt.Format(time.RFC3339)
+	}
+	healthMutex.Lock()
+	view.Health = string(accountHealthState(account))
+	if time.Now().Before(account.CooldownUntil) {
+		view.CooldownUntil = account.CooldownUntil.Format(time.RFC3339)
+	}
+	view.LastError = account.LastError
+	healthMutex.Unlock()
+	if refreshErr != nil {
+		view.RefreshError = refreshErr.Error()
+	}
+	return view
+}
+
+// refreshAccountStatus 立即刷新账户的 JWT 并重新检查配额
+func refreshAccountStatus(account *JetbrainsAccount) error {
+	return refreshAccount(account, true)
+}
+
+// respondWithAccount 刷新账户状态后返回账户信息，刷新失败不影响操作结果，错误在 refresh_error 中返回
+func respondWithAccount(c *gin.Context, status int, account *JetbrainsAccount) {
+	refreshErr := refreshAccountStatus(account)
+	if refreshErr != nil {
+		Warn("Admin API: refresh of account %s failed: %v", getTokenDisplayName(account), refreshErr)
+	}
+	c.JSON(status, newAdminAccountView(account, refreshErr))
+}
+
+// respondWithAccountError 将账户操作错误映射为 HTTP 状态码
+func respondWithAccountError(c *gin.Context, err error) {
+	status := http.StatusBadRequest
+	switch {
+	case errors.Is(err, errAccountNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, errAccountExists):
+		status = http.StatusConflict
+	}
+	respondWithError(c, status, err.Error())
+}
+
+// listAccounts 列出所有账户
+func listAccounts(c *gin.Context) {
+	accounts := accountsSnapshot()
+	views := make([]AdminAccountView, 0, len(accounts))
+	for _, account := range accounts {
+		views = append(views, newAdminAccountView(account, nil))
+	}
+	c.JSON(http.StatusOK, gin.H{"accounts": views})
+}
+
+// refreshAccounts 立即刷新所有账户的 JWT 和配额，完成后返回账户列表
+func refreshAccounts(c *gin.Context) {
+	refreshAccountsNow()
+	listAccounts(c)
+}
+
+// getAccount 返回单个账户，不刷新状态
+func getAccount(c *gin.Context) {
+	accounts := accountsSnapshot()
+	index := findAccount(accounts, c.Param("id"))
+	if index < 0 {
+		respondWithAccountError(c, errAccountNotFound)
+		return
+	}
+	c.JSON(http.StatusOK, newAdminAccountView(accounts[index], nil))
+}
+
+// addAccount 添加许可证账户 (license_id + authorization) 或静态JWT账户 (jwt)
+func addAccount(c *gin.Context) {
+	var req AdminAccountRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondWithError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if req.Weight != nil && *req.Weight < 0 {
+		respondWithError(c, http.StatusBadRequest, "weight must not be negative")
+		return
+	}
+
+	var account *JetbrainsAccount
+	switch {
+	case req.JWT != "" && req.LicenseID == "" && req.Authorization == "":
+		account = newStaticJWTAccount(req.JWT)
+		if isStaticJWTExpired(account) {
+			respondWithError(c, http.StatusBadRequest, "static JWT has already expired")
+			return
+		}
+	case req.JWT == "" && req.LicenseID != "" && req.Authorization != "":
+		account = newLicenseAccount(req.LicenseID, req.Authorization)
+	default:
+		respondWithError(c, http.StatusBadRequest, "Provide either license_id and authorization, or jwt")
+		return
+	}
+	applyAccountFlags(account, &req)
+
+	err := updateJetbrainsAccounts(func(accounts []*JetbrainsAccount) ([]*JetbrainsAccount, error) {
+		if findAccount(accounts, accountID(account)) >= 0 {
+			return nil, errAccountExists
+		}
+		accountSource.markAdded(account)
+		return append(slices.Clip(accounts), account), nil
+	})
+	if err != nil {
+		respondWithAccountError(c, err)
+		return
+	}
+
+	Info("Admin API: added account %s", getTokenDisplayName(account))
+	respondWithAccount(c, http.StatusCreated, account)
+}
+
+// updateAccount 修改账户授权信息、权重或停用/排空状态
+func updateAccount(c *gin.Context) {
+	var req AdminAccountRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondWithError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	modifyAccount(c, "updated", func(account *JetbrainsAccount) error {
+		if req.Weight != nil && *req.Weight < 0 {
+			return errors.New("weight must not be negative")
+		}
+		if req.LicenseID != "" || req.JWT != "" {
+			return errors.New("license_id and jwt identify the account and cannot be changed, add a new account instead")
+		}
+		if req.Authorization != "" {
+			if isStaticJWTAccount(account) {
+				return errors.New("static JWT accounts have no authorization")
+			}
+			if req.Authorization != account.Authorization {
+				// 授权信息变化后重新获取 JWT
+				account.stateMu.Lock()
+				account.Authorization = req.Authorization
+				account.JWT = ""
+				account.stateMu.Unlock()
+			}
+		}
+		applyAccountFlags(account, &req)
+		return nil
+	})
+}
+
+// disableAccount 停用账户，正在处理的请求继续完成
+func disableAccount(c *gin.Context) {
+	modifyAccount(c, "disabled", func(account *JetbrainsAccount) error {
+		setAccountDisabled(account, true, "disabled by admin")
+		return nil
+	})
+}
+
+// enableAccount 重新启用停用或排空中的账户
+func enableAccount(c *gin.Context) {
+	modifyAccount(c, "enabled", func(account *JetbrainsAccount) error {
+		setAccountDisabled(account, false, "enabled by admin")
+		setAccountDraining(account, false)
+		return nil
+	})
+}
+
+// drainAccount 排空账户：不再分配新请求，in_flight 降为 0 后状态变为 drained，可以安全删除
+func drainAccount(c *gin.Context) {
+	modifyAccount(c, "draining", func(account *JetbrainsAccount) error {
+		setAccountDraining(account, true)
+		return nil
+	})
+}
+
+// deleteAccount 删除账户，正在使用该账户的请求继续完成
+func deleteAccount(c *gin.Context) {
+	id := c.Param("id")
+	var removed *JetbrainsAccount
+	err := updateJetbrainsAccounts(func(accounts []*JetbrainsAccount) ([]*JetbrainsAccount, error) {
+		index := findAccount(accounts, id)
+		if index < 0 {
+			return nil, errAccountNotFound
+		}
+		removed = accounts[index]
+		accountSource.markDeleted(removed)
+		return slices.Delete(slices.Clone(accounts), index, index+1), nil
+	})
+	if err != nil {
+		respondWithAccountError(c, err)
+		return
+	}
+
+	Info("Admin API: deleted account %s", getTokenDisplayName(removed))
+	c.JSON(http.StatusOK, gin.H{"id": id, "deleted": true, "in_flight": atomic.LoadInt32(&removed.InFlight)})
+}
+
+// modifyAccount 在账户锁内修改账户，然后立即刷新 JWT 和配额
+// DRY: 修改、停用、启用和排空共用
+func modifyAccount(c *gin.Context, action string, modify func(*JetbrainsAccount) error) {
+	id := c.Param("id")
+	var account *JetbrainsAccount
+	err := updateJetbrainsAccounts(func(accounts []*JetbrainsAccount) ([]*JetbrainsAccount, error) {
+		index := findAccount(accounts, id)
+		if index < 0 {
+			return nil, errAccountNotFound
+		}
+		account = accounts[index]
+		return accounts, modify(account)
+	})
+	if err != nil {
+		respondWithAccountError(c, err)
+		return
+	}
+
+	Info("Admin API: account %s %s", getTokenDisplayName(account), action)
+	respondWithAccount(c, http.StatusOK, account)
+}
+
+// applyAccountFlags 应用请求中的停用、排空状态和权重
+func applyAccountFlags(account *JetbrainsAccount, req *AdminAccountRequest) {
+	if req.Weight != nil {
+		weight := *req.Weight
+		setAccountWeight(account, &weight)
+	}
+	if req.Disabled != nil && *req.Disabled != accountFlagsState(account).Disabled {
+		reason := "enabled by admin"
+		if *req.Disabled {
+			reason = "disabled by admin"
+		}
+		setAccountDisabled(account, *req.Disabled, reason)
+	}
+	if req.Draining != nil {
+		setAccountDraining(account, *req.Draining)
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/bytedance/sonic"
+	"github.com/gin-gonic/gin"
+)
+
+const testAdminKey = "admin-secret"
+
+// doAdminRequest sends a request authenticated with the admin API key
+func doAdminRequest(router *gin.Engine, method, path, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("x-api-key", testAdminKey)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+// decodeAccountView decodes a single account from an admin response
+func decodeAccountView(t *testing.T, w *httptest.ResponseRecorder) AdminAccountView {
+	t.Helper()
+	var view AdminAccountView
+	if err := sonic.Unmarshal(w.Body.Bytes(), &view); err != nil {
+		t.Fatalf("invalid account response %s: %v", w.Body.String(), err)
+	}
+	return view
+}
+
+func TestAdminAccounts_Lifecycle(t *testing.T) {
+	_, router := setupFakeUpstream(t, DefaultFakeGrazieOptions())
+	currentConfig().AdminAPIKey = testAdminKey
+
+	w := doAdminRequest(router, http.MethodPost, "/admin/accounts", `{"license_id":"license-2","authorization":"auth-2"}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", w.Code, w.Body.String())
+	}
+	added := decodeAccountView(t, w)
+	// 添加后立即获取 JWT 并检查配额
+	if !added.HasJWT || !added.HasQuota || added.Status != "active" || added.LastQuotaCheck == "" {
+		t.Errorf("new account should be refreshed immediately, got %+v", added)
+	}
+	if accounts := accountsSnapshot(); len(accounts) != 2 {
+		t.Errorf("expected 2 accounts, got %d", len(accounts))
+	}
+	if w := doAdminRequest(router, http.MethodPost, "/admin/accounts", `{"license_id":"license-2","authorization":"auth-2"}`); w.Code != http.StatusConflict {
+		t.Errorf("duplicate account should be rejected with 409, got %d", w.Code)
+	}
+	if w := doAdminRequest(router, http.MethodPost, "/admin/accounts", `{"license_id":"license-3"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("license without authorization should be rejected, got %d", w.Code)
+	}
+
+	// 排空正在使用的账户：不再分配新请求，已有请求完成后状态变为 drained
+	leased, err := getNextJetbrainsAccount()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	w = doAdminRequest(router, http.MethodPost, "/admin/accounts/"+accountID(leased)+"/drain", "")
+	if view := decodeAccountView(t, w); w.Code != http.StatusOK || view.Status != "draining" || view.InFlight != 1 {
+		t.Fatalf("expected draining account with 1 in-flight request, got %d: %s", w.Code, w.Body.String())
+	}
+	for range 3 {
+		account, err := getNextJetbrainsAccount()
+		if err != nil || account == leased {
+			t.Fatalf("draining account must not be leased (err=%v)", err)
+		}
+		releaseJetbrainsAccount(account)
+	}
+	releaseJetbrainsAccount(leased)
+	w = doAdminRequest(router, http.MethodGet, "/admin/accounts/"+accountID(leased), "")
+	if view := decodeAccountView(t, w); view.Status != "drained" || view.InFlight != 0 {
+		t.Errorf("account should be drained once requests finish, got %+v", view)
+	}
+
+	// 停用另一个账户后没有可用账户
+	w = doAdminRequest(router, http.MethodGet, "/admin/accounts", "")
+	var list struct {
+		Accounts []AdminAccountView `json:"accounts"`
+	}
+	if err := sonic.Unmarshal(w.Body.Bytes(), &list); err != nil || len(list.Accounts) != 2 {
+		t.Fatalf("expected 2 accounts, got %s", w.Body.String())
+	}
+	for _, view := range list.Accounts {
+		if view.ID != accountID(leased) {
+			doAdminRequest(router, http.MethodPost, "/admin/accounts/"+view.ID+"/disable", "")
+		}
+	}
+	body := `{"model":"test-model","messages":[{"role":"user","content":"hi"}]}`
+	if w := doProxyRequest(router, "/v1/chat/completions", body); w.Code != http.StatusTooManyRequests {
+		t.Errorf("requests should fail with every account disabled or drained, got %d", w.Code)
+	}
+
+	w = doAdminRequest(router, http.MethodPost, "/admin/accounts/"+accountID(leased)+"/enable", "")
+	if view := decodeAccountView(t, w); view.Status != "active" {
+		t.Errorf("enabled account should be active, got %+v", view)
+	}
+	if w := doProxyRequest(router, "/v1/chat/completions", body); w.Code != http.StatusOK {
+		t.Errorf("request should succeed after enabling an account, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// 修改授权信息后重新获取 JWT
+	leased.JWT = "stale"
+	w = doAdminRequest(router, http.MethodPatch, "/admin/accounts/"+accountID(leased), `{"authorization":"auth-new"}`)
+	if w.Code != http.StatusOK || leased.Authorization != "auth-new" || leased.JWT == "stale" {
+		t.Errorf("authorization update should refresh the JWT, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := doAdminRequest(router, http.MethodPatch, "/admin/accounts/"+accountID(leased), `{"license_id":"other"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("changing the license id should be rejected, got %d", w.Code)
+	}
+
+	w = doAdminRequest(router, http.MethodDelete, "/admin/accounts/"+accountID(leased), "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("delete failed: %d %s", w.Code, w.Body.String())
+	}
+	if accounts := accountsSnapshot(); len(accounts) != 1 {
+		t.Errorf("expected 1 account after delete, got %d", len(accounts))
+	}
+	if w := doAdminRequest(router, http.MethodDelete, "/admin/accounts/"+accountID(leased), ""); w.Code != http.StatusNotFound {
+		t.Errorf("deleting a missing account should return 404, got %d", w.Code)
+	}
+}
+
+// 用 -race 运行：管理接口排空、停用和修改权重时，请求并发选择账户
+func TestAdminAccounts_FlagsConcurrentWithSelection(t *testing.T) {
+	_, router := setupFakeUpstream(t, DefaultFakeGrazieOptions())
+	currentConfig().AdminAPIKey = testAdminKey
+	account := jetbrainsAccounts[0]
+	path := "/admin/accounts/" + accountID(account)
+
+	var wg, started sync.WaitGroup
+	done := make(chan struct{})
+	for range 4 {
+		wg.Add(1)
+		started.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				if selected, err := getNextJetbrainsAccount(); err == nil {
+					releaseJetbrainsAccount(selected)
+				}
+				weightedSelector{}.Order(accountsSnapshot())
+				refreshAccount(account, false)
+				newAdminAccountView(account, nil)
+				if i == 0 {
+					started.Done()
+				}
+			}
+		}()
+	}
+	started.Wait()
+	for range 10 {
+		for _, req := range []struct{ method, path, body string }{
+			{http.MethodPost, path + "/drain", ""},
+			{http.MethodPost, path + "/enable", ""},
+			{http.MethodPatch, path, `{"weight":3,"disabled":true}`},
+			{http.MethodPatch, path, `{"weight":1,"disabled":false,"draining":false}`},
+		} {
+			if w := doAdminRequest(router, req.method, req.path, req.body); w.Code != http.StatusOK {
+				t.Errorf("%s %s failed: %d %s", req.method, req.path, w.Code, w.Body.String())
+			}
+			runtime.Gosched()
+		}
+	}
+	close(done)
+	wg.Wait()
+
+	if !accountLeasable(account) || accountWeight(account) != 1 {
+		t.Errorf("account should be active with weight 1, got %+v", accountFlagsState(account))
+	}
+}
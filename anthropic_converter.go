@@ -234,19 +234,18 @@ func generateAnthropicStreamResponse(responseType string, content string, index
 
 	switch responseType {
 	case "content_block_start":
+		emptyText := ""
 		resp = AnthropicStreamResponse{
-			Type:  "content_block_start",
-			Index: &index,
+			Type:         "content_block_start",
+			Index:        &index,
+			ContentBlock: &AnthropicStreamContentBlock{Type: "text", Text: &emptyText},
 		}
 
 	case "content_block_delta":
 		resp = AnthropicStreamResponse{
 			Type:  "content_block_delta",
 			Index: &index,
-			Delta: &struct {
-				Type string `json:"type,omitempty"`
-				Text string `json:"text,omitempty"`
-			}{
+			Delta: &AnthropicStreamDelta{
 				Type: "text_delta",
 				Text: content,
 			},
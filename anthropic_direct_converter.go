@@ -6,7 +6,8 @@ import (
 	"io"
 	"net/http"
 	"strings"
-	"time"
+
+	"github.com/gin-gonic/gin"
 )
 
 // anthropicToJetbrainsMessages 直接将 Anthropic 消息转换为 JetBrains 格式
@@ -36,6 +37,7 @@ func anthropicToJetbrainsMessages(anthMessages []AnthropicMessage) []JetbrainsMe
 	}
 
 	// 第二遍：转换消息
+	validator := NewImageValidator()
 	for _, msg := range anthMessages {
 		// 特殊处理：检查是否为包含 tool_result 的混合内容消息
 		if msg.Role == "user" && hasToolResult(msg.Content) {
@@ -55,18 +57,41 @@ func anthropicToJetbrainsMessages(anthMessages []AnthropicMessage) []JetbrainsMe
 			continue
 		}
 
+		// 图片块转换为 v8 API 的 media_message，文本合并为 user_message
+		if msg.Role == "user" && hasImage(msg.Content) {
+			mediaMessages, textContent := extractImageContent(msg.Content, validator)
+			jetbrainsMessages = append(jetbrainsMessages, mediaMessages...)
+			if textContent != "" {
+				jetbrainsMessages = append(jetbrainsMessages, JetbrainsMessage{
+					Type:    "user_message",
+					Content: textContent,
+				})
+			}
+			continue
+		}
+
+		// 助手消息中的每个 tool_use 块都需要转换为独立的 assistant_message_tool
+		if msg.Role == "assistant" && hasToolUse(msg.Content) {
+			toolMessages, textContent := extractToolUseContent(msg.Content)
+
+			// 保留与工具调用相邻的助手文本
+			if textContent != "" {
+				jetbrainsMessages = append(jetbrainsMessages, JetbrainsMessage{
+					Type:    "assistant_message_text",
+					Content: textContent,
+				})
+			}
+			jetbrainsMessages = append(jetbrainsMessages, toolMessages...)
+			continue
+		}
+
 		// 常规消息处理
 		var messageType string
 		switch msg.Role {
 		case "user":
 			messageType = "user_message"
 		case "assistant":
-			// 检查是否包含工具调用
-			if hasToolUse(msg.Content) {
-				messageType = "assistant_message_tool"
-			} else {
-				messageType = "assistant_message"
-			}
+			messageType = "assistant_message"
 		case "tool":
 			messageType = "tool_message"
 		default:
@@ -79,7 +104,7 @@ func anthropicToJetbrainsMessages(anthMessages []AnthropicMessage) []JetbrainsMe
 		}
 
 		// 如果是工具相关消息，需要添加额外字段
-		if messageType == "assistant_message_tool" || messageType == "tool_message" {
+		if messageType == "tool_message" {
 			// 从内容中提取工具信息
 			if toolInfo := extractToolInfo(msg.Content); toolInfo != nil {
 				jetbrainsMessage.ID = toolInfo.ID
@@ -95,7 +120,7 @@ func anthropicToJetbrainsMessages(anthMessages []AnthropicMessage) []JetbrainsMe
 		jetbrainsMessages = append(jetbrainsMessages, jetbrainsMessage)
 	}
 
-	return jetbrainsMessages
+	return orderToolResults(jetbrainsMessages)
 }
 
 // anthropicToJetbrainsTools 直接转换工具定义
@@ -115,9 +140,9 @@ func anthropicToJetbrainsTools(anthTools []AnthropicTool) []JetbrainsToolDefinit
 	return jetbrainsTools
 }
 
-// callJetbrainsAPIDirect 直接调用 JetBrains API
+// callJetbrainsAPIDirect 直接调用 JetBrains API，返回响应和最终使用的账户 (没有可用账户时为 nil)
 // KISS: 简化调用链，消除中间转换
-func callJetbrainsAPIDirect(anthReq *AnthropicMessagesRequest, jetbrainsMessages []JetbrainsMessage, data []JetbrainsData, account *JetbrainsAccount, startTime time.Time, accountIdentifier string) (*http.Response, int, error) {
+func callJetbrainsAPIDirect(c *gin.Context, anthReq *AnthropicMessagesRequest, jetbrainsMessages []JetbrainsMessage, data []JetbrainsData) (*http.Response, *JetbrainsAccount, int, error) {
 	internalModel := getInternalModelName(anthReq.Model)
 	payload := JetbrainsPayload{
 		Prompt:  "ij.chat.request.new-chat-on-start",
@@ -132,54 +157,42 @@ func callJetbrainsAPIDirect(anthReq *AnthropicMessagesRequest, jetbrainsMessages
 
 	payloadBytes, err := marshalJSON(payload)
 	if err != nil {
-		return nil, http.StatusInternalServerError, fmt.Errorf("failed to marshal request")
+		return nil, nil, http.StatusInternalServerError, fmt.Errorf("failed to marshal request")
 	}
 
-	Debug("=== JetBrains API Request Debug (Direct) ===")
-	Debug("Model: %s -> %s", anthReq.Model, internalModel)
-	Debug("Messages converted: %d", len(jetbrainsMessages))
-	Debug("Tools attached: %d", len(data))
-	Debug("Payload size: %d bytes", len(payloadBytes))
-	Debug("=== Complete Upstream Payload ===")
-	Debug("%s", string(payloadBytes))
-	Debug("=== End Upstream Payload ===")
-	Debug("=== End Debug ===")
-
-	req, err := http.NewRequest("POST", "https://api.jetbrains.ai/user/v5/llm/chat/stream/v8", bytes.NewBuffer(payloadBytes))
+	DebugContext(c, "=== JetBrains API Request Debug (Direct) ===")
+	DebugContext(c, "Model: %s -> %s", anthReq.Model, internalModel)
+	DebugContext(c, "Messages converted: %d", len(jetbrainsMessages))
+	DebugContext(c, "Tools attached: %d", len(data))
+	DebugContext(c, "Payload size: %d bytes", len(payloadBytes))
+	DebugContext(c, "=== Complete Upstream Payload ===")
+	DebugContext(c, "%s", string(payloadBytes))
+	DebugContext(c, "=== End Upstream Payload ===")
+	DebugContext(c, "=== End Debug ===")
+
+	resp, account, statusCode, err := sendUpstreamWithFailover(upstreamRequest{
+		ctx:     c.Request.Context(),
+		payload: payloadBytes,
+		model:   anthReq.Model,
+		client:  clientKeyName(c),
+		tools:   len(anthReq.Tools),
+	})
 	if err != nil {
-		return nil, http.StatusInternalServerError, fmt.Errorf("failed to create request")
-	}
-
-	req.Header.Set("Accept", "text/event-stream")
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Cache-Control", "no-cache")
-	setJetbrainsHeaders(req, account.JWT)
-
-	resp, err := httpClient.Do(req)
-	if err != nil {
-		return nil, http.StatusInternalServerError, fmt.Errorf("failed to make request")
-	}
-
-	Debug("JetBrains API Response Status: %d", resp.StatusCode)
-
-	if resp.StatusCode == 477 {
-		Warn("Account %s has no quota (received 477)", getTokenDisplayName(account))
-		account.HasQuota = false
-		account.LastQuotaCheck = float64(time.Now().Unix())
+		return nil, account, statusCode, err
 	}
 
 	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(resp.Body)
 		errorMsg := string(body)
-		Error("JetBrains API Error: Status %d, Body: %s", resp.StatusCode, errorMsg)
+		ErrorContext(c, "JetBrains API Error: Status %d, Body: %s", resp.StatusCode, errorMsg)
 
 		// 重新创建 response body reader，以便后续处理
 		resp.Body = io.NopCloser(bytes.NewReader(body))
 
-		return resp, resp.StatusCode, fmt.Errorf("JetBrains API error: %d", resp.StatusCode)
+		return resp, account, resp.StatusCode, fmt.Errorf("JetBrains API error: %d", resp.StatusCode)
 	}
 
-	return resp, http.StatusOK, nil
+	return resp, account, http.StatusOK, nil
 }
 
 // extractStringContent 提取字符串内容 (KISS: 简单实用)
@@ -241,6 +254,61 @@ func hasToolResult(content any) bool {
 	return false
 }
 
+// hasImage 检查消息内容是否包含图片
+func hasImage(content any) bool {
+	if contentArray, ok := content.([]any); ok {
+		for _, block := range contentArray {
+			if blockMap, ok := block.(map[string]any); ok {
+				if blockType, _ := blockMap["type"].(string); blockType == "image" {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// extractImageContent 从内容中提取 base64 图片 (media_message) 和文本内容
+// 未通过校验的图片会被跳过，只保留文本
+func extractImageContent(content any, validator *ImageValidator) ([]JetbrainsMessage, string) {
+	var mediaMessages []JetbrainsMessage
+	var textParts []string
+
+	contentArray, _ := content.([]any)
+	for _, block := range contentArray {
+		blockMap, ok := block.(map[string]any)
+		if !ok {
+			continue
+		}
+
+		switch blockType, _ := blockMap["type"].(string); blockType {
+		case "image":
+			source, _ := blockMap["source"].(map[string]any)
+			if sourceType, _ := source["type"].(string); sourceType != "base64" {
+				Warn("Unsupported image source type: %v", source["type"])
+				continue
+			}
+			mediaType, _ := source["media_type"].(string)
+			data, _ := source["data"].(string)
+			if err := validator.ValidateImageData(mediaType, data); err != nil {
+				Warn("Image validation failed: %v", err)
+				continue
+			}
+			mediaMessages = append(mediaMessages, JetbrainsMessage{
+				Type:      "media_message",
+				MediaType: mediaType,
+				Data:      data,
+			})
+		case "text":
+			if text, ok := blockMap["text"].(string); ok && text != "" {
+				textParts = append(textParts, text)
+			}
+		}
+	}
+
+	return mediaMessages, strings.Join(textParts, " ")
+}
+
 // extractMixedContent 从混合内容中分别提取工具结果和文本内容
 func extractMixedContent(content any, toolIDToName map[string]string) ([]JetbrainsMessage, string) {
 	var toolMessages []JetbrainsMessage
@@ -307,6 +375,43 @@ func extractMixedContent(content any, toolIDToName map[string]string) ([]Jetbrai
 	return toolMessages, textContent
 }
 
+// extractToolUseContent 从助手消息中按顺序提取全部 tool_use 块和文本内容
+func extractToolUseContent(content any) ([]JetbrainsMessage, string) {
+	var toolMessages []JetbrainsMessage
+	var textParts []string
+
+	if contentArray, ok := content.([]any); ok {
+		for _, block := range contentArray {
+			blockMap, ok := block.(map[string]any)
+			if !ok {
+				continue
+			}
+
+			switch blockType, _ := blockMap["type"].(string); blockType {
+			case "tool_use":
+				toolMsg := JetbrainsMessage{Type: "assistant_message_tool"}
+				toolMsg.ID, _ = blockMap["id"].(string)
+				toolMsg.ToolName, _ = blockMap["name"].(string)
+
+				// 工具参数以 JSON 字符串形式传递
+				toolMsg.Content = "{}"
+				if input, ok := blockMap["input"]; ok && input != nil {
+					if inputJSON, err := marshalJSON(input); err == nil {
+						toolMsg.Content = string(inputJSON)
+					}
+				}
+				toolMessages = append(toolMessages, toolMsg)
+			case "text":
+				if text, ok := blockMap["text"].(string); ok && text != "" {
+					textParts = append(textParts, text)
+				}
+			}
+		}
+	}
+
+	return toolMessages, strings.Join(textParts, " ")
+}
+
 // ToolInfo 工具信息结构
 type ToolInfo struct {
 	ID     string
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/bytedance/sonic"
+)
+
+// countTokensRequest calls /v1/messages/count_tokens and returns input_tokens
+func countTokensRequest(t *testing.T, body string) int {
+	t.Helper()
+	_, router := setupFakeUpstream(t, DefaultFakeGrazieOptions())
+
+	w := doProxyRequest(router, "/v1/messages/count_tokens", body)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var resp map[string]int
+	if err := sonic.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("invalid response: %v", err)
+	}
+	return resp["input_tokens"]
+}
+
+// 1x1 PNG
+const pixel = "iVBORw0KGgoAAAANSUhEUgAAAAEAAAABCAYAAAAfFcSJAAAADUlEQVR42mNkYPhfDwAChwGA60e6kgAAAABJRU5ErkJggg=="
+
+func TestAnthropicCountTokens(t *testing.T) {
+	plain := countTokensRequest(t, `{"model":"test-model","messages":[{"role":"user","content":"What is the weather in Paris?"}]}`)
+	if plain == 0 {
+		t.Fatal("expected a non-zero token count")
+	}
+
+	withSystemAndTools := countTokensRequest(t, `{
+		"model":"test-model","system":"You are a helpful assistant.",
+		"messages":[{"role":"user","content":"What is the weather in Paris?"}],
+		"tools":[{"name":"get_weather","description":"Get the weather","input_schema":{"type":"object","properties":{"city":{"type":"string"}}}}]
+	}`)
+	if withSystemAndTools <= plain {
+		t.Errorf("system prompt and tools should add tokens: %d <= %d", withSystemAndTools, plain)
+	}
+
+	withImage := countTokensRequest(t, `{"model":"test-model","messages":[{"role":"user","content":[
+		{"type":"image","source":{"type":"base64","media_type":"image/png","data":"`+pixel+`"}},
+		{"type":"text","text":"What is the weather in Paris?"}
+	]}]}`)
+	if withImage < plain+imageTokenEstimate {
+		t.Errorf("image should be counted as a media message: %d < %d", withImage, plain+imageTokenEstimate)
+	}
+}
+
+func TestAnthropicCountTokens_UnknownModel(t *testing.T) {
+	_, router := setupFakeUpstream(t, DefaultFakeGrazieOptions())
+
+	w := doProxyRequest(router, "/v1/messages/count_tokens",
+		`{"model":"missing","messages":[{"role":"user","content":"hi"}]}`)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for unknown model, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestAnthropicMessages_ImageBlocksSentAsMediaMessages(t *testing.T) {
+	fake, router := setupFakeUpstream(t, DefaultFakeGrazieOptions())
+
+	w := doProxyRequest(router, "/v1/messages", `{"model":"test-model","max_tokens":100,"messages":[{"role":"user","content":[
+		{"type":"image","source":{"type":"base64","media_type":"image/png","data":"`+pixel+`"}},
+		{"type":"image","source":{"type":"url","url":"https://example.com/cat.png"}},
+		{"type":"text","text":"What is in this picture?"}
+	]}]}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	payload := fake.LastChatPayload()
+	if payload == nil {
+		t.Fatal("the upstream should have received the request")
+	}
+	messages := payload.Chat.Messages
+	if len(messages) != 2 {
+		t.Fatalf("expected a media_message and a user_message (unsupported sources dropped), got %+v", messages)
+	}
+	if messages[0].Type != "media_message" || messages[0].MediaType != "image/png" || messages[0].Data != pixel {
+		t.Errorf("base64 image should be sent as a media_message, got %+v", messages[0])
+	}
+	if messages[1].Type != "user_message" || messages[1].Content != "What is in this picture?" {
+		t.Errorf("text blocks should follow as a user_message, got %+v", messages[1])
+	}
+}
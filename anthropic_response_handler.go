@@ -1,7 +1,6 @@
 package main
 
 import (
-	"bufio"
 	"fmt"
 	"io"
 	"net/http"
@@ -12,212 +11,246 @@ import (
 	"github.com/gin-gonic/gin"
 )
 
-// handleAnthropicStreamingResponse 处理流式响应 (Anthropic 格式)
-// SRP: 专门处理 Anthropic 流式响应的单一职责
-func handleAnthropicStreamingResponse(c *gin.Context, resp *http.Response, anthReq *AnthropicMessagesRequest, startTime time.Time, accountIdentifier string) {
-	defer resp.Body.Close()
-
-	// 设置 Anthropic 流式响应头
-	c.Header("Content-Type", "text/event-stream")
-	c.Header("Cache-Control", "no-cache")
-	c.Header("Connection", "keep-alive")
-	c.Header("Access-Control-Allow-Origin", "*")
-
-	// 发送 message_start 事件
-	messageStartData := generateAnthropicStreamResponse("message_start", "", 0)
-	c.Writer.Write([]byte("event: message_start\n"))
-	c.Writer.Write([]byte(fmt.Sprintf("data: %s\n\n", string(messageStartData))))
-	c.Writer.Flush()
-
-	// 发送 content_block_start 事件
-	contentBlockStartData := generateAnthropicStreamResponse("content_block_start", "", 0)
-	c.Writer.Write([]byte("event: content_block_start\n"))
-	c.Writer.Write([]byte(fmt.Sprintf("data: %s\n\n", string(contentBlockStartData))))
-	c.Writer.Flush()
-
-	scanner := bufio.NewScanner(resp.Body)
-	var fullContent strings.Builder
-	var hasContent bool
-	lineCount := 0
-
-	Debug("=== JetBrains Streaming Response Debug ===")
+// anthropicStreamWriter 按 Anthropic 流式语义输出事件，并管理内容块索引
+// SRP: 专门负责事件序列化和内容块的打开/关闭
+type anthropicStreamWriter struct {
+	c          *gin.Context
+	nextIndex  int    // 下一个内容块的索引
+	openBlock  string // 当前打开的内容块类型："" / "text" / "tool_use"
+	toolBlocks int    // 已输出的 tool_use 块数量
+}
 
-	for scanner.Scan() {
-		line := scanner.Text()
-		lineCount++
+// writeEvent 写入一个 SSE 事件并立即刷新
+func (w *anthropicStreamWriter) writeEvent(eventType string, data []byte) error {
+	if _, err := fmt.Fprintf(w.c.Writer, "event: %s\ndata: %s\n\n", eventType, data); err != nil {
+		return err
+	}
+	w.c.Writer.Flush()
+	return nil
+}
 
-		// 记录每一行原始数据
-		Debug("Line %d: '%s'", lineCount, line)
+// writeResponse 序列化并写入一个流式事件
+func (w *anthropicStreamWriter) writeResponse(resp AnthropicStreamResponse) error {
+	data, err := marshalJSON(resp)
+	if err != nil {
+		return err
+	}
+	return w.writeEvent(resp.Type, data)
+}
 
-		line = strings.TrimSpace(line)
+// currentIndex 返回当前打开的内容块索引
+func (w *anthropicStreamWriter) currentIndex() int {
+	return w.nextIndex - 1
+}
 
-		if line == "" {
-			Debug("Line %d: Empty line, skipping", lineCount)
-			continue
+// text 输出文本增量，必要时先打开一个 text 内容块
+func (w *anthropicStreamWriter) text(content string) error {
+	if w.openBlock != "text" {
+		if err := w.closeBlock(); err != nil {
+			return err
+		}
+		if err := w.writeEvent("content_block_start", generateAnthropicStreamResponse("content_block_start", "", w.nextIndex)); err != nil {
+			return err
 		}
+		w.openBlock = "text"
+		w.nextIndex++
+	}
+	return w.writeEvent("content_block_delta", generateAnthropicStreamResponse("content_block_delta", content, w.currentIndex()))
+}
 
-		// 处理 SSE 格式 (KISS: 简单的行解析)
-		if strings.HasPrefix(line, "data: ") {
-			data := strings.TrimPrefix(line, "data: ")
-			Debug("Line %d: SSE data = '%s'", lineCount, data)
+// startToolUse 关闭当前内容块并打开一个新的 tool_use 内容块
+func (w *anthropicStreamWriter) startToolUse(id, name string) error {
+	if err := w.closeBlock(); err != nil {
+		return err
+	}
+	index := w.nextIndex
+	if err := w.writeResponse(AnthropicStreamResponse{
+		Type:  "content_block_start",
+		Index: &index,
+		ContentBlock: &AnthropicStreamContentBlock{
+			Type:  "tool_use",
+			ID:    id,
+			Name:  name,
+			Input: map[string]any{},
+		},
+	}); err != nil {
+		return err
+	}
+	w.openBlock = "tool_use"
+	w.nextIndex++
+	w.toolBlocks++
+	return nil
+}
 
-			if data == "[DONE]" {
-				Debug("Line %d: Found [DONE], breaking", lineCount)
-				break
-			}
-			if data == "end" {
-				Debug("Line %d: Found 'end', breaking", lineCount)
-				break
-			}
+// inputJSON 输出工具参数的 partial JSON 增量
+func (w *anthropicStreamWriter) inputJSON(partial string) error {
+	if w.openBlock != "tool_use" || partial == "" {
+		return nil
+	}
+	index := w.currentIndex()
+	return w.writeResponse(AnthropicStreamResponse{
+		Type:  "content_block_delta",
+		Index: &index,
+		Delta: &AnthropicStreamDelta{Type: "input_json_delta", PartialJSON: partial},
+	})
+}
 
-			// 解析 JetBrains 流式数据
-			content, err := parseJetbrainsStreamData(data)
-			if err != nil {
-				Debug("Line %d: Failed to parse stream data: %v", lineCount, err)
-				continue
-			}
+// closeBlock 关闭当前打开的内容块
+func (w *anthropicStreamWriter) closeBlock() error {
+	if w.openBlock == "" {
+		return nil
+	}
+	w.openBlock = ""
+	return w.writeEvent("content_block_stop", generateAnthropicStreamResponse("content_block_stop", "", w.currentIndex()))
+}
 
-			Debug("Line %d: Parsed content = '%s'", lineCount, content)
+// finish 关闭内容块并输出 message_delta 和 message_stop
+func (w *anthropicStreamWriter) finish(stopReason string, usage AnthropicUsage) error {
+	if err := w.closeBlock(); err != nil {
+		return err
+	}
+	if w.toolBlocks > 0 {
+		stopReason = "tool_use"
+	}
+	if err := w.writeResponse(AnthropicStreamResponse{
+		Type:  "message_delta",
+		Delta: &AnthropicStreamDelta{StopReason: stopReason},
+		Usage: &usage,
+	}); err != nil {
+		return err
+	}
+	return w.writeEvent("message_stop", generateAnthropicStreamResponse("message_stop", "", 0))
+}
 
-			if content != "" {
-				hasContent = true
-				fullContent.WriteString(content)
+// handleAnthropicStreamingResponse 处理流式响应 (Anthropic 格式)
+// SRP: 专门处理 Anthropic 流式响应的单一职责
+// 文本和工具调用按出现顺序映射为独立的内容块：text_delta 和 input_json_delta
+func handleAnthropicStreamingResponse(c *gin.Context, resp *http.Response, anthReq *AnthropicMessagesRequest, promptTokens int, startTime time.Time, accountIdentifier string) {
+	defer resp.Body.Close()
 
-				// 发送 content_block_delta 事件 (Anthropic 格式)
-				contentBlockDeltaData := generateAnthropicStreamResponse("content_block_delta", content, 0)
+	// 设置 Anthropic 流式响应头
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("Access-Control-Allow-Origin", "*")
 
-				// 检查连接状态
-				select {
-				case <-c.Request.Context().Done():
-					Debug("Line %d: Client disconnected during streaming, stopping", lineCount)
-					return
-				default:
-					// 连接正常，继续发送
-				}
+	writer := &anthropicStreamWriter{c: c}
 
-				bytesWritten, err := c.Writer.Write([]byte("event: content_block_delta\n"))
-				if err != nil {
-					Debug("Line %d: Failed to write event header: %v", lineCount, err)
-					return
-				}
-				Debug("Line %d: Wrote event header, %d bytes", lineCount, bytesWritten)
+	// 发送 message_start 事件
+	if err := writer.writeResponse(AnthropicStreamResponse{
+		Type: "message_start",
+		Message: &AnthropicMessagesResponse{
+			ID:      generateMessageID(),
+			Type:    "message",
+			Role:    "assistant",
+			Content: []AnthropicContentBlock{},
+			Model:   anthReq.Model,
+			Usage:   AnthropicUsage{InputTokens: promptTokens},
+		},
+	}); err != nil {
+		DebugContext(c, "Failed to write message_start: %v", err)
+		return
+	}
 
-				dataLine := fmt.Sprintf("data: %s\n\n", string(contentBlockDeltaData))
-				bytesWritten, err = c.Writer.Write([]byte(dataLine))
-				if err != nil {
-					Debug("Line %d: Failed to write data: %v", lineCount, err)
-					return
-				}
-				Debug("Line %d: Wrote data, %d bytes, content: '%s'", lineCount, bytesWritten, content)
+	var fullContent strings.Builder
+	usage := newUsageTracker(anthReq.Model, promptTokens)
+	stopReason := "end_turn"
+	var writeErr error
+
+	processJetbrainsStream(resp, func(data map[string]any) bool {
+		// 检查连接状态
+		select {
+		case <-c.Request.Context().Done():
+			DebugContext(c, "Client disconnected during streaming, stopping")
+			writeErr = c.Request.Context().Err()
+			return false
+		default:
+		}
 
-				if flusher, ok := c.Writer.(http.Flusher); ok {
-					flusher.Flush()
-					Debug("Line %d: Flushed data to client", lineCount)
-				} else {
-					Debug("Line %d: Warning: Writer does not support flushing", lineCount)
+		eventType, _ := data["type"].(string)
+		switch eventType {
+		case "Content":
+			content, _ := data["content"].(string)
+			if content == "" {
+				return true
+			}
+			fullContent.WriteString(content)
+			usage.addCompletion(content)
+			writeErr = writer.text(content)
+		case "ToolCall", "FunctionCall":
+			toolEvent, _ := parseJetbrainsToolEvent(data)
+			if toolEvent.Start {
+				DebugContext(c, "Streaming tool_use block: id=%s, name=%s", toolEvent.ID, toolEvent.Name)
+				if writeErr = writer.startToolUse(toolEvent.ID, toolEvent.Name); writeErr != nil {
+					break
 				}
 			}
-		} else {
-			Debug("Line %d: Not SSE data format, raw line: '%s'", lineCount, line)
+			usage.addCompletion(toolEvent.Name + toolEvent.Arguments)
+			writeErr = writer.inputJSON(toolEvent.Arguments)
+		case "FinishMetadata":
+			if reason, ok := data["reason"].(string); ok {
+				stopReason = mapJetbrainsFinishReason(reason)
+			}
+			usage.observeFinishMetadata(data)
+			return false
 		}
+		return writeErr == nil
+	})
+	total := usage.usage()
+	chargeClientTokens(c, total)
+
+	if writeErr != nil {
+		DebugContext(c, "Anthropic streaming aborted: %v", writeErr)
+		recordFailureWithTimer(startTime, anthReq.Model, accountIdentifier, clientKeyName(c))
+		return
+	}
+
+	if err := writer.finish(stopReason, total.anthropic()); err != nil {
+		DebugContext(c, "Failed to finish Anthropic stream: %v", err)
 	}
 
-	Debug("=== Streaming Response Summary ===")
-	Debug("Total lines processed: %d", lineCount)
-	Debug("Has content: %v", hasContent)
-	Debug("Full aggregated content: '%s'", fullContent.String())
-	Debug("===================================")
-
-	// 发送 content_block_stop 事件
-	contentBlockStopData := generateAnthropicStreamResponse("content_block_stop", "", 0)
-	c.Writer.Write([]byte("event: content_block_stop\n"))
-	c.Writer.Write([]byte(fmt.Sprintf("data: %s\n\n", string(contentBlockStopData))))
-	c.Writer.Flush()
-
-	// 发送 message_stop 事件
-	messageStopData := generateAnthropicStreamResponse("message_stop", "", 0)
-	c.Writer.Write([]byte("event: message_stop\n"))
-	c.Writer.Write([]byte(fmt.Sprintf("data: %s\n\n", string(messageStopData))))
-	c.Writer.Flush()
-
-	if hasContent {
-		recordSuccess(startTime, anthReq.Model, accountIdentifier)
-		Debug("Anthropic streaming response completed successfully")
+	DebugContext(c, "Anthropic streaming summary: content_blocks=%d, tool_use_blocks=%d, text_length=%d",
+		writer.nextIndex, writer.toolBlocks, fullContent.Len())
+
+	if fullContent.Len() > 0 || writer.toolBlocks > 0 {
+		recordSuccess(startTime, anthReq.Model, accountIdentifier, clientKeyName(c))
+		DebugContext(c, "Anthropic streaming response completed successfully")
 	} else {
-		recordFailureWithTimer(startTime, anthReq.Model, accountIdentifier)
-		Warn("Anthropic streaming response completed with no content")
+		recordFailureWithTimer(startTime, anthReq.Model, accountIdentifier, clientKeyName(c))
+		WarnContext(c, "Anthropic streaming response completed with no content")
 	}
 }
 
 // handleAnthropicNonStreamingResponse 处理非流式响应 (Anthropic 格式)
 // SRP: 专门处理 Anthropic 非流式响应的单一职责
-func handleAnthropicNonStreamingResponse(c *gin.Context, resp *http.Response, anthReq *AnthropicMessagesRequest, startTime time.Time, accountIdentifier string) {
+func handleAnthropicNonStreamingResponse(c *gin.Context, resp *http.Response, anthReq *AnthropicMessagesRequest, promptTokens int, startTime time.Time, accountIdentifier string) {
 	defer resp.Body.Close()
 
 	// 读取完整响应
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		recordFailureWithTimer(startTime, anthReq.Model, accountIdentifier)
+		recordFailureWithTimer(startTime, anthReq.Model, accountIdentifier, clientKeyName(c))
 		respondWithAnthropicError(c, http.StatusInternalServerError, "api_error",
 			"Failed to read response body")
 		return
 	}
 
-	Debug("JetBrains API Response Body: %s", string(body))
+	DebugContext(c, "JetBrains API Response Body: %s", string(body))
 
 	// 直接转换 JetBrains 响应为 Anthropic 格式 (KISS: 消除中间转换)
-	anthResp, err := parseJetbrainsToAnthropicDirect(body, anthReq.Model)
+	anthResp, err := parseJetbrainsToAnthropicDirect(body, anthReq.Model, promptTokens)
 	if err != nil {
-		recordFailureWithTimer(startTime, anthReq.Model, accountIdentifier)
+		recordFailureWithTimer(startTime, anthReq.Model, accountIdentifier, clientKeyName(c))
 		respondWithAnthropicError(c, http.StatusInternalServerError, "api_error",
 			fmt.Sprintf("Failed to parse response: %v", err))
 		return
 	}
 
-	recordSuccess(startTime, anthReq.Model, accountIdentifier)
+	chargeClientTokens(c, tokenUsage{PromptTokens: anthResp.Usage.InputTokens, CompletionTokens: anthResp.Usage.OutputTokens})
+	recordSuccess(startTime, anthReq.Model, accountIdentifier, clientKeyName(c))
 	c.JSON(http.StatusOK, anthResp)
 
-	Debug("Anthropic non-streaming response completed successfully: id=%s", anthResp.ID)
-}
-
-// parseJetbrainsStreamData 解析 JetBrains 流式数据
-// KISS: 保持简单的解析逻辑
-func parseJetbrainsStreamData(data string) (string, error) {
-	if data == "" || data == "null" {
-		return "", nil
-	}
-
-	// 尝试解析 JSON 数据
-	var streamData map[string]any
-	if err := sonic.Unmarshal([]byte(data), &streamData); err != nil {
-		// 如果不是 JSON，可能是纯文本
-		return data, nil
-	}
-
-	// 提取内容：优先处理 JetBrains API 格式
-	if eventType, ok := streamData["type"].(string); ok && eventType == "Content" {
-		if content, ok := streamData["content"].(string); ok {
-			return content, nil
-		}
-	}
-
-	// 兼容 OpenAI 格式 (保留原有逻辑)
-	if choices, ok := streamData["choices"].([]any); ok && len(choices) > 0 {
-		if choice, ok := choices[0].(map[string]any); ok {
-			if delta, ok := choice["delta"].(map[string]any); ok {
-				if content, ok := delta["content"].(string); ok {
-					return content, nil
-				}
-			}
-		}
-	}
-
-	// 检查是否是直接的内容响应
-	if content, ok := streamData["content"].(string); ok {
-		return content, nil
-	}
-
-	return "", nil
+	DebugContext(c, "Anthropic non-streaming response completed successfully: id=%s", anthResp.ID)
 }
 
 // parseJetbrainsNonStreamResponse 解析 JetBrains 非流式响应
@@ -269,11 +302,7 @@ func parseJetbrainsNonStreamResponse(body []byte, model string) (*ChatCompletion
 				FinishReason: "stop",
 			},
 		},
-		Usage: map[string]int{
-			"prompt_tokens":     estimateTokenCount(content) / 4, // 粗略估算
-			"completion_tokens": estimateTokenCount(content),
-			"total_tokens":      estimateTokenCount(content) * 5 / 4,
-		},
+		Usage: tokenUsage{CompletionTokens: countTokens(model, content)}.openAI(),
 	}
 
 	return openAIResp, nil
@@ -284,34 +313,13 @@ func generateResponseID() string {
 	return fmt.Sprintf("chatcmpl-%d", time.Now().UnixNano())
 }
 
-// estimateTokenCount 估算 token 数量 (KISS: 简单估算)
-func estimateTokenCount(text string) int {
-	// 简单估算：平均每个 token 约 4 个字符
-	return len(text) / 4
-}
-
-// createJetbrainsStreamRequest 创建 JetBrains API 流式请求 (DRY: 提取公共逻辑)
-func createJetbrainsStreamRequest(payloadBytes []byte, jwt string) (*http.Request, error) {
-	req, err := http.NewRequest("POST", "https://api.jetbrains.ai/user/v5/llm/chat/stream/v8",
-		strings.NewReader(string(payloadBytes)))
-	if err != nil {
-		return nil, err
-	}
-
-	req.Header.Set("Accept", "text/event-stream")
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Cache-Control", "no-cache")
-	setJetbrainsHeaders(req, jwt)
-
-	return req, nil
-}
-
 // parseAndAggregateStreamResponse 解析并聚合流式响应数据
 // 处理 JetBrains API 的流式格式，聚合所有内容片段
 func parseAndAggregateStreamResponse(bodyStr, model string) (*ChatCompletionResponse, error) {
 	lines := strings.Split(bodyStr, "\n")
 	var contentParts []string
 	var finishReason string
+	usage := newUsageTracker(model, 0)
 
 	for _, line := range lines {
 		line = strings.TrimSpace(line)
@@ -346,12 +354,14 @@ func parseAndAggregateStreamResponse(bodyStr, model string) (*ChatCompletionResp
 				if reason, ok := streamData["reason"].(string); ok {
 					finishReason = reason
 				}
+				usage.observeFinishMetadata(streamData)
 			}
 		}
 	}
 
 	// 聚合所有内容片段
 	fullContent := strings.Join(contentParts, "")
+	usage.addCompletion(fullContent)
 
 	if finishReason == "" {
 		finishReason = "stop" // 默认结束原因
@@ -373,11 +383,7 @@ func parseAndAggregateStreamResponse(bodyStr, model string) (*ChatCompletionResp
 				FinishReason: finishReason,
 			},
 		},
-		Usage: map[string]int{
-			"prompt_tokens":     0, // JetBrains API 通常不返回 token 计数
-			"completion_tokens": 0,
-			"total_tokens":      0,
-		},
+		Usage: usage.usage().openAI(),
 	}
 
 	Debug("Successfully aggregated stream response: %d content parts, finish_reason=%s",
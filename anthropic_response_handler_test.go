@@ -0,0 +1,145 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bytedance/sonic"
+	"github.com/gin-gonic/gin"
+)
+
+// sseEvent is a parsed server-sent event
+type sseEvent struct {
+	Name string
+	Data map[string]any
+}
+
+// parseSSEEvents parses "event:" / "data:" pairs from a recorded SSE body
+func parseSSEEvents(t *testing.T, body string) []sseEvent {
+	t.Helper()
+	var events []sseEvent
+	for _, chunk := range strings.Split(body, "\n\n") {
+		var event sseEvent
+		for _, line := range strings.Split(chunk, "\n") {
+			if name, ok := strings.CutPrefix(line, "event: "); ok {
+				event.Name = name
+			} else if data, ok := strings.CutPrefix(line, "data: "); ok {
+				if err := sonic.UnmarshalString(data, &event.Data); err != nil {
+					t.Fatalf("invalid event data %q: %v", data, err)
+				}
+			}
+		}
+		if event.Name != "" {
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
+// jetbrainsStreamBody builds an upstream v8 SSE body from raw event JSON
+func jetbrainsStreamBody(events ...string) *http.Response {
+	var b strings.Builder
+	for _, event := range events {
+		b.WriteString("data: " + event + "\n\n")
+	}
+	b.WriteString("data: end\n\n")
+	return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(b.String()))}
+}
+
+func TestHandleAnthropicStreamingResponse_TextAndToolUse(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/messages", nil)
+
+	resp := jetbrainsStreamBody(
+		`{"type":"Content","content":"Let me check."}`,
+		`{"type":"ToolCall","id":"call_1","name":"get_weather","content":""}`,
+		`{"type":"ToolCall","id":null,"name":null,"content":"{\"city\":"}`,
+		`{"type":"ToolCall","id":null,"name":null,"content":"\"Paris\"}"}`,
+		`{"type":"ToolCall","id":"call_2","name":"get_time","content":""}`,
+		`{"type":"ToolCall","id":null,"name":null,"content":"{}"}`,
+		`{"type":"FinishMetadata","reason":"tool_call"}`,
+	)
+	handleAnthropicStreamingResponse(c, resp, &AnthropicMessagesRequest{Model: "test-model"}, 0, time.Now(), "test")
+
+	events := parseSSEEvents(t, w.Body.String())
+	var names []string
+	for _, e := range events {
+		names = append(names, e.Name)
+	}
+	expected := []string{
+		"message_start",
+		"content_block_start", "content_block_delta", "content_block_stop",
+		"content_block_start", "content_block_delta", "content_block_delta", "content_block_stop",
+		"content_block_start", "content_block_delta", "content_block_stop",
+		"message_delta", "message_stop",
+	}
+	if strings.Join(names, ",") != strings.Join(expected, ",") {
+		t.Fatalf("unexpected event sequence:\n got %v\nwant %v", names, expected)
+	}
+
+	// 文本块在索引 0，两个工具块依次在索引 1 和 2
+	toolStart := events[4].Data
+	if toolStart["index"] != float64(1) {
+		t.Errorf("first tool_use block should have index 1, got %v", toolStart["index"])
+	}
+	block := toolStart["content_block"].(map[string]any)
+	if block["type"] != "tool_use" || block["id"] != "call_1" || block["name"] != "get_weather" {
+		t.Errorf("unexpected tool_use block: %v", block)
+	}
+	if _, ok := block["input"].(map[string]any); !ok {
+		t.Errorf("tool_use block should carry an empty input object, got %v", block["input"])
+	}
+
+	var partialJSON string
+	for _, e := range events[5:7] {
+		delta := e.Data["delta"].(map[string]any)
+		if delta["type"] != "input_json_delta" || e.Data["index"] != float64(1) {
+			t.Errorf("unexpected tool delta: %v", e.Data)
+		}
+		partialJSON += delta["partial_json"].(string)
+	}
+	if partialJSON != `{"city":"Paris"}` {
+		t.Errorf("partial JSON should reassemble the arguments, got %q", partialJSON)
+	}
+
+	if events[8].Data["index"] != float64(2) {
+		t.Errorf("second tool_use block should have index 2, got %v", events[8].Data["index"])
+	}
+
+	delta := events[11].Data["delta"].(map[string]any)
+	if delta["stop_reason"] != "tool_use" {
+		t.Errorf("message_delta should carry stop_reason tool_use, got %v", delta["stop_reason"])
+	}
+}
+
+func TestHandleAnthropicStreamingResponse_TextOnly(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/messages", nil)
+
+	resp := jetbrainsStreamBody(
+		`{"type":"Content","content":"Hello"}`,
+		`{"type":"Content","content":" world"}`,
+		`{"type":"FinishMetadata","reason":"stop"}`,
+	)
+	handleAnthropicStreamingResponse(c, resp, &AnthropicMessagesRequest{Model: "test-model"}, 0, time.Now(), "test")
+
+	events := parseSSEEvents(t, w.Body.String())
+	if len(events) != 7 {
+		t.Fatalf("expected 7 events, got %d: %s", len(events), w.Body.String())
+	}
+	if events[0].Data["message"].(map[string]any)["model"] != "test-model" {
+		t.Errorf("message_start should carry the model: %v", events[0].Data)
+	}
+	delta := events[5].Data["delta"].(map[string]any)
+	if delta["stop_reason"] != "end_turn" {
+		t.Errorf("expected stop_reason end_turn, got %v", delta["stop_reason"])
+	}
+}
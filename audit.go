@@ -0,0 +1,440 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 审计参数，可通过环境变量配置；auditLog 为 nil 时不记录
+var (
+	auditLog          *auditWriter
+	auditSampleRate   = 1.0
+	auditMaxBodyBytes = 1 << 20
+	auditRedaction    = newAuditRedactor(defaultAuditRedactions, nil)
+)
+
+const (
+	defaultAuditMaxFileSize = 100 << 20
+	defaultAuditRetention   = 7 * 24 * time.Hour
+)
+
+// defaultAuditRedactions 默认启用的内置脱敏规则
+var defaultAuditRedactions = []string{"api_keys", "jwts", "images"}
+
+// loadAuditConfig 从环境变量加载审计配置，设置 AUDIT_DIR 后启用
+func loadAuditConfig() {
+	dir := os.Getenv("AUDIT_DIR")
+	if dir == "" {
+		auditLog = nil
+		return
+	}
+
+	if value := os.Getenv("AUDIT_SAMPLE_RATE"); value != "" {
+		if rate, err := strconv.ParseFloat(value, 64); err == nil && rate >= 0 && rate <= 1 {
+			auditSampleRate = rate
+		} else {
+			Warn("Invalid AUDIT_SAMPLE_RATE=%q, using %g", value, auditSampleRate)
+		}
+	}
+	if value := os.Getenv("AUDIT_MAX_BODY_BYTES"); value != "" {
+		if n, err := strconv.Atoi(value); err == nil && n > 0 {
+			auditMaxBodyBytes = n
+		} else {
+			Warn("Invalid AUDIT_MAX_BODY_BYTES=%q, using %d", value, auditMaxBodyBytes)
+		}
+	}
+	maxFileSize := int64(defaultAuditMaxFileSize)
+	if value := os.Getenv("AUDIT_MAX_FILE_MB"); value != "" {
+		if n, err := strconv.Atoi(value); err == nil && n > 0 {
+			maxFileSize = int64(n) << 20
+		} else {
+			Warn("Invalid AUDIT_MAX_FILE_MB=%q, using %d", value, maxFileSize>>20)
+		}
+	}
+	retention := parseDurationEnv("AUDIT_RETENTION", defaultAuditRetention)
+
+	rules := defaultAuditRedactions
+	if value := strings.TrimSpace(os.Getenv("AUDIT_REDACT")); value == "none" {
+		rules = nil
+	} else if value != "" {
+		rules = parseEnvList(value)
+	}
+	var patterns []*regexp.Regexp
+	for _, pattern := range parseEnvList(os.Getenv("AUDIT_REDACT_PATTERNS")) {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			Warn("Ignoring invalid AUDIT_REDACT_PATTERNS entry %q: %v", pattern, err)
+			continue
+		}
+		patterns = append(patterns, re)
+	}
+	auditRedaction = newAuditRedactor(rules, patterns)
+
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		Error("Failed to create AUDIT_DIR %s, audit capture disabled: %v", dir, err)
+		auditLog = nil
+		return
+	}
+	auditLog = &auditWriter{dir: dir, maxSize: maxFileSize, retention: retention}
+	Info("Audit capture enabled: dir=%s, sample_rate=%g, retention=%s, redact=%s",
+		dir, auditSampleRate, retention, strings.Join(rules, ","))
+}
+
+// closeAuditLog 关闭当前的审计文件，供退出时调用
+func closeAuditLog() {
+	if auditLog != nil {
+		auditLog.close()
+	}
+}
+
+// auditRedactor 写入前对整条审计记录 (JSON 文本) 进行脱敏
+type auditRedactor struct {
+	secrets  bool             // 替换已配置的客户端密钥、管理密钥和账户凭据
+	patterns []*regexp.Regexp // 匹配内容替换为 [REDACTED]
+	images   bool             // 长 base64 内容替换为长度说明
+}
+
+var (
+	jwtPattern    = regexp.MustCompile(`eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`)
+	apiKeyPattern = regexp.MustCompile(`\bsk-[A-Za-z0-9_-]{16,}|(?i:bearer\s+)[A-Za-z0-9._~+/=-]{8,}`)
+	base64Pattern = regexp.MustCompile(`[A-Za-z0-9+/]{256,}={0,2}`)
+)
+
+// minRedactedSecretLength 短于此长度的已知凭据不做字面替换，避免误伤普通内容
+const minRedactedSecretLength = 6
+
+func newAuditRedactor(rules []string, custom []*regexp.Regexp) *auditRedactor {
+	r := &auditRedactor{}
+	for _, rule := range rules {
+		switch rule {
+		case "api_keys":
+			r.secrets = true
+			r.patterns = append(r.patterns, apiKeyPattern)
+		case "jwts":
+			r.patterns = append(r.patterns, jwtPattern)
+		case "images":
+			r.images = true
+		default:
+			Warn("Unknown AUDIT_REDACT rule %q (supported: api_keys, jwts, images, none)", rule)
+		}
+	}
+	r.patterns = append(r.patterns, custom...)
+	return r
+}
+
+// knownSecrets 当前配置中的客户端密钥、管理密钥和账户凭据
+func knownSecrets() []string {
+	cfg := currentConfig()
+	secrets := []string{cfg.AdminAPIKey}
+	for key := range cfg.ClientKeys {
+		secrets = append(secrets, key)
+	}
+	for _, account := range accountsSnapshot() {
+		jwt, _ := accountJWT(account)
+		secrets = append(secrets, accountAuthorization(account), jwt, account.LicenseID)
+	}
+	return secrets
+}
+
+// redact 返回脱敏后的文本
+func (r *auditRedactor) redact(text string) string {
+	if r.secrets {
+		for _, secret := range knownSecrets() {
+			if len(secret) >= minRedactedSecretLength {
+				text = strings.ReplaceAll(text, secret, "[REDACTED]")
+			}
+		}
+	}
+	for _, re := range r.patterns {
+		text = re.ReplaceAllString(text, "[REDACTED]")
+	}
+	if r.images {
+		text = base64Pattern.ReplaceAllStringFunc(text, func(data string) string {
+			return fmt.Sprintf("[REDACTED base64 %d chars]", len(data))
+		})
+	}
+	return text
+}
+
+// auditWriter 按大小和日期轮转的 JSONL 审计文件，轮转时删除超过保留期的文件
+type auditWriter struct {
+	dir       string
+	maxSize   int64
+	retention time.Duration
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+	day  string
+}
+
+func (w *auditWriter) write(line []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	now := time.Now().UTC()
+	if w.file == nil || w.size+int64(len(line))+1 > w.maxSize || now.Format("20060102") != w.day {
+		if err := w.rotate(now); err != nil {
+			return err
+		}
+	}
+	n, err := w.file.Write(append(line, '\n'))
+	w.size += int64(n)
+	return err
+}
+
+// rotate 关闭当前文件并创建新文件 (调用方持有 w.mu)
+func (w *auditWriter) rotate(now time.Time) error {
+	if w.file != nil {
+		w.file.Close()
+		w.file = nil
+	}
+	name := filepath.Join(w.dir, "audit-"+now.Format("20060102-150405.000000")+".jsonl")
+	file, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	w.file, w.size, w.day = file, 0, now.Format("20060102")
+	w.prune(now, name)
+	return nil
+}
+
+// prune 删除最后修改时间超过保留期的审计文件
+func (w *auditWriter) prune(now time.Time, current string) {
+	files, _ := filepath.Glob(filepath.Join(w.dir, "audit-*.jsonl"))
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil || file == current || now.Sub(info.ModTime()) < w.retention {
+			continue
+		}
+		if err := os.Remove(file); err != nil {
+			Warn("Failed to remove expired audit file %s: %v", file, err)
+		}
+	}
+}
+
+func (w *auditWriter) close() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.file != nil {
+		w.file.Close()
+		w.file = nil
+	}
+}
+
+// cappedBuffer 最多保存 limit 字节，超出部分丢弃并标记 truncated
+type cappedBuffer struct {
+	buf       bytes.Buffer
+	limit     int
+	truncated bool
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	if room := b.limit - b.buf.Len(); len(p) > room {
+		b.buf.Write(p[:max(room, 0)])
+		b.truncated = true
+	} else {
+		b.buf.Write(p)
+	}
+	return len(p), nil
+}
+
+// auditCapture 一个被采样请求的捕获状态，保存在请求 context 中
+type auditCapture struct {
+	mu              sync.Mutex
+	request         cappedBuffer
+	response        cappedBuffer
+	upstream        cappedBuffer
+	upstreamPayload []byte
+	attempts        []AuditAttempt
+}
+
+type auditCaptureKey struct{}
+
+func auditFromContext(ctx context.Context) *auditCapture {
+	capture, _ := ctx.Value(auditCaptureKey{}).(*auditCapture)
+	return capture
+}
+
+// beginUpstreamAttempt 记录发送给上游的 payload 和本次尝试的账户，丢弃上一次尝试的上游响应
+// 方法可以在 nil 上调用 (请求未被采样)
+func (a *auditCapture) beginUpstreamAttempt(payload []byte, account *JetbrainsAccount) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.upstreamPayload == nil {
+		a.upstreamPayload = payload
+	}
+	a.attempts = append(a.attempts, AuditAttempt{Account: accountID(account)})
+	a.upstream.buf.Reset()
+	a.upstream.truncated = false
+}
+
+// endUpstreamAttempt 记录本次尝试的结果，成功收到响应时捕获上游响应体
+func (a *auditCapture) endUpstreamAttempt(resp *http.Response, err error) {
+	if a == nil || len(a.attempts) == 0 {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	attempt := &a.attempts[len(a.attempts)-1]
+	if err != nil {
+		attempt.Error = err.Error()
+		return
+	}
+	attempt.Status = resp.StatusCode
+	resp.Body = &auditTeeReader{ReadCloser: resp.Body, capture: a, buf: &a.upstream}
+}
+
+// auditTeeReader 读取时把内容复制到捕获缓冲区
+type auditTeeReader struct {
+	io.ReadCloser
+	capture *auditCapture
+	buf     *cappedBuffer
+}
+
+func (r *auditTeeReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 {
+		r.capture.mu.Lock()
+		r.buf.Write(p[:n])
+		r.capture.mu.Unlock()
+	}
+	return n, err
+}
+
+// auditResponseWriter 把写给客户端的响应复制到捕获缓冲区
+type auditResponseWriter struct {
+	gin.ResponseWriter
+	capture *auditCapture
+}
+
+func (w *auditResponseWriter) Write(p []byte) (int, error) {
+	w.capture.mu.Lock()
+	w.capture.response.Write(p)
+	w.capture.mu.Unlock()
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *auditResponseWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+// auditSensitiveHeaders 不写入审计记录的请求头
+var auditSensitiveHeaders = map[string]bool{
+	"Authorization":       true,
+	"Proxy-Authorization": true,
+	"X-Api-Key":           true,
+	"X-Goog-Api-Key":      true,
+	"Cookie":              true,
+}
+
+// auditMiddleware 按 AUDIT_SAMPLE_RATE 采样，捕获客户端请求、上游 payload、上游 SSE 行和返回给客户端的响应
+// 放在认证之后，只记录通过认证的请求
+func auditMiddleware(c *gin.Context) {
+	if auditLog == nil || rand.Float64() >= auditSampleRate {
+		c.Next()
+		return
+	}
+
+	start := time.Now()
+	capture := &auditCapture{}
+	for _, buf := range []*cappedBuffer{&capture.request, &capture.response, &capture.upstream} {
+		buf.limit = auditMaxBodyBytes
+	}
+	c.Request.Body = &auditTeeReader{ReadCloser: c.Request.Body, capture: capture, buf: &capture.request}
+	c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), auditCaptureKey{}, capture))
+	c.Writer = &auditResponseWriter{ResponseWriter: c.Writer, capture: capture}
+
+	c.Next()
+
+	record := capture.record(c, start)
+	if err := writeAuditRecord(record); err != nil {
+		WarnContext(c, "Failed to write audit record: %v", err)
+	}
+}
+
+// record 在请求结束后生成审计记录
+func (a *auditCapture) record(c *gin.Context, start time.Time) *AuditRecord {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	query := c.Request.URL.Query()
+	query.Del("key") // Gemini 客户端可以在查询参数中传递密钥
+	headers := make(map[string]string)
+	for name, values := range c.Request.Header {
+		if !auditSensitiveHeaders[http.CanonicalHeaderKey(name)] {
+			headers[name] = strings.Join(values, ", ")
+		}
+	}
+
+	record := &AuditRecord{
+		ID:               requestIDFromContext(c),
+		Time:             start.UTC(),
+		DurationMs:       time.Since(start).Milliseconds(),
+		Method:           c.Request.Method,
+		Path:             c.Request.URL.Path,
+		Query:            query.Encode(),
+		Headers:          headers,
+		Client:           clientKeyName(c),
+		Status:           c.Writer.Status(),
+		Request:          auditBody(a.request.buf.Bytes()),
+		UpstreamPayload:  auditBody(a.upstreamPayload),
+		UpstreamAttempts: a.attempts,
+		Response:         auditBody(a.response.buf.Bytes()),
+		Truncated:        a.request.truncated || a.response.truncated || a.upstream.truncated,
+	}
+	for _, line := range strings.Split(a.upstream.buf.String(), "\n") {
+		if line = strings.TrimRight(line, "\r"); line != "" {
+			record.UpstreamLines = append(record.UpstreamLines, line)
+		}
+	}
+	if rm := requestMetricsFromContext(c.Request.Context()); rm != nil {
+		rm.mu.Lock()
+		record.Model, record.Account = rm.model, rm.account
+		rm.mu.Unlock()
+	}
+	return record
+}
+
+// auditBody 合法 JSON 压缩后原样保存，其他内容 (SSE 流、截断的 JSON) 保存为 JSON 字符串
+func auditBody(body []byte) json.RawMessage {
+	if len(body) == 0 {
+		return nil
+	}
+	var compact bytes.Buffer
+	if json.Compact(&compact, body) == nil {
+		return compact.Bytes()
+	}
+	quoted, _ := marshalJSON(string(body))
+	return quoted
+}
+
+// writeAuditRecord 脱敏后写入审计文件；脱敏规则破坏了 JSON 结构时不写入
+func writeAuditRecord(record *AuditRecord) error {
+	data, err := marshalJSON(record)
+	if err != nil {
+		return err
+	}
+	line := []byte(auditRedaction.redact(string(data)))
+	if !json.Valid(line) {
+		return fmt.Errorf("redaction produced invalid JSON for request %s, check AUDIT_REDACT_PATTERNS", record.ID)
+	}
+	return auditLog.write(line)
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// enableAudit 将审计记录写入临时目录，测试结束后关闭
+func enableAudit(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	t.Setenv("AUDIT_DIR", dir)
+	loadAuditConfig()
+	t.Cleanup(func() {
+		closeAuditLog()
+		auditLog = nil
+	})
+	return dir
+}
+
+// readOnlyAuditRecords 读取目录中唯一的审计文件
+func readOnlyAuditRecords(t *testing.T, dir string) ([]AuditRecord, string) {
+	t.Helper()
+	files, _ := filepath.Glob(filepath.Join(dir, "audit-*.jsonl"))
+	if len(files) != 1 {
+		t.Fatalf("expected one audit file, got %v", files)
+	}
+	records, err := readAuditRecords(files[0], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := os.ReadFile(files[0])
+	return records, string(data)
+}
+
+func TestAudit_CapturesRequestPipelineWithRedaction(t *testing.T) {
+	_, router := setupFakeUpstream(t, DefaultFakeGrazieOptions())
+	dir := enableAudit(t)
+	image := strings.Repeat("QUJD", 100)
+	jwt := jetbrainsAccounts[0].JWT
+
+	w := doProxyRequest(router, "/v1/chat/completions",
+		`{"model":"test-model","stream":true,"messages":[{"role":"user","content":"hi, my key is `+testClientKey+
+			` and token `+jwt+` data:image/png;base64,`+image+`"}]}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("request failed: %d %s", w.Code, w.Body.String())
+	}
+
+	records, raw := readOnlyAuditRecords(t, dir)
+	if len(records) != 1 {
+		t.Fatalf("expected one record, got %d", len(records))
+	}
+	record := records[0]
+	if record.ID != w.Header().Get(requestIDHeader) || record.Path != "/v1/chat/completions" || record.Status != http.StatusOK ||
+		record.Client != "test-client" || record.Model != "test-model" || record.Account != accountID(jetbrainsAccounts[0]) {
+		t.Errorf("unexpected record metadata: %+v", record)
+	}
+	if len(record.UpstreamPayload) == 0 || len(record.UpstreamAttempts) != 1 || record.UpstreamAttempts[0].Status != http.StatusOK {
+		t.Errorf("record should include the upstream payload and attempt, got %+v", record)
+	}
+	if len(record.UpstreamLines) == 0 || !strings.HasPrefix(record.UpstreamLines[0], "data: ") {
+		t.Errorf("record should include the upstream SSE lines, got %v", record.UpstreamLines)
+	}
+	if response := string(auditText(record.Response)); !strings.Contains(response, "chat.completion.chunk") {
+		t.Errorf("record should include the streamed response, got %s", response)
+	}
+	if _, ok := record.Headers["Authorization"]; ok {
+		t.Error("authentication headers should not be recorded")
+	}
+
+	for _, secret := range []string{testClientKey, jwt, image} {
+		if strings.Contains(raw, secret) {
+			t.Errorf("audit file should not contain %.20s...", secret)
+		}
+	}
+	if !strings.Contains(raw, "[REDACTED base64 400 chars]") {
+		t.Error("base64 image data should be replaced with its length")
+	}
+}
+
+func TestAudit_SampleRateZeroCapturesNothing(t *testing.T) {
+	_, router := setupFakeUpstream(t, DefaultFakeGrazieOptions())
+	t.Setenv("AUDIT_SAMPLE_RATE", "0")
+	dir := enableAudit(t)
+	t.Cleanup(func() { auditSampleRate = 1 })
+
+	doProxyRequest(router, "/v1/chat/completions", `{"model":"test-model","messages":[{"role":"user","content":"hi"}]}`)
+	if files, _ := filepath.Glob(filepath.Join(dir, "*")); len(files) != 0 {
+		t.Errorf("no records should be written, got %v", files)
+	}
+}
+
+func TestAuditWriter_RotatesBySizeAndPrunesExpiredFiles(t *testing.T) {
+	dir := t.TempDir()
+	expired := filepath.Join(dir, "audit-20000101-000000.000000.jsonl")
+	os.WriteFile(expired, []byte("{}\n"), 0o600)
+	old := time.Now().Add(-48 * time.Hour)
+	os.Chtimes(expired, old, old)
+
+	w := &auditWriter{dir: dir, maxSize: 64, retention: 24 * time.Hour}
+	defer w.close()
+	line := []byte(`{"id":"` + strings.Repeat("x", 30) + `"}`)
+	for range 3 {
+		if err := w.write(line); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond) // 文件名精确到微秒
+	}
+
+	if _, err := os.Stat(expired); !os.IsNotExist(err) {
+		t.Error("files older than the retention period should be removed")
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "audit-*.jsonl")); len(files) != 3 {
+		t.Errorf("each record exceeding the size limit should start a new file, got %v", files)
+	}
+}
+
+func TestReplay_ProxyAndUpstreamTargets(t *testing.T) {
+	_, router := setupFakeUpstream(t, DefaultFakeGrazieOptions())
+	dir := enableAudit(t)
+	// 只测试重放比较，不脱敏请求中的凭据
+	auditRedaction = newAuditRedactor(nil, nil)
+	t.Cleanup(func() { auditRedaction = newAuditRedactor(defaultAuditRedactions, nil) })
+
+	if w := doProxyRequest(router, "/v1/chat/completions",
+		`{"model":"test-model","stream":true,"messages":[{"role":"user","content":"hello replay"}]}`); w.Code != http.StatusOK {
+		t.Fatalf("request failed: %d %s", w.Code, w.Body.String())
+	}
+	records, _ := readOnlyAuditRecords(t, dir)
+	auditLog = nil // 重放的请求不再记录
+
+	server := httptest.NewServer(router)
+	defer server.Close()
+	opts := replayOptions{target: "proxy", proxyURL: server.URL, apiKey: testClientKey, client: &http.Client{}}
+	var out strings.Builder
+	if n, err := replayRecords(records, opts, &out); err != nil || n != 0 {
+		t.Fatalf("replaying against the same proxy should be identical, got %d differences (%v):\n%s", n, err, out.String())
+	}
+
+	opts.target, opts.jwt = "upstream", jetbrainsAccounts[0].JWT
+	out.Reset()
+	if n, err := replayRecords(records, opts, &out); err != nil || n != 0 {
+		t.Fatalf("replaying against the same upstream should be identical, got %d differences (%v):\n%s", n, err, out.String())
+	}
+
+	records[0].Response = auditBody([]byte(strings.Replace(string(auditText(records[0].Response)), "hello", "goodbye", 1)))
+	opts.target = "proxy"
+	out.Reset()
+	if n, _ := replayRecords(records, opts, &out); n != 1 || !strings.Contains(out.String(), "- ") || !strings.Contains(out.String(), "+ ") {
+		t.Errorf("a changed response should be reported as a difference, got:\n%s", out.String())
+	}
+}
+
+func TestDiffLines(t *testing.T) {
+	diff := diffLines([]string{"a", "b", "c"}, []string{"a", "x", "c", "d"})
+	want := []string{"+ x", "- b", "+ d"}
+	if strings.Join(diff, "|") != strings.Join(want, "|") {
+		t.Errorf("diffLines = %v, want %v", diff, want)
+	}
+	if diffLines([]string{"a"}, []string{"a"}) != nil {
+		t.Error("identical input should have no differences")
+	}
+}
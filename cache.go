@@ -106,6 +106,17 @@ var (
 	toolsValidationCache   = NewCache()
 )
 
+// Delete removes an item from the cache.
+func (c *LRUCache) Delete(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if item, exists := c.items[key]; exists {
+		c.remove(item)
+		delete(c.items, key)
+	}
+}
+
 // generateMessagesCacheKey creates a cache key from chat messages.
 func generateMessagesCacheKey(messages []ChatMessage) string {
 	var b strings.Builder
@@ -113,7 +124,18 @@ func generateMessagesCacheKey(messages []ChatMessage) string {
 		b.WriteString(msg.Role)
 		if content, ok := msg.Content.(string); ok {
 			b.WriteString(content)
+		} else if msg.Content != nil {
+			contentJSON, _ := marshalJSON(msg.Content)
+			b.Write(contentJSON)
+		}
+		// 工具调用和工具结果同样影响转换结果
+		b.WriteString(msg.ToolCallID)
+		for _, tc := range msg.ToolCalls {
+			b.WriteString(tc.ID)
+			b.WriteString(tc.Function.Name)
+			b.WriteString(tc.Function.Arguments)
 		}
+		b.WriteByte(0)
 	}
 	hash := sha1.Sum([]byte(b.String()))
 	return hex.EncodeToString(hash[:])
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"time"
+
+	"github.com/bytedance/sonic"
+	"github.com/gin-gonic/gin"
+)
+
+// clientKeyContextKey gin 上下文中保存已认证客户端密钥的键
+const clientKeyContextKey = "clientKey"
+
+// parseClientKeysFile 解析客户端密钥注册文件
+func parseClientKeysFile(data []byte) ([]*ClientKey, error) {
+	var file ClientKeysFile
+	if err := sonic.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+
+	keys := make([]*ClientKey, 0, len(file.Keys))
+	names := make(map[string]string, len(file.Keys))
+	for i := range file.Keys {
+		key := file.Keys[i]
+		if key.Key == "" {
+			return nil, fmt.Errorf("entry %d has no key", i)
+		}
+		if key.Name == "" {
+			key.Name = defaultClientKeyName(key.Key)
+		}
+		// 名称用于统计汇总，不同的密钥不能重名
+		if other, exists := names[key.Name]; exists && other != key.Key {
+			return nil, fmt.Errorf("entry %d: duplicate key name %q", i, key.Name)
+		}
+		names[key.Name] = key.Key
+		if key.ExpiresAt != "" {
+			expiry, err := parseClientKeyExpiry(key.ExpiresAt)
+			if err != nil {
+				return nil, fmt.Errorf("key %s: invalid expires_at %q", key.Name, key.ExpiresAt)
+			}
+			key.Expiry = expiry
+		}
+		for _, pattern := range key.Models {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("key %s: invalid model pattern %q", key.Name, pattern)
+			}
+		}
+		keys = append(keys, &key)
+	}
+	return keys, nil
+}
+
+// parseClientKeyExpiry 解析过期时间，只有日期时在当天结束时过期
+func parseClientKeyExpiry(value string) (time.Time, error) {
+	if expiry, err := time.Parse(time.RFC3339, value); err == nil {
+		return expiry, nil
+	}
+	date, err := time.ParseInLocation("2006-01-02", value, time.Local)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return date.AddDate(0, 0, 1), nil
+}
+
+// loadClientKeysFile 从 CLIENT_KEYS_FILE 加载密钥，文件中的条目覆盖同名的环境变量密钥
+func loadClientKeysFile(registry map[string]*ClientKey) error {
+	filePath := os.Getenv("CLIENT_KEYS_FILE")
+	if filePath == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return fmt.Errorf("error loading client keys file %s: %w", filePath, err)
+	}
+	keys, err := parseClientKeysFile(data)
+	if err != nil {
+		return fmt.Errorf("error parsing client keys file %s: %w", filePath, err)
+	}
+
+	for _, key := range keys {
+		if _, exists := registry[key.Key]; exists {
+			Warn("Client key %s is defined more than once, using the last definition", key.Name)
+		}
+		registry[key.Key] = key
+	}
+	Info("Loaded %d client API keys from %s", len(keys), filePath)
+	return nil
+}
+
+// defaultClientKeyName 为未命名的密钥生成显示名称 (不暴露完整密钥)
+// 过短的密钥显示后四位会泄露大部分内容，改用哈希标识
+func defaultClientKeyName(key string) string {
+	if len(key) <= 8 {
+		return "Key #" + clientKeyID(key)[:8]
+	}
+	return truncateString(key, 0, 4, "Key ...")
+}
+
+// clientKeyID 密钥的稳定标识 (SHA-256 前缀)，用于代替明文密钥保存在 Redis 和响应存储中
+// 名称只是显示用途，不保证唯一
+func clientKeyID(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:8])
+}
+
+// isEnabled 密钥是否启用
+func (k *ClientKey) isEnabled() bool {
+	return k.Enabled == nil || *k.Enabled
+}
+
+// checkUsable 检查密钥在当前时间是否可用
+func (k *ClientKey) checkUsable(now time.Time) error {
+	if !k.isEnabled() {
+		return errors.New("client API key is disabled")
+	}
+	if !k.Expiry.IsZero() && !now.Before(k.Expiry) {
+		return fmt.Errorf("client API key expired at %s", k.Expiry.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// allowsModel 检查密钥是否允许使用模型，Models 为空表示不限制
+func (k *ClientKey) allowsModel(model string) bool {
+	if len(k.Models) == 0 {
+		return true
+	}
+	for _, pattern := range k.Models {
+		if matched, _ := path.Match(pattern, model); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// currentClientKey 返回当前请求认证通过的客户端密钥
+func currentClientKey(c *gin.Context) *ClientKey {
+	if value, ok := c.Get(clientKeyContextKey); ok {
+		if key, ok := value.(*ClientKey); ok {
+			return key
+		}
+	}
+	return nil
+}
+
+// clientKeyName 返回当前请求的客户端密钥名称，用于统计记录
+func clientKeyName(c *gin.Context) string {
+	if key := currentClientKey(c); key != nil {
+		return key.Name
+	}
+	return ""
+}
+
+// currentClientKeyID 返回当前请求的客户端密钥标识，未认证时为空
+func currentClientKeyID(c *gin.Context) string {
+	if key := currentClientKey(c); key != nil {
+		return clientKeyID(key.Key)
+	}
+	return ""
+}
+
+// clientModelAllowed 检查当前请求的客户端密钥是否允许使用模型
+func clientModelAllowed(c *gin.Context, model string) bool {
+	key := currentClientKey(c)
+	return key == nil || key.allowsModel(model)
+}
+
+// clientModelForbiddenMessage 模型不在允许列表中时的错误信息
+func clientModelForbiddenMessage(c *gin.Context, model string) string {
+	return fmt.Sprintf("Client API key %s is not allowed to use model %s", clientKeyName(c), model)
+}
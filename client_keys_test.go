@@ -0,0 +1,121 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseClientKeysFile(t *testing.T) {
+	keys, err := parseClientKeysFile([]byte(`{"keys":[
+		{"key":"sk-alice","name":"alice-laptop","owner":"alice","models":["gpt-*","claude-4-sonnet"],"max_request_bytes":1024,"expires_at":"2030-01-31"},
+		{"key":"sk-bob-0123","enabled":false}
+	]}`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	alice := keys[0]
+	if !alice.allowsModel("gpt-4o") || !alice.allowsModel("claude-4-sonnet") || alice.allowsModel("claude-4-opus") {
+		t.Errorf("model allowlist not applied: %+v", alice.Models)
+	}
+	// 只有日期时在当天结束时过期
+	want := time.Date(2030, 2, 1, 0, 0, 0, 0, time.Local)
+	if !alice.Expiry.Equal(want) {
+		t.Errorf("expected expiry %s, got %s", want, alice.Expiry)
+	}
+	if err := alice.checkUsable(want.Add(-time.Second)); err != nil {
+		t.Errorf("key should be usable before expiry: %v", err)
+	}
+	if err := alice.checkUsable(want); err == nil {
+		t.Error("key should be rejected after expiry")
+	}
+
+	bob := keys[1]
+	if bob.Name != "Key ...0123" || bob.checkUsable(time.Now()) == nil || !bob.allowsModel("anything") {
+		t.Errorf("unexpected defaults for unnamed disabled key: %+v", bob)
+	}
+
+	if _, err := parseClientKeysFile([]byte(`{"keys":[{"key":"sk-x","models":["[gpt"]}]}`)); err == nil {
+		t.Error("invalid model pattern should be rejected")
+	}
+	if _, err := parseClientKeysFile([]byte(`{"keys":[{"name":"no key"}]}`)); err == nil {
+		t.Error("entry without key should be rejected")
+	}
+	if _, err := parseClientKeysFile([]byte(`{"keys":[{"key":"sk-a","name":"shared"},{"key":"sk-b","name":"shared"}]}`)); err == nil {
+		t.Error("different keys with the same name should be rejected")
+	}
+
+	// 短密钥不能以明文或大部分明文出现在名称中
+	if name := defaultClientKeyName("abcd"); strings.Contains(name, "abcd") || name == defaultClientKeyName("wxyz") {
+		t.Errorf("short keys should be masked with a distinct hash, got %q", name)
+	}
+}
+
+func TestAuthenticateClient_KeyPolicies(t *testing.T) {
+	_, router := setupFakeUpstream(t, DefaultFakeGrazieOptions())
+	disabled := false
+	currentConfig().ClientKeys = map[string]*ClientKey{
+		testClientKey:  {Key: testClientKey, Name: "limited", Models: []string{"other-*"}, MaxRequestBytes: 200},
+		"sk-disabled":  {Key: "sk-disabled", Name: "disabled", Enabled: &disabled},
+		"sk-expired":   {Key: "sk-expired", Name: "expired", Expiry: time.Now().Add(-time.Minute)},
+		"sk-unlimited": {Key: "sk-unlimited", Name: "unlimited"},
+	}
+	statsMutex.Lock()
+	oldStats := requestStats
+	requestStats = RequestStats{}
+	statsMutex.Unlock()
+	t.Cleanup(func() {
+		statsMutex.Lock()
+		requestStats = oldStats
+		statsMutex.Unlock()
+	})
+
+	body := `{"model":"test-model","messages":[{"role":"user","content":"hi"}]}`
+	w := doProxyRequest(router, "/v1/chat/completions", body)
+	if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "not allowed to use model test-model") {
+		t.Errorf("model outside the allowlist should be rejected, got %d: %s", w.Code, w.Body.String())
+	}
+	w = doProxyRequest(router, "/v1/messages", `{"model":"test-model","max_tokens":10,"messages":[{"role":"user","content":"hi"}]}`)
+	if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "permission_error") {
+		t.Errorf("Anthropic endpoint should enforce the allowlist, got %d: %s", w.Code, w.Body.String())
+	}
+	w = doProxyRequestWithMethod(router, http.MethodGet, "/v1/models", "")
+	if strings.Contains(w.Body.String(), "test-model") {
+		t.Errorf("model list should be filtered by the allowlist: %s", w.Body.String())
+	}
+	w = doProxyRequest(router, "/v1/chat/completions", `{"model":"test-model","messages":[{"role":"user","content":"`+strings.Repeat("x", 300)+`"}]}`)
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("oversized request should be rejected with 413, got %d", w.Code)
+	}
+
+	for key, want := range map[string]string{"sk-disabled": "disabled", "sk-expired": "expired"} {
+		req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+key)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), want) {
+			t.Errorf("%s key should be rejected, got %d: %s", want, w.Code, w.Body.String())
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(body))
+	req.Header.Set("x-api-key", "sk-unlimited")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("unrestricted key should be accepted, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// 请求记录中保存密钥名称
+	usage := getClientUsageStats(1)
+	clients := map[string]int64{}
+	for _, u := range usage {
+		clients[u.Client] += u.Requests
+	}
+	if clients["limited"] != 2 || clients["unlimited"] != 1 {
+		t.Errorf("requests should be attributed to key names, got %+v", usage)
+	}
+}
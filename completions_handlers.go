@@ -0,0 +1,309 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// completionSystemPrompt 引导聊天模型按文本补全方式续写
+const completionSystemPrompt = "You are a text completion engine. Continue the text provided by the user exactly from where it ends. " +
+	"Output only the continuation, without repeating the input, explanations or markdown formatting."
+
+// fimSystemPrompt 引导聊天模型进行中间填充 (fill-in-the-middle)
+const fimSystemPrompt = "You are a fill-in-the-middle code completion engine. The user provides the text before the cursor in <prefix> " +
+	"and the text after the cursor in <suffix>. Output only the text that belongs between them, " +
+	"without repeating either part, explanations or markdown formatting."
+
+// completions handles legacy OpenAI text completion requests
+func completions(c *gin.Context) {
+	startTime := time.Now()
+
+	// 记录性能指标开始
+	defer func() {
+		duration := time.Since(startTime)
+		RecordHTTPRequest(duration)
+	}()
+
+	var request CompletionRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		recordFailureWithTimer(startTime, "", "", clientKeyName(c))
+		RecordHTTPError()
+		respondWithError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	prompt, err := parseCompletionPrompt(request.Prompt)
+	if err != nil {
+		recordFailureWithTimer(startTime, request.Model, "", clientKeyName(c))
+		RecordHTTPError()
+		respondWithError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// KISS: 文本补全转换为聊天请求，复用现有的转换和上游调用路径
+	chatRequest := completionToChatRequest(request, prompt)
+	serveChatCompletion(c, chatRequest, startTime, func(c *gin.Context, resp *http.Response, _ ChatCompletionRequest, promptTokens int, startTime time.Time, accountIdentifier string) {
+		handleCompletionResponse(c, resp, request, prompt, promptTokens, startTime, accountIdentifier)
+	})
+}
+
+// parseCompletionPrompt extracts a single prompt string from the prompt field
+func parseCompletionPrompt(prompt any) (string, error) {
+	switch v := prompt.(type) {
+	case string:
+		if v != "" {
+			return v, nil
+		}
+	case []any:
+		if len(v) > 1 {
+			return "", errors.New("batched prompts are not supported, send one prompt per request")
+		}
+		if len(v) == 1 {
+			if text, ok := v[0].(string); ok && text != "" {
+				return text, nil
+			}
+			return "", errors.New("token array prompts are not supported, send the prompt as a string")
+		}
+	}
+	return "", errors.New("prompt is required")
+}
+
+// completionToChatRequest maps a text completion request (and FIM suffix) to chat messages
+func completionToChatRequest(request CompletionRequest, prompt string) ChatCompletionRequest {
+	messages := []ChatMessage{
+		{Role: "system", Content: completionSystemPrompt},
+		{Role: "user", Content: prompt},
+	}
+	if request.Suffix != "" {
+		messages = []ChatMessage{
+			{Role: "system", Content: fimSystemPrompt},
+			{Role: "user", Content: "<prefix>" + prompt + "</prefix>\n<suffix>" + request.Suffix + "</suffix>"},
+		}
+	}
+
+	return ChatCompletionRequest{
+		Model:         request.Model,
+		Messages:      messages,
+		Stream:        request.Stream,
+		Temperature:   request.Temperature,
+		MaxTokens:     request.MaxTokens,
+		TopP:          request.TopP,
+		Stop:          request.Stop,
+		StreamOptions: request.StreamOptions,
+	}
+}
+
+// parseStopSequences normalises the stop field (string or array) into a list
+func parseStopSequences(stop any) []string {
+	var sequences []string
+	switch v := stop.(type) {
+	case string:
+		sequences = append(sequences, v)
+	case []any:
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				sequences = append(sequences, s)
+			}
+		}
+	}
+
+	result := sequences[:0]
+	for _, s := range sequences {
+		if s != "" {
+			result = append(result, s)
+		}
+	}
+	return result
+}
+
+// completionTextFilter applies stop sequences and max_tokens to generated text
+// 上游不支持这两个参数，因此在代理端截断
+type completionTextFilter struct {
+	model        string
+	stop         []string
+	maxTokens    int    // 0 means unlimited
+	pending      string // text held back because it may start a stop sequence
+	tokens       int
+	finishReason string // set once the filter stops accepting text
+}
+
+// newCompletionTextFilter creates a filter for the request
+func newCompletionTextFilter(request CompletionRequest) *completionTextFilter {
+	filter := &completionTextFilter{
+		model: request.Model,
+		stop:  parseStopSequences(request.Stop),
+	}
+	if request.MaxTokens != nil && *request.MaxTokens > 0 {
+		filter.maxTokens = *request.MaxTokens
+	}
+	return filter
+}
+
+// push accepts a text fragment and returns the part that is safe to emit
+func (f *completionTextFilter) push(text string) string {
+	if f.finishReason != "" {
+		return ""
+	}
+	buf := f.pending + text
+	f.pending = ""
+
+	cut := -1
+	for _, s := range f.stop {
+		if i := strings.Index(buf, s); i >= 0 && (cut < 0 || i < cut) {
+			cut = i
+		}
+	}
+	if cut >= 0 {
+		f.finishReason = "stop"
+		return f.limit(buf[:cut])
+	}
+
+	// 保留可能是停止序列开头的尾部文本，等待后续片段
+	hold := 0
+	for _, s := range f.stop {
+		for n := min(len(s)-1, len(buf)); n > hold; n-- {
+			if strings.HasSuffix(buf, s[:n]) {
+				hold = n
+				break
+			}
+		}
+	}
+	f.pending = buf[len(buf)-hold:]
+	return f.limit(buf[:len(buf)-hold])
+}
+
+// flush returns any held-back text once the upstream stream has ended
+func (f *completionTextFilter) flush() string {
+	if f.finishReason != "" {
+		return ""
+	}
+	pending := f.pending
+	f.pending = ""
+	return f.limit(pending)
+}
+
+// limit enforces max_tokens on emitted text
+func (f *completionTextFilter) limit(text string) string {
+	if f.maxTokens == 0 || text == "" {
+		return text
+	}
+	n := countTokens(f.model, text)
+	if f.tokens+n <= f.maxTokens {
+		f.tokens += n
+		return text
+	}
+
+	// 二分查找不超过剩余 token 数的最长前缀
+	remaining := f.maxTokens - f.tokens
+	runes := []rune(text)
+	lo, hi := 0, len(runes)
+	for lo < hi {
+		mid := (lo + hi + 1) / 2
+		if countTokens(f.model, string(runes[:mid])) <= remaining {
+			lo = mid
+		} else {
+			hi = mid - 1
+		}
+	}
+	f.tokens = f.maxTokens
+	f.finishReason = "length"
+	f.pending = ""
+	// 空格属于下一个 token，截断时一并去掉
+	return strings.TrimRightFunc(string(runes[:lo]), unicode.IsSpace)
+}
+
+// handleCompletionResponse writes the upstream response as text_completion objects or chunks
+func handleCompletionResponse(c *gin.Context, resp *http.Response, request CompletionRequest, prompt string, promptTokens int, startTime time.Time, accountIdentifier string) {
+	completionID := "cmpl-" + uuid.New().String()
+	filter := newCompletionTextFilter(request)
+	usage := newUsageTracker(request.Model, promptTokens)
+	var text strings.Builder
+	upstreamReason := ""
+
+	newResponse := func(text string, finishReason *string) CompletionResponse {
+		return CompletionResponse{
+			ID:      completionID,
+			Object:  "text_completion",
+			Created: time.Now().Unix(),
+			Model:   request.Model,
+			Choices: []CompletionChoice{{Text: text, Index: 0, FinishReason: finishReason}},
+		}
+	}
+	writeChunk := func(chunk CompletionResponse) {
+		respJSON, _ := marshalJSON(chunk)
+		fmt.Fprintf(c.Writer, "data: %s\n\n", string(respJSON))
+		c.Writer.Flush()
+	}
+	emit := func(fragment string) {
+		if fragment == "" {
+			return
+		}
+		usage.addCompletion(fragment)
+		text.WriteString(fragment)
+		if request.Stream {
+			writeChunk(newResponse(fragment, nil))
+		}
+	}
+
+	if request.Stream {
+		c.Header("Content-Type", "text/event-stream")
+		c.Header("Cache-Control", "no-cache")
+		c.Header("Connection", "keep-alive")
+		if request.Echo {
+			writeChunk(newResponse(prompt, nil))
+		}
+	}
+
+	processJetbrainsStream(resp, func(data map[string]any) bool {
+		eventType, _ := data["type"].(string)
+		switch eventType {
+		case "Content":
+			content, _ := data["content"].(string)
+			emit(filter.push(content))
+			return filter.finishReason == ""
+		case "FinishMetadata":
+			upstreamReason, _ = data["reason"].(string)
+			usage.observeFinishMetadata(data)
+			return false
+		}
+		return true
+	})
+	emit(filter.flush())
+
+	finishReason := filter.finishReason
+	if finishReason == "" {
+		finishReason = mapJetbrainsFinishReasonToOpenAI(upstreamReason, false)
+	}
+	total := usage.usage()
+	chargeClientTokens(c, total)
+
+	recordRequest(true, time.Since(startTime).Milliseconds(), request.Model, accountIdentifier, clientKeyName(c))
+
+	if !request.Stream {
+		completionText := text.String()
+		if request.Echo {
+			completionText = prompt + completionText
+		}
+		response := newResponse(completionText, stringPtr(finishReason))
+		response.Usage = total.openAI()
+		c.JSON(http.StatusOK, response)
+		return
+	}
+
+	writeChunk(newResponse("", stringPtr(finishReason)))
+	if request.StreamOptions != nil && request.StreamOptions.IncludeUsage {
+		usageChunk := newResponse("", nil)
+		usageChunk.Choices = []CompletionChoice{}
+		usageChunk.Usage = total.openAI()
+		writeChunk(usageChunk)
+	}
+	c.Writer.Write([]byte("data: [DONE]\n\n"))
+	c.Writer.Flush()
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/bytedance/sonic"
+)
+
+func TestCompletionTextFilter_StopSequenceAcrossChunks(t *testing.T) {
+	filter := newCompletionTextFilter(CompletionRequest{Model: "test-model", Stop: []any{"END"}})
+
+	var out strings.Builder
+	for _, chunk := range []string{"hello E", "N", "D world"} {
+		out.WriteString(filter.push(chunk))
+	}
+	out.WriteString(filter.flush())
+
+	if out.String() != "hello " {
+		t.Errorf("expected text before the stop sequence, got %q", out.String())
+	}
+	if filter.finishReason != "stop" {
+		t.Errorf("expected finish reason stop, got %q", filter.finishReason)
+	}
+}
+
+func TestCompletionTextFilter_HeldBackTextIsFlushed(t *testing.T) {
+	filter := newCompletionTextFilter(CompletionRequest{Model: "test-model", Stop: "END"})
+
+	out := filter.push("almost E") + filter.flush()
+	if out != "almost E" || filter.finishReason != "" {
+		t.Errorf("partial stop sequence should be flushed at the end, got %q (%q)", out, filter.finishReason)
+	}
+}
+
+func TestCompletionTextFilter_MaxTokens(t *testing.T) {
+	maxTokens := 2
+	filter := newCompletionTextFilter(CompletionRequest{Model: "test-model", MaxTokens: &maxTokens})
+
+	out := filter.push("one two three four")
+	if out != "one two" || filter.finishReason != "length" {
+		t.Errorf("expected truncation to two tokens, got %q (%q)", out, filter.finishReason)
+	}
+	if filter.push(" five") != "" {
+		t.Error("no text should be emitted after max_tokens is reached")
+	}
+}
+
+func TestFakeGrazie_Completions(t *testing.T) {
+	_, router := setupFakeUpstream(t, DefaultFakeGrazieOptions())
+
+	w := doProxyRequest(router, "/v1/completions", `{"model":"test-model","prompt":"def add(a, b):","echo":true}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	var resp CompletionResponse
+	if err := sonic.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("invalid response: %v", err)
+	}
+	if resp.Object != "text_completion" || !strings.HasPrefix(resp.ID, "cmpl-") {
+		t.Errorf("unexpected completion object: %+v", resp)
+	}
+	// echo 将提示词放在生成内容之前
+	if got := resp.Choices[0].Text; got != "def add(a, b):Echo: def add(a, b):" {
+		t.Errorf("unexpected text %q", got)
+	}
+	if resp.Usage["prompt_tokens"] == 0 || resp.Usage["completion_tokens"] == 0 {
+		t.Errorf("usage should be estimated, got %v", resp.Usage)
+	}
+}
+
+func TestFakeGrazie_CompletionsStreamingWithStop(t *testing.T) {
+	_, router := setupFakeUpstream(t, DefaultFakeGrazieOptions())
+
+	w := doProxyRequest(router, "/v1/completions",
+		`{"model":"test-model","prompt":"alpha beta gamma","stream":true,"stop":["gamma"]}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	var text strings.Builder
+	var finishReason string
+	for _, line := range strings.Split(w.Body.String(), "\n") {
+		data, ok := strings.CutPrefix(line, "data: ")
+		if !ok || data == "[DONE]" {
+			continue
+		}
+		var chunk CompletionResponse
+		if err := sonic.UnmarshalString(data, &chunk); err != nil {
+			t.Fatalf("invalid chunk %q: %v", data, err)
+		}
+		if chunk.Object != "text_completion" {
+			t.Errorf("unexpected chunk object %q", chunk.Object)
+		}
+		text.WriteString(chunk.Choices[0].Text)
+		if chunk.Choices[0].FinishReason != nil {
+			finishReason = *chunk.Choices[0].FinishReason
+		}
+	}
+
+	if text.String() != "Echo: alpha beta " || finishReason != "stop" {
+		t.Errorf("expected text cut at the stop sequence, got %q (%q)", text.String(), finishReason)
+	}
+}
+
+func TestFakeGrazie_CompletionsRejectsBatchedPrompts(t *testing.T) {
+	_, router := setupFakeUpstream(t, DefaultFakeGrazieOptions())
+
+	w := doProxyRequest(router, "/v1/completions", `{"model":"test-model","prompt":["a","b"]}`)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for batched prompts, got %d: %s", w.Code, w.Body.String())
+	}
+}
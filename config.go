@@ -1,28 +1,56 @@
 package main
 
 import (
-	"github.com/bytedance/sonic"
+	"fmt"
 	"os"
+	"sort"
+	"strings"
 	"time"
+
+	"github.com/bytedance/sonic"
 )
 
+const defaultJetbrainsAPIBaseURL = "https://api.jetbrains.ai"
+
+// JetBrains API paths, resolved against the configured upstream endpoint
+const (
+	jetbrainsChatStreamPath = "/user/v5/llm/chat/stream/v8"
+	jetbrainsQuotaPath      = "/user/v5/quota/get"
+	jetbrainsJWTPath        = "/auth/jetbrains-jwt/provide-access/license/v2"
+)
+
+// jetbrainsAPIBaseURL is the upstream endpoint all JetBrains API calls go to
+var jetbrainsAPIBaseURL = defaultJetbrainsAPIBaseURL
+
+// loadUpstreamConfig loads the JetBrains upstream endpoint from environment variables
+func loadUpstreamConfig() {
+	jetbrainsAPIBaseURL = strings.TrimRight(getEnvWithDefault("JETBRAINS_API_BASE_URL", defaultJetbrainsAPIBaseURL), "/")
+	if jetbrainsAPIBaseURL != defaultJetbrainsAPIBaseURL {
+		Info("Using custom JetBrains upstream endpoint: %s", jetbrainsAPIBaseURL)
+	}
+}
+
+// jetbrainsAPIURL resolves a JetBrains API path against the configured upstream endpoint
+func jetbrainsAPIURL(path string) string {
+	return jetbrainsAPIBaseURL + path
+}
+
 // loadModels loads model definitions from models.json
-func loadModels() ModelsData {
+// 返回错误时调用方决定如何处理：启动时记录错误继续运行，热更新时保留旧配置
+func loadModels() (ModelsConfig, ModelsData, error) {
+	var config ModelsConfig
 	var result ModelsData
 
 	data, err := os.ReadFile("models.json")
 	if err != nil {
-		Error("Error loading models.json: %v", err)
-		return result
+		return config, result, err
 	}
 
-	var config ModelsConfig
 	if err := sonic.Unmarshal(data, &config); err != nil {
 		// Try old format (string array)
 		var modelIDs []string
 		if err := sonic.Unmarshal(data, &modelIDs); err != nil {
-			Error("Error parsing models.json: %v", err)
-			return result
+			return config, result, fmt.Errorf("error parsing models.json: %w", err)
 		}
 		// Convert to new format
 		config.Models = make(map[string]string)
@@ -40,28 +68,35 @@ func loadModels() ModelsData {
 			OwnedBy: "jetbrains-ai",
 		})
 	}
+	// map 遍历顺序随机，排序后模型列表和热更新差异才稳定
+	sort.Slice(result.Data, func(i, j int) bool { return result.Data[i].ID < result.Data[j].ID })
 
 	Info("Loaded %d models from models.json", len(config.Models))
-	return result
+	return config, result, nil
 }
 
-// loadClientAPIKeys loads client API keys from environment variables
-func loadClientAPIKeys() {
+// loadClientAPIKeys loads client API keys from CLIENT_API_KEYS and the optional CLIENT_KEYS_FILE registry
+// 环境变量中的密钥没有任何限制，注册文件中的密钥可以配置模型、请求大小和有效期
+// 注册文件出错时返回错误，同时返回环境变量中的密钥
+func loadClientAPIKeys() (map[string]*ClientKey, error) {
 	keys := parseEnvList(os.Getenv("CLIENT_API_KEYS"))
-	validClientKeys = make(map[string]bool)
+	registry := make(map[string]*ClientKey)
 	for _, key := range keys {
-		validClientKeys[key] = true
+		registry[key] = &ClientKey{Key: key, Name: defaultClientKeyName(key)}
+	}
+	if len(keys) > 0 {
+		Info("Successfully loaded %d client API keys from environment", len(keys))
 	}
 
-	if len(validClientKeys) == 0 {
-		Warn("CLIENT_API_KEYS environment variable is empty")
-	} else {
-		Info("Successfully loaded %d client API keys from environment", len(validClientKeys))
+	err := loadClientKeysFile(registry)
+	if len(registry) == 0 {
+		Warn("No client API keys configured (CLIENT_API_KEYS and CLIENT_KEYS_FILE are empty)")
 	}
+	return registry, err
 }
 
 // loadJetbrainsAccounts loads JetBrains account information from environment variables
-func loadJetbrainsAccounts() {
+func loadJetbrainsAccounts() []*JetbrainsAccount {
 	licenseIDsEnv := os.Getenv("JETBRAINS_LICENSE_IDS")
 	authorizationsEnv := os.Getenv("JETBRAINS_AUTHORIZATIONS")
 
@@ -80,37 +115,75 @@ func loadJetbrainsAccounts() {
 		authorizations = append(authorizations, "")
 	}
 
-	jetbrainsAccounts = []JetbrainsAccount{}
+	// weighted 策略的权重，与许可证和静态JWT列表一一对应
+	licenseWeights := parseAccountWeights("JETBRAINS_LICENSE_WEIGHTS", os.Getenv("JETBRAINS_LICENSE_WEIGHTS"), maxLen)
+
+	accounts := []*JetbrainsAccount{}
 	for i := 0; i < maxLen; i++ {
 		if licenseIDs[i] != "" && authorizations[i] != "" {
-			account := JetbrainsAccount{
-				LicenseID:      licenseIDs[i],
-				Authorization:  authorizations[i],
-				JWT:            "",
-				LastUpdated:    0,
-				HasQuota:       true,
-				LastQuotaCheck: 0,
-			}
-			jetbrainsAccounts = append(jetbrainsAccounts, account)
+			account := newLicenseAccount(licenseIDs[i], authorizations[i])
+			account.Weight = licenseWeights[i]
+			accounts = append(accounts, account)
 		}
 	}
+	licenseCount := len(accounts)
+
+	// 静态JWT账户：无法刷新，过期后自动退出账户池
+	tokens := parseEnvList(os.Getenv("JETBRAINS_JWTS"))
+	jwtWeights := parseAccountWeights("JETBRAINS_JWT_WEIGHTS", os.Getenv("JETBRAINS_JWT_WEIGHTS"), len(tokens))
+	for i, token := range tokens {
+		account := newStaticJWTAccount(token)
+		account.Weight = jwtWeights[i]
+		if isStaticJWTExpired(account) {
+			Warn("Skipping static JWT %s: expired at %s", getTokenDisplayName(account), account.ExpiryTime.Format(time.RFC3339))
+			continue
+		}
+		accounts = append(accounts, account)
+	}
 
-	if len(jetbrainsAccounts) == 0 {
+	if len(accounts) == 0 {
 		Warn("No valid JetBrains accounts found in environment variables")
 	} else {
-		Info("Successfully loaded %d JetBrains AI accounts from environment", len(jetbrainsAccounts))
+		Info("Successfully loaded %d JetBrains AI accounts from environment (%d license, %d static JWT)",
+			len(accounts), licenseCount, len(accounts)-licenseCount)
+	}
+	return accounts
+}
+
+// newLicenseAccount creates a license account, the JWT is fetched on first use
+func newLicenseAccount(licenseID, authorization string) *JetbrainsAccount {
+	return &JetbrainsAccount{
+		LicenseID:     licenseID,
+		Authorization: authorization,
+		HasQuota:      true,
+	}
+}
+
+// newStaticJWTAccount creates a static JWT account with the expiry parsed from the exp claim
+func newStaticJWTAccount(token string) *JetbrainsAccount {
+	account := &JetbrainsAccount{
+		JWT:         token,
+		LastUpdated: float64(time.Now().Unix()),
+		HasQuota:    true,
+	}
+	expiryTime, err := parseJWTExpiry(token)
+	if err != nil {
+		Warn("Could not parse expiry of static JWT %s: %v", getTokenDisplayName(account), err)
+	} else {
+		account.ExpiryTime = expiryTime
 	}
+	return account
 }
 
 func getInternalModelName(modelID string) string {
-	if internalModel, exists := modelsConfig.Models[modelID]; exists {
+	if internalModel, exists := currentConfig().ModelsConfig.Models[modelID]; exists {
 		return internalModel
 	}
 	return modelID
 }
 
 func getModelItem(modelID string) *ModelInfo {
-	for _, model := range modelsData.Data {
+	for _, model := range currentConfig().ModelsData.Data {
 		if model.ID == modelID {
 			return &model
 		}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLoadJetbrainsAccounts_MixedLicenseAndStaticJWT(t *testing.T) {
+	fake := NewFakeGrazieServer(DefaultFakeGrazieOptions())
+	validJWT, _ := fake.IssueJWT("static-valid", time.Hour)
+	expiredJWT, _ := fake.IssueJWT("static-expired", -time.Hour)
+
+	t.Setenv("JETBRAINS_LICENSE_IDS", "license-1")
+	t.Setenv("JETBRAINS_AUTHORIZATIONS", "auth-1")
+	t.Setenv("JETBRAINS_JWTS", validJWT+","+expiredJWT)
+	accounts := loadJetbrainsAccounts()
+
+	// 已过期的静态JWT在加载时被跳过
+	if len(accounts) != 2 {
+		t.Fatalf("expected 2 accounts, got %d", len(accounts))
+	}
+	if accounts[0].LicenseID != "license-1" || isStaticJWTAccount(accounts[0]) {
+		t.Errorf("first account should be the license account, got %+v", accounts[0])
+	}
+
+	static := accounts[1]
+	if !isStaticJWTAccount(static) || static.JWT != validJWT {
+		t.Fatalf("second account should be the valid static JWT, got %+v", static)
+	}
+	if until := time.Until(static.ExpiryTime); until <= 0 || until > time.Hour {
+		t.Errorf("expiry should be parsed from exp claim, got %s", static.ExpiryTime)
+	}
+}
+
+func TestGetNextJetbrainsAccount_RetiresExpiredStaticJWT(t *testing.T) {
+	fake, _ := setupFakeUpstream(t, DefaultFakeGrazieOptions())
+	expiringJWT, _ := fake.IssueJWT("static-expiring", time.Hour)
+	validJWT, _ := fake.IssueJWT("static-valid", time.Hour)
+
+	jetbrainsAccounts = []*JetbrainsAccount{
+		// 模拟运行期间过期的静态JWT
+		{JWT: expiringJWT, HasQuota: true, ExpiryTime: time.Now().Add(-time.Minute)},
+		{JWT: validJWT, HasQuota: true, ExpiryTime: time.Now().Add(time.Hour)},
+	}
+
+	account, err := getNextJetbrainsAccount()
+	if err != nil {
+		t.Fatalf("expected the valid static JWT account, got error: %v", err)
+	}
+	if account.JWT != validJWT {
+		t.Errorf("selected the wrong account: %s", getTokenDisplayName(account))
+	}
+	if !jetbrainsAccounts[0].Retired {
+		t.Error("expired static JWT account should be retired")
+	}
+
+	jetbrainsAccounts[1].ExpiryTime = time.Now().Add(-time.Minute)
+	jetbrainsAccounts[1].Retired = true
+	if _, err := getNextJetbrainsAccount(); err == nil {
+		t.Error("expected an error once every account has expired")
+	}
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"sort"
+
 	"github.com/bytedance/sonic"
 )
 
@@ -84,23 +86,31 @@ func openAIToJetbrainsMessages(messages []ChatMessage) []JetbrainsMessage {
 			})
 		case "assistant":
 			if len(msg.ToolCalls) > 0 {
-				// V8 API: Use assistant_message_tool for tool calls
-				toolCall := msg.ToolCalls[0]
-
-				// 尝试解析参数，如果是一个 JSON 字符串，就解码它以获取原始的参数对象
-				var argsMap map[string]any
-				if err := sonic.UnmarshalString(toolCall.Function.Arguments, &argsMap); err == nil {
-					// 如果成功解码，重新编码以确保它是一个干净的 JSON
-					cleanArgs, _ := marshalJSON(argsMap)
-					toolCall.Function.Arguments = string(cleanArgs)
+				// 保留与工具调用相邻的助手文本
+				if textContent := extractTextContent(msg.Content); textContent != "" {
+					jetbrainsMessages = append(jetbrainsMessages, JetbrainsMessage{
+						Type:    "assistant_message_text",
+						Content: textContent,
+					})
 				}
 
-				jetbrainsMessages = append(jetbrainsMessages, JetbrainsMessage{
-					Type:     "assistant_message_tool",
-					ID:       toolCall.ID,
-					ToolName: toolCall.Function.Name,
-					Content:  toolCall.Function.Arguments,
-				})
+				// V8 API: 每个工具调用对应一条 assistant_message_tool，保持客户端发送的顺序
+				for _, toolCall := range msg.ToolCalls {
+					// 尝试解析参数，如果是一个 JSON 字符串，就解码它以获取原始的参数对象
+					var argsMap map[string]any
+					if err := sonic.UnmarshalString(toolCall.Function.Arguments, &argsMap); err == nil {
+						// 如果成功解码，重新编码以确保它是一个干净的 JSON
+						cleanArgs, _ := marshalJSON(argsMap)
+						toolCall.Function.Arguments = string(cleanArgs)
+					}
+
+					jetbrainsMessages = append(jetbrainsMessages, JetbrainsMessage{
+						Type:     "assistant_message_tool",
+						ID:       toolCall.ID,
+						ToolName: toolCall.Function.Name,
+						Content:  toolCall.Function.Arguments,
+					})
+				}
 			} else {
 				// V8 API: Use assistant_message_text for text responses
 				textContent := extractTextContent(msg.Content)
@@ -131,5 +141,41 @@ func openAIToJetbrainsMessages(messages []ChatMessage) []JetbrainsMessage {
 			})
 		}
 	}
-	return jetbrainsMessages
+	return orderToolResults(jetbrainsMessages)
+}
+
+// orderToolResults 将每组连续的 tool_message 按其对应工具调用的顺序排列
+// DRY: OpenAI 与 Anthropic 两条转换路径共用
+func orderToolResults(messages []JetbrainsMessage) []JetbrainsMessage {
+	callOrder := make(map[string]int)
+	for i := 0; i < len(messages); i++ {
+		switch messages[i].Type {
+		case "assistant_message_tool":
+			if messages[i].ID != "" {
+				callOrder[messages[i].ID] = len(callOrder)
+			}
+		case "tool_message":
+			end := i
+			for end < len(messages) && messages[end].Type == "tool_message" {
+				end++
+			}
+			// 未知 ID 的结果排在最后，其余保持稳定顺序
+			sort.SliceStable(messages[i:end], func(a, b int) bool {
+				return toolCallPosition(callOrder, messages[i+a].ID) < toolCallPosition(callOrder, messages[i+b].ID)
+			})
+			callOrder = make(map[string]int)
+			i = end - 1
+		default:
+			callOrder = make(map[string]int)
+		}
+	}
+	return messages
+}
+
+// toolCallPosition 返回工具调用在所属助手消息中的位置
+func toolCallPosition(callOrder map[string]int, id string) int {
+	if position, ok := callOrder[id]; ok {
+		return position
+	}
+	return len(callOrder)
 }
@@ -70,4 +70,74 @@ func TestOpenAIToJetbrainsMessages_SingleTextContent(t *testing.T) {
 	if result[0].Content != "单一文本消息" {
 		t.Errorf("消息内容错误，期望 '单一文本消息'，实际 '%s'", result[0].Content)
 	}
-}
\ No newline at end of file
+}
+
+func TestOpenAIToJetbrainsMessages_ParallelToolCallHistory(t *testing.T) {
+	messages := []ChatMessage{
+		{Role: "user", Content: "查询巴黎的天气和时间"},
+		{
+			Role:    "assistant",
+			Content: "我来查询一下。",
+			ToolCalls: []ToolCall{
+				{ID: "call_1", Type: "function", Function: Function{Name: "get_weather", Arguments: `{"city":"Paris"}`}},
+				{ID: "call_2", Type: "function", Function: Function{Name: "get_time", Arguments: `{}`}},
+			},
+		},
+		// 工具结果的顺序与调用顺序不同
+		{Role: "tool", ToolCallID: "call_2", Content: "12:00"},
+		{Role: "tool", ToolCallID: "call_1", Content: "晴"},
+	}
+
+	result := openAIToJetbrainsMessages(messages)
+
+	expected := []JetbrainsMessage{
+		{Type: "user_message", Content: "查询巴黎的天气和时间"},
+		{Type: "assistant_message_text", Content: "我来查询一下。"},
+		{Type: "assistant_message_tool", ID: "call_1", ToolName: "get_weather", Content: `{"city":"Paris"}`},
+		{Type: "assistant_message_tool", ID: "call_2", ToolName: "get_time", Content: `{}`},
+		{Type: "tool_message", ID: "call_1", ToolName: "get_weather", Result: "晴"},
+		{Type: "tool_message", ID: "call_2", ToolName: "get_time", Result: "12:00"},
+	}
+	if len(result) != len(expected) {
+		t.Fatalf("期望生成 %d 个消息，实际生成 %d 个: %+v", len(expected), len(result), result)
+	}
+	for i := range expected {
+		if result[i] != expected[i] {
+			t.Errorf("消息 %d 错误，期望 %+v，实际 %+v", i, expected[i], result[i])
+		}
+	}
+}
+
+func TestAnthropicToJetbrainsMessages_ParallelToolUseHistory(t *testing.T) {
+	messages := []AnthropicMessage{
+		{Role: "user", Content: "查询巴黎的天气和时间"},
+		{Role: "assistant", Content: []any{
+			map[string]any{"type": "text", "text": "我来查询一下。"},
+			map[string]any{"type": "tool_use", "id": "toolu_1", "name": "get_weather", "input": map[string]any{"city": "Paris"}},
+			map[string]any{"type": "tool_use", "id": "toolu_2", "name": "get_time", "input": map[string]any{}},
+		}},
+		{Role: "user", Content: []any{
+			map[string]any{"type": "tool_result", "tool_use_id": "toolu_2", "content": "12:00"},
+			map[string]any{"type": "tool_result", "tool_use_id": "toolu_1", "content": "晴"},
+		}},
+	}
+
+	result := anthropicToJetbrainsMessages(messages)
+
+	expected := []JetbrainsMessage{
+		{Type: "user_message", Content: "查询巴黎的天气和时间"},
+		{Type: "assistant_message_text", Content: "我来查询一下。"},
+		{Type: "assistant_message_tool", ID: "toolu_1", ToolName: "get_weather", Content: `{"city":"Paris"}`},
+		{Type: "assistant_message_tool", ID: "toolu_2", ToolName: "get_time", Content: `{}`},
+		{Type: "tool_message", ID: "toolu_1", ToolName: "get_weather", Result: "晴"},
+		{Type: "tool_message", ID: "toolu_2", ToolName: "get_time", Result: "12:00"},
+	}
+	if len(result) != len(expected) {
+		t.Fatalf("期望生成 %d 个消息，实际生成 %d 个: %+v", len(expected), len(result), result)
+	}
+	for i := range expected {
+		if result[i] != expected[i] {
+			t.Errorf("消息 %d 错误，期望 %+v，实际 %+v", i, expected[i], result[i])
+		}
+	}
+}
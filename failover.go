@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+)
+
+// 故障转移参数，可通过环境变量配置
+var (
+	upstreamMaxAttempts  = 3
+	upstreamRetryBackoff = 200 * time.Millisecond
+)
+
+// loadFailoverConfig loads the upstream attempt limit and retry backoff from environment variables
+func loadFailoverConfig() {
+	value := getEnvWithDefault("UPSTREAM_MAX_ATTEMPTS", strconv.Itoa(upstreamMaxAttempts))
+	if attempts, err := strconv.Atoi(value); err == nil && attempts > 0 {
+		upstreamMaxAttempts = attempts
+	} else {
+		Warn("Invalid UPSTREAM_MAX_ATTEMPTS=%q, using %d", value, upstreamMaxAttempts)
+	}
+	upstreamRetryBackoff = parseDurationEnv("UPSTREAM_RETRY_BACKOFF", upstreamRetryBackoff)
+}
+
+// isRetryableUpstreamStatus 换一个账户可能成功的上游状态码：配额用完、认证失败和服务端错误
+func isRetryableUpstreamStatus(statusCode int) bool {
+	return statusCode == 477 || statusCode == http.StatusUnauthorized || statusCode >= 500
+}
+
+// upstreamRequest 一次上游聊天请求的内容，payload 在各次尝试之间重复使用
+type upstreamRequest struct {
+	ctx     context.Context
+	payload []byte
+	model   string
+	client  string
+	tools   int // 工具数量，记录在 span 中
+}
+
+// sendUpstreamWithFailover 选择账户并发送请求，失败时换一个账户重试
+// 只在尚未向客户端写入任何内容时调用，因此重试对客户端透明；
+// 连接失败或上游返回 477/401/5xx 时，在 UPSTREAM_MAX_ATTEMPTS 次以内换用本次请求还没有尝试过的账户，
+// 每次重试前按 UPSTREAM_RETRY_BACKOFF 指数退避。每个失败后重试的尝试都单独计入统计。
+//
+// 返回最后一次尝试的响应 (可能不是 200，由调用方按原样返回给客户端) 和所使用的账户，
+// 调用方负责关闭响应并调用 releaseJetbrainsAccount；没有可用账户时 account 为 nil
+func sendUpstreamWithFailover(req upstreamRequest) (*http.Response, *JetbrainsAccount, int, error) {
+	account, err := selectUpstreamAccount(req.ctx, nil)
+	if err != nil {
+		return nil, nil, http.StatusTooManyRequests, err
+	}
+
+	tried := map[*JetbrainsAccount]bool{account: true}
+	backoff := upstreamRetryBackoff
+	for attempt := 1; ; attempt++ {
+		attemptStart := time.Now()
+		resp, statusCode, err := sendUpstreamAttempt(req, account, attempt)
+		if err == nil && !isRetryableUpstreamStatus(resp.StatusCode) {
+			return resp, account, statusCode, nil
+		}
+		if attempt >= upstreamMaxAttempts {
+			return resp, account, statusCode, err
+		}
+
+		reason := fmt.Sprintf("status %d", statusCode)
+		if err != nil {
+			reason = err.Error()
+		}
+
+		// 没有其他可用账户时直接返回本次结果，不必等待
+		next, nextErr := selectUpstreamAccount(req.ctx, tried)
+		if nextErr != nil {
+			WarnContext(req.ctx, "Upstream attempt %d with %s failed (%s), no other account available: %v",
+				attempt, getTokenDisplayName(account), reason, nextErr)
+			return resp, account, statusCode, err
+		}
+		select {
+		case <-req.ctx.Done():
+			releaseJetbrainsAccount(next)
+			return resp, account, statusCode, err
+		case <-time.After(backoff):
+		}
+
+		WarnContext(req.ctx, "Upstream attempt %d/%d with %s failed (%s), retrying with %s",
+			attempt, upstreamMaxAttempts, getTokenDisplayName(account), reason, getTokenDisplayName(next))
+		if resp != nil {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		recordRequest(false, time.Since(attemptStart).Milliseconds(), req.model, getTokenDisplayName(account), req.client)
+		releaseJetbrainsAccount(account)
+
+		account = next
+		tried[account] = true
+		backoff *= 2
+	}
+}
+
+// selectUpstreamAccount 从账户池选择账户 (跳过 excluded)，记录等待时间和 account.select span
+func selectUpstreamAccount(ctx context.Context, excluded map[*JetbrainsAccount]bool) (*JetbrainsAccount, error) {
+	_, span := startSpan(ctx, "account.select")
+	start := time.Now()
+	account, err := getNextJetbrainsAccountExcluding(excluded)
+	RecordAccountPoolWait(time.Since(start))
+	if account != nil {
+		span.SetAttributes(attrAccount.String(getTokenDisplayName(account)))
+	}
+	endSpan(span, err)
+	return account, err
+}
+
+// sendUpstreamAttempt 使用指定账户发送一次请求并更新账户健康状态
+// upstream.attempt span 在收到响应头时结束，之后的流式阶段由 upstream.stream span 记录
+func sendUpstreamAttempt(req upstreamRequest, account *JetbrainsAccount, attempt int) (*http.Response, int, error) {
+	attrs := []attribute.KeyValue{
+		attrModel.String(req.model),
+		attrAccount.String(getTokenDisplayName(account)),
+		attrToolCount.Int(req.tools),
+	}
+	setRequestSpanAttributes(req.ctx, attrs...)
+	ctx, span := startSpan(req.ctx, "upstream.attempt", append(attrs, attrAttempt.Int(attempt))...)
+
+	jwt, _ := accountJWT(account)
+	httpReq, err := createJetbrainsStreamRequest(req.payload, jwt)
+	if err != nil {
+		err = fmt.Errorf("failed to create request")
+		endSpan(span, err)
+		return nil, http.StatusInternalServerError, err
+	}
+	httpReq = httpReq.WithContext(ctx)
+	setRequestMetricsLabels(req.ctx, req.model, account)
+	audit := auditFromContext(req.ctx)
+	audit.beginUpstreamAttempt(req.payload, account)
+
+	start := time.Now()
+	resp, err := httpClient.Do(httpReq)
+	if err != nil {
+		upstreamDuration.ObserveDuration(time.Since(start), req.model, accountID(account), "error")
+		recordAccountFailure(account, fmt.Sprintf("request failed: %v", err))
+		audit.endUpstreamAttempt(nil, err)
+		endSpan(span, err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("failed to make request: %w", err)
+	}
+	upstreamDuration.ObserveDuration(time.Since(start), req.model, accountID(account), strconv.Itoa(resp.StatusCode))
+	span.SetAttributes(attrStatus.Int(resp.StatusCode))
+	if resp.StatusCode != http.StatusOK {
+		span.SetStatus(codes.Error, fmt.Sprintf("upstream returned %d", resp.StatusCode))
+	}
+	span.End()
+
+	DebugContext(req.ctx, "JetBrains API Response Status: %d", resp.StatusCode)
+	recordUpstreamStatus(account, resp.StatusCode)
+	observeTimeToFirstToken(req.ctx, resp, req.model, account)
+	audit.endUpstreamAttempt(resp, nil)
+	if resp.StatusCode == http.StatusOK {
+		resp.Body = traceStreamBody(req.ctx, resp.Body, attrs...)
+	}
+	return resp, resp.StatusCode, nil
+}
+
+// setAccountRetryAfter 账户池暂时没有可用账户时，按下一个账户恢复的时间设置 Retry-After
+func setAccountRetryAfter(c *gin.Context, err error) {
+	var unavailable *accountsUnavailableError
+	if !errors.As(err, &unavailable) || unavailable.nextAvailable.IsZero() {
+		return
+	}
+	retryAfter := int(math.Ceil(time.Until(unavailable.nextAvailable).Seconds()))
+	c.Header("Retry-After", strconv.Itoa(max(1, retryAfter)))
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+// fixedOrderSelector tries the accounts in configuration order
+type fixedOrderSelector struct{}
+
+func (fixedOrderSelector) Name() string { return "fixed" }
+
+func (fixedOrderSelector) Order(candidates []*JetbrainsAccount) []*JetbrainsAccount {
+	return candidates
+}
+
+// licenseAccounts creates license accounts the fake upstream issues JWTs for
+func licenseAccounts(names ...string) []*JetbrainsAccount {
+	accounts := testAccounts(names...)
+	for _, account := range accounts {
+		account.Authorization = "auth"
+	}
+	return accounts
+}
+
+func TestFailover_RetriesOnAnotherAccount(t *testing.T) {
+	tests := []struct {
+		path string
+		body string
+	}{
+		{"/v1/chat/completions", `{"model":"test-model","messages":[{"role":"user","content":"hi"}]}`},
+		{"/v1/messages", `{"model":"test-model","max_tokens":100,"messages":[{"role":"user","content":"hi"}]}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			opts := DefaultFakeGrazieOptions()
+			opts.QuotaMaximum = 1
+			opts.RequestCost = 1
+			fake, router := setupFakeUpstream(t, opts)
+			jetbrainsAccounts = licenseAccounts("license-1", "license-2")
+			refreshAccountsNow()
+			currentConfig().AccountSelector = fixedOrderSelector{}
+
+			oldBackoff := upstreamRetryBackoff
+			t.Cleanup(func() { upstreamRetryBackoff = oldBackoff })
+			upstreamRetryBackoff = 0
+
+			// 第一个请求用完 license-1 的配额，配额缓存仍认为有余量
+			if w := doProxyRequest(router, tt.path, tt.body); w.Code != http.StatusOK {
+				t.Fatalf("first request should succeed, got %d: %s", w.Code, w.Body.String())
+			}
+
+			statsMutex.Lock()
+			historyBefore := len(requestStats.RequestHistory)
+			statsMutex.Unlock()
+
+			// license-1 返回 477，换用 license-2，客户端只看到成功的响应
+			if w := doProxyRequest(router, tt.path, tt.body); w.Code != http.StatusOK {
+				t.Fatalf("expected failover to succeed, got %d: %s", w.Code, w.Body.String())
+			}
+			if used := fake.Usage("license-2"); used != 1 {
+				t.Errorf("expected license-2 to serve the retried request, got usage %v", used)
+			}
+			if state := getAccountHealth(jetbrainsAccounts[0]); state != AccountExhausted {
+				t.Errorf("license-1 should be exhausted, got %s", state)
+			}
+
+			statsMutex.Lock()
+			records := append([]RequestRecord(nil), requestStats.RequestHistory[historyBefore:]...)
+			statsMutex.Unlock()
+			if len(records) != 2 || records[0].Success || !records[1].Success || records[0].Account == records[1].Account {
+				t.Errorf("expected the failed attempt and the successful retry in stats, got %+v", records)
+			}
+		})
+	}
+}
+
+func TestFailover_StopsAtAttemptLimit(t *testing.T) {
+	_, router := setupFakeUpstream(t, DefaultFakeGrazieOptions())
+	jetbrainsAccounts = licenseAccounts("license-1", "license-2", "license-3")
+	refreshAccountsNow()
+	currentConfig().AccountSelector = fixedOrderSelector{}
+
+	oldAttempts, oldBackoff := upstreamMaxAttempts, upstreamRetryBackoff
+	t.Cleanup(func() { upstreamMaxAttempts, upstreamRetryBackoff = oldAttempts, oldBackoff })
+	upstreamMaxAttempts, upstreamRetryBackoff = 2, 0
+
+	w := doProxyRequest(router, "/v1/chat/completions",
+		`{"model":"test-model","messages":[{"role":"user","content":"[fake:status=503] hi"}]}`)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected the last upstream error, got %d: %s", w.Code, w.Body.String())
+	}
+	if jetbrainsAccounts[2].ConsecutiveFailures != 0 {
+		t.Error("the third account should not be tried when the attempt limit is 2")
+	}
+	if jetbrainsAccounts[0].ConsecutiveFailures != 1 || jetbrainsAccounts[1].ConsecutiveFailures != 1 {
+		t.Error("each attempted account should record the failure")
+	}
+}
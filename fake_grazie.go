@@ -0,0 +1,375 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bytedance/sonic"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// fakeDirectivePattern matches test directives embedded in the last user message, e.g. [fake:477]
+var fakeDirectivePattern = regexp.MustCompile(`\[fake:([a-z0-9_]+)(?:=([^\]]*))?\]`)
+
+// FakeGrazieOptions configures the built-in stand-in for the JetBrains AI (Grazie) API
+type FakeGrazieOptions struct {
+	QuotaMaximum float64       // 每个账户的每日配额
+	RequestCost  float64       // 每次聊天请求消耗的配额
+	JWTTTL       time.Duration // 签发 JWT 的有效期
+	Secret       string        // JWT 签名密钥
+	ChunkDelay   time.Duration // 流式事件之间的延迟
+}
+
+// DefaultFakeGrazieOptions returns options suitable for local end-to-end testing
+func DefaultFakeGrazieOptions() FakeGrazieOptions {
+	return FakeGrazieOptions{
+		QuotaMaximum: 1000000,
+		RequestCost:  1000,
+		JWTTTL:       24 * time.Hour,
+		Secret:       "fake-grazie-secret",
+	}
+}
+
+// FakeGrazieServer mimics the JetBrains AI endpoints used by this proxy:
+// JWT issuance, the quota API and the v8 chat event stream (including 477 responses)
+type FakeGrazieServer struct {
+	opts  FakeGrazieOptions
+	mu    sync.Mutex
+	usage map[string]float64 // JWT subject -> used quota
+	last  *JetbrainsPayload  // most recent chat request, for assertions in tests
+}
+
+// NewFakeGrazieServer creates a fake Grazie server with the given options
+func NewFakeGrazieServer(opts FakeGrazieOptions) *FakeGrazieServer {
+	return &FakeGrazieServer{
+		opts:  opts,
+		usage: make(map[string]float64),
+	}
+}
+
+// Handler returns the HTTP handler serving the fake JetBrains API
+func (s *FakeGrazieServer) Handler() http.Handler {
+	r := gin.New()
+	r.Use(gin.Recovery())
+	r.POST(jetbrainsJWTPath, s.handleProvideJWT)
+	r.POST(jetbrainsQuotaPath, s.handleQuota)
+	r.POST(jetbrainsChatStreamPath, s.handleChatStream)
+	return r
+}
+
+// IssueJWT signs a JWT for the given subject, usable as a static JWT account
+func (s *FakeGrazieServer) IssueJWT(subject string, ttl time.Duration) (string, error) {
+	now := time.Now()
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"sub": subject,
+		"iat": now.Unix(),
+		"exp": now.Add(ttl).Unix(),
+	})
+	return token.SignedString([]byte(s.opts.Secret))
+}
+
+// Usage returns the quota consumed by the given JWT subject
+func (s *FakeGrazieServer) Usage(subject string) float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.usage[subject]
+}
+
+// handleProvideJWT issues a JWT for a license, like /auth/jetbrains-jwt/provide-access/license/v2
+func (s *FakeGrazieServer) handleProvideJWT(c *gin.Context) {
+	if !strings.HasPrefix(c.GetHeader("Authorization"), "Bearer ") {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "missing authorization"})
+		return
+	}
+
+	var body struct {
+		LicenseID string `json:"licenseId"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil || body.LicenseID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "licenseId is required"})
+		return
+	}
+
+	// 以 unpaid 开头的许可证模拟未付费状态
+	if strings.HasPrefix(body.LicenseID, "unpaid") {
+		c.JSON(http.StatusOK, gin.H{"state": "NONE"})
+		return
+	}
+
+	token, err := s.IssueJWT(body.LicenseID, s.opts.JWTTTL)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"state": "PAID", "token": token})
+}
+
+// handleQuota reports the quota of the authenticated subject, like /user/v5/quota/get
+func (s *FakeGrazieServer) handleQuota(c *gin.Context) {
+	subject, ok := s.authenticate(c)
+	if !ok {
+		return
+	}
+
+	quota := JetbrainsQuotaResponse{Until: nextQuotaReset(time.Now()).Format(time.RFC3339)}
+	quota.Current.Current.Amount = strconv.FormatFloat(s.Usage(subject), 'f', -1, 64)
+	quota.Current.Maximum.Amount = strconv.FormatFloat(s.opts.QuotaMaximum, 'f', -1, 64)
+	c.JSON(http.StatusOK, quota)
+}
+
+// handleChatStream answers chat requests with a v8 SSE event stream
+//
+// The reply is driven by the last user message:
+//   - [fake:477] or [fake:status=NNN] forces an error status
+//   - [fake:tool_calls=N] emits N ToolCall events (cycling through the declared tools)
+//   - [fake:function_call] uses legacy FunctionCall events instead of ToolCall
+//   - [fake:text] answers with text even when tools are declared
+//
+// A request whose last message is a tool result always gets a text summary. Otherwise,
+// without directives, a request with tools gets one tool call and anything else is echoed.
+func (s *FakeGrazieServer) handleChatStream(c *gin.Context) {
+	subject, ok := s.authenticate(c)
+	if !ok {
+		return
+	}
+
+	var payload JetbrainsPayload
+	if err := c.ShouldBindJSON(&payload); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	directives := parseFakeDirectives(lastFakeUserMessage(payload.Chat.Messages))
+	if status, ok := directives["status"]; ok {
+		code, err := strconv.Atoi(status)
+		if err == nil && code >= 400 {
+			c.JSON(code, gin.H{"error": fmt.Sprintf("fake error status %d", code)})
+			return
+		}
+	}
+
+	s.mu.Lock()
+	s.last = &payload
+	_, forceQuotaError := directives["477"]
+	exhausted := forceQuotaError || s.usage[subject] >= s.opts.QuotaMaximum
+	if !exhausted {
+		s.usage[subject] += s.opts.RequestCost
+	}
+	s.mu.Unlock()
+
+	if exhausted {
+		c.JSON(477, gin.H{"type": "QuotaExceeded", "message": "quota exceeded"})
+		return
+	}
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Status(http.StatusOK)
+
+	for _, event := range s.buildChatEvents(payload, directives) {
+		eventJSON, _ := marshalJSON(event)
+		fmt.Fprintf(c.Writer, "data: %s\n\n", eventJSON)
+		c.Writer.Flush()
+		if s.opts.ChunkDelay > 0 {
+			time.Sleep(s.opts.ChunkDelay)
+		}
+	}
+	fmt.Fprint(c.Writer, "data: end\n\n")
+	c.Writer.Flush()
+}
+
+// buildChatEvents builds the v8 stream events for a chat request
+func (s *FakeGrazieServer) buildChatEvents(payload JetbrainsPayload, directives map[string]string) []map[string]any {
+	var events []map[string]any
+	messages := payload.Chat.Messages
+	tools := fakeDeclaredTools(payload.Parameters)
+
+	_, forceText := directives["text"]
+	toolCallCount := 0
+	if len(tools) > 0 && !forceText {
+		toolCallCount = 1
+		if n, err := strconv.Atoi(directives["tool_calls"]); err == nil && n >= 0 {
+			toolCallCount = n
+		}
+	}
+	if len(messages) > 0 && messages[len(messages)-1].Type == "tool_message" {
+		toolCallCount = 0
+	}
+
+	if toolCallCount == 0 {
+		for _, chunk := range splitFakeText(fakeReplyText(messages)) {
+			events = append(events, map[string]any{"type": "Content", "content": chunk})
+		}
+		return append(events, map[string]any{"type": "FinishMetadata", "reason": "stop"})
+	}
+
+	_, legacy := directives["function_call"]
+	for i := 0; i < toolCallCount; i++ {
+		tool := tools[i%len(tools)]
+		args, _ := marshalJSON(fakeToolArguments(tool.Parameters.Schema))
+		half := len(args) / 2
+
+		if legacy {
+			events = append(events,
+				map[string]any{"type": "FunctionCall", "name": tool.Name, "content": ""},
+				map[string]any{"type": "FunctionCall", "name": nil, "content": string(args[:half])},
+				map[string]any{"type": "FunctionCall", "name": nil, "content": string(args[half:])},
+			)
+			continue
+		}
+		events = append(events,
+			map[string]any{"type": "ToolCall", "id": fakeToolCallID(), "name": tool.Name, "content": ""},
+			map[string]any{"type": "ToolCall", "id": nil, "name": nil, "content": string(args[:half])},
+			map[string]any{"type": "ToolCall", "id": nil, "name": nil, "content": string(args[half:])},
+		)
+	}
+	return append(events, map[string]any{"type": "FinishMetadata", "reason": "tool_call"})
+}
+
+// LastChatPayload returns the most recent chat request received, or nil
+func (s *FakeGrazieServer) LastChatPayload() *JetbrainsPayload {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.last
+}
+
+// authenticate validates the grazie-authenticate-jwt header and returns the JWT subject
+func (s *FakeGrazieServer) authenticate(c *gin.Context) (string, bool) {
+	tokenStr := c.GetHeader("grazie-authenticate-jwt")
+	token, err := jwt.Parse(tokenStr, func(t *jwt.Token) (any, error) {
+		return []byte(s.opts.Secret), nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
+	if err != nil || !token.Valid {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid or expired JWT"})
+		return "", false
+	}
+
+	subject, _ := token.Claims.GetSubject()
+	return subject, true
+}
+
+// parseFakeDirectives extracts [fake:name=value] directives from a message
+func parseFakeDirectives(text string) map[string]string {
+	directives := make(map[string]string)
+	for _, match := range fakeDirectivePattern.FindAllStringSubmatch(text, -1) {
+		directives[match[1]] = match[2]
+	}
+	return directives
+}
+
+// lastFakeUserMessage returns the content of the last user message
+func lastFakeUserMessage(messages []JetbrainsMessage) string {
+	for i := len(messages) - 1; i >= 0; i-- {
+		if messages[i].Type == "user_message" {
+			return messages[i].Content
+		}
+	}
+	return ""
+}
+
+// fakeReplyText builds the text reply for a conversation
+func fakeReplyText(messages []JetbrainsMessage) string {
+	if len(messages) > 0 {
+		if last := messages[len(messages)-1]; last.Type == "tool_message" {
+			return fmt.Sprintf("Tool %s returned: %s", last.ToolName, last.Result)
+		}
+	}
+	text := strings.TrimSpace(fakeDirectivePattern.ReplaceAllString(lastFakeUserMessage(messages), ""))
+	return "Echo: " + text
+}
+
+// splitFakeText splits a reply into word-sized chunks to exercise streaming
+func splitFakeText(text string) []string {
+	var chunks []string
+	for _, word := range strings.SplitAfter(text, " ") {
+		if word != "" {
+			chunks = append(chunks, word)
+		}
+	}
+	return chunks
+}
+
+// fakeDeclaredTools extracts the tool definitions from the request parameters
+func fakeDeclaredTools(params *JetbrainsParameters) []JetbrainsToolDefinition {
+	if params == nil {
+		return nil
+	}
+	for _, item := range params.Data {
+		if item.Value == "" {
+			continue
+		}
+		var tools []JetbrainsToolDefinition
+		if err := sonic.UnmarshalString(item.Value, &tools); err == nil && len(tools) > 0 {
+			return tools
+		}
+	}
+	return nil
+}
+
+// fakeToolArguments builds sample arguments satisfying a tool's parameter schema
+func fakeToolArguments(schema map[string]any) map[string]any {
+	args := make(map[string]any)
+	properties, _ := schema["properties"].(map[string]any)
+	for name, prop := range properties {
+		propMap, _ := prop.(map[string]any)
+		switch propMap["type"] {
+		case "integer", "number":
+			args[name] = 1
+		case "boolean":
+			args[name] = true
+		case "array":
+			args[name] = []any{}
+		case "object":
+			args[name] = map[string]any{}
+		default:
+			args[name] = "test"
+		}
+	}
+	return args
+}
+
+// fakeToolCallID generates an upstream-style tool call ID
+func fakeToolCallID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return "call_" + hex.EncodeToString(b)
+}
+
+// nextQuotaReset returns the next daily quota reset time (midnight UTC)
+func nextQuotaReset(now time.Time) time.Time {
+	return now.UTC().Truncate(24 * time.Hour).Add(24 * time.Hour)
+}
+
+// runFakeGrazie runs the fake Grazie server as a standalone subcommand
+func runFakeGrazie(args []string) {
+	opts := DefaultFakeGrazieOptions()
+	fs := flag.NewFlagSet("fake-grazie", flag.ExitOnError)
+	addr := fs.String("addr", ":8787", "listen address")
+	fs.Float64Var(&opts.QuotaMaximum, "quota", opts.QuotaMaximum, "daily quota per account")
+	fs.Float64Var(&opts.RequestCost, "cost", opts.RequestCost, "quota consumed per chat request")
+	fs.DurationVar(&opts.JWTTTL, "jwt-ttl", opts.JWTTTL, "lifetime of issued JWTs")
+	fs.StringVar(&opts.Secret, "secret", opts.Secret, "JWT signing secret")
+	fs.DurationVar(&opts.ChunkDelay, "chunk-delay", opts.ChunkDelay, "delay between stream events")
+	fs.Parse(args)
+
+	InitializeLogger()
+	gin.SetMode(gin.ReleaseMode)
+
+	server := NewFakeGrazieServer(opts)
+	if staticJWT, err := server.IssueJWT("static-account", opts.JWTTTL); err == nil {
+		Info("Sample static JWT (JETBRAINS_JWTS): %s", staticJWT)
+	}
+	Info("Fake Grazie server listening on %s (set JETBRAINS_API_BASE_URL to point the proxy at it)", *addr)
+	if err := http.ListenAndServe(*addr, server.Handler()); err != nil {
+		Fatal("Fake Grazie server failed: %v", err)
+	}
+}
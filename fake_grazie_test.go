@@ -0,0 +1,125 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/bytedance/sonic"
+	"github.com/gin-gonic/gin"
+)
+
+const testClientKey = "sk-test"
+
+// setupFakeUpstream points the proxy at a fresh fake Grazie server with one license account
+func setupFakeUpstream(t *testing.T, opts FakeGrazieOptions) (*FakeGrazieServer, *gin.Engine) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+
+	fake := NewFakeGrazieServer(opts)
+	upstream := httptest.NewServer(fake.Handler())
+
+	oldBaseURL, oldClient := jetbrainsAPIBaseURL, httpClient
+	oldConfig, oldAccounts, oldSources := currentConfig(), jetbrainsAccounts, accountSource
+	t.Cleanup(func() {
+		upstream.Close()
+		jetbrainsAPIBaseURL, httpClient = oldBaseURL, oldClient
+		setRuntimeConfig(oldConfig)
+		jetbrainsAccounts, accountSource = oldAccounts, oldSources
+	})
+
+	jetbrainsAPIBaseURL = upstream.URL
+	httpClient = upstream.Client()
+	setRuntimeConfig(&RuntimeConfig{
+		ClientKeys:   map[string]*ClientKey{testClientKey: {Key: testClientKey, Name: "test-client"}},
+		ModelsConfig: ModelsConfig{Models: map[string]string{"test-model": "openai-test"}},
+		ModelsData:   ModelsData{Data: []ModelInfo{{ID: "test-model", Object: "model", OwnedBy: "jetbrains-ai"}}},
+	})
+	jetbrainsAccounts = []*JetbrainsAccount{{LicenseID: "license-1", Authorization: "auth-1", HasQuota: true}}
+	accountSource = accountSources{}
+	refreshAccountsNow()
+
+	return fake, setupRoutes()
+}
+
+// doProxyRequest sends an authenticated JSON POST request to the proxy
+func doProxyRequest(router *gin.Engine, path, body string) *httptest.ResponseRecorder {
+	return doProxyRequestWithMethod(router, http.MethodPost, path, body)
+}
+
+// doProxyRequestWithMethod sends an authenticated JSON request to the proxy
+func doProxyRequestWithMethod(router *gin.Engine, method, path, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+testClientKey)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestFakeGrazie_ChatCompletionEcho(t *testing.T) {
+	_, router := setupFakeUpstream(t, DefaultFakeGrazieOptions())
+
+	w := doProxyRequest(router, "/v1/chat/completions",
+		`{"model":"test-model","messages":[{"role":"user","content":"hello there"}]}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	var resp ChatCompletionResponse
+	if err := sonic.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("invalid response: %v", err)
+	}
+	if got := resp.Choices[0].Message.Content; got != "Echo: hello there" {
+		t.Errorf("unexpected content %q", got)
+	}
+	if resp.Usage["prompt_tokens"] == 0 || resp.Usage["completion_tokens"] == 0 {
+		t.Errorf("usage should be estimated, got %v", resp.Usage)
+	}
+}
+
+func TestFakeGrazie_StreamingToolCall(t *testing.T) {
+	_, router := setupFakeUpstream(t, DefaultFakeGrazieOptions())
+
+	w := doProxyRequest(router, "/v1/chat/completions", `{
+		"model":"test-model","stream":true,
+		"messages":[{"role":"user","content":"weather?"}],
+		"tools":[{"type":"function","function":{"name":"get_weather","parameters":{"type":"object","properties":{"location":{"type":"string"}}}}}]
+	}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	body := w.Body.String()
+	if !strings.Contains(body, `"name":"get_weather"`) || !strings.Contains(body, `"finish_reason":"tool_calls"`) {
+		t.Errorf("expected a streamed tool call, got:\n%s", body)
+	}
+	if !strings.HasSuffix(body, "data: [DONE]\n\n") {
+		t.Errorf("stream should end with [DONE], got:\n%s", body)
+	}
+}
+
+func TestFakeGrazie_QuotaExhausted(t *testing.T) {
+	opts := DefaultFakeGrazieOptions()
+	opts.QuotaMaximum = 1
+	opts.RequestCost = 1
+	fake, router := setupFakeUpstream(t, opts)
+
+	body := `{"model":"test-model","messages":[{"role":"user","content":"hi"}]}`
+	if w := doProxyRequest(router, "/v1/chat/completions", body); w.Code != http.StatusOK {
+		t.Fatalf("first request should succeed, got %d: %s", w.Code, w.Body.String())
+	}
+	if used := fake.Usage("license-1"); used != 1 {
+		t.Errorf("expected fake usage 1, got %v", used)
+	}
+
+	// 配额缓存仍认为有余量，上游返回 477
+	w := doProxyRequest(router, "/v1/chat/completions", body)
+	if w.Code != 477 {
+		t.Fatalf("expected 477 from exhausted upstream, got %d: %s", w.Code, w.Body.String())
+	}
+	if jetbrainsAccounts[0].HasQuota {
+		t.Error("account should be marked as out of quota after 477")
+	}
+}
@@ -0,0 +1,443 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/bytedance/sonic"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// geminiModelAction handles POST /v1beta/models/{model}:generateContent and :streamGenerateContent
+// KISS: Gemini contents 转换为聊天消息，复用现有的账户池和 v8 转换路径
+func geminiModelAction(c *gin.Context) {
+	startTime := time.Now()
+
+	// 记录性能指标开始
+	defer func() {
+		duration := time.Since(startTime)
+		RecordHTTPRequest(duration)
+	}()
+
+	model, action, found := strings.Cut(c.Param("modelAction"), ":")
+	if !found || (action != "generateContent" && action != "streamGenerateContent") {
+		recordFailureWithTimer(startTime, model, "", clientKeyName(c))
+		respondWithGeminiError(c, http.StatusNotFound, fmt.Sprintf("Unsupported model action: %s", c.Param("modelAction")))
+		return
+	}
+
+	var request GeminiGenerateContentRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		recordFailureWithTimer(startTime, model, "", clientKeyName(c))
+		RecordHTTPError()
+		respondWithGeminiError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	messages, err := geminiContentsToChatMessages(request.Contents)
+	if err != nil {
+		recordFailureWithTimer(startTime, model, "", clientKeyName(c))
+		RecordHTTPError()
+		respondWithGeminiError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	if len(messages) == 0 {
+		recordFailureWithTimer(startTime, model, "", clientKeyName(c))
+		respondWithGeminiError(c, http.StatusBadRequest, "contents is required")
+		return
+	}
+
+	stream := action == "streamGenerateContent"
+	chatRequest := geminiToChatRequest(model, request, messages, stream)
+	serveChatCompletion(c, chatRequest, startTime, func(c *gin.Context, resp *http.Response, _ ChatCompletionRequest, promptTokens int, startTime time.Time, accountIdentifier string) {
+		handleGeminiResponse(c, resp, model, stream, c.Query("alt") == "sse", promptTokens, startTime, accountIdentifier)
+	})
+}
+
+// geminiErrorStatuses HTTP 状态码对应的 google.rpc.Code 名称
+var geminiErrorStatuses = map[int]string{
+	http.StatusBadRequest:            "INVALID_ARGUMENT",
+	http.StatusUnauthorized:          "UNAUTHENTICATED",
+	http.StatusForbidden:             "PERMISSION_DENIED",
+	http.StatusNotFound:              "NOT_FOUND",
+	http.StatusConflict:              "ABORTED",
+	http.StatusRequestEntityTooLarge: "INVALID_ARGUMENT",
+	http.StatusTooManyRequests:       "RESOURCE_EXHAUSTED",
+	http.StatusNotImplemented:        "UNIMPLEMENTED",
+	http.StatusServiceUnavailable:    "UNAVAILABLE",
+	http.StatusGatewayTimeout:        "DEADLINE_EXCEEDED",
+}
+
+// isGeminiRoute 判断请求是否为 Gemini 兼容端点 (/v1beta)
+func isGeminiRoute(c *gin.Context) bool {
+	return strings.HasPrefix(c.FullPath(), "/v1beta/")
+}
+
+// respondWithGeminiError 返回 Google API 格式的错误响应: {"error":{"code","message","status"}}
+func respondWithGeminiError(c *gin.Context, code int, message string) {
+	status, ok := geminiErrorStatuses[code]
+	if !ok {
+		status = "UNKNOWN"
+		if code >= http.StatusInternalServerError {
+			status = "INTERNAL"
+		}
+	}
+	c.JSON(code, gin.H{
+		"error": gin.H{
+			"code":    code,
+			"message": message,
+			"status":  status,
+		},
+		"request_id": requestIDFromContext(c),
+	})
+}
+
+// geminiContentsToChatMessages converts Gemini contents to chat messages.
+// Gemini 的 functionCall 可以没有 id，此时生成 ID，并按名称将 functionResponse 配对到最早未完成的调用
+func geminiContentsToChatMessages(contents []GeminiContent) ([]ChatMessage, error) {
+	var messages []ChatMessage
+	var pending []ToolCall // 尚未收到结果的函数调用
+	generatedIDs := 0
+
+	for _, content := range contents {
+		switch content.Role {
+		case "model":
+			message := ChatMessage{Role: "assistant"}
+			var text strings.Builder
+			for _, part := range content.Parts {
+				switch {
+				case part.Thought:
+					continue
+				case part.FunctionCall != nil:
+					id := part.FunctionCall.ID
+					if id == "" {
+						generatedIDs++
+						id = fmt.Sprintf("call_%s_%d", part.FunctionCall.Name, generatedIDs)
+					}
+					args, _ := marshalJSON(part.FunctionCall.Args)
+					if part.FunctionCall.Args == nil {
+						args = []byte("{}")
+					}
+					toolCall := ToolCall{ID: id, Type: "function", Function: Function{Name: part.FunctionCall.Name, Arguments: string(args)}}
+					message.ToolCalls = append(message.ToolCalls, toolCall)
+					pending = append(pending, toolCall)
+				default:
+					text.WriteString(part.Text)
+				}
+			}
+			if text.Len() > 0 {
+				message.Content = text.String()
+			}
+			if message.Content != nil || len(message.ToolCalls) > 0 {
+				messages = append(messages, message)
+			}
+		case "", "user", "function":
+			var parts []any
+			for _, part := range content.Parts {
+				switch {
+				case part.Thought:
+					continue
+				case part.FunctionResponse != nil:
+					response := part.FunctionResponse
+					callID := response.ID
+					for i, call := range pending {
+						if (callID != "" && call.ID == callID) || (callID == "" && call.Function.Name == response.Name) {
+							callID = call.ID
+							pending = append(pending[:i], pending[i+1:]...)
+							break
+						}
+					}
+					if callID == "" {
+						return nil, fmt.Errorf("functionResponse for %s does not match any functionCall", response.Name)
+					}
+					output, _ := marshalJSON(response.Response)
+					messages = append(messages, ChatMessage{Role: "tool", ToolCallID: callID, Content: string(output)})
+				case part.InlineData != nil:
+					url := "data:" + part.InlineData.MimeType + ";base64," + part.InlineData.Data
+					parts = append(parts, map[string]any{"type": "image_url", "image_url": map[string]any{"url": url}})
+				case part.Text != "":
+					parts = append(parts, map[string]any{"type": "text", "text": part.Text})
+				}
+			}
+			if len(parts) > 0 {
+				messages = append(messages, ChatMessage{Role: "user", Content: parts})
+			}
+		default:
+			return nil, fmt.Errorf("unsupported content role: %s", content.Role)
+		}
+	}
+	return messages, nil
+}
+
+// geminiToChatRequest builds the chat request sent through the shared upstream path
+func geminiToChatRequest(model string, request GeminiGenerateContentRequest, conversation []ChatMessage, stream bool) ChatCompletionRequest {
+	var messages []ChatMessage
+	if request.SystemInstruction != nil {
+		var parts []string
+		for _, part := range request.SystemInstruction.Parts {
+			if part.Text != "" {
+				parts = append(parts, part.Text)
+			}
+		}
+		if len(parts) > 0 {
+			messages = append(messages, ChatMessage{Role: "system", Content: strings.Join(parts, "\n")})
+		}
+	}
+	messages = append(messages, conversation...)
+
+	var tools []Tool
+	for _, tool := range request.Tools {
+		for _, declaration := range tool.FunctionDeclarations {
+			parameters := declaration.ParametersJSONSchema
+			if parameters == nil {
+				parameters = geminiSchemaToJSONSchema(declaration.Parameters)
+			}
+			tools = append(tools, Tool{
+				Type: "function",
+				Function: ToolFunction{
+					Name:        declaration.Name,
+					Description: declaration.Description,
+					Parameters:  parameters,
+				},
+			})
+		}
+	}
+
+	chatRequest := ChatCompletionRequest{
+		Model:      model,
+		Messages:   messages,
+		Stream:     stream,
+		Tools:      tools,
+		ToolChoice: geminiToolChoice(request.ToolConfig),
+	}
+	if config := request.GenerationConfig; config != nil {
+		chatRequest.Temperature = config.Temperature
+		chatRequest.TopP = config.TopP
+		chatRequest.MaxTokens = config.MaxOutputTokens
+		if len(config.StopSequences) > 0 {
+			chatRequest.Stop = config.StopSequences
+		}
+	}
+	return chatRequest
+}
+
+// geminiToolChoice maps toolConfig.functionCallingConfig to an OpenAI tool_choice
+func geminiToolChoice(toolConfig any) any {
+	config, _ := toolConfig.(map[string]any)
+	callingConfig, _ := config["functionCallingConfig"].(map[string]any)
+	mode, _ := callingConfig["mode"].(string)
+
+	switch strings.ToUpper(mode) {
+	case "NONE":
+		return "none"
+	case "AUTO":
+		return "auto"
+	case "ANY":
+		if names, _ := callingConfig["allowedFunctionNames"].([]any); len(names) == 1 {
+			return map[string]any{"type": "function", "function": map[string]any{"name": names[0]}}
+		}
+		return "required"
+	}
+	return nil
+}
+
+// geminiSchemaToJSONSchema converts a Gemini OpenAPI schema (upper-case type names) to JSON Schema
+func geminiSchemaToJSONSchema(schema map[string]any) map[string]any {
+	if schema == nil {
+		return nil
+	}
+	result := make(map[string]any, len(schema))
+	for key, value := range schema {
+		switch v := value.(type) {
+		case string:
+			if key == "type" {
+				v = strings.ToLower(v)
+			}
+			result[key] = v
+		case map[string]any:
+			if key == "properties" {
+				properties := make(map[string]any, len(v))
+				for name, property := range v {
+					propertySchema, _ := property.(map[string]any)
+					properties[name] = geminiSchemaToJSONSchema(propertySchema)
+				}
+				result[key] = properties
+			} else {
+				result[key] = geminiSchemaToJSONSchema(v)
+			}
+		case []any:
+			items := make([]any, len(v))
+			for i, item := range v {
+				if itemSchema, ok := item.(map[string]any); ok {
+					items[i] = geminiSchemaToJSONSchema(itemSchema)
+				} else {
+					items[i] = item
+				}
+			}
+			result[key] = items
+		default:
+			result[key] = value
+		}
+	}
+	return result
+}
+
+// mapJetbrainsFinishReasonToGemini maps the upstream finish reason to a Gemini finishReason
+func mapJetbrainsFinishReasonToGemini(reason string) string {
+	if reason == "length" {
+		return "MAX_TOKENS"
+	}
+	return "STOP"
+}
+
+// geminiFunctionCallPart converts a completed tool call into a functionCall part
+func geminiFunctionCallPart(call ToolCall) GeminiPart {
+	args := map[string]any{}
+	if call.Function.Arguments != "" {
+		if err := sonic.UnmarshalString(call.Function.Arguments, &args); err != nil {
+			Warn("Invalid arguments for tool call %s: %v", call.Function.Name, err)
+			args = map[string]any{}
+		}
+	}
+	return GeminiPart{FunctionCall: &GeminiFunctionCall{ID: call.ID, Name: call.Function.Name, Args: args}}
+}
+
+// geminiStreamWriter writes streamGenerateContent chunks as SSE (alt=sse) or as a streamed JSON array
+type geminiStreamWriter struct {
+	c      *gin.Context
+	sse    bool
+	chunks int
+}
+
+// write sends one response chunk
+func (w *geminiStreamWriter) write(chunk GeminiGenerateContentResponse) {
+	respJSON, _ := marshalJSON(chunk)
+	switch {
+	case w.sse:
+		fmt.Fprintf(w.c.Writer, "data: %s\r\n\r\n", string(respJSON))
+	case w.chunks == 0:
+		fmt.Fprintf(w.c.Writer, "[%s", string(respJSON))
+	default:
+		fmt.Fprintf(w.c.Writer, ",\r\n%s", string(respJSON))
+	}
+	w.chunks++
+	w.c.Writer.Flush()
+}
+
+// close terminates the JSON array
+func (w *geminiStreamWriter) close() {
+	if !w.sse {
+		w.c.Writer.Write([]byte("]"))
+		w.c.Writer.Flush()
+	}
+}
+
+// handleGeminiResponse writes the upstream response as a Gemini response or stream
+// 工具调用参数在上游分片到达，完整后才作为 functionCall 部分发送
+func handleGeminiResponse(c *gin.Context, resp *http.Response, model string, stream, sse bool, promptTokens int, startTime time.Time, accountIdentifier string) {
+	responseID := strings.ReplaceAll(uuid.New().String(), "-", "")
+	collector := newToolCallCollector(ChatCompletionRequest{})
+	usage := newUsageTracker(model, promptTokens)
+	var text strings.Builder
+	upstreamReason := ""
+	flushedCalls := 0
+
+	writer := &geminiStreamWriter{c: c, sse: sse}
+	newChunk := func(parts []GeminiPart) GeminiGenerateContentResponse {
+		if parts == nil {
+			parts = []GeminiPart{}
+		}
+		return GeminiGenerateContentResponse{
+			Candidates:   []GeminiCandidate{{Content: GeminiContent{Role: "model", Parts: parts}, Index: 0}},
+			ModelVersion: model,
+			ResponseID:   responseID,
+		}
+	}
+	// completedCalls returns tool calls that can no longer receive argument fragments
+	completedCalls := func(final bool) []GeminiPart {
+		var parts []GeminiPart
+		end := len(collector.calls)
+		if !final {
+			end--
+		}
+		for ; flushedCalls < end; flushedCalls++ {
+			parts = append(parts, geminiFunctionCallPart(collector.calls[flushedCalls]))
+		}
+		return parts
+	}
+
+	if stream {
+		if sse {
+			c.Header("Content-Type", "text/event-stream")
+		} else {
+			c.Header("Content-Type", "application/json")
+		}
+		c.Header("Cache-Control", "no-cache")
+		c.Header("Connection", "keep-alive")
+	}
+
+	processJetbrainsStream(resp, func(data map[string]any) bool {
+		eventType, _ := data["type"].(string)
+		switch eventType {
+		case "Content":
+			content, _ := data["content"].(string)
+			if content == "" {
+				return true
+			}
+			usage.addCompletion(content)
+			text.WriteString(content)
+			if stream {
+				writer.write(newChunk([]GeminiPart{{Text: content}}))
+			}
+		case "ToolCall", "FunctionCall":
+			toolEvent, _ := parseJetbrainsToolEvent(data)
+			if _, ok := collector.add(toolEvent); ok {
+				usage.addCompletion(toolEvent.Name + toolEvent.Arguments)
+			}
+			if stream && toolEvent.Start {
+				if parts := completedCalls(false); len(parts) > 0 {
+					writer.write(newChunk(parts))
+				}
+			}
+		case "FinishMetadata":
+			upstreamReason, _ = data["reason"].(string)
+			usage.observeFinishMetadata(data)
+			return false
+		}
+		return true
+	})
+	collector.validate()
+
+	total := usage.usage()
+	chargeClientTokens(c, total)
+	metadata := &GeminiUsageMetadata{
+		PromptTokenCount:     total.PromptTokens,
+		CandidatesTokenCount: total.CompletionTokens,
+		TotalTokenCount:      total.PromptTokens + total.CompletionTokens,
+	}
+	finishReason := mapJetbrainsFinishReasonToGemini(upstreamReason)
+
+	recordRequest(true, time.Since(startTime).Milliseconds(), model, accountIdentifier, clientKeyName(c))
+
+	if stream {
+		final := newChunk(completedCalls(true))
+		final.Candidates[0].FinishReason = finishReason
+		final.UsageMetadata = metadata
+		writer.write(final)
+		writer.close()
+		return
+	}
+
+	var parts []GeminiPart
+	if text.Len() > 0 {
+		parts = append(parts, GeminiPart{Text: text.String()})
+	}
+	parts = append(parts, completedCalls(true)...)
+	response := newChunk(parts)
+	response.Candidates[0].FinishReason = finishReason
+	response.UsageMetadata = metadata
+	c.JSON(http.StatusOK, response)
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/bytedance/sonic"
+	"github.com/gin-gonic/gin"
+)
+
+const geminiWeatherTools = `"tools":[{"functionDeclarations":[{"name":"get_weather","parameters":{"type":"OBJECT","properties":{"location":{"type":"STRING"}},"required":["location"]}}]}]`
+
+// doGeminiRequest sends a POST request authenticated the way Gemini SDKs do (x-goog-api-key)
+func doGeminiRequest(router *gin.Engine, path, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("x-goog-api-key", testClientKey)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+// geminiCandidate decodes a response and returns the first candidate
+func geminiCandidate(t *testing.T, body []byte) (map[string]any, map[string]any) {
+	t.Helper()
+	var resp map[string]any
+	if err := sonic.Unmarshal(body, &resp); err != nil {
+		t.Fatalf("invalid response %s: %v", body, err)
+	}
+	return resp, resp["candidates"].([]any)[0].(map[string]any)
+}
+
+func TestFakeGrazie_GeminiGenerateContent(t *testing.T) {
+	_, router := setupFakeUpstream(t, DefaultFakeGrazieOptions())
+
+	w := doGeminiRequest(router, "/v1beta/models/test-model:generateContent", `{
+		"systemInstruction":{"parts":[{"text":"Be brief."}]},
+		"contents":[{"role":"user","parts":[{"text":"hello there"}]}]
+	}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	resp, candidate := geminiCandidate(t, w.Body.Bytes())
+	content := candidate["content"].(map[string]any)
+	text := content["parts"].([]any)[0].(map[string]any)["text"]
+	if content["role"] != "model" || text != "Echo: hello there" || candidate["finishReason"] != "STOP" {
+		t.Errorf("unexpected candidate: %v", candidate)
+	}
+	usage := resp["usageMetadata"].(map[string]any)
+	if usage["promptTokenCount"] == float64(0) || usage["candidatesTokenCount"] == float64(0) {
+		t.Errorf("usage should be estimated, got %v", usage)
+	}
+}
+
+func TestFakeGrazie_GeminiFunctionCallRoundTrip(t *testing.T) {
+	_, router := setupFakeUpstream(t, DefaultFakeGrazieOptions())
+
+	// 使用 ?key= 查询参数认证
+	path := "/v1beta/models/test-model:generateContent?key=" + testClientKey
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(`{
+		"contents":[{"role":"user","parts":[{"text":"weather?"}]}],`+geminiWeatherTools+`}`))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	_, candidate := geminiCandidate(t, w.Body.Bytes())
+	call := candidate["content"].(map[string]any)["parts"].([]any)[0].(map[string]any)["functionCall"].(map[string]any)
+	if call["name"] != "get_weather" {
+		t.Fatalf("expected a get_weather functionCall, got %v", candidate)
+	}
+	if _, ok := call["args"].(map[string]any)["location"]; !ok {
+		t.Errorf("args should be parsed into an object, got %v", call["args"])
+	}
+
+	// 不带 id 的 functionResponse 按名称配对
+	w = doGeminiRequest(router, "/v1beta/models/test-model:generateContent", `{
+		"contents":[
+			{"role":"user","parts":[{"text":"weather?"}]},
+			{"role":"model","parts":[{"functionCall":{"name":"get_weather","args":{"location":"Paris"}}}]},
+			{"role":"user","parts":[{"functionResponse":{"name":"get_weather","response":{"result":"sunny"}}}]}
+		],`+geminiWeatherTools+`}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	_, candidate = geminiCandidate(t, w.Body.Bytes())
+	text := candidate["content"].(map[string]any)["parts"].([]any)[0].(map[string]any)["text"]
+	if text != `Tool get_weather returned: {"result":"sunny"}` {
+		t.Errorf("functionResponse should be sent as the tool result, got %v", text)
+	}
+}
+
+func TestFakeGrazie_GeminiStreamGenerateContent(t *testing.T) {
+	_, router := setupFakeUpstream(t, DefaultFakeGrazieOptions())
+
+	w := doGeminiRequest(router, "/v1beta/models/test-model:streamGenerateContent?alt=sse", `{
+		"contents":[{"role":"user","parts":[{"text":"weather? [fake:tool_calls=2]"}]}],`+geminiWeatherTools+`}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	var calls int
+	var last map[string]any
+	for _, chunk := range strings.Split(strings.TrimSpace(w.Body.String()), "\r\n\r\n") {
+		data, ok := strings.CutPrefix(chunk, "data: ")
+		if !ok {
+			t.Fatalf("unexpected SSE chunk %q", chunk)
+		}
+		_, candidate := geminiCandidate(t, []byte(data))
+		for _, part := range candidate["content"].(map[string]any)["parts"].([]any) {
+			if call, ok := part.(map[string]any)["functionCall"].(map[string]any); ok {
+				calls++
+				if _, ok := call["args"].(map[string]any)["location"]; !ok {
+					t.Errorf("streamed functionCall should carry complete args, got %v", call)
+				}
+			}
+		}
+		last = candidate
+	}
+	if calls != 2 {
+		t.Errorf("expected 2 streamed functionCall parts, got %d:\n%s", calls, w.Body.String())
+	}
+	if last["finishReason"] != "STOP" {
+		t.Errorf("last chunk should carry finishReason, got %v", last)
+	}
+
+	// 不带 alt=sse 时返回 JSON 数组
+	w = doGeminiRequest(router, "/v1beta/models/test-model:streamGenerateContent", `{"contents":[{"parts":[{"text":"hi"}]}]}`)
+	var chunks []GeminiGenerateContentResponse
+	if err := sonic.Unmarshal(w.Body.Bytes(), &chunks); err != nil || len(chunks) < 2 {
+		t.Fatalf("expected a JSON array of chunks, got %s (%v)", w.Body.String(), err)
+	}
+	if chunks[len(chunks)-1].UsageMetadata == nil {
+		t.Errorf("last chunk should carry usageMetadata")
+	}
+}
+
+func TestAuthenticateClient_GeminiKeys(t *testing.T) {
+	_, router := setupFakeUpstream(t, DefaultFakeGrazieOptions())
+
+	req := httptest.NewRequest(http.MethodPost, "/v1beta/models/test-model:generateContent", strings.NewReader(`{"contents":[]}`))
+	req.Header.Set("x-goog-api-key", "wrong")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("invalid x-goog-api-key should be rejected with 403, got %d", w.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/v1beta/models/test-model:generateContent?key=wrong", strings.NewReader(`{"contents":[]}`))
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("invalid key query parameter should be rejected with 403, got %d", w.Code)
+	}
+
+	// key 查询参数只在 Gemini 端点有效
+	req = httptest.NewRequest(http.MethodPost, "/v1beta/models/test-model:generateContent?key="+testClientKey,
+		strings.NewReader(`{"contents":[{"role":"user","parts":[{"text":"hi"}]}]}`))
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("valid key query parameter should be accepted on /v1beta, got %d: %s", w.Code, w.Body.String())
+	}
+	for _, route := range [][2]string{{http.MethodGet, "/v1/models"}, {http.MethodPost, "/v1/chat/completions"}} {
+		method, path := route[0], route[1]
+		req = httptest.NewRequest(method, path+"?key="+testClientKey, nil)
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("key query parameter should be ignored on %s, got %d", path, w.Code)
+		}
+	}
+}
+
+// geminiError decodes a Google API error body
+func geminiError(t *testing.T, w *httptest.ResponseRecorder) (float64, string) {
+	t.Helper()
+	var resp struct {
+		Error struct {
+			Code    float64 `json:"code"`
+			Message string  `json:"message"`
+			Status  string  `json:"status"`
+		} `json:"error"`
+	}
+	if err := sonic.Unmarshal(w.Body.Bytes(), &resp); err != nil || resp.Error.Message == "" {
+		t.Fatalf("expected a Google API error body, got %d: %s", w.Code, w.Body.String())
+	}
+	return resp.Error.Code, resp.Error.Status
+}
+
+func TestGemini_ErrorsUseGoogleFormat(t *testing.T) {
+	_, router := setupFakeUpstream(t, DefaultFakeGrazieOptions())
+	oldLimiter := rateLimiter
+	rateLimiter = NewMemoryRateLimiter()
+	t.Cleanup(func() { rateLimiter = oldLimiter })
+
+	req := httptest.NewRequest(http.MethodPost, "/v1beta/models/test-model:generateContent", strings.NewReader(`{"contents":[]}`))
+	req.Header.Set("x-goog-api-key", "wrong")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if code, status := geminiError(t, w); w.Code != http.StatusForbidden || code != http.StatusForbidden || status != "PERMISSION_DENIED" {
+		t.Errorf("auth failure: got %d %v %s", w.Code, code, status)
+	}
+
+	cases := []struct {
+		path, body string
+		code       int
+		status     string
+	}{
+		{"/v1beta/models/test-model:generateContent", `{"contents":[]}`, http.StatusBadRequest, "INVALID_ARGUMENT"},
+		{"/v1beta/models/test-model:countTokens", `{}`, http.StatusNotFound, "NOT_FOUND"},
+		{"/v1beta/models/missing-model:generateContent", `{"contents":[{"role":"user","parts":[{"text":"hi"}]}]}`, http.StatusNotFound, "NOT_FOUND"},
+	}
+	for _, tc := range cases {
+		w := doGeminiRequest(router, tc.path, tc.body)
+		if code, status := geminiError(t, w); w.Code != tc.code || code != float64(tc.code) || status != tc.status {
+			t.Errorf("%s: expected %d %s, got %d %v %s", tc.path, tc.code, tc.status, w.Code, code, status)
+		}
+	}
+
+	currentConfig().ClientKeys[testClientKey].RequestsPerMinute = 1
+	body := `{"contents":[{"role":"user","parts":[{"text":"hi"}]}]}`
+	doGeminiRequest(router, "/v1beta/models/test-model:generateContent", body)
+	w = doGeminiRequest(router, "/v1beta/models/test-model:generateContent", body)
+	if code, status := geminiError(t, w); w.Code != http.StatusTooManyRequests || code != http.StatusTooManyRequests || status != "RESOURCE_EXHAUSTED" {
+		t.Errorf("rate limit: got %d %v %s", w.Code, code, status)
+	}
+}
+
+func TestGeminiSchemaToJSONSchema(t *testing.T) {
+	schema := geminiSchemaToJSONSchema(map[string]any{
+		"type": "OBJECT",
+		"properties": map[string]any{
+			"tags": map[string]any{"type": "ARRAY", "items": map[string]any{"type": "STRING"}},
+			"type": map[string]any{"type": "STRING", "enum": []any{"A", "B"}},
+		},
+	})
+	properties := schema["properties"].(map[string]any)
+	tags := properties["tags"].(map[string]any)
+	if schema["type"] != "object" || tags["type"] != "array" || tags["items"].(map[string]any)["type"] != "string" {
+		t.Errorf("type names should be lower-cased, got %v", schema)
+	}
+	// 名为 type 的属性不是类型名
+	if kind := properties["type"].(map[string]any); kind["type"] != "string" || kind["enum"].([]any)[0] != "A" {
+		t.Errorf("property named type should be converted as a schema, got %v", kind)
+	}
+}
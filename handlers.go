@@ -1,7 +1,6 @@
 package main
 
 import (
-	"bytes"
 	"fmt"
 	"io"
 	"net/http"
@@ -12,46 +11,84 @@ import (
 )
 
 // authenticateClient 客户端认证中间件
+// 认证通过后执行密钥策略 (启用、有效期、请求大小)，并将密钥保存到上下文供处理器检查模型权限
 func authenticateClient(c *gin.Context) {
-	if len(validClientKeys) == 0 {
-		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Service unavailable: no client API keys configured"})
+	clientKeys := currentConfig().ClientKeys
+	if len(clientKeys) == 0 {
+		respondWithError(c, http.StatusServiceUnavailable, "Service unavailable: no client API keys configured")
 		c.Abort()
 		return
 	}
 
-	authHeader := c.GetHeader("Authorization")
-	apiKey := c.GetHeader("x-api-key")
-
-	// Check x-api-key first
-	if apiKey != "" {
-		if validClientKeys[apiKey] {
-			return
+	key, source := extractClientKey(c)
+	if key == "" {
+		message := "API key required in Authorization header (Bearer), x-api-key or x-goog-api-key header"
+		if isGeminiRoute(c) {
+			message += " or key query parameter"
 		}
-		c.JSON(http.StatusForbidden, gin.H{"error": "Invalid client API key (x-api-key)"})
+		respondWithError(c, http.StatusUnauthorized, message)
 		c.Abort()
 		return
 	}
 
-	// Check Authorization header
-	if authHeader != "" {
-		token := strings.TrimPrefix(authHeader, "Bearer ")
-		if validClientKeys[token] {
-			return
-		}
-		c.JSON(http.StatusForbidden, gin.H{"error": "Invalid client API key (Bearer token)"})
+	clientKey, ok := clientKeys[key]
+	if !ok {
+		respondWithError(c, http.StatusForbidden, fmt.Sprintf("Invalid client API key (%s)", source))
+		c.Abort()
+		return
+	}
+	if err := clientKey.checkUsable(time.Now()); err != nil {
+		respondWithError(c, http.StatusForbidden, err.Error())
 		c.Abort()
 		return
 	}
 
-	c.JSON(http.StatusUnauthorized, gin.H{"error": "API key required in Authorization header (Bearer) or x-api-key header"})
-	c.Abort()
+	if clientKey.MaxRequestBytes > 0 {
+		if c.Request.ContentLength > clientKey.MaxRequestBytes {
+			respondWithError(c, http.StatusRequestEntityTooLarge, fmt.Sprintf("Request body exceeds the %d byte limit for this API key", clientKey.MaxRequestBytes))
+			c.Abort()
+			return
+		}
+		// 未声明长度的请求体在读取时截断
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, clientKey.MaxRequestBytes)
+	}
+
+	c.Set(clientKeyContextKey, clientKey)
+}
+
+// extractClientKey returns the client key and where it was found
+// 按 x-api-key、x-goog-api-key、Authorization、key 查询参数的顺序，第一个出现的来源生效；
+// key 查询参数只在 Gemini 端点接受，避免其他端点的密钥出现在 URL 和访问日志中
+func extractClientKey(c *gin.Context) (string, string) {
+	if apiKey := c.GetHeader("x-api-key"); apiKey != "" {
+		return apiKey, "x-api-key"
+	}
+	// Gemini clients send x-goog-api-key or the key query parameter
+	if googKey := c.GetHeader("x-goog-api-key"); googKey != "" {
+		return googKey, "x-goog-api-key"
+	}
+	if authHeader := c.GetHeader("Authorization"); authHeader != "" {
+		return strings.TrimPrefix(authHeader, "Bearer "), "Bearer token"
+	}
+	if queryKey := c.Query("key"); queryKey != "" && isGeminiRoute(c) {
+		return queryKey, "key query parameter"
+	}
+	return "", ""
 }
 
 // listModels 列出可用模型
+// 只返回当前客户端密钥允许使用的模型
 func listModels(c *gin.Context) {
+	modelsData := currentConfig().ModelsData
+	models := make([]ModelInfo, 0, len(modelsData.Data))
+	for _, model := range modelsData.Data {
+		if clientModelAllowed(c, model.ID) {
+			models = append(models, model)
+		}
+	}
 	modelList := ModelList{
 		Object: "list",
-		Data:   modelsData.Data,
+		Data:   models,
 	}
 	c.JSON(http.StatusOK, modelList)
 }
@@ -68,37 +105,47 @@ func chatCompletions(c *gin.Context) {
 
 	var request ChatCompletionRequest
 	if err := c.ShouldBindJSON(&request); err != nil {
-		recordFailureWithTimer(startTime, "", "")
+		recordFailureWithTimer(startTime, "", "", clientKeyName(c))
 		RecordHTTPError()
 		respondWithError(c, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	modelConfig := getModelItem(request.Model)
-	if modelConfig == nil {
-		recordFailureWithTimer(startTime, request.Model, "")
-		respondWithError(c, http.StatusNotFound, fmt.Sprintf("Model %s not found", request.Model))
+	serveChatCompletion(c, request, startTime, respondChatCompletion)
+}
+
+// chatResponseWriter writes an upstream JetBrains response in a client-specific format
+type chatResponseWriter func(c *gin.Context, resp *http.Response, request ChatCompletionRequest, promptTokens int, startTime time.Time, accountIdentifier string)
+
+// respondChatCompletion writes the upstream response as an OpenAI chat completion
+func respondChatCompletion(c *gin.Context, resp *http.Response, request ChatCompletionRequest, promptTokens int, startTime time.Time, accountIdentifier string) {
+	if request.Stream {
+		handleStreamingResponse(c, resp, request, promptTokens, startTime, accountIdentifier)
+	} else {
+		handleNonStreamingResponse(c, resp, request, promptTokens, startTime, accountIdentifier)
+	}
+}
+
+// serveChatCompletion converts a chat request, sends it upstream and hands the response to respond
+// DRY: shared by every OpenAI-style endpoint
+func serveChatCompletion(c *gin.Context, request ChatCompletionRequest, startTime time.Time, respond chatResponseWriter) {
+	if !clientModelAllowed(c, request.Model) {
+		recordFailureWithTimer(startTime, request.Model, "", clientKeyName(c))
+		respondWithError(c, http.StatusForbidden, clientModelForbiddenMessage(c, request.Model))
 		return
 	}
 
-	account, err := getNextJetbrainsAccount()
-	if err != nil {
-		recordFailureWithTimer(startTime, request.Model, "")
-		respondWithError(c, http.StatusTooManyRequests, err.Error())
+	modelConfig := getModelItem(request.Model)
+	if modelConfig == nil {
+		recordFailureWithTimer(startTime, request.Model, "", clientKeyName(c))
+		respondWithError(c, http.StatusNotFound, fmt.Sprintf("Model %s not found", request.Model))
 		return
 	}
-	defer func() {
-		// Return the account to the pool when the function exits
-		select {
-		case accountPool <- account:
-			// Returned successfully
-		default:
-			// Pool is full, which shouldn't happen if managed correctly.
-			Warn("account pool is full. Could not return account.")
-		}
-	}()
 
-	accountIdentifier := getTokenDisplayName(account)
+	// convert span 覆盖消息转换、工具验证和序列化，出错提前返回时由 defer 结束
+	_, convertSpan := startSpan(c.Request.Context(), "convert",
+		attrModel.String(request.Model), attrToolCount.Int(len(request.Tools)))
+	defer convertSpan.End()
 
 	// Convert OpenAI format to JetBrains format with caching
 	messagesCacheKey := generateMessagesCacheKey(request.Messages)
@@ -106,18 +153,18 @@ func chatCompletions(c *gin.Context) {
 	var jetbrainsMessages []JetbrainsMessage
 	if found {
 		jetbrainsMessages = jetbrainsMessagesAny.([]JetbrainsMessage)
-		RecordCacheHit()
+		RecordCacheHit("message_conversion")
 	} else {
 		jetbrainsMessages = openAIToJetbrainsMessages(request.Messages)
 		messageConversionCache.Set(messagesCacheKey, jetbrainsMessages, 10*time.Minute)
-		RecordCacheMiss()
+		RecordCacheMiss("message_conversion")
 	}
 
 	// CRITICAL FIX: Force tool usage when tools are provided
 	if len(request.Tools) > 0 {
 		if request.ToolChoice == nil {
 			request.ToolChoice = "any"
-			Debug("FORCING tool_choice to 'any' for tool usage guarantee")
+			DebugContext(c, "FORCING tool_choice to 'any' for tool usage guarantee")
 		}
 	}
 
@@ -128,7 +175,7 @@ func chatCompletions(c *gin.Context) {
 		var validatedTools []Tool
 		if found {
 			validatedTools = validatedToolsAny.([]Tool)
-			RecordCacheHit()
+			RecordCacheHit("tools_validation")
 		} else {
 			validationStart := time.Now()
 			var validationErr error
@@ -137,13 +184,13 @@ func chatCompletions(c *gin.Context) {
 			RecordToolValidation(validationDuration)
 
 			if validationErr != nil {
-				recordFailureWithTimer(startTime, request.Model, accountIdentifier)
+				recordFailureWithTimer(startTime, request.Model, "", clientKeyName(c))
 				RecordHTTPError()
 				respondWithError(c, http.StatusBadRequest, fmt.Sprintf("Tool validation failed: %v", validationErr))
 				return
 			}
 			toolsValidationCache.Set(toolsCacheKey, validatedTools, 30*time.Minute)
-			RecordCacheMiss()
+			RecordCacheMiss("tools_validation")
 		}
 
 		if len(validatedTools) > 0 {
@@ -161,11 +208,11 @@ func chatCompletions(c *gin.Context) {
 			}
 			toolsJSON, marshalErr := marshalJSON(jetbrainsTools)
 			if marshalErr != nil {
-				recordFailureWithTimer(startTime, request.Model, accountIdentifier)
+				recordFailureWithTimer(startTime, request.Model, "", clientKeyName(c))
 				respondWithError(c, http.StatusInternalServerError, "Failed to marshal tools")
 				return
 			}
-			Debug("Transformed tools for JetBrains API: %s", string(toolsJSON))
+			DebugContext(c, "Transformed tools for JetBrains API: %s", string(toolsJSON))
 			data = append(data, JetbrainsData{Type: "json", Value: string(toolsJSON)})
 			// 添加modified字段，模拟preview.json的格式
 			modifiedTime := time.Now().UnixMilli()
@@ -181,7 +228,7 @@ func chatCompletions(c *gin.Context) {
 			}
 			if shouldForceToolUse(request) {
 				jetbrainsMessages = openAIToJetbrainsMessages(request.Messages)
-				Debug("Using original messages for tool usage")
+				DebugContext(c, "Using original messages for tool usage")
 			}
 		}
 	}
@@ -203,61 +250,55 @@ func chatCompletions(c *gin.Context) {
 
 	payloadBytes, err := marshalJSON(payload)
 	if err != nil {
-		recordFailureWithTimer(startTime, request.Model, accountIdentifier)
+		recordFailureWithTimer(startTime, request.Model, "", clientKeyName(c))
 		respondWithError(c, http.StatusInternalServerError, "Failed to marshal request")
 		return
 	}
+	convertSpan.End()
 
-	Debug("=== JetBrains API Request Debug ===")
-	Debug("Model: %s -> %s", request.Model, internalModel)
-	Debug("Messages processed: %d", len(jetbrainsMessages))
-	Debug("Tools processed: %d", len(request.Tools))
-	Debug("Payload size: %d bytes", len(payloadBytes))
-	Debug("=== Complete Upstream Payload ===")
-	Debug("%s", string(payloadBytes))
-	Debug("=== End Upstream Payload ===")
-	Debug("=== End Debug ===")
+	DebugContext(c, "=== JetBrains API Request Debug ===")
+	DebugContext(c, "Model: %s -> %s", request.Model, internalModel)
+	DebugContext(c, "Messages processed: %d", len(jetbrainsMessages))
+	DebugContext(c, "Tools processed: %d", len(request.Tools))
+	DebugContext(c, "Payload size: %d bytes", len(payloadBytes))
+	DebugContext(c, "=== Complete Upstream Payload ===")
+	DebugContext(c, "%s", string(payloadBytes))
+	DebugContext(c, "=== End Upstream Payload ===")
+	DebugContext(c, "=== End Debug ===")
 
-	req, err := http.NewRequest("POST", "https://api.jetbrains.ai/user/v5/llm/chat/stream/v8", bytes.NewBuffer(payloadBytes))
-	if err != nil {
-		recordFailureWithTimer(startTime, request.Model, accountIdentifier)
-		respondWithError(c, http.StatusInternalServerError, "Failed to create request")
+	// 上游失败时换账户重试，payloadBytes 在各次尝试之间重复使用
+	resp, account, statusCode, err := sendUpstreamWithFailover(upstreamRequest{
+		ctx:     c.Request.Context(),
+		payload: payloadBytes,
+		model:   request.Model,
+		client:  clientKeyName(c),
+		tools:   len(request.Tools),
+	})
+	if account == nil {
+		setAccountRetryAfter(c, err)
+		recordFailureWithTimer(startTime, request.Model, "", clientKeyName(c))
+		respondWithError(c, statusCode, err.Error())
 		return
 	}
+	defer releaseJetbrainsAccount(account)
 
-	req.Header.Set("Accept", "text/event-stream")
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Cache-Control", "no-cache")
-	setJetbrainsHeaders(req, account.JWT)
-
-	resp, err := httpClient.Do(req)
+	accountIdentifier := getTokenDisplayName(account)
 	if err != nil {
-		recordFailureWithTimer(startTime, request.Model, accountIdentifier)
-		respondWithError(c, http.StatusInternalServerError, "Failed to make request")
+		recordFailureWithTimer(startTime, request.Model, accountIdentifier, clientKeyName(c))
+		respondWithError(c, statusCode, "Failed to make request")
 		return
 	}
 	defer resp.Body.Close()
 
-	Debug("JetBrains API Response Status: %d", resp.StatusCode)
-
-	if resp.StatusCode == 477 {
-		Warn("Account %s has no quota (received 477)", getTokenDisplayName(account))
-		account.HasQuota = false
-		account.LastQuotaCheck = float64(time.Now().Unix())
-	}
-
 	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(resp.Body)
 		errorMsg := string(body)
-		Error("JetBrains API Error: Status %d, Body: %s", resp.StatusCode, errorMsg)
-		recordFailureWithTimer(startTime, request.Model, accountIdentifier)
-		c.JSON(resp.StatusCode, gin.H{"error": errorMsg})
+		ErrorContext(c, "JetBrains API Error: Status %d, Body: %s", resp.StatusCode, errorMsg)
+		recordFailureWithTimer(startTime, request.Model, accountIdentifier, clientKeyName(c))
+		respondWithError(c, resp.StatusCode, errorMsg)
 		return
 	}
 
-	if request.Stream {
-		handleStreamingResponse(c, resp, request, startTime, accountIdentifier)
-	} else {
-		handleNonStreamingResponse(c, resp, request, startTime, accountIdentifier)
-	}
+	promptTokens := estimatePromptTokens(request.Model, jetbrainsMessages, data)
+	respond(c, resp, request, promptTokens, startTime, accountIdentifier)
 }
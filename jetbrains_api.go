@@ -1,11 +1,15 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"io"
 	"net/http"
+	"slices"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/bytedance/sonic"
@@ -25,6 +29,21 @@ func setJetbrainsHeaders(req *http.Request, jwt string) {
 	}
 }
 
+// createJetbrainsStreamRequest 创建 JetBrains API 流式请求 (DRY: 提取公共逻辑)
+func createJetbrainsStreamRequest(payloadBytes []byte, jwt string) (*http.Request, error) {
+	req, err := http.NewRequest("POST", jetbrainsAPIURL(jetbrainsChatStreamPath), bytes.NewReader(payloadBytes))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Accept", "text/event-stream")
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Cache-Control", "no-cache")
+	setJetbrainsHeaders(req, jwt)
+
+	return req, nil
+}
+
 // handleJWTExpiredAndRetry handles JWT expiration and retries the request
 func handleJWTExpiredAndRetry(req *http.Request, account *JetbrainsAccount) (*http.Response, error) {
 	resp, err := httpClient.Do(req)
@@ -38,7 +57,7 @@ func handleJWTExpiredAndRetry(req *http.Request, account *JetbrainsAccount) (*ht
 
 		jwtRefreshMutex.Lock()
 		// Check if another goroutine already refreshed the JWT
-		if req.Header.Get("grazie-authenticate-jwt") == account.JWT {
+		if current, _ := accountJWT(account); req.Header.Get("grazie-authenticate-jwt") == current {
 			if err := refreshJetbrainsJWT(account); err != nil {
 				jwtRefreshMutex.Unlock()
 				return nil, err
@@ -46,45 +65,28 @@ func handleJWTExpiredAndRetry(req *http.Request, account *JetbrainsAccount) (*ht
 		}
 		jwtRefreshMutex.Unlock()
 
-		req.Header.Set("grazie-authenticate-jwt", account.JWT)
+		jwt, _ := accountJWT(account)
+		req.Header.Set("grazie-authenticate-jwt", jwt)
 		return httpClient.Do(req)
 	}
 
 	return resp, nil
 }
 
-// ensureValidJWT ensures that the account has a valid JWT
-func ensureValidJWT(account *JetbrainsAccount) error {
-	if account.JWT == "" && account.LicenseID != "" {
-		jwtRefreshMutex.Lock()
-		defer jwtRefreshMutex.Unlock()
-
-		// Double-check after acquiring lock
-		if account.JWT == "" {
-			return refreshJetbrainsJWT(account)
-		}
-	}
-	return nil
-}
-
-// checkQuota checks the quota for a given JetBrains account
+// checkQuota queries the quota for a given JetBrains account and updates its status
 func checkQuota(account *JetbrainsAccount) error {
-	quotaData, err := getQuotaData(account)
-	if err != nil {
-		account.HasQuota = false
-		return err
-	}
-
-	processQuotaData(quotaData, account)
-	return nil
+	_, err := fetchQuotaData(account)
+	return err
 }
 
 // refreshJetbrainsJWT refreshes the JWT for a given JetBrains account
 func refreshJetbrainsJWT(account *JetbrainsAccount) error {
 	Info("Refreshing JWT for licenseId %s...", account.LicenseID)
 
+	authorization := accountAuthorization(account)
+
 	payload := map[string]string{"licenseId": account.LicenseID}
-	req, err := createJetbrainsRequest("POST", "https://api.jetbrains.ai/auth/jetbrains-jwt/provide-access/license/v2", payload, account.Authorization)
+	req, err := createJetbrainsRequest("POST", jetbrainsAPIURL(jetbrainsJWTPath), payload, authorization)
 	if err != nil {
 		return err
 	}
@@ -110,114 +112,239 @@ func refreshJetbrainsJWT(account *JetbrainsAccount) error {
 	tokenStr, _ := data["token"].(string)
 
 	if state == "PAID" && tokenStr != "" {
-		account.JWT = tokenStr
-		account.LastUpdated = float64(time.Now().Unix())
-
 		// Parse the JWT to get the expiration time
-		token, _, err := new(jwt.Parser).ParseUnverified(tokenStr, jwt.MapClaims{})
+		expiryTime, err := parseJWTExpiry(tokenStr)
 		if err != nil {
 			Warn("could not parse JWT: %v", err)
-		} else if claims, ok := token.Claims.(jwt.MapClaims); ok {
-			if exp, ok := claims["exp"].(float64); ok {
-				account.ExpiryTime = time.Unix(int64(exp), 0)
-			}
 		}
 
-		Info("Successfully refreshed JWT for licenseId %s, expires at %s", account.LicenseID, account.ExpiryTime.Format(time.RFC3339))
+		account.stateMu.Lock()
+		account.JWT = tokenStr
+		account.LastUpdated = float64(time.Now().Unix())
+		if err == nil {
+			account.ExpiryTime = expiryTime
+		}
+		expiryTime = account.ExpiryTime
+		account.stateMu.Unlock()
+
+		Info("Successfully refreshed JWT for licenseId %s, expires at %s", account.LicenseID, expiryTime.Format(time.RFC3339))
 		return nil
 	}
 
 	return fmt.Errorf("JWT refresh failed: invalid response state %s", state)
 }
 
-// getNextJetbrainsAccount gets the next available JetBrains account from the pool
+// parseJWTExpiry extracts the expiration time from a JWT without verifying its signature
+func parseJWTExpiry(tokenStr string) (time.Time, error) {
+	token, _, err := new(jwt.Parser).ParseUnverified(tokenStr, jwt.MapClaims{})
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	exp, err := token.Claims.GetExpirationTime()
+	if err != nil {
+		return time.Time{}, err
+	}
+	if exp == nil {
+		return time.Time{}, fmt.Errorf("JWT has no exp claim")
+	}
+	return exp.Time, nil
+}
+
+// isStaticJWTAccount reports whether the account uses a static JWT that cannot be refreshed
+// 静态JWT账户的 JWT 和过期时间创建后不再修改，无需持有 stateMu
+func isStaticJWTAccount(account *JetbrainsAccount) bool {
+	return account.LicenseID == "" && account.JWT != ""
+}
+
+// isStaticJWTExpired reports whether a static JWT account has passed its expiry time
+func isStaticJWTExpired(account *JetbrainsAccount) bool {
+	return isStaticJWTAccount(account) && !account.ExpiryTime.IsZero() && time.Now().After(account.ExpiryTime)
+}
+
+// retireAccount permanently removes an account from rotation
+func retireAccount(account *JetbrainsAccount) {
+	setAccountRetired(account, "static JWT expired at "+account.ExpiryTime.Format(time.RFC3339))
+}
+
+// accountLeasable reports whether an account may be handed out to new requests
+func accountLeasable(account *JetbrainsAccount) bool {
+	return accountFlagsState(account).leasable()
+}
+
+// leasableAccounts returns the accounts that can be handed out to new requests
+func leasableAccounts(accounts []*JetbrainsAccount) []*JetbrainsAccount {
+	candidates := make([]*JetbrainsAccount, 0, len(accounts))
+	for _, account := range accounts {
+		if accountLeasable(account) {
+			candidates = append(candidates, account)
+		}
+	}
+	return candidates
+}
+
+// getNextJetbrainsAccount selects an account with available quota using the configured selection strategy
+// 多个请求可以共用一个账户，调用方使用完后调用 releaseJetbrainsAccount
 func getNextJetbrainsAccount() (*JetbrainsAccount, error) {
-	if len(jetbrainsAccounts) == 0 {
+	return getNextJetbrainsAccountExcluding(nil)
+}
+
+// getNextJetbrainsAccountExcluding selects an account like getNextJetbrainsAccount, skipping the excluded accounts
+// 故障转移时用于跳过本次请求已经尝试过的账户
+func getNextJetbrainsAccountExcluding(excluded map[*JetbrainsAccount]bool) (*JetbrainsAccount, error) {
+	accounts := accountsSnapshot()
+	if len(accounts) == 0 {
 		return nil, fmt.Errorf("service unavailable: no JetBrains accounts configured")
 	}
 
-	// Try up to all accounts before giving up
-	maxRetries := len(jetbrainsAccounts)
-	var lastError error
-	var triedAccounts []string
+	if len(leasableAccounts(accounts)) == 0 {
+		return nil, fmt.Errorf("service unavailable: all JetBrains accounts have expired or are disabled")
+	}
 
-	for retryCount := 0; retryCount < maxRetries; retryCount++ {
-		accountWaitStart := time.Now()
-		select {
-		case account := <-accountPool:
-			// 记录账户池等待时间
-			waitDuration := time.Since(accountWaitStart)
-			if waitDuration > 100*time.Millisecond { // 只记录超过100ms的等待
-				RecordAccountPoolWait(waitDuration)
-			}
+	// 跳过冷却中和配额用完的账户 (只检查本地状态，不访问网络)
+	candidates := slices.DeleteFunc(eligibleAccounts(accounts), func(account *JetbrainsAccount) bool {
+		return excluded[account]
+	})
+	if len(candidates) == 0 {
+		return nil, &accountsUnavailableError{
+			message:       "no healthy JetBrains accounts available: " + describeAccountHealth(accounts),
+			nextAvailable: nextAccountAvailableAt(accounts),
+		}
+	}
 
-			accountName := getTokenDisplayName(account)
+	selector := currentConfig().AccountSelector
+	if selector == nil {
+		selector = defaultAccountSelector
+	}
 
-			// Skip if we've already tried this account in this round
-			skipAccount := false
-			for _, tried := range triedAccounts {
-				if tried == accountName {
-					skipAccount = true
-					break
-				}
-			}
+	// Try every candidate in the order chosen by the strategy before giving up
+	// 策略顺序内健康账户优先，降级账户其次，冷却结束的账户最后 (半开探测)
+	// JWT 和配额由后台监控维护，这里只读取缓存的状态
+	ordered := selector.Order(candidates)
+	slices.SortStableFunc(ordered, func(a, b *JetbrainsAccount) int {
+		return accountHealthRank(a) - accountHealthRank(b)
+	})
+
+	var pending, overQuota int
+	for _, account := range ordered {
+		if !accountHasValidJWT(account) {
+			// 还没有获取到 JWT 或 JWT 已过期，等待后台监控刷新
+			requestAccountRefresh(account)
+			pending++
+			continue
+		}
+		// 配额用完的账户只在冷却结束后作为半开探测使用
+		if !accountQuotaState(account).HasQuota && getAccountHealth(account) != AccountExhausted {
+			overQuota++
+			continue
+		}
 
-			if skipAccount {
-				// Return account to pool and continue to next iteration
-				go func() {
-					accountPool <- account
-				}()
-				continue
-			}
+		// 其他请求可能已经占用了探测名额
+		if !beginAccountAttempt(account) {
+			continue
+		}
+		Info("Selected account %s with available quota (%s)", getTokenDisplayName(account), selector.Name())
+		atomic.AddInt32(&account.InFlight, 1)
+		return account, nil
+	}
 
-			triedAccounts = append(triedAccounts, accountName)
-
-			// Defer re-queueing the account for future use
-			defer func() {
-				accountPool <- account
-			}()
-
-			// 检查JWT是否需要刷新
-			if account.LicenseID != "" {
-				if account.JWT == "" || time.Now().After(account.ExpiryTime.Add(-JWTRefreshTime)) {
-					if err := refreshJetbrainsJWT(account); err != nil {
-						Error("Failed to refresh JWT for %s: %v", accountName, err)
-						RecordAccountPoolError()
-						lastError = fmt.Errorf("JWT refresh failed for %s: %v", accountName, err)
-						continue // Try next account
-					}
-				}
-			}
+	RecordAccountPoolError()
+	return nil, &accountsUnavailableError{
+		message: fmt.Sprintf("no accounts with available quota found among %d candidates (%d over quota, %d waiting for a JWT refresh)",
+			len(candidates), overQuota, pending),
+		nextAvailable: nextAccountAvailableAt(accounts),
+	}
+}
 
-			// 检查配额
-			if err := checkQuota(account); err != nil {
-				Error("Failed to check quota for %s: %v", accountName, err)
-				RecordAccountPoolError()
-				lastError = fmt.Errorf("quota check failed for %s: %v", accountName, err)
-				continue // Try next account
-			}
+// accountsUnavailableError 所有账户暂时不可用 (冷却中或配额用完)
+// nextAvailable 为最早恢复的账户的时间，未知时为零值
+type accountsUnavailableError struct {
+	message       string
+	nextAvailable time.Time
+}
 
-			if account.HasQuota {
-				Info("Selected account %s with available quota", accountName)
-				return account, nil
-			} else {
-				Warn("Account %s is over quota, trying next account", accountName)
-				lastError = fmt.Errorf("account %s is over quota", accountName)
-				continue // Try next account
-			}
+func (e *accountsUnavailableError) Error() string {
+	if e.nextAvailable.IsZero() {
+		return e.message
+	}
+	return fmt.Sprintf("%s; next account available at %s", e.message, e.nextAvailable.Format(time.RFC3339))
+}
+
+// accountHasValidJWT reports whether the account has an unexpired JWT
+func accountHasValidJWT(account *JetbrainsAccount) bool {
+	jwt, expiry := accountJWT(account)
+	if jwt == "" {
+		return false
+	}
+	return expiry.IsZero() || time.Now().Before(expiry)
+}
+
+// accountJWT 返回账户当前的 JWT 和过期时间
+func accountJWT(account *JetbrainsAccount) (string, time.Time) {
+	account.stateMu.RLock()
+	defer account.stateMu.RUnlock()
+	return account.JWT, account.ExpiryTime
+}
 
-		case <-time.After(30 * time.Second): // Reduced timeout for individual account checks
-			RecordAccountPoolError()
-			lastError = fmt.Errorf("timed out waiting for an available JetBrains account")
-			break
+// accountAuthorization 返回许可证账户当前的授权信息
+func accountAuthorization(account *JetbrainsAccount) string {
+	account.stateMu.RLock()
+	defer account.stateMu.RUnlock()
+	return account.Authorization
+}
+
+// accountQuotaState 返回账户配额字段的快照
+func accountQuotaState(account *JetbrainsAccount) accountQuota {
+	account.stateMu.RLock()
+	defer account.stateMu.RUnlock()
+	return accountQuota{
+		HasQuota:  account.HasQuota,
+		Used:      account.QuotaUsed,
+		Total:     account.QuotaTotal,
+		LastCheck: account.LastQuotaCheck,
+		ResetAt:   account.QuotaResetAt,
+	}
+}
+
+// releaseJetbrainsAccount 请求结束时释放 getNextJetbrainsAccount 返回的账户
+func releaseJetbrainsAccount(account *JetbrainsAccount) {
+	atomic.AddInt32(&account.InFlight, -1)
+	endAccountProbe(account)
+}
+
+// eligibleAccounts returns the leasable accounts that are not cooling down or exhausted
+// 过期的静态JWT在此退出账户池，无需访问网络
+func eligibleAccounts(accounts []*JetbrainsAccount) []*JetbrainsAccount {
+	now := time.Now()
+	candidates := make([]*JetbrainsAccount, 0, len(accounts))
+	for _, account := range accounts {
+		if accountLeasable(account) && isStaticJWTExpired(account) {
+			retireAccount(account)
+			continue
+		}
+		if accountEligible(account, now) {
+			candidates = append(candidates, account)
 		}
 	}
+	return candidates
+}
 
-	// If we get here, all accounts were tried and none had quota
-	if lastError != nil {
-		return nil, fmt.Errorf("no accounts with available quota found after trying %d accounts: %v", maxRetries, lastError)
+// describeAccountHealth summarizes why no account is available, e.g. "2 exhausted, 1 cooling-down"
+func describeAccountHealth(accounts []*JetbrainsAccount) string {
+	counts := make(map[AccountHealthState]int)
+	var order []AccountHealthState
+	for _, account := range accounts {
+		state := getAccountHealth(account)
+		if counts[state] == 0 {
+			order = append(order, state)
+		}
+		counts[state]++
+	}
+	parts := make([]string, 0, len(order))
+	for _, state := range order {
+		parts = append(parts, fmt.Sprintf("%d %s", counts[state], state))
 	}
-	return nil, fmt.Errorf("no accounts with available quota found after trying all %d accounts", maxRetries)
+	return strings.Join(parts, ", ")
 }
 
 // processQuotaData processes quota data and updates account status
@@ -229,39 +356,50 @@ func processQuotaData(quotaData *JetbrainsQuotaResponse, account *JetbrainsAccou
 		dailyTotal = 1 // Avoid division by zero
 	}
 
-	account.HasQuota = dailyUsed < dailyTotal
-	if !account.HasQuota {
-		Warn("Account %s has no quota", getTokenDisplayName(account))
-	}
-
+	hasQuota := dailyUsed < dailyTotal
+	account.stateMu.Lock()
+	account.QuotaUsed = dailyUsed
+	account.QuotaTotal = dailyTotal
+	account.HasQuota = hasQuota
 	account.LastQuotaCheck = float64(time.Now().Unix())
+	account.QuotaResetAt = parseQuotaReset(quotaData.Until)
+	account.stateMu.Unlock()
+	if !hasQuota {
+		markAccountExhausted(account, "daily quota used up")
+	} else {
+		markAccountQuotaAvailable(account)
+	}
 }
 
-func getQuotaData(account *JetbrainsAccount) (*JetbrainsQuotaResponse, error) {
-	if err := ensureValidJWT(account); err != nil {
-		return nil, fmt.Errorf("failed to refresh JWT: %w", err)
+// parseQuotaReset parses the quota reset time ("until") reported by the quota API
+// 无法解析时返回零值，配额用完的账户退回到指数退避
+func parseQuotaReset(until string) time.Time {
+	if until == "" {
+		return time.Time{}
 	}
-
-	if account.JWT == "" {
-		return nil, fmt.Errorf("account has no JWT")
+	resetAt, err := time.Parse(time.RFC3339, until)
+	if err != nil {
+		Debug("Unrecognized quota reset time %q: %v", until, err)
+		return time.Time{}
 	}
+	return resetAt
+}
 
-	// 检查缓存
-	quotaCacheMutex.RLock()
-	cacheKey := account.JWT
-	if cachedInfo, found := accountQuotaCache[cacheKey]; found && time.Since(cachedInfo.LastAccess) < QuotaCacheTime {
-		quotaCacheMutex.RUnlock()
-		return cachedInfo.QuotaData, nil
+// fetchQuotaData queries the quota API, caches the result for the account and updates its status
+// 只由后台监控和管理接口调用，请求处理时读取 getCachedQuota
+func fetchQuotaData(account *JetbrainsAccount) (*JetbrainsQuotaResponse, error) {
+	jwt, _ := accountJWT(account)
+	if jwt == "" {
+		return nil, fmt.Errorf("account has no JWT")
 	}
-	quotaCacheMutex.RUnlock()
 
-	req, err := http.NewRequest("POST", "https://api.jetbrains.ai/user/v5/quota/get", nil)
+	req, err := http.NewRequest("POST", jetbrainsAPIURL(jetbrainsQuotaPath), nil)
 	if err != nil {
 		return nil, err
 	}
 
 	req.Header.Set("Content-Length", "0")
-	setJetbrainsHeaders(req, account.JWT)
+	setJetbrainsHeaders(req, jwt)
 
 	resp, err := handleJWTExpiredAndRetry(req, account)
 	if err != nil {
@@ -271,12 +409,6 @@ func getQuotaData(account *JetbrainsAccount) (*JetbrainsQuotaResponse, error) {
 
 	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(resp.Body)
-		// 如果是401，则JWT可能已失效，从缓存中删除
-		if resp.StatusCode == 401 {
-			quotaCacheMutex.Lock()
-			delete(accountQuotaCache, cacheKey)
-			quotaCacheMutex.Unlock()
-		}
 		return nil, fmt.Errorf("quota check failed with status %d: %s", resp.StatusCode, string(body))
 	}
 
@@ -285,15 +417,15 @@ func getQuotaData(account *JetbrainsAccount) (*JetbrainsQuotaResponse, error) {
 		return nil, err
 	}
 
-	// 更新缓存
+	// 更新缓存 (按账户保存，JWT 刷新后仍然有效)
 	quotaCacheMutex.Lock()
-	accountQuotaCache[cacheKey] = &CachedQuotaInfo{
-		QuotaData:  &quotaData,
-		LastAccess: time.Now(),
+	accountQuotaCache[account] = &CachedQuotaInfo{
+		QuotaData: &quotaData,
+		FetchedAt: time.Now(),
 	}
 	quotaCacheMutex.Unlock()
 
-	if IsDebug() {
+	if debugEnabled() {
 		quotaJSON, _ := sonic.MarshalIndent(quotaData, "", "  ")
 		Debug("JetBrains Quota API Response: %s", string(quotaJSON))
 	}
@@ -302,3 +434,10 @@ func getQuotaData(account *JetbrainsAccount) (*JetbrainsQuotaResponse, error) {
 
 	return &quotaData, nil
 }
+
+// getCachedQuota returns the last quota fetched for the account, nil if it has not been checked yet
+func getCachedQuota(account *JetbrainsAccount) *CachedQuotaInfo {
+	quotaCacheMutex.RLock()
+	defer quotaCacheMutex.RUnlock()
+	return accountQuotaCache[account]
+}
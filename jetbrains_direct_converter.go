@@ -9,12 +9,13 @@ import (
 
 // parseJetbrainsToAnthropicDirect 直接将 JetBrains 响应转换为 Anthropic 格式
 // KISS: 消除不必要的中间转换步骤
-func parseJetbrainsToAnthropicDirect(body []byte, model string) (*AnthropicMessagesResponse, error) {
+// promptTokens 为请求的估算值，上游返回真实计数时以上游为准
+func parseJetbrainsToAnthropicDirect(body []byte, model string, promptTokens int) (*AnthropicMessagesResponse, error) {
 	bodyStr := string(body)
 
 	// 检查是否是流式响应格式
 	if strings.HasPrefix(strings.TrimSpace(bodyStr), "data:") {
-		return parseJetbrainsStreamToAnthropic(bodyStr, model)
+		return parseJetbrainsStreamToAnthropic(bodyStr, model, promptTokens)
 	}
 
 	// 尝试解析为完整的聊天响应
@@ -44,10 +45,10 @@ func parseJetbrainsToAnthropicDirect(body []byte, model string) (*AnthropicMessa
 		Content:    content,
 		Model:      model,
 		StopReason: stopReason,
-		Usage: AnthropicUsage{
-			InputTokens:  0,
-			OutputTokens: estimateTokenCount(getContentText(content)),
-		},
+		Usage: tokenUsage{
+			PromptTokens:     promptTokens,
+			CompletionTokens: countTokens(model, getContentText(content)),
+		}.anthropic(),
 	}
 
 	Debug("Direct JetBrains→Anthropic conversion: id=%s, content_blocks=%d",
@@ -58,8 +59,9 @@ func parseJetbrainsToAnthropicDirect(body []byte, model string) (*AnthropicMessa
 
 // parseJetbrainsStreamToAnthropic 解析 JetBrains 流式响应为 Anthropic 格式
 // SRP: 专门处理流式响应的单一职责
-func parseJetbrainsStreamToAnthropic(bodyStr, model string) (*AnthropicMessagesResponse, error) {
+func parseJetbrainsStreamToAnthropic(bodyStr, model string, promptTokens int) (*AnthropicMessagesResponse, error) {
 	lines := strings.Split(bodyStr, "\n")
+	usage := newUsageTracker(model, promptTokens)
 	var content []AnthropicContentBlock
 	var currentToolCall *AnthropicContentBlock
 	var textParts []string
@@ -85,33 +87,31 @@ func parseJetbrainsStreamToAnthropic(bodyStr, model string) (*AnthropicMessagesR
 				// 文本内容
 				if text, ok := streamData["content"].(string); ok {
 					textParts = append(textParts, text)
+					usage.addCompletion(text)
 				}
-			case "ToolCall":
+			case "ToolCall", "FunctionCall":
 				// 工具调用处理
-				if upstreamID, ok := streamData["id"].(string); ok && upstreamID != "" {
-					// 开始新的工具调用
-					if name, ok := streamData["name"].(string); ok && name != "" {
-						currentToolCall = &AnthropicContentBlock{
-							Type:  "tool_use",
-							ID:    upstreamID,
-							Name:  name,
-							Input: make(map[string]any),
-						}
-						Debug("Started tool call: id=%s, name=%s", upstreamID, name)
+				toolEvent, _ := parseJetbrainsToolEvent(streamData)
+				usage.addCompletion(toolEvent.Name + toolEvent.Arguments)
+				if toolEvent.Start {
+					// 开始新的工具调用前，先完成上一个
+					if currentToolCall != nil {
+						content = append(content, finishAnthropicToolCall(currentToolCall))
 					}
-				} else if currentToolCall != nil {
-					// 累积工具参数
-					if contentStr, ok := streamData["content"].(string); ok {
-						// 这里需要解析JSON参数
-						if currentToolCall.Input == nil {
-							currentToolCall.Input = make(map[string]any)
-						}
-						// 累积参数字符串，在FinishMetadata时解析
-						if existing, exists := currentToolCall.Input["_raw_args"]; exists {
-							currentToolCall.Input["_raw_args"] = existing.(string) + contentStr
-						} else {
-							currentToolCall.Input["_raw_args"] = contentStr
-						}
+					currentToolCall = &AnthropicContentBlock{
+						Type:  "tool_use",
+						ID:    toolEvent.ID,
+						Name:  toolEvent.Name,
+						Input: make(map[string]any),
+					}
+					Debug("Started tool call: id=%s, name=%s", toolEvent.ID, toolEvent.Name)
+				}
+				if currentToolCall != nil && toolEvent.Arguments != "" {
+					// 累积参数字符串，在工具调用结束时解析
+					if existing, exists := currentToolCall.Input["_raw_args"]; exists {
+						currentToolCall.Input["_raw_args"] = existing.(string) + toolEvent.Arguments
+					} else {
+						currentToolCall.Input["_raw_args"] = toolEvent.Arguments
 					}
 				}
 			case "FinishMetadata":
@@ -119,21 +119,11 @@ func parseJetbrainsStreamToAnthropic(bodyStr, model string) (*AnthropicMessagesR
 				if reasonStr, ok := streamData["reason"].(string); ok {
 					finishReason = mapJetbrainsFinishReason(reasonStr)
 				}
+				usage.observeFinishMetadata(streamData)
 
 				// 完成工具调用
 				if currentToolCall != nil {
-					if rawArgs, exists := currentToolCall.Input["_raw_args"]; exists {
-						// 解析累积的JSON参数
-						var parsedArgs map[string]any
-						if err := sonic.Unmarshal([]byte(rawArgs.(string)), &parsedArgs); err == nil {
-							currentToolCall.Input = parsedArgs
-						} else {
-							// 如果JSON解析失败，保留原始字符串
-							currentToolCall.Input = map[string]any{"arguments": rawArgs.(string)}
-						}
-					}
-					content = append(content, *currentToolCall)
-					Debug("Completed tool call: id=%s, args=%v", currentToolCall.ID, currentToolCall.Input)
+					content = append(content, finishAnthropicToolCall(currentToolCall))
 					currentToolCall = nil
 				}
 			}
@@ -160,10 +150,7 @@ func parseJetbrainsStreamToAnthropic(bodyStr, model string) (*AnthropicMessagesR
 		Content:    content,
 		Model:      model,
 		StopReason: finishReason,
-		Usage: AnthropicUsage{
-			InputTokens:  0,
-			OutputTokens: 0,
-		},
+		Usage:      usage.usage().anthropic(),
 	}
 
 	Debug("Successfully parsed JetBrains stream to Anthropic: content_blocks=%d, finish_reason=%s",
@@ -172,6 +159,22 @@ func parseJetbrainsStreamToAnthropic(bodyStr, model string) (*AnthropicMessagesR
 	return response, nil
 }
 
+// finishAnthropicToolCall 解析累积的工具参数，生成完整的 tool_use 内容块
+func finishAnthropicToolCall(toolCall *AnthropicContentBlock) AnthropicContentBlock {
+	if rawArgs, exists := toolCall.Input["_raw_args"]; exists {
+		// 解析累积的JSON参数
+		var parsedArgs map[string]any
+		if err := sonic.Unmarshal([]byte(rawArgs.(string)), &parsedArgs); err == nil {
+			toolCall.Input = parsedArgs
+		} else {
+			// 如果JSON解析失败，保留原始字符串
+			toolCall.Input = map[string]any{"arguments": rawArgs.(string)}
+		}
+	}
+	Debug("Completed tool call: id=%s, args=%v", toolCall.ID, toolCall.Input)
+	return *toolCall
+}
+
 // mapJetbrainsFinishReason 映射 JetBrains 结束原因到 Anthropic 格式
 // KISS: 简单的映射逻辑
 func mapJetbrainsFinishReason(jetbrainsReason string) string {
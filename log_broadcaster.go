@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// logBufferSize 内存中保留的最近日志条数，新的 /log 订阅者连接时回放
+	logBufferSize = 1000
+	// logSubscriberBuffer 每个订阅者的待发送队列长度，队列满时丢弃最旧的条目
+	logSubscriberBuffer = 256
+	// logKeepAliveInterval 没有日志时发送 SSE 注释的间隔，避免代理断开空闲连接
+	logKeepAliveInterval = 15 * time.Second
+)
+
+// logEntry 一条广播的日志，Line 为 JSON 格式 (与 LOG_FORMAT=json 的输出相同)
+type logEntry struct {
+	Seq   uint64
+	Level slog.Level
+	Line  string
+}
+
+// logFilter /log 订阅者的过滤条件：最低级别和子串 (不区分大小写)
+type logFilter struct {
+	level slog.Level
+	query string
+}
+
+func (f logFilter) match(entry logEntry) bool {
+	return entry.Level >= f.level && (f.query == "" || strings.Contains(strings.ToLower(entry.Line), f.query))
+}
+
+// logSubscriber 一个 /log 连接
+type logSubscriber struct {
+	ch      chan logEntry
+	filter  logFilter
+	dropped atomic.Uint64 // 因消费过慢被丢弃、尚未通知客户端的条目数
+}
+
+// logBroadcaster 保存最近的日志并分发给订阅者
+// KISS: 环形缓冲区 + 每个订阅者一个有界队列，发布日志永远不会阻塞
+type logBroadcaster struct {
+	mu          sync.Mutex
+	ring        []logEntry
+	start       int // 最旧条目在 ring 中的位置
+	size        int
+	seq         uint64
+	subscribers map[*logSubscriber]struct{}
+}
+
+func newLogBroadcaster(capacity int) *logBroadcaster {
+	return &logBroadcaster{
+		ring:        make([]logEntry, capacity),
+		subscribers: make(map[*logSubscriber]struct{}),
+	}
+}
+
+// logBroadcast 全局日志广播，由 AppLogger 的 handler 写入
+var logBroadcast = newLogBroadcaster(logBufferSize)
+
+// publish 保存日志并发送给匹配的订阅者，订阅者队列满时丢弃其最旧的条目
+func (b *logBroadcaster) publish(level slog.Level, line string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.seq++
+	entry := logEntry{Seq: b.seq, Level: level, Line: line}
+	if b.size < len(b.ring) {
+		b.ring[(b.start+b.size)%len(b.ring)] = entry
+		b.size++
+	} else {
+		b.ring[b.start] = entry
+		b.start = (b.start + 1) % len(b.ring)
+	}
+
+	for sub := range b.subscribers {
+		if !sub.filter.match(entry) {
+			continue
+		}
+		select {
+		case sub.ch <- entry:
+		default:
+			// 只有发布者写入队列 (持有 b.mu)，丢弃最旧的一条后一定有空位
+			select {
+			case <-sub.ch:
+				sub.dropped.Add(1)
+			default:
+			}
+			sub.ch <- entry
+		}
+	}
+}
+
+// subscribe 注册订阅者，并返回缓冲区中最近 backlog 条匹配的日志 (backlog < 0 表示全部)
+// 回放和订阅在同一把锁内完成，保证两者之间不会漏掉日志
+func (b *logBroadcaster) subscribe(filter logFilter, backlog int) (*logSubscriber, []logEntry) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var entries []logEntry
+	for i := 0; i < b.size; i++ {
+		if entry := b.ring[(b.start+i)%len(b.ring)]; filter.match(entry) {
+			entries = append(entries, entry)
+		}
+	}
+	if backlog >= 0 && len(entries) > backlog {
+		entries = entries[len(entries)-backlog:]
+	}
+
+	sub := &logSubscriber{ch: make(chan logEntry, logSubscriberBuffer), filter: filter}
+	b.subscribers[sub] = struct{}{}
+	return sub, entries
+}
+
+func (b *logBroadcaster) unsubscribe(sub *logSubscriber) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.subscribers, sub)
+}
+
+// broadcastHandler 包装日志 handler，把每条记录以 JSON 格式同时发布到 logBroadcast
+type broadcastHandler struct {
+	slog.Handler
+	broadcaster *logBroadcaster
+	attrs       []slog.Attr
+}
+
+func newBroadcastHandler(inner slog.Handler, broadcaster *logBroadcaster) slog.Handler {
+	return &broadcastHandler{Handler: inner, broadcaster: broadcaster}
+}
+
+func (h *broadcastHandler) Handle(ctx context.Context, r slog.Record) error {
+	err := h.Handler.Handle(ctx, r)
+
+	var buf bytes.Buffer
+	line := slog.NewJSONHandler(&buf, &slog.HandlerOptions{ReplaceAttr: replaceLevelAttr}).WithAttrs(h.attrs)
+	if line.Handle(ctx, r) == nil {
+		h.broadcaster.publish(r.Level, strings.TrimSuffix(buf.String(), "\n"))
+	}
+	return err
+}
+
+func (h *broadcastHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &broadcastHandler{
+		Handler:     h.Handler.WithAttrs(attrs),
+		broadcaster: h.broadcaster,
+		attrs:       append(append([]slog.Attr{}, h.attrs...), attrs...),
+	}
+}
+
+// WithGroup 本服务不使用日志分组，广播的日志不包含分组
+func (h *broadcastHandler) WithGroup(name string) slog.Handler {
+	return &broadcastHandler{Handler: h.Handler.WithGroup(name), broadcaster: h.broadcaster, attrs: h.attrs}
+}
+
+// parseLogFilter 解析 /log 的查询参数：level (最低级别)、q (子串) 和 backlog (回放条数)
+func parseLogFilter(c *gin.Context) (logFilter, int, error) {
+	filter := logFilter{level: slog.LevelDebug, query: strings.ToLower(c.Query("q"))}
+	if value := c.Query("level"); value != "" {
+		if err := filter.level.UnmarshalText([]byte(value)); err != nil {
+			return filter, 0, fmt.Errorf("invalid level %q: use debug, info, warn or error", value)
+		}
+	}
+	backlog := -1
+	if value := c.Query("backlog"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return filter, 0, fmt.Errorf("invalid backlog %q: must be a non-negative integer", value)
+		}
+		backlog = n
+	}
+	return filter, backlog, nil
+}
+
+// streamLog 以 SSE 流式输出服务日志 (需要 ADMIN_API_KEY，日志中可能包含请求内容)
+// 连接时先回放缓冲区中匹配的日志，之后推送新日志；客户端消费过慢时发送 dropped 事件
+func streamLog(c *gin.Context) {
+	filter, backlog, err := parseLogFilter(c)
+	if err != nil {
+		respondWithError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	sub, entries := logBroadcast.subscribe(filter, backlog)
+	defer logBroadcast.unsubscribe(sub)
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Status(http.StatusOK)
+
+	for _, entry := range entries {
+		writeLogEvent(c, entry)
+	}
+	c.Writer.Flush()
+
+	keepAlive := time.NewTicker(logKeepAliveInterval)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case entry := <-sub.ch:
+			if dropped := sub.dropped.Swap(0); dropped > 0 {
+				fmt.Fprintf(c.Writer, "event: dropped\ndata: {\"dropped\":%d}\n\n", dropped)
+			}
+			writeLogEvent(c, entry)
+			c.Writer.Flush()
+		case <-keepAlive.C:
+			fmt.Fprint(c.Writer, ": keep-alive\n\n")
+			c.Writer.Flush()
+		}
+	}
+}
+
+func writeLogEvent(c *gin.Context, entry logEntry) {
+	fmt.Fprintf(c.Writer, "id: %d\ndata: %s\n\n", entry.Seq, entry.Line)
+}
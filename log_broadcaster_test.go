@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// captureBroadcast 将全局日志替换为只写入测试广播器的日志，测试结束后恢复
+func captureBroadcast(t *testing.T, capacity int) *logBroadcaster {
+	t.Helper()
+	b := newLogBroadcaster(capacity)
+	previousLogger, previousBroadcast := appLogger, logBroadcast
+	logBroadcast = b
+	appLogger = &AppLogger{
+		logger: slog.New(newBroadcastHandler(newLogHandler(io.Discard, "text", slog.LevelDebug), b)),
+		level:  slog.LevelDebug,
+	}
+	t.Cleanup(func() { appLogger, logBroadcast = previousLogger, previousBroadcast })
+	return b
+}
+
+func TestLogBroadcaster_BacklogKeepsNewestMatchingEntries(t *testing.T) {
+	captureBroadcast(t, 3)
+	Debug("debug 1")
+	Warn("warn 2")
+	Warn("warn 3")
+	Error("error 4")
+
+	sub, backlog := logBroadcast.subscribe(logFilter{level: slog.LevelWarn}, -1)
+	defer logBroadcast.unsubscribe(sub)
+	if len(backlog) != 3 || !strings.Contains(backlog[0].Line, `"msg":"warn 2"`) || !strings.Contains(backlog[2].Line, `"level":"ERROR"`) {
+		t.Fatalf("backlog should hold the newest buffered entries at warn and above, got %v", backlog)
+	}
+
+	_, limited := logBroadcast.subscribe(logFilter{level: slog.LevelDebug, query: "warn"}, 1)
+	if len(limited) != 1 || !strings.Contains(limited[0].Line, "warn 3") {
+		t.Errorf("backlog should be limited to the newest matching entry, got %v", limited)
+	}
+}
+
+func TestLogBroadcaster_SlowSubscriberDropsOldest(t *testing.T) {
+	b := captureBroadcast(t, 10)
+	sub, _ := b.subscribe(logFilter{level: slog.LevelDebug}, 0)
+	defer b.unsubscribe(sub)
+
+	for i := range logSubscriberBuffer + 5 {
+		Info("line %d", i)
+	}
+	if dropped := sub.dropped.Load(); dropped != 5 {
+		t.Fatalf("expected 5 dropped entries, got %d", dropped)
+	}
+	if first := <-sub.ch; !strings.Contains(first.Line, `"msg":"line 5"`) {
+		t.Errorf("the oldest entries should be dropped first, got %s", first.Line)
+	}
+}
+
+func TestStreamLog_RequiresAdminKeyAndStreamsFilteredLogs(t *testing.T) {
+	_, router := setupFakeUpstream(t, DefaultFakeGrazieOptions())
+	currentConfig().AdminAPIKey = testAdminKey
+	captureBroadcast(t, 10)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("/log should require the admin key, got %d", resp.StatusCode)
+	}
+
+	Info("backlog needle")
+	Info("unrelated")
+	Debug("debug needle")
+
+	req, _ := http.NewRequest(http.MethodGet, server.URL+"/log?level=info&q=NEEDLE", nil)
+	req.Header.Set("x-api-key", testAdminKey)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("expected an SSE stream, got %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+
+	lines := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			if data, ok := strings.CutPrefix(scanner.Text(), "data: "); ok {
+				lines <- data
+			}
+		}
+		close(lines)
+	}()
+	next := func() string {
+		select {
+		case line := <-lines:
+			return line
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for a log event")
+			return ""
+		}
+	}
+
+	if line := next(); !strings.Contains(line, `"msg":"backlog needle"`) {
+		t.Fatalf("expected the buffered entry to be replayed first, got %s", line)
+	}
+	Info("live %s", "unrelated")
+	Warn("live needle")
+	if line := next(); !strings.Contains(line, `"msg":"live needle"`) || !strings.Contains(line, `"level":"WARN"`) {
+		t.Errorf("expected the live matching entry, got %s", line)
+	}
+
+	if w := doAdminRequest(router, http.MethodGet, "/log?level=loud", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("invalid level should be rejected, got %d %s", w.Code, w.Body.String())
+	}
+}
@@ -1,68 +1,99 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"io"
 	"log"
+	"log/slog"
 	"os"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
 )
 
-type LogLevel int
-
-const (
-	DEBUG LogLevel = iota
-	INFO
-	WARN
-	ERROR
-	FATAL
-)
+// LevelFatal 比 Error 更高的级别，记录后退出进程
+const LevelFatal = slog.Level(12)
 
 type Logger interface {
-	Debug(format string, args ...any)
-	Info(format string, args ...any)
-	Warn(format string, args ...any)
-	Error(format string, args ...any)
-	Fatal(format string, args ...any)
+	Log(ctx context.Context, level slog.Level, format string, args ...any)
+	LogAttrs(level slog.Level, msg string, attrs ...slog.Attr)
+	Enabled(level slog.Level) bool
 }
 
+// AppLogger 基于 log/slog 的结构化日志，输出格式由 LOG_FORMAT 决定 (text 或 json)
+// 级别由 LOG_LEVEL 决定，与 GIN_MODE 无关
 type AppLogger struct {
-	logger     *log.Logger
-	debug      bool
+	logger     *slog.Logger
+	level      slog.Level
 	fileHandle *os.File     // 可能为nil
 	mu         sync.RWMutex // 保护文件句柄操作
 }
 
 func NewAppLogger() *AppLogger {
 	output, fileHandle := createDebugFileOutput()
+	level := parseLogLevel(os.Getenv("LOG_LEVEL"))
 	return &AppLogger{
-		logger:     log.New(output, "", log.LstdFlags),
-		debug:      gin.Mode() == gin.DebugMode,
+		logger:     slog.New(newBroadcastHandler(newLogHandler(output, os.Getenv("LOG_FORMAT"), level), logBroadcast)),
+		level:      level,
 		fileHandle: fileHandle,
 	}
 }
 
-func (l *AppLogger) Debug(format string, args ...any) {
-	if l.debug {
-		l.logger.Printf("[DEBUG] "+format, args...)
+// parseLogLevel 解析 LOG_LEVEL (debug/info/warn/error)，未设置或无法识别时为 info
+func parseLogLevel(value string) slog.Level {
+	var level slog.Level
+	if value == "" || level.UnmarshalText([]byte(value)) != nil {
+		if value != "" {
+			log.Printf("[WARN] Unknown LOG_LEVEL %q, using info", value)
+		}
+		return slog.LevelInfo
+	}
+	return level
+}
+
+// newLogHandler 按 LOG_FORMAT 创建 JSON 或文本 handler
+func newLogHandler(output io.Writer, format string, level slog.Level) slog.Handler {
+	opts := &slog.HandlerOptions{Level: level, ReplaceAttr: replaceLevelAttr}
+	if strings.EqualFold(format, "json") {
+		return slog.NewJSONHandler(output, opts)
 	}
+	return slog.NewTextHandler(output, opts)
 }
 
-func (l *AppLogger) Info(format string, args ...any) {
-	l.logger.Printf("[INFO] "+format, args...)
+// replaceLevelAttr FATAL 级别显示为 FATAL 而不是 ERROR+4
+func replaceLevelAttr(groups []string, a slog.Attr) slog.Attr {
+	if a.Key == slog.LevelKey && len(groups) == 0 {
+		if l, ok := a.Value.Any().(slog.Level); ok && l >= LevelFatal {
+			a.Value = slog.StringValue("FATAL")
+		}
+	}
+	return a
 }
 
-func (l *AppLogger) Warn(format string, args ...any) {
-	l.logger.Printf("[WARN] "+format, args...)
+// Log 按 format 格式化消息并记录，ctx 中有请求ID时附加 request_id 字段
+func (l *AppLogger) Log(ctx context.Context, level slog.Level, format string, args ...any) {
+	if !l.Enabled(level) {
+		return
+	}
+	var attrs []slog.Attr
+	if id := requestIDFromContext(ctx); id != "" {
+		attrs = append(attrs, slog.String("request_id", id))
+	}
+	l.LogAttrs(level, fmt.Sprintf(format, args...), attrs...)
 }
 
-func (l *AppLogger) Error(format string, args ...any) {
-	l.logger.Printf("[ERROR] "+format, args...)
+// LogAttrs 记录带有结构化字段的日志
+func (l *AppLogger) LogAttrs(level slog.Level, msg string, attrs ...slog.Attr) {
+	l.logger.LogAttrs(context.Background(), level, msg, attrs...)
 }
 
-func (l *AppLogger) Fatal(format string, args ...any) {
-	l.logger.Fatalf("[FATAL] "+format, args...)
+// Enabled 是否记录该级别的日志
+func (l *AppLogger) Enabled(level slog.Level) bool {
+	return level >= l.level
 }
 
 // 全局日志实例 - 延迟初始化
@@ -121,34 +152,114 @@ func CloseLogger() error {
 	return nil
 }
 
-// 全局日志函数 - 自动初始化保护
-func Debug(format string, args ...any) {
+// logf 全局日志函数的公共实现 - 自动初始化保护
+func logf(ctx context.Context, level slog.Level, format string, args ...any) {
 	if appLogger == nil {
 		InitializeLogger()
 	}
-	appLogger.Debug(format, args...)
+	appLogger.Log(ctx, level, format, args...)
 }
-func Info(format string, args ...any) {
+
+// 全局日志函数，用于与请求无关的日志 (启动、后台监控等)
+func Debug(format string, args ...any) { logf(context.Background(), slog.LevelDebug, format, args...) }
+func Info(format string, args ...any)  { logf(context.Background(), slog.LevelInfo, format, args...) }
+func Warn(format string, args ...any)  { logf(context.Background(), slog.LevelWarn, format, args...) }
+func Error(format string, args ...any) { logf(context.Background(), slog.LevelError, format, args...) }
+func Fatal(format string, args ...any) {
+	logf(context.Background(), LevelFatal, format, args...)
+	os.Exit(1)
+}
+
+// 请求内的日志函数，ctx 为 *gin.Context 或请求的 context，日志带有 request_id
+func DebugContext(ctx context.Context, format string, args ...any) {
+	logf(ctx, slog.LevelDebug, format, args...)
+}
+func InfoContext(ctx context.Context, format string, args ...any) {
+	logf(ctx, slog.LevelInfo, format, args...)
+}
+func WarnContext(ctx context.Context, format string, args ...any) {
+	logf(ctx, slog.LevelWarn, format, args...)
+}
+func ErrorContext(ctx context.Context, format string, args ...any) {
+	logf(ctx, slog.LevelError, format, args...)
+}
+
+// debugEnabled 是否记录 debug 日志，用于跳过只在调试时需要的开销较大的格式化
+func debugEnabled() bool {
 	if appLogger == nil {
 		InitializeLogger()
 	}
-	appLogger.Info(format, args...)
+	return appLogger.Enabled(slog.LevelDebug)
 }
-func Warn(format string, args ...any) {
-	if appLogger == nil {
-		InitializeLogger()
+
+// requestIDHeader 请求ID的请求头和响应头
+const requestIDHeader = "X-Request-ID"
+
+// requestIDKey 请求ID在 gin.Context 和请求 context 中的键
+type requestIDKey struct{}
+
+const requestIDContextKey = "request_id"
+
+// maxRequestIDLength 客户端提供的请求ID的最大长度，超过时重新生成
+const maxRequestIDLength = 128
+
+// requestIDMiddleware 使用客户端的 X-Request-ID 或生成新的请求ID，写入响应头并保存到上下文
+func requestIDMiddleware(c *gin.Context) {
+	id := strings.TrimSpace(c.GetHeader(requestIDHeader))
+	if id == "" || len(id) > maxRequestIDLength || strings.ContainsFunc(id, func(r rune) bool { return r < 0x20 || r > 0x7e }) {
+		id = uuid.NewString()
 	}
-	appLogger.Warn(format, args...)
+	c.Set(requestIDContextKey, id)
+	c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), requestIDKey{}, id))
+	c.Header(requestIDHeader, id)
+	c.Next()
 }
-func Error(format string, args ...any) {
-	if appLogger == nil {
-		InitializeLogger()
+
+// requestIDFromContext 返回请求ID，ctx 可以是 *gin.Context 或请求的 context
+func requestIDFromContext(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	if c, ok := ctx.(*gin.Context); ok {
+		return c.GetString(requestIDContextKey)
 	}
-	appLogger.Error(format, args...)
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
 }
-func Fatal(format string, args ...any) {
+
+// accessLogMiddleware 使用结构化日志记录访问日志，包括客户端密钥名称、模型和账户
+func accessLogMiddleware(c *gin.Context) {
+	start := time.Now()
+	c.Next()
+
+	attrs := []slog.Attr{
+		slog.String("request_id", requestIDFromContext(c)),
+		slog.String("method", c.Request.Method),
+		slog.String("path", c.Request.URL.Path),
+		slog.Int("status", c.Writer.Status()),
+		slog.Duration("latency", time.Since(start)),
+		slog.String("client_ip", c.ClientIP()),
+	}
+	if client := clientKeyName(c); client != "" {
+		attrs = append(attrs, slog.String("client", client))
+	}
+	if rm := requestMetricsFromContext(c.Request.Context()); rm != nil {
+		rm.mu.Lock()
+		model, account := rm.model, rm.accountName
+		rm.mu.Unlock()
+		if model != "" {
+			attrs = append(attrs, slog.String("model", model))
+		}
+		if account != "" {
+			attrs = append(attrs, slog.String("account", account))
+		}
+	}
+	if len(c.Errors) > 0 {
+		attrs = append(attrs, slog.String("error", c.Errors.String()))
+	}
+
 	if appLogger == nil {
 		InitializeLogger()
 	}
-	appLogger.Fatal(format, args...)
+	appLogger.LogAttrs(slog.LevelInfo, "request", attrs...)
 }
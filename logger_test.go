@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// captureLogs 将全局日志替换为写入缓冲区的 JSON 日志，测试结束后恢复
+func captureLogs(t *testing.T, level slog.Level) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	previous := appLogger
+	appLogger = &AppLogger{logger: slog.New(newLogHandler(&buf, "json", level)), level: level}
+	t.Cleanup(func() { appLogger = previous })
+	return &buf
+}
+
+// logLines 解析缓冲区中的 JSON 日志行
+func logLines(t *testing.T, buf *bytes.Buffer) []map[string]any {
+	t.Helper()
+	var lines []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var entry map[string]any
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("log line is not JSON: %q", line)
+		}
+		lines = append(lines, entry)
+	}
+	return lines
+}
+
+func TestParseLogLevel(t *testing.T) {
+	cases := map[string]slog.Level{
+		"":        slog.LevelInfo,
+		"debug":   slog.LevelDebug,
+		"WARN":    slog.LevelWarn,
+		"error":   slog.LevelError,
+		"verbose": slog.LevelInfo,
+	}
+	for value, want := range cases {
+		if got := parseLogLevel(value); got != want {
+			t.Errorf("parseLogLevel(%q) = %v, want %v", value, got, want)
+		}
+	}
+}
+
+func TestLogger_LevelFilteringAndFatalLabel(t *testing.T) {
+	buf := captureLogs(t, slog.LevelWarn)
+	Debug("debug message")
+	Info("info message")
+	Warn("warn %d", 1)
+	appLogger.Log(t.Context(), LevelFatal, "fatal message")
+
+	lines := logLines(t, buf)
+	if len(lines) != 2 {
+		t.Fatalf("expected only warn and fatal lines, got %v", lines)
+	}
+	if lines[0]["level"] != "WARN" || lines[0]["msg"] != "warn 1" {
+		t.Errorf("unexpected warn line: %v", lines[0])
+	}
+	if lines[1]["level"] != "FATAL" {
+		t.Errorf("fatal level should be labelled FATAL, got %v", lines[1]["level"])
+	}
+	if debugEnabled() {
+		t.Error("debug should be disabled at warn level")
+	}
+}
+
+func TestRequestID_PropagatedToLogsHeadersAndErrors(t *testing.T) {
+	_, router := setupFakeUpstream(t, DefaultFakeGrazieOptions())
+	buf := captureLogs(t, slog.LevelDebug)
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions",
+		strings.NewReader(`{"model":"missing-model","messages":[{"role":"user","content":"hi"}]}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+testClientKey)
+	req.Header.Set(requestIDHeader, "client-supplied-id")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	if w.Header().Get(requestIDHeader) != "client-supplied-id" {
+		t.Errorf("response should echo X-Request-ID, got %q", w.Header().Get(requestIDHeader))
+	}
+	var body map[string]any
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || body["request_id"] != "client-supplied-id" {
+		t.Errorf("error body should include the request ID, got %s", w.Body.String())
+	}
+
+	var access map[string]any
+	for _, line := range logLines(t, buf) {
+		if line["request_id"] != "client-supplied-id" {
+			t.Errorf("every request log line should carry the request ID, got %v", line)
+		}
+		if line["msg"] == "request" {
+			access = line
+		}
+	}
+	if access == nil {
+		t.Fatal("expected an access log line")
+	}
+	if access["path"] != "/v1/chat/completions" || access["status"] != float64(http.StatusNotFound) || access["client"] == "" {
+		t.Errorf("unexpected access log line: %v", access)
+	}
+}
+
+func TestRequestID_GeneratedAndAccessLogIncludesAccount(t *testing.T) {
+	_, router := setupFakeUpstream(t, DefaultFakeGrazieOptions())
+	buf := captureLogs(t, slog.LevelInfo)
+
+	w := doProxyRequest(router, "/v1/chat/completions",
+		`{"model":"test-model","messages":[{"role":"user","content":"hi"}],"stream":true}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("request failed: %d %s", w.Code, w.Body.String())
+	}
+	id := w.Header().Get(requestIDHeader)
+	if len(id) != 36 {
+		t.Fatalf("expected a generated UUID request ID, got %q", id)
+	}
+
+	for _, line := range logLines(t, buf) {
+		if line["msg"] != "request" {
+			continue
+		}
+		if line["request_id"] != id || line["model"] != "test-model" ||
+			line["account"] != getTokenDisplayName(jetbrainsAccounts[0]) {
+			t.Errorf("access log should include the request ID, model and account, got %v", line)
+		}
+		return
+	}
+	t.Fatal("expected an access log line")
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"net"
 	"net/http"
 	"os"
@@ -8,36 +9,41 @@ import (
 	"sync"
 	"syscall"
 	"time"
-
-	"github.com/bytedance/sonic"
-
-	"github.com/joho/godotenv"
 )
 
 const (
 	DefaultRequestTimeout = 5 * time.Minute // 增加到5分钟，适应长响应
-	QuotaCacheTime        = time.Hour
 	JWTRefreshTime        = 12 * time.Hour
+	ResponseStoreTTL      = 24 * time.Hour // Responses API 存储响应的保留时间
 )
 
 // Global variables
 var (
-	validClientKeys   = make(map[string]bool)
-	jetbrainsAccounts []JetbrainsAccount
-	accountPool       chan *JetbrainsAccount // 新增账户池通道
-	modelsData        ModelsData
-	modelsConfig      ModelsConfig
+	jetbrainsAccounts []*JetbrainsAccount
+	accountsMutex     sync.RWMutex // 保护 jetbrainsAccounts 的替换
 	httpClient        *http.Client
 	requestStats      RequestStats
 	statsMutex        sync.Mutex
 
-	accountQuotaCache = make(map[string]*CachedQuotaInfo)
+	accountQuotaCache = make(map[*JetbrainsAccount]*CachedQuotaInfo)
 	quotaCacheMutex   sync.RWMutex
 )
 
 func main() {
+	// 子命令分发
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "fake-grazie":
+			runFakeGrazie(os.Args[2:])
+			return
+		case "replay":
+			runReplay(os.Args[2:])
+			return
+		}
+	}
+
 	// Load .env file
-	if err := godotenv.Load(); err != nil {
+	if err := loadDotenv(); err != nil {
 		// 此时日志系统还没初始化，使用标准日志
 		println("No .env file found, using system environment variables")
 	}
@@ -46,6 +52,13 @@ func main() {
 	InitializeLogger()
 	Info("Logger initialized with environment configuration")
 
+	// 未配置 OTLP 导出地址时 tracing 为 no-op
+	shutdownTracing, err := initTracing(context.Background())
+	if err != nil {
+		Error("Failed to initialize tracing: %v", err)
+		shutdownTracing = func(context.Context) error { return nil }
+	}
+
 	// Initialize storage and load statistics
 	if err := initStorage(); err != nil {
 		Fatal("Failed to initialize storage: %v", err)
@@ -78,21 +91,35 @@ func main() {
 	}
 
 	// Load configuration
-	modelsData = loadModels()
-	data, err := os.ReadFile("models.json")
-	if err == nil {
-		sonic.Unmarshal(data, &modelsConfig)
+	loadUpstreamConfig()
+	cfg, err := loadRuntimeConfig()
+	if err != nil {
+		Error("Error loading configuration: %v", err)
 	}
-	loadClientAPIKeys()
-	loadJetbrainsAccounts()
-	// 初始化账户池
-	initAccountPool()
+	setRuntimeConfig(cfg)
+	loadRateLimitConfig()
+	loadAccountHealthConfig()
+	loadFailoverConfig()
+	loadAccountMonitorConfig()
+	loadAccountStateConfig()
+	loadAuditConfig()
+	jetbrainsAccounts = loadAccountsFromEnv()
+	Info("Account selection strategy: %s", currentConfig().AccountSelector.Name())
+
+	// 恢复上次保存的 JWT 和配额，启动前只刷新没有恢复的账户，之后由后台监控定期刷新
+	restoreAccountStates(jetbrainsAccounts)
+	refreshDueAccounts(false)
+	startAccountMonitor()
+
+	// 配置热更新: SIGHUP、文件轮询和 POST /admin/reload
+	setupReloadSignal()
+	startConfigWatcher()
 
 	// Initialize request-triggered statistics saving
 	initRequestTriggeredSaving()
 
 	// Set up graceful shutdown
-	setupGracefulShutdown()
+	setupGracefulShutdown(shutdownTracing)
 
 	r := setupRoutes()
 
@@ -104,26 +131,43 @@ func main() {
 	}
 }
 
-func setupGracefulShutdown() {
+func setupGracefulShutdown(shutdownTracing func(context.Context) error) {
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		<-c
 		Info("Shutdown signal received, saving statistics before exiting...")
 		saveStats()
+		saveAccountStates()
+		closeAuditLog()
+
+		// 导出尚未发送的 span
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		if err := shutdownTracing(ctx); err != nil {
+			Error("Failed to flush traces: %v", err)
+		}
+		cancel()
 		CloseLogger()
 		os.Exit(0)
 	}()
 }
 
-func initAccountPool() {
-	if len(jetbrainsAccounts) == 0 {
-		Warn("No JetBrains accounts loaded, account pool is empty.")
-		return
-	}
-	accountPool = make(chan *JetbrainsAccount, len(jetbrainsAccounts))
-	for i := range jetbrainsAccounts {
-		accountPool <- &jetbrainsAccounts[i]
+// updateJetbrainsAccounts 在锁内修改账户列表 (或账户状态)
+// 返回新的切片而不是原地修改，持有旧快照的读取方不受影响
+func updateJetbrainsAccounts(update func([]*JetbrainsAccount) ([]*JetbrainsAccount, error)) error {
+	accountsMutex.Lock()
+	defer accountsMutex.Unlock()
+	accounts, err := update(jetbrainsAccounts)
+	if err != nil {
+		return err
 	}
-	Info("Account pool initialized with %d accounts", len(jetbrainsAccounts))
+	jetbrainsAccounts = accounts
+	return nil
+}
+
+// accountsSnapshot 返回当前的账户列表
+func accountsSnapshot() []*JetbrainsAccount {
+	accountsMutex.RLock()
+	defer accountsMutex.RUnlock()
+	return jetbrainsAccounts
 }
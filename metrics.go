@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// metricsNamespace Prometheus 指标名前缀
+const metricsNamespace = "jetbrainsai2api"
+
+// 直方图的桶 (秒)
+var (
+	latencyBuckets  = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120}
+	poolWaitBuckets = []float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1}
+)
+
+// metricVec 带标签的计数器或直方图，按 Prometheus 文本格式输出
+// KISS: 只实现本服务需要的两种类型，不引入客户端库
+type metricVec struct {
+	name       string
+	help       string
+	kind       string // counter 或 histogram
+	labelNames []string
+	buckets    []float64
+
+	mu     sync.Mutex
+	series map[string]*metricSeries
+}
+
+// metricSeries 一组标签值对应的数据，counter 只使用 value
+type metricSeries struct {
+	labelValues []string
+	value       float64
+	bucketCount []uint64 // 每个桶 (不累积) 的观测数
+	count       uint64
+	sum         float64
+}
+
+// registeredMetrics 按注册顺序输出的所有指标
+var registeredMetrics []*metricVec
+
+func newCounterVec(name, help string, labelNames ...string) *metricVec {
+	return registerMetric(&metricVec{name: name, help: help, kind: "counter", labelNames: labelNames})
+}
+
+func newHistogramVec(name, help string, buckets []float64, labelNames ...string) *metricVec {
+	return registerMetric(&metricVec{name: name, help: help, kind: "histogram", labelNames: labelNames, buckets: buckets})
+}
+
+func registerMetric(v *metricVec) *metricVec {
+	v.name = metricsNamespace + "_" + v.name
+	v.series = make(map[string]*metricSeries)
+	registeredMetrics = append(registeredMetrics, v)
+	return v
+}
+
+// get 返回标签值对应的数据，不存在时创建 (调用方持有 v.mu)
+func (v *metricVec) get(labelValues []string) *metricSeries {
+	key := strings.Join(labelValues, "\xff")
+	s, ok := v.series[key]
+	if !ok {
+		s = &metricSeries{labelValues: slices.Clone(labelValues)}
+		if v.kind == "histogram" {
+			s.bucketCount = make([]uint64, len(v.buckets))
+		}
+		v.series[key] = s
+	}
+	return s
+}
+
+// Inc 计数器加一
+func (v *metricVec) Inc(labelValues ...string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.get(labelValues).value++
+}
+
+// Observe 记录一次直方图观测
+func (v *metricVec) Observe(value float64, labelValues ...string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	s := v.get(labelValues)
+	s.count++
+	s.sum += value
+	if i, _ := slices.BinarySearch(v.buckets, value); i < len(v.buckets) {
+		s.bucketCount[i]++
+	}
+}
+
+// ObserveDuration 以秒记录一次耗时
+func (v *metricVec) ObserveDuration(d time.Duration, labelValues ...string) {
+	v.Observe(d.Seconds(), labelValues...)
+}
+
+// write 按 Prometheus 文本格式输出，标签按字典序排列保证输出稳定
+func (v *metricVec) write(b *strings.Builder) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	writeMetricHeader(b, v.name, v.help, v.kind)
+	keys := make([]string, 0, len(v.series))
+	for key := range v.series {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	for _, key := range keys {
+		s := v.series[key]
+		labels := formatLabels(v.labelNames, s.labelValues)
+		if v.kind == "counter" {
+			writeSample(b, v.name, labels, s.value)
+			continue
+		}
+		var cumulative uint64
+		for i, bound := range v.buckets {
+			cumulative += s.bucketCount[i]
+			writeSample(b, v.name+"_bucket", appendLabel(labels, "le", formatFloat(bound)), float64(cumulative))
+		}
+		writeSample(b, v.name+"_bucket", appendLabel(labels, "le", "+Inf"), float64(s.count))
+		writeSample(b, v.name+"_sum", labels, s.sum)
+		writeSample(b, v.name+"_count", labels, float64(s.count))
+	}
+}
+
+func writeMetricHeader(b *strings.Builder, name, help, kind string) {
+	b.WriteString("# HELP " + name + " " + help + "\n")
+	b.WriteString("# TYPE " + name + " " + kind + "\n")
+}
+
+func writeSample(b *strings.Builder, name, labels string, value float64) {
+	b.WriteString(name)
+	if labels != "" {
+		b.WriteString("{" + labels + "}")
+	}
+	b.WriteString(" " + formatFloat(value) + "\n")
+}
+
+// formatLabels 输出 name="value" 列表，值按 Prometheus 规则转义
+func formatLabels(names, values []string) string {
+	parts := make([]string, len(names))
+	for i, name := range names {
+		parts[i] = name + `="` + escapeLabelValue(values[i]) + `"`
+	}
+	return strings.Join(parts, ",")
+}
+
+func appendLabel(labels, name, value string) string {
+	label := name + `="` + escapeLabelValue(value) + `"`
+	if labels == "" {
+		return label
+	}
+	return labels + "," + label
+}
+
+var labelValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabelValue(value string) string {
+	return labelValueReplacer.Replace(value)
+}
+
+func formatFloat(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// 服务指标
+var (
+	requestsTotal = newCounterVec("requests_total",
+		"Client API requests by endpoint, model, account and HTTP status.",
+		"endpoint", "model", "account", "status")
+	requestDuration = newHistogramVec("request_duration_seconds",
+		"Client API request latency by endpoint, model, account and HTTP status.",
+		latencyBuckets, "endpoint", "model", "account", "status")
+	upstreamDuration = newHistogramVec("upstream_duration_seconds",
+		"Time until the JetBrains AI API returned response headers, per attempt.",
+		latencyBuckets, "model", "account", "status")
+	timeToFirstToken = newHistogramVec("time_to_first_token_seconds",
+		"Time from receiving a request until the first upstream stream data arrived.",
+		latencyBuckets, "endpoint", "model", "account")
+	accountPoolWait = newHistogramVec("account_pool_wait_seconds",
+		"Time spent selecting an account from the pool.",
+		poolWaitBuckets)
+	accountPoolErrorsTotal = newCounterVec("account_pool_errors_total",
+		"Account selections and refreshes that failed.")
+	cacheRequestsTotal = newCounterVec("cache_requests_total",
+		"Cache lookups by cache and result (hit or miss).",
+		"cache", "result")
+)
+
+// requestMetrics 一个客户端请求的指标标签，模型和账户在选择账户后才知道
+type requestMetrics struct {
+	start    time.Time
+	endpoint string
+
+	mu          sync.Mutex
+	model       string
+	account     string // 账户 ID
+	accountName string // 账户显示名，用于访问日志
+}
+
+type requestMetricsKey struct{}
+
+// metricsMiddleware 记录客户端请求的数量和耗时，放在认证之前以便统计被拒绝的请求
+func metricsMiddleware(c *gin.Context) {
+	rm := &requestMetrics{start: time.Now(), endpoint: c.FullPath()}
+	c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), requestMetricsKey{}, rm))
+
+	c.Next()
+
+	rm.mu.Lock()
+	model, account := rm.model, rm.account
+	rm.mu.Unlock()
+	status := strconv.Itoa(c.Writer.Status())
+	requestsTotal.Inc(rm.endpoint, model, account, status)
+	requestDuration.ObserveDuration(time.Since(rm.start), rm.endpoint, model, account, status)
+}
+
+// requestMetricsFromContext 返回 metricsMiddleware 保存的请求指标，没有时返回 nil
+func requestMetricsFromContext(ctx context.Context) *requestMetrics {
+	rm, _ := ctx.Value(requestMetricsKey{}).(*requestMetrics)
+	return rm
+}
+
+// setRequestMetricsLabels 记录请求使用的模型和账户 (故障转移时为最后一个账户)
+func setRequestMetricsLabels(ctx context.Context, model string, account *JetbrainsAccount) {
+	if rm := requestMetricsFromContext(ctx); rm != nil {
+		rm.mu.Lock()
+		rm.model, rm.account, rm.accountName = model, accountID(account), getTokenDisplayName(account)
+		rm.mu.Unlock()
+	}
+}
+
+// firstByteReader 第一次读到上游数据时调用 onFirstByte
+type firstByteReader struct {
+	io.ReadCloser
+	once        sync.Once
+	onFirstByte func()
+}
+
+func (r *firstByteReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 {
+		r.once.Do(r.onFirstByte)
+	}
+	return n, err
+}
+
+// observeTimeToFirstToken 包装成功的上游响应，记录从收到客户端请求到第一批流数据的时间
+func observeTimeToFirstToken(ctx context.Context, resp *http.Response, model string, account *JetbrainsAccount) {
+	rm := requestMetricsFromContext(ctx)
+	if rm == nil || resp.StatusCode != http.StatusOK {
+		return
+	}
+	id := accountID(account)
+	resp.Body = &firstByteReader{ReadCloser: resp.Body, onFirstByte: func() {
+		timeToFirstToken.ObserveDuration(time.Since(rm.start), rm.endpoint, model, id)
+	}}
+}
+
+// writeAccountMetrics 输出抓取时计算的账户指标：剩余配额和 JWT 剩余有效期
+func writeAccountMetrics(b *strings.Builder) {
+	accounts := accountsSnapshot()
+	now := time.Now()
+
+	quotaName := metricsNamespace + "_account_quota_remaining"
+	writeMetricHeader(b, quotaName, "Daily quota remaining per account, from the last quota check.", "gauge")
+	for _, account := range accounts {
+		if getCachedQuota(account) == nil {
+			continue
+		}
+		quota := accountQuotaState(account)
+		writeSample(b, quotaName, formatLabels([]string{"account"}, []string{accountID(account)}), max(0, quota.Total-quota.Used))
+	}
+
+	expiryName := metricsNamespace + "_account_jwt_expiry_seconds"
+	writeMetricHeader(b, expiryName, "Seconds until the account JWT expires (negative once expired).", "gauge")
+	for _, account := range accounts {
+		jwt, expiry := accountJWT(account)
+		if jwt == "" || expiry.IsZero() {
+			continue
+		}
+		writeSample(b, expiryName, formatLabels([]string{"account"}, []string{accountID(account)}), math.Round(expiry.Sub(now).Seconds()))
+	}
+}
+
+// prometheusMetrics 以 Prometheus 文本格式输出所有指标
+func prometheusMetrics(c *gin.Context) {
+	var b strings.Builder
+	for _, v := range registeredMetrics {
+		v.write(&b)
+	}
+	writeAccountMetrics(&b)
+	c.Data(http.StatusOK, "text/plain; version=0.0.4; charset=utf-8", []byte(b.String()))
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetricVec_HistogramTextFormat(t *testing.T) {
+	v := &metricVec{name: "test_seconds", help: "Test.", kind: "histogram", labelNames: []string{"path"},
+		buckets: []float64{1, 2.5}, series: make(map[string]*metricSeries)}
+	v.Observe(0.5, `a"b`)
+	v.Observe(2.5, `a"b`)
+	v.Observe(7, `a"b`)
+
+	var b strings.Builder
+	v.write(&b)
+	want := `# HELP test_seconds Test.
+# TYPE test_seconds histogram
+test_seconds_bucket{path="a\"b",le="1"} 1
+test_seconds_bucket{path="a\"b",le="2.5"} 2
+test_seconds_bucket{path="a\"b",le="+Inf"} 3
+test_seconds_sum{path="a\"b"} 10
+test_seconds_count{path="a\"b"} 3
+`
+	if b.String() != want {
+		t.Errorf("unexpected output:\n%s\nwant:\n%s", b.String(), want)
+	}
+}
+
+func TestPrometheusMetricsEndpoint(t *testing.T) {
+	_, router := setupFakeUpstream(t, DefaultFakeGrazieOptions())
+	id := accountID(jetbrainsAccounts[0])
+
+	if w := doProxyRequest(router, "/v1/chat/completions",
+		`{"model":"test-model","messages":[{"role":"user","content":"hi"}],"stream":true}`); w.Code != http.StatusOK {
+		t.Fatalf("request failed: %d %s", w.Code, w.Body.String())
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if w.Code != http.StatusOK || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain") {
+		t.Fatalf("expected Prometheus text output, got %d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+	body := w.Body.String()
+	for _, series := range []string{
+		`jetbrainsai2api_requests_total{endpoint="/v1/chat/completions",model="test-model",account="` + id + `",status="200"}`,
+		`jetbrainsai2api_request_duration_seconds_bucket{endpoint="/v1/chat/completions",model="test-model",account="` + id + `",status="200",le="+Inf"}`,
+		`jetbrainsai2api_upstream_duration_seconds_count{model="test-model",account="` + id + `",status="200"}`,
+		`jetbrainsai2api_time_to_first_token_seconds_count{endpoint="/v1/chat/completions",model="test-model",account="` + id + `"}`,
+		`jetbrainsai2api_account_pool_wait_seconds_count `,
+		`jetbrainsai2api_cache_requests_total{cache="message_conversion",result=`,
+		`jetbrainsai2api_account_quota_remaining{account="` + id + `"} `,
+		`jetbrainsai2api_account_jwt_expiry_seconds{account="` + id + `"} `,
+	} {
+		if !strings.Contains(body, series) {
+			t.Errorf("metrics should include %s", series)
+		}
+	}
+}
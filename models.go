@@ -1,8 +1,10 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/bytedance/sonic"
@@ -23,8 +25,8 @@ type JetbrainsQuotaResponse struct {
 
 // CachedQuotaInfo defines the structure for cached quota information
 type CachedQuotaInfo struct {
-	QuotaData  *JetbrainsQuotaResponse
-	LastAccess time.Time
+	QuotaData *JetbrainsQuotaResponse
+	FetchedAt time.Time
 }
 
 // Data structures
@@ -43,6 +45,15 @@ type RequestRecord struct {
 	ResponseTime int64     `json:"response_time"`
 	Model        string    `json:"model"`
 	Account      string    `json:"account"`
+	Client       string    `json:"client,omitempty"` // 客户端密钥名称
+}
+
+// ClientUsageStats 某个客户端密钥对某个模型的使用统计
+type ClientUsageStats struct {
+	Client      string  `json:"client"`
+	Model       string  `json:"model"`
+	Requests    int64   `json:"requests"`
+	SuccessRate float64 `json:"successRate"`
 }
 
 type PeriodStats struct {
@@ -61,6 +72,7 @@ type TokenInfo struct {
 	ExpiryDate time.Time `json:"expiry_date"`
 	Status     string    `json:"status"`
 	HasQuota   bool      `json:"has_quota"`
+	QuotaReset time.Time `json:"quota_reset"` // 配额用完时上游报告的重置时间
 }
 
 type JetbrainsAccount struct {
@@ -71,6 +83,97 @@ type JetbrainsAccount struct {
 	HasQuota       bool      `json:"has_quota"`
 	LastQuotaCheck float64   `json:"last_quota_check"`
 	ExpiryTime     time.Time `json:"expiry_time"`
+	QuotaUsed      float64   `json:"quota_used,omitempty"`  // 最近一次配额检查的每日用量
+	QuotaTotal     float64   `json:"quota_total,omitempty"` // 最近一次配额检查的每日额度
+	QuotaResetAt   time.Time `json:"quota_reset_at"`        // 配额接口返回的重置时间 (until)
+	InFlight       int32     `json:"-"`                     // 正在使用该账户的请求数 (原子操作)
+
+	// 调度状态：账户加入账户池后由 healthMutex 保护，读取使用 accountFlagsState/accountWeight
+	Retired  bool `json:"retired,omitempty"`  // 静态JWT过期后退出账户池
+	Disabled bool `json:"disabled,omitempty"` // 管理接口停用，不再分配给请求
+	Draining bool `json:"draining,omitempty"` // 排空中：不再分配新请求，已有请求继续完成
+	Weight   *int `json:"weight,omitempty"`   // weighted 策略使用的权重，未配置时为 1
+
+	// stateMu 保护授权信息、JWT、过期时间和配额字段：后台监控和管理接口写入，请求处理和统计并发读取
+	// 读取使用 accountJWT/accountQuotaState，不与 healthMutex 嵌套持有
+	stateMu sync.RWMutex
+
+	// 健康状态，由 healthMutex 保护
+	Health              AccountHealthState `json:"health,omitempty"`
+	HealthChangedAt     time.Time          `json:"health_changed_at,omitempty"`
+	ConsecutiveFailures int                `json:"consecutive_failures,omitempty"`
+	CooldownLevel       int                `json:"cooldown_level,omitempty"` // 指数退避的级别
+	CooldownUntil       time.Time          `json:"cooldown_until,omitempty"`
+	LastError           string             `json:"last_error,omitempty"`
+	Probing             bool               `json:"-"` // 冷却结束后的半开探测请求正在进行
+}
+
+// accountQuota 账户配额字段的一致快照
+type accountQuota struct {
+	HasQuota  bool
+	Used      float64
+	Total     float64
+	LastCheck float64
+	ResetAt   time.Time
+}
+
+// accountFlags 账户调度状态的一致快照
+type accountFlags struct {
+	Retired  bool
+	Disabled bool
+	Draining bool
+}
+
+// leasable 是否可以分配给新请求
+func (f accountFlags) leasable() bool {
+	return !f.Retired && !f.Disabled && !f.Draining
+}
+
+// PersistedAccountState 持久化的账户运行状态，重启后恢复，避免启动时重新获取所有 JWT
+// 不保存许可证ID、授权信息或明文JWT
+type PersistedAccountState struct {
+	Key                 string                  `json:"key"`                     // sha256(账户标识)
+	EncryptedJWT        string                  `json:"encrypted_jwt,omitempty"` // AES-GCM 加密，未配置密钥时不保存
+	ExpiryTime          time.Time               `json:"expiry_time"`
+	LastUpdated         float64                 `json:"last_updated"`
+	HasQuota            bool                    `json:"has_quota"`
+	LastQuotaCheck      float64                 `json:"last_quota_check"`
+	QuotaUsed           float64                 `json:"quota_used"`
+	QuotaTotal          float64                 `json:"quota_total"`
+	Quota               *JetbrainsQuotaResponse `json:"quota,omitempty"`
+	QuotaFetchedAt      time.Time               `json:"quota_fetched_at,omitempty"`
+	QuotaResetAt        time.Time               `json:"quota_reset_at,omitempty"`
+	Health              AccountHealthState      `json:"health,omitempty"`
+	HealthChangedAt     time.Time               `json:"health_changed_at,omitempty"`
+	ConsecutiveFailures int                     `json:"consecutive_failures,omitempty"`
+	CooldownLevel       int                     `json:"cooldown_level,omitempty"`
+	CooldownUntil       time.Time               `json:"cooldown_until,omitempty"`
+	LastError           string                  `json:"last_error,omitempty"`
+	SavedAt             time.Time               `json:"saved_at"`
+}
+
+// AccountHealthState 账户健康状态
+type AccountHealthState string
+
+// AccountHealthEvent 账户健康状态变化事件
+type AccountHealthEvent struct {
+	Time    time.Time          `json:"time"`
+	Account string             `json:"account"`
+	From    AccountHealthState `json:"from"`
+	To      AccountHealthState `json:"to"`
+	Reason  string             `json:"reason"`
+}
+
+// AccountHealthInfo /api/stats 中的账户健康状态
+type AccountHealthInfo struct {
+	Name                string             `json:"name"`
+	State               AccountHealthState `json:"state"`
+	Since               string             `json:"since,omitempty"`
+	ConsecutiveFailures int                `json:"consecutiveFailures"`
+	CooldownUntil       string             `json:"cooldownUntil,omitempty"`
+	LastError           string             `json:"lastError,omitempty"`
+	Probing             bool               `json:"probing"`
+	InFlight            int32              `json:"inFlight"`
 }
 
 type ModelInfo struct {
@@ -91,6 +194,9 @@ type ModelList struct {
 
 type ModelsConfig struct {
 	Models map[string]string `json:"models"`
+	// Tokenizers 模型 ID (支持通配符) 到 token 计数家族的映射
+	// cl100k/o200k 使用 BPE 词表精确计数，其余家族为启发式估算
+	Tokenizers map[string]string `json:"tokenizers,omitempty"`
 }
 
 type ChatMessage struct {
@@ -122,6 +228,46 @@ type ChatCompletionRequest struct {
 	ToolChoice  any           `json:"tool_choice,omitempty"`
 	Stop        any           `json:"stop,omitempty"`
 	ServiceTier string        `json:"service_tier,omitempty"`
+	// ParallelToolCalls 为 false 时每轮最多返回一个工具调用
+	ParallelToolCalls *bool          `json:"parallel_tool_calls,omitempty"`
+	StreamOptions     *StreamOptions `json:"stream_options,omitempty"`
+}
+
+// CompletionRequest OpenAI 旧版文本补全请求 (/v1/completions)
+type CompletionRequest struct {
+	Model         string         `json:"model"`
+	Prompt        any            `json:"prompt"`
+	Suffix        string         `json:"suffix,omitempty"`
+	MaxTokens     *int           `json:"max_tokens,omitempty"`
+	Temperature   *float64       `json:"temperature,omitempty"`
+	TopP          *float64       `json:"top_p,omitempty"`
+	Stop          any            `json:"stop,omitempty"`
+	Echo          bool           `json:"echo,omitempty"`
+	Stream        bool           `json:"stream"`
+	StreamOptions *StreamOptions `json:"stream_options,omitempty"`
+}
+
+type CompletionChoice struct {
+	Text         string  `json:"text"`
+	Index        int     `json:"index"`
+	Logprobs     any     `json:"logprobs"`
+	FinishReason *string `json:"finish_reason"`
+}
+
+// CompletionResponse 文本补全响应，流式块使用相同结构
+type CompletionResponse struct {
+	ID      string             `json:"id"`
+	Object  string             `json:"object"`
+	Created int64              `json:"created"`
+	Model   string             `json:"model"`
+	Choices []CompletionChoice `json:"choices"`
+	Usage   map[string]int     `json:"usage,omitempty"`
+}
+
+// StreamOptions OpenAI 流式选项
+type StreamOptions struct {
+	// IncludeUsage 为 true 时在 [DONE] 之前发送一个携带 usage 的额外块
+	IncludeUsage bool `json:"include_usage"`
 }
 
 type Tool struct {
@@ -173,6 +319,7 @@ type StreamResponse struct {
 	Created int64          `json:"created"`
 	Model   string         `json:"model"`
 	Choices []StreamChoice `json:"choices"`
+	Usage   map[string]int `json:"usage,omitempty"`
 }
 
 // JetbrainsMessage updated to support v8 API format including tool calls
@@ -315,12 +462,285 @@ type AnthropicMessagesResponse struct {
 
 // 流式响应结构
 type AnthropicStreamResponse struct {
-	Type  string `json:"type"`
-	Index *int   `json:"index,omitempty"`
-	Delta *struct {
-		Type string `json:"type,omitempty"`
-		Text string `json:"text,omitempty"`
-	} `json:"delta,omitempty"`
-	Message *AnthropicMessagesResponse `json:"message,omitempty"`
-	Usage   *AnthropicUsage            `json:"usage,omitempty"`
+	Type         string                       `json:"type"`
+	Index        *int                         `json:"index,omitempty"`
+	ContentBlock *AnthropicStreamContentBlock `json:"content_block,omitempty"`
+	Delta        *AnthropicStreamDelta        `json:"delta,omitempty"`
+	Message      *AnthropicMessagesResponse   `json:"message,omitempty"`
+	Usage        *AnthropicUsage              `json:"usage,omitempty"`
+}
+
+// AnthropicStreamContentBlock content_block_start 事件中的内容块
+type AnthropicStreamContentBlock struct {
+	Type  string  `json:"type"`
+	Text  *string `json:"text,omitempty"`
+	ID    string  `json:"id,omitempty"`
+	Name  string  `json:"name,omitempty"`
+	Input any     `json:"input,omitempty"`
+}
+
+// AnthropicStreamDelta content_block_delta / message_delta 事件中的增量
+type AnthropicStreamDelta struct {
+	Type        string `json:"type,omitempty"`
+	Text        string `json:"text,omitempty"`
+	PartialJSON string `json:"partial_json,omitempty"`
+	StopReason  string `json:"stop_reason,omitempty"`
+}
+
+// ResponsesRequest OpenAI Responses API 请求 (/v1/responses)
+type ResponsesRequest struct {
+	Model              string            `json:"model"`
+	Input              any               `json:"input"`
+	Instructions       string            `json:"instructions,omitempty"`
+	PreviousResponseID string            `json:"previous_response_id,omitempty"`
+	Tools              []ResponsesTool   `json:"tools,omitempty"`
+	ToolChoice         any               `json:"tool_choice,omitempty"`
+	ParallelToolCalls  *bool             `json:"parallel_tool_calls,omitempty"`
+	MaxOutputTokens    *int              `json:"max_output_tokens,omitempty"`
+	Temperature        *float64          `json:"temperature,omitempty"`
+	TopP               *float64          `json:"top_p,omitempty"`
+	Stream             bool              `json:"stream"`
+	Store              *bool             `json:"store,omitempty"`
+	Metadata           map[string]string `json:"metadata,omitempty"`
+}
+
+// ResponsesTool Responses API 的工具定义 (函数字段位于顶层)
+type ResponsesTool struct {
+	Type        string         `json:"type"`
+	Name        string         `json:"name,omitempty"`
+	Description string         `json:"description,omitempty"`
+	Parameters  map[string]any `json:"parameters,omitempty"`
+	Strict      *bool          `json:"strict,omitempty"`
+}
+
+// ResponseObject Responses API 响应对象
+type ResponseObject struct {
+	ID                 string            `json:"id"`
+	Object             string            `json:"object"`
+	CreatedAt          int64             `json:"created_at"`
+	Status             string            `json:"status"`
+	Model              string            `json:"model"`
+	Output             []any             `json:"output"`
+	Instructions       *string           `json:"instructions"`
+	PreviousResponseID *string           `json:"previous_response_id"`
+	Tools              []ResponsesTool   `json:"tools"`
+	ToolChoice         any               `json:"tool_choice"`
+	ParallelToolCalls  bool              `json:"parallel_tool_calls"`
+	MaxOutputTokens    *int              `json:"max_output_tokens"`
+	Store              bool              `json:"store"`
+	Metadata           map[string]string `json:"metadata"`
+	Usage              *ResponseUsage    `json:"usage"`
+	Error              any               `json:"error"`
+	IncompleteDetails  any               `json:"incomplete_details"`
+}
+
+type ResponseUsage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+	TotalTokens  int `json:"total_tokens"`
+}
+
+// ResponseOutputMessage 助手消息输出项
+type ResponseOutputMessage struct {
+	Type    string               `json:"type"`
+	ID      string               `json:"id"`
+	Status  string               `json:"status"`
+	Role    string               `json:"role"`
+	Content []ResponseOutputText `json:"content"`
+}
+
+type ResponseOutputText struct {
+	Type        string `json:"type"`
+	Text        string `json:"text"`
+	Annotations []any  `json:"annotations"`
+}
+
+// ResponseFunctionCall 函数调用输出项
+type ResponseFunctionCall struct {
+	Type      string `json:"type"`
+	ID        string `json:"id"`
+	CallID    string `json:"call_id"`
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"`
+	Status    string `json:"status"`
+}
+
+// StoredResponse 服务端保存的响应，用于 previous_response_id 续接和查询
+type StoredResponse struct {
+	Response ResponseObject `json:"response"`
+	// Messages 截至该响应的完整对话 (不含 instructions)
+	Messages []ChatMessage `json:"messages"`
+	// Owner 创建该响应的客户端密钥标识 (clientKeyID)，其他密钥无法读取、续接或删除
+	Owner string `json:"owner"`
+}
+
+// GeminiGenerateContentRequest Gemini generateContent 请求
+type GeminiGenerateContentRequest struct {
+	Contents          []GeminiContent         `json:"contents"`
+	SystemInstruction *GeminiContent          `json:"systemInstruction,omitempty"`
+	Tools             []GeminiTool            `json:"tools,omitempty"`
+	ToolConfig        any                     `json:"toolConfig,omitempty"`
+	GenerationConfig  *GeminiGenerationConfig `json:"generationConfig,omitempty"`
+}
+
+type GeminiContent struct {
+	Role  string       `json:"role,omitempty"`
+	Parts []GeminiPart `json:"parts"`
+}
+
+type GeminiPart struct {
+	Text             string                  `json:"text,omitempty"`
+	Thought          bool                    `json:"thought,omitempty"`
+	InlineData       *GeminiInlineData       `json:"inlineData,omitempty"`
+	FunctionCall     *GeminiFunctionCall     `json:"functionCall,omitempty"`
+	FunctionResponse *GeminiFunctionResponse `json:"functionResponse,omitempty"`
+}
+
+type GeminiInlineData struct {
+	MimeType string `json:"mimeType"`
+	Data     string `json:"data"`
+}
+
+type GeminiFunctionCall struct {
+	ID   string         `json:"id,omitempty"`
+	Name string         `json:"name"`
+	Args map[string]any `json:"args"`
+}
+
+type GeminiFunctionResponse struct {
+	ID       string         `json:"id,omitempty"`
+	Name     string         `json:"name"`
+	Response map[string]any `json:"response"`
+}
+
+type GeminiTool struct {
+	FunctionDeclarations []GeminiFunctionDeclaration `json:"functionDeclarations,omitempty"`
+}
+
+type GeminiFunctionDeclaration struct {
+	Name                 string         `json:"name"`
+	Description          string         `json:"description,omitempty"`
+	Parameters           map[string]any `json:"parameters,omitempty"`
+	ParametersJSONSchema map[string]any `json:"parametersJsonSchema,omitempty"`
+}
+
+type GeminiGenerationConfig struct {
+	Temperature     *float64 `json:"temperature,omitempty"`
+	TopP            *float64 `json:"topP,omitempty"`
+	TopK            *int     `json:"topK,omitempty"`
+	MaxOutputTokens *int     `json:"maxOutputTokens,omitempty"`
+	StopSequences   []string `json:"stopSequences,omitempty"`
+}
+
+// GeminiGenerateContentResponse Gemini 响应，流式块使用相同结构
+type GeminiGenerateContentResponse struct {
+	Candidates    []GeminiCandidate    `json:"candidates"`
+	UsageMetadata *GeminiUsageMetadata `json:"usageMetadata,omitempty"`
+	ModelVersion  string               `json:"modelVersion,omitempty"`
+	ResponseID    string               `json:"responseId,omitempty"`
+}
+
+type GeminiCandidate struct {
+	Content      GeminiContent `json:"content"`
+	FinishReason string        `json:"finishReason,omitempty"`
+	Index        int           `json:"index"`
+}
+
+type GeminiUsageMetadata struct {
+	PromptTokenCount     int `json:"promptTokenCount"`
+	CandidatesTokenCount int `json:"candidatesTokenCount"`
+	TotalTokenCount      int `json:"totalTokenCount"`
+}
+
+// ClientKey 客户端 API 密钥及其访问策略
+type ClientKey struct {
+	Key               string    `json:"key"`
+	Name              string    `json:"name"`
+	Owner             string    `json:"owner,omitempty"`
+	Models            []string  `json:"models,omitempty"`              // 允许的模型，支持通配符，为空表示不限制
+	MaxRequestBytes   int64     `json:"max_request_bytes,omitempty"`   // 0 表示不限制
+	RequestsPerMinute int       `json:"requests_per_minute,omitempty"` // 0 表示使用默认限额
+	TokensPerMinute   int       `json:"tokens_per_minute,omitempty"`   // 0 表示使用默认限额
+	ExpiresAt         string    `json:"expires_at,omitempty"`          // RFC3339 或 YYYY-MM-DD
+	Enabled           *bool     `json:"enabled,omitempty"`             // 省略时视为启用
+	Expiry            time.Time `json:"-"`
+}
+
+// ClientKeysFile 客户端密钥注册文件格式
+type ClientKeysFile struct {
+	Keys []ClientKey `json:"keys"`
+}
+
+// RuntimeConfig 可热更新的配置快照，热更新时整体替换，不会原地修改
+type RuntimeConfig struct {
+	ModelsData   ModelsData
+	ModelsConfig ModelsConfig
+	ClientKeys   map[string]*ClientKey
+	AdminAPIKey  string
+	// AccountSelector 账户选择策略 (ACCOUNT_SELECTION_STRATEGY)，策略不变时热更新沿用原实例
+	AccountSelector AccountSelector
+}
+
+// AdminAccountRequest 管理接口添加或修改账户的请求体
+// 添加时提供 license_id + authorization (许可证账户) 或 jwt (静态JWT账户)
+type AdminAccountRequest struct {
+	LicenseID     string `json:"license_id,omitempty"`
+	Authorization string `json:"authorization,omitempty"`
+	JWT           string `json:"jwt,omitempty"`
+	Disabled      *bool  `json:"disabled,omitempty"`
+	Draining      *bool  `json:"draining,omitempty"`
+	Weight        *int   `json:"weight,omitempty"`
+}
+
+// AdminAccountView 管理接口返回的账户信息 (不包含授权信息和 JWT)
+type AdminAccountView struct {
+	ID             string  `json:"id"`
+	Name           string  `json:"name"`
+	Type           string  `json:"type"`
+	LicenseID      string  `json:"license_id,omitempty"`
+	Status         string  `json:"status"`
+	HasJWT         bool    `json:"has_jwt"`
+	HasQuota       bool    `json:"has_quota"`
+	ExpiryTime     string  `json:"expiry_time,omitempty"`
+	LastQuotaCheck string  `json:"last_quota_check,omitempty"`
+	InFlight       int32   `json:"in_flight"`
+	Weight         int     `json:"weight"`
+	QuotaUsed      float64 `json:"quota_used"`
+	QuotaTotal     float64 `json:"quota_total"`
+	QuotaResetAt   string  `json:"quota_reset_at,omitempty"`
+	Disabled       bool    `json:"disabled"`
+	Draining       bool    `json:"draining"`
+	Health         string  `json:"health"`
+	CooldownUntil  string  `json:"cooldown_until,omitempty"`
+	LastError      string  `json:"last_error,omitempty"`
+	RefreshError   string  `json:"refresh_error,omitempty"`
+}
+
+// AuditRecord 一次客户端请求的审计记录，每条记录是审计文件中的一行 JSON
+// 请求体和响应体是合法 JSON 时原样保存，否则 (如 SSE 流) 保存为字符串
+type AuditRecord struct {
+	ID               string            `json:"id"` // 请求ID
+	Time             time.Time         `json:"time"`
+	DurationMs       int64             `json:"duration_ms"`
+	Method           string            `json:"method"`
+	Path             string            `json:"path"`
+	Query            string            `json:"query,omitempty"`
+	Headers          map[string]string `json:"headers,omitempty"` // 不包含认证请求头
+	Client           string            `json:"client,omitempty"`
+	Model            string            `json:"model,omitempty"`
+	Account          string            `json:"account,omitempty"` // 账户 ID
+	Status           int               `json:"status"`
+	Request          json.RawMessage   `json:"request,omitempty"`
+	UpstreamPayload  json.RawMessage   `json:"upstream_payload,omitempty"`
+	UpstreamAttempts []AuditAttempt    `json:"upstream_attempts,omitempty"`
+	UpstreamLines    []string          `json:"upstream_lines,omitempty"` // 最后一次尝试的上游 SSE 行
+	Response         json.RawMessage   `json:"response,omitempty"`
+	Truncated        bool              `json:"truncated,omitempty"` // 有内容超过 AUDIT_MAX_BODY_BYTES 被截断
+}
+
+// AuditAttempt 一次上游尝试
+type AuditAttempt struct {
+	Account string `json:"account"`
+	Status  int    `json:"status,omitempty"`
+	Error   string `json:"error,omitempty"`
 }
@@ -87,8 +87,10 @@ func RecordHTTPError() {
 	httpErrorsVar.Add(1)
 }
 
-// RecordCacheHit 记录缓存命中
-func RecordCacheHit() {
+// RecordCacheHit 记录缓存命中，cache 为缓存名称
+func RecordCacheHit(cache string) {
+	cacheRequestsTotal.Inc(cache, "hit")
+
 	metrics.mu.Lock()
 	defer metrics.mu.Unlock()
 
@@ -103,8 +105,10 @@ func RecordCacheHit() {
 	cacheHitsVar.Add(1)
 }
 
-// RecordCacheMiss 记录缓存未命中
-func RecordCacheMiss() {
+// RecordCacheMiss 记录缓存未命中，cache 为缓存名称
+func RecordCacheMiss(cache string) {
+	cacheRequestsTotal.Inc(cache, "miss")
+
 	metrics.mu.Lock()
 	defer metrics.mu.Unlock()
 
@@ -137,6 +141,8 @@ func RecordToolValidation(duration time.Duration) {
 
 // RecordAccountPoolWait 记录账户池等待
 func RecordAccountPoolWait(duration time.Duration) {
+	accountPoolWait.ObserveDuration(duration)
+
 	metrics.mu.Lock()
 	defer metrics.mu.Unlock()
 
@@ -145,6 +151,8 @@ func RecordAccountPoolWait(duration time.Duration) {
 
 // RecordAccountPoolError 记录账户池错误
 func RecordAccountPoolError() {
+	accountPoolErrorsTotal.Inc()
+
 	metrics.mu.Lock()
 	defer metrics.mu.Unlock()
 
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+const rateLimitRedisKeyPrefix = "jetbrainsai2api:ratelimit:"
+
+// rateLimitStatus 一次令牌桶操作后的桶状态
+type rateLimitStatus struct {
+	Allowed    bool
+	Limit      int
+	Remaining  int
+	Reset      time.Duration // 桶重新装满所需时间
+	RetryAfter time.Duration // 被拒绝时需要等待的时间
+}
+
+// RateLimiter 令牌桶限流器，容量为每分钟的额度，按每分钟额度匀速补充
+type RateLimiter interface {
+	// Take 从桶中取出 cost 个令牌；force 为 true 时总是扣除 (允许透支，用于请求完成后结算 token 用量)
+	Take(bucket string, limit int, cost float64, force bool) (rateLimitStatus, error)
+}
+
+// rateLimiter 默认使用内存令牌桶，配置 Redis 时在多实例之间共享
+var rateLimiter RateLimiter = NewMemoryRateLimiter()
+
+// defaultRequestsPerMinute/defaultTokensPerMinute 未单独配置的密钥使用的限额，0 表示不限制
+var (
+	defaultRequestsPerMinute int
+	defaultTokensPerMinute   int
+)
+
+// loadRateLimitConfig loads the default per-key limits from environment variables
+func loadRateLimitConfig() {
+	defaultRequestsPerMinute = parseRateLimitEnv("RATE_LIMIT_REQUESTS_PER_MINUTE")
+	defaultTokensPerMinute = parseRateLimitEnv("RATE_LIMIT_TOKENS_PER_MINUTE")
+	if defaultRequestsPerMinute > 0 || defaultTokensPerMinute > 0 {
+		Info("Default client rate limits: %d requests/min, %d tokens/min", defaultRequestsPerMinute, defaultTokensPerMinute)
+	}
+}
+
+// parseRateLimitEnv parses a non-negative limit, invalid values disable the limit
+func parseRateLimitEnv(name string) int {
+	value := getEnvWithDefault(name, "0")
+	limit, err := strconv.Atoi(value)
+	if err != nil || limit < 0 {
+		Warn("Invalid %s=%q, rate limit disabled", name, value)
+		return 0
+	}
+	return limit
+}
+
+// refillBucket 计算补充后的令牌数并执行取令牌操作
+// DRY: 内存和 Redis 实现共用的令牌桶算法 (Redis 版本在 Lua 脚本中实现相同逻辑)
+func refillBucket(tokens float64, elapsed time.Duration, limit int, cost float64, force bool) (float64, bool) {
+	rate := float64(limit) / float64(time.Minute)
+	tokens = math.Min(float64(limit), tokens+float64(elapsed)*rate)
+	if force || tokens >= cost {
+		return tokens - cost, true
+	}
+	return tokens, false
+}
+
+// newRateLimitStatus 根据桶中剩余的令牌数计算状态
+func newRateLimitStatus(tokens float64, limit int, cost float64, allowed bool) rateLimitStatus {
+	perToken := float64(time.Minute) / float64(limit)
+	status := rateLimitStatus{
+		Allowed:   allowed,
+		Limit:     limit,
+		Remaining: int(math.Max(0, math.Floor(tokens))),
+		Reset:     time.Duration(math.Max(0, float64(limit)-tokens) * perToken),
+	}
+	if !allowed {
+		status.RetryAfter = time.Duration(math.Max(0, cost-tokens) * perToken)
+	}
+	return status
+}
+
+// MemoryRateLimiter keeps token buckets in process memory
+type MemoryRateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*memoryBucket
+}
+
+type memoryBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+func NewMemoryRateLimiter() *MemoryRateLimiter {
+	return &MemoryRateLimiter{buckets: make(map[string]*memoryBucket)}
+}
+
+func (ml *MemoryRateLimiter) Take(bucket string, limit int, cost float64, force bool) (rateLimitStatus, error) {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+
+	now := time.Now()
+	state, ok := ml.buckets[bucket]
+	if !ok {
+		state = &memoryBucket{tokens: float64(limit), updated: now}
+		ml.buckets[bucket] = state
+	}
+
+	tokens, allowed := refillBucket(state.tokens, now.Sub(state.updated), limit, cost, force)
+	state.tokens, state.updated = tokens, now
+	return newRateLimitStatus(tokens, limit, cost, allowed), nil
+}
+
+// redisTokenBucketScript 原子地执行 refillBucket，令牌数以字符串返回以保留小数
+var redisTokenBucketScript = redis.NewScript(`
+local limit = tonumber(ARGV[1])
+local now = tonumber(ARGV[2])
+local cost = tonumber(ARGV[3])
+local force = ARGV[4] == "1"
+local rate = limit / 60000
+
+local state = redis.call("HMGET", KEYS[1], "tokens", "updated")
+local tokens = tonumber(state[1]) or limit
+local updated = tonumber(state[2]) or now
+tokens = math.min(limit, tokens + math.max(0, now - updated) * rate)
+
+local allowed = 0
+if force or tokens >= cost then
+	tokens = tokens - cost
+	allowed = 1
+end
+
+redis.call("HSET", KEYS[1], "tokens", tostring(tokens), "updated", now)
+redis.call("PEXPIRE", KEYS[1], math.ceil((limit - tokens) / rate) + 1000)
+return {allowed, tostring(tokens)}
+`)
+
+// RedisRateLimiter shares token buckets between instances through Redis
+type RedisRateLimiter struct {
+	client *redis.Client
+	ctx    context.Context
+}
+
+func NewRedisRateLimiter(rs *RedisStorage) *RedisRateLimiter {
+	return &RedisRateLimiter{client: rs.client, ctx: rs.ctx}
+}
+
+func (rl *RedisRateLimiter) Take(bucket string, limit int, cost float64, force bool) (rateLimitStatus, error) {
+	forceArg := "0"
+	if force {
+		forceArg = "1"
+	}
+	result, err := redisTokenBucketScript.Run(rl.ctx, rl.client, []string{rateLimitRedisKeyPrefix + bucket},
+		limit, time.Now().UnixMilli(), cost, forceArg).Slice()
+	if err != nil {
+		return rateLimitStatus{}, err
+	}
+	if len(result) != 2 {
+		return rateLimitStatus{}, fmt.Errorf("unexpected rate limit script result: %v", result)
+	}
+
+	allowed, _ := result[0].(int64)
+	tokensStr, _ := result[1].(string)
+	tokens, err := strconv.ParseFloat(tokensStr, 64)
+	if err != nil {
+		return rateLimitStatus{}, fmt.Errorf("invalid token count %q: %w", tokensStr, err)
+	}
+	return newRateLimitStatus(tokens, limit, cost, allowed == 1), nil
+}
+
+// clientRateLimits 返回密钥的每分钟请求数和 token 数限额
+func clientRateLimits(key *ClientKey) (int, int) {
+	requests, tokens := key.RequestsPerMinute, key.TokensPerMinute
+	if requests == 0 {
+		requests = defaultRequestsPerMinute
+	}
+	if tokens == 0 {
+		tokens = defaultTokensPerMinute
+	}
+	return requests, tokens
+}
+
+// clientBucketID 令牌桶标识，使用密钥哈希避免在 Redis 中保存明文密钥
+func clientBucketID(key *ClientKey, kind string) string {
+	return clientKeyID(key.Key) + ":" + kind
+}
+
+// takeRateLimit 执行一次限流操作，后端出错时放行 (fail open)
+func takeRateLimit(bucket string, limit int, cost float64, force bool) rateLimitStatus {
+	status, err := rateLimiter.Take(bucket, limit, cost, force)
+	if err != nil {
+		Warn("Rate limiter error, allowing request: %v", err)
+		return rateLimitStatus{Allowed: true, Limit: limit, Remaining: limit}
+	}
+	return status
+}
+
+// rateLimitClient 客户端限流中间件，必须在 authenticateClient 之后执行
+// 请求数在请求开始时扣除；token 用量在响应完成后结算，桶透支时拒绝后续请求直到补充
+func rateLimitClient(c *gin.Context) {
+	key := currentClientKey(c)
+	if key == nil {
+		return
+	}
+	requestLimit, tokenLimit := clientRateLimits(key)
+
+	var rejected *rateLimitStatus
+	if tokenLimit > 0 {
+		// 只检查是否透支，不扣除
+		status := takeRateLimit(clientBucketID(key, "tokens"), tokenLimit, 0, false)
+		setRateLimitHeaders(c, "tokens", status)
+		if !status.Allowed {
+			rejected = &status
+		}
+	}
+	if requestLimit > 0 {
+		// token 额度已透支时只读取请求桶状态，不扣除请求数
+		cost := 1.0
+		if rejected != nil {
+			cost = 0
+		}
+		status := takeRateLimit(clientBucketID(key, "requests"), requestLimit, cost, false)
+		setRateLimitHeaders(c, "requests", status)
+		if !status.Allowed {
+			rejected = &status
+		}
+	}
+
+	if rejected != nil {
+		retryAfter := int(math.Ceil(rejected.RetryAfter.Seconds()))
+		c.Header("Retry-After", strconv.Itoa(max(1, retryAfter)))
+		message := fmt.Sprintf("Rate limit exceeded for client API key %s, retry after %d seconds", key.Name, max(1, retryAfter))
+		recordFailureWithTimer(time.Now(), "", "", key.Name)
+		switch {
+		case strings.HasPrefix(c.FullPath(), "/v1/messages"):
+			respondWithAnthropicError(c, http.StatusTooManyRequests, "rate_limit_error", message)
+		case isGeminiRoute(c):
+			respondWithGeminiError(c, http.StatusTooManyRequests, message)
+		default:
+			respondWithError(c, http.StatusTooManyRequests, message)
+		}
+		c.Abort()
+	}
+}
+
+// setRateLimitHeaders 设置 OpenAI 风格的 x-ratelimit-* 响应头
+func setRateLimitHeaders(c *gin.Context, kind string, status rateLimitStatus) {
+	c.Header("x-ratelimit-limit-"+kind, strconv.Itoa(status.Limit))
+	c.Header("x-ratelimit-remaining-"+kind, strconv.Itoa(status.Remaining))
+	c.Header("x-ratelimit-reset-"+kind, formatRateLimitReset(status.Reset))
+}
+
+// formatRateLimitReset 按 OpenAI 的格式输出重置时间，例如 "1s"、"6m0s"、"20ms"
+func formatRateLimitReset(d time.Duration) string {
+	if d < time.Second {
+		return strconv.FormatInt(d.Milliseconds(), 10) + "ms"
+	}
+	return d.Round(time.Second).String()
+}
+
+// chargeClientTokens 请求完成后按实际用量扣除 token 额度
+func chargeClientTokens(c *gin.Context, usage tokenUsage) {
+	key := currentClientKey(c)
+	if key == nil {
+		return
+	}
+	if _, tokenLimit := clientRateLimits(key); tokenLimit > 0 {
+		takeRateLimit(clientBucketID(key, "tokens"), tokenLimit, float64(usage.PromptTokens+usage.CompletionTokens), true)
+	}
+}
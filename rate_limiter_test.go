@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMemoryRateLimiter_TokenBucket(t *testing.T) {
+	limiter := NewMemoryRateLimiter()
+
+	for i := 0; i < 2; i++ {
+		if status, _ := limiter.Take("k", 2, 1, false); !status.Allowed || status.Remaining != 1-i {
+			t.Fatalf("request %d should be allowed, got %+v", i, status)
+		}
+	}
+	status, _ := limiter.Take("k", 2, 1, false)
+	if status.Allowed || status.RetryAfter <= 29*time.Second || status.RetryAfter > 30*time.Second {
+		t.Errorf("third request should wait about 30s for a refill, got %+v", status)
+	}
+
+	// 强制扣除允许透支，透支期间 cost 为 0 的检查也会被拒绝
+	limiter.Take("t", 100, 250, true)
+	if status, _ := limiter.Take("t", 100, 0, false); status.Allowed || status.Remaining != 0 || status.Reset < time.Minute {
+		t.Errorf("overdrawn bucket should be rejected, got %+v", status)
+	}
+}
+
+func TestRateLimitClient_Headers(t *testing.T) {
+	_, router := setupFakeUpstream(t, DefaultFakeGrazieOptions())
+	oldLimiter := rateLimiter
+	rateLimiter = NewMemoryRateLimiter()
+	t.Cleanup(func() { rateLimiter = oldLimiter })
+	currentConfig().ClientKeys[testClientKey].RequestsPerMinute = 1
+
+	body := `{"model":"test-model","messages":[{"role":"user","content":"hi"}]}`
+	w := doProxyRequest(router, "/v1/chat/completions", body)
+	if w.Code != http.StatusOK {
+		t.Fatalf("first request should pass, got %d: %s", w.Code, w.Body.String())
+	}
+	if w.Header().Get("x-ratelimit-limit-requests") != "1" || w.Header().Get("x-ratelimit-remaining-requests") != "0" ||
+		w.Header().Get("x-ratelimit-reset-requests") != "1m0s" {
+		t.Errorf("unexpected rate limit headers: %v", w.Header())
+	}
+
+	w = doProxyRequest(router, "/v1/chat/completions", body)
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" || !strings.Contains(w.Body.String(), "Rate limit exceeded") {
+		t.Errorf("second request should be limited, got %d %v: %s", w.Code, w.Header(), w.Body.String())
+	}
+	w = doProxyRequest(router, "/v1/messages", `{"model":"test-model","max_tokens":10,"messages":[{"role":"user","content":"hi"}]}`)
+	if w.Code != http.StatusTooManyRequests || !strings.Contains(w.Body.String(), `"rate_limit_error"`) {
+		t.Errorf("Anthropic endpoint should answer with rate_limit_error, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestRateLimitClient_TokenLimit(t *testing.T) {
+	_, router := setupFakeUpstream(t, DefaultFakeGrazieOptions())
+	oldLimiter := rateLimiter
+	rateLimiter = NewMemoryRateLimiter()
+	t.Cleanup(func() { rateLimiter = oldLimiter })
+	currentConfig().ClientKeys[testClientKey].TokensPerMinute = 5
+
+	// 第一次请求的用量超过额度，结算后桶透支，下一次请求被拒绝
+	body := `{"model":"test-model","messages":[{"role":"user","content":"tell me a long story about the sea"}]}`
+	if w := doProxyRequest(router, "/v1/chat/completions", body); w.Code != http.StatusOK {
+		t.Fatalf("first request should pass, got %d: %s", w.Code, w.Body.String())
+	}
+	w := doProxyRequest(router, "/v1/chat/completions", body)
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("x-ratelimit-remaining-tokens") != "0" {
+		t.Errorf("overdrawn token budget should be limited, got %d %v", w.Code, w.Header())
+	}
+}
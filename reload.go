@@ -0,0 +1,463 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"reflect"
+	"slices"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/joho/godotenv"
+)
+
+// runtimeConfig 当前生效的配置快照
+// 处理中的请求持有旧快照中的对象 (模型列表、密钥)，热更新只替换指针，不修改旧快照
+var runtimeConfig atomic.Pointer[RuntimeConfig]
+
+// reloadMutex 保证同一时间只有一次热更新
+var reloadMutex sync.Mutex
+
+// systemEnvKeys 启动时进程环境中已有的变量，.env 不会覆盖它们 (与 godotenv.Load 的行为一致)
+// dotenvKeys 上一次从 .env 设置的变量
+var (
+	systemEnvKeys map[string]bool
+	dotenvKeys    map[string]bool
+)
+
+// currentConfig 返回当前配置快照
+func currentConfig() *RuntimeConfig {
+	if cfg := runtimeConfig.Load(); cfg != nil {
+		return cfg
+	}
+	return &RuntimeConfig{}
+}
+
+// setRuntimeConfig 原子地替换配置快照
+func setRuntimeConfig(cfg *RuntimeConfig) {
+	runtimeConfig.Store(cfg)
+}
+
+// loadDotenv 加载 .env 文件，并记录哪些变量来自 .env 以便热更新时重新读取
+func loadDotenv() error {
+	systemEnvKeys = make(map[string]bool)
+	for _, entry := range os.Environ() {
+		for i := 0; i < len(entry); i++ {
+			if entry[i] == '=' {
+				systemEnvKeys[entry[:i]] = true
+				break
+			}
+		}
+	}
+	if _, err := os.Stat(".env"); err != nil {
+		return err
+	}
+	return reloadDotenv()
+}
+
+// reloadDotenv 重新读取 .env，更新 (或删除) 之前由 .env 设置的变量，文件不存在时视为空
+func reloadDotenv() error {
+	values, err := godotenv.Read()
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("error reading .env: %w", err)
+	}
+
+	loaded := make(map[string]bool)
+	for key, value := range values {
+		if systemEnvKeys[key] {
+			continue
+		}
+		os.Setenv(key, value)
+		loaded[key] = true
+	}
+	for key := range dotenvKeys {
+		if !loaded[key] {
+			os.Unsetenv(key)
+		}
+	}
+	dotenvKeys = loaded
+	return nil
+}
+
+// loadRuntimeConfig 读取 models.json、客户端密钥和管理密钥
+// 出错时仍返回能加载的部分，由调用方决定是否使用
+func loadRuntimeConfig() (*RuntimeConfig, error) {
+	modelsConfig, modelsData, modelsErr := loadModels()
+	clientKeys, keysErr := loadClientAPIKeys()
+	selector, selectorErr := newAccountSelector(os.Getenv("ACCOUNT_SELECTION_STRATEGY"))
+	if selectorErr != nil {
+		selector = defaultAccountSelector
+	}
+	cfg := &RuntimeConfig{
+		ModelsData:      modelsData,
+		ModelsConfig:    modelsConfig,
+		ClientKeys:      clientKeys,
+		AdminAPIKey:     os.Getenv("ADMIN_API_KEY"),
+		AccountSelector: selector,
+	}
+	return cfg, errors.Join(modelsErr, keysErr, selectorErr)
+}
+
+// reloadRuntimeConfig 重新加载配置并原子地替换，返回变更列表
+// 新配置验证失败时保留旧配置；正在处理的请求 (包括流式会话) 继续使用旧的模型、密钥和账户对象
+func reloadRuntimeConfig(trigger string) ([]string, error) {
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+
+	Info("Reloading configuration (%s)", trigger)
+	if err := reloadDotenv(); err != nil {
+		Error("Configuration reload failed: %v", err)
+		return nil, err
+	}
+
+	cfg, err := loadRuntimeConfig()
+	if err == nil && len(cfg.ClientKeys) == 0 {
+		err = errors.New("new configuration has no client API keys")
+	}
+	if err != nil {
+		Error("Configuration reload failed, keeping the current configuration: %v", err)
+		return nil, err
+	}
+
+	// 账户环境变量没有变化时不重新读取账户
+	envValues := accountEnvValues()
+	envChanged := !slices.Equal(envValues, accountSource.envValues)
+	var envAccounts []*JetbrainsAccount
+	if envChanged {
+		envAccounts = loadJetbrainsAccounts()
+	}
+
+	oldCfg := currentConfig()
+	if oldCfg.AccountSelector != nil && oldCfg.AccountSelector.Name() == cfg.AccountSelector.Name() {
+		// 策略不变时保留轮询位置
+		cfg.AccountSelector = oldCfg.AccountSelector
+	}
+	changes := diffRuntimeConfig(oldCfg, cfg)
+
+	// 在账户锁内合并，避免覆盖热更新期间通过管理接口所做的修改
+	err = updateJetbrainsAccounts(func(current []*JetbrainsAccount) ([]*JetbrainsAccount, error) {
+		accounts := current
+		if envChanged {
+			accounts = mergeEnvAccounts(current, envAccounts)
+		}
+		if len(accounts) == 0 {
+			return nil, errors.New("new configuration has no JetBrains accounts")
+		}
+		if envChanged {
+			accountSource.recordEnv(envValues, envAccounts)
+		}
+		changes = append(changes, diffAccounts(current, accounts)...)
+		return accounts, nil
+	})
+	if err != nil {
+		Error("Configuration reload failed, keeping the current configuration: %v", err)
+		return nil, err
+	}
+	setRuntimeConfig(cfg)
+
+	if len(changes) == 0 {
+		Info("Configuration reloaded (%s): no changes", trigger)
+	} else {
+		Info("Configuration reloaded (%s): %d changes", trigger, len(changes))
+		for _, change := range changes {
+			Info("  %s", change)
+		}
+	}
+	return changes, nil
+}
+
+// accountIdentity 账户的稳定标识，用于热更新时匹配新旧账户
+func accountIdentity(account *JetbrainsAccount) string {
+	if account.LicenseID != "" {
+		return "license:" + account.LicenseID
+	}
+	return "jwt:" + account.JWT
+}
+
+// accountEnvVars 定义 JetBrains 账户的环境变量，热更新时只有它们变化才重新读取账户
+var accountEnvVars = []string{
+	"JETBRAINS_LICENSE_IDS", "JETBRAINS_AUTHORIZATIONS", "JETBRAINS_LICENSE_WEIGHTS",
+	"JETBRAINS_JWTS", "JETBRAINS_JWT_WEIGHTS",
+}
+
+// accountEnvValues 返回账户环境变量的当前值
+func accountEnvValues() []string {
+	values := make([]string, len(accountEnvVars))
+	for i, name := range accountEnvVars {
+		values[i] = os.Getenv(name)
+	}
+	return values
+}
+
+// envAccountDef 环境变量中账户的定义，用于判断热更新时环境变量是否修改了该账户
+type envAccountDef struct {
+	authorization string
+	weight        int
+}
+
+// accountSources 记录账户来自环境变量还是管理接口
+// 由 accountsMutex 保护 (envValues 只在启动和持有 reloadMutex 的热更新中修改)
+type accountSources struct {
+	envValues []string                 // 上次读取账户时的环境变量值
+	env       map[string]envAccountDef // 上次从环境变量读取的账户定义 (按 accountIdentity)
+	added     map[string]bool          // 通过管理接口添加的账户
+	deleted   map[string]bool          // 通过管理接口删除的环境变量账户
+}
+
+// accountSource 热更新重新读取环境变量时，据此保留管理接口添加、删除和修改的账户
+var accountSource accountSources
+
+// recordEnv 记录从环境变量读取的账户，环境变量中已不存在的账户不再保留删除标记
+func (s *accountSources) recordEnv(values []string, accounts []*JetbrainsAccount) {
+	s.envValues = values
+	s.env = make(map[string]envAccountDef, len(accounts))
+	for _, account := range accounts {
+		s.env[accountIdentity(account)] = envAccountDef{account.Authorization, accountWeight(account)}
+	}
+	for identity := range s.deleted {
+		if _, ok := s.env[identity]; !ok {
+			delete(s.deleted, identity)
+		}
+	}
+}
+
+// markAdded 记录通过管理接口添加的账户
+func (s *accountSources) markAdded(account *JetbrainsAccount) {
+	identity := accountIdentity(account)
+	if s.added == nil {
+		s.added = make(map[string]bool)
+	}
+	s.added[identity] = true
+	delete(s.deleted, identity)
+}
+
+// markDeleted 记录通过管理接口删除的账户，热更新不会从环境变量中恢复它
+func (s *accountSources) markDeleted(account *JetbrainsAccount) {
+	identity := accountIdentity(account)
+	delete(s.added, identity)
+	if _, ok := s.env[identity]; ok {
+		if s.deleted == nil {
+			s.deleted = make(map[string]bool)
+		}
+		s.deleted[identity] = true
+	}
+}
+
+// loadAccountsFromEnv 启动时读取环境变量中的账户并记录其来源
+func loadAccountsFromEnv() []*JetbrainsAccount {
+	accounts := loadJetbrainsAccounts()
+	accountSource.recordEnv(accountEnvValues(), accounts)
+	return accounts
+}
+
+// mergeEnvAccounts 账户环境变量变化后，将重新读取的账户与当前账户合并，调用方持有 accountsMutex
+//   - 管理接口删除的账户不会恢复，管理接口添加的账户继续保留
+//   - 环境变量中定义未变的账户沿用当前对象，保留管理接口修改的授权信息和权重
+//   - 定义变化的账户：授权信息相同时沿用当前对象 (保留 JWT、配额、停用/排空状态和正在处理的请求计数) 并使用新权重，
+//     授权信息变化时使用新对象重新获取 JWT
+//   - 从环境变量中删除的账户被移除
+func mergeEnvAccounts(current, envAccounts []*JetbrainsAccount) []*JetbrainsAccount {
+	existing := make(map[string]*JetbrainsAccount, len(current))
+	for _, account := range current {
+		existing[accountIdentity(account)] = account
+	}
+
+	merged := make([]*JetbrainsAccount, 0, len(envAccounts)+len(accountSource.added))
+	listed := make(map[string]bool, len(envAccounts))
+	for _, account := range envAccounts {
+		identity := accountIdentity(account)
+		listed[identity] = true
+		if accountSource.deleted[identity] {
+			continue
+		}
+		old, ok := existing[identity]
+		previous, wasListed := accountSource.env[identity]
+		switch {
+		case !ok:
+			merged = append(merged, account)
+		case wasListed && previous == envAccountDef{account.Authorization, accountWeight(account)}:
+			merged = append(merged, old)
+		case accountAuthorization(old) == account.Authorization:
+			setAccountWeight(old, account.Weight)
+			merged = append(merged, old)
+		default:
+			merged = append(merged, account)
+		}
+	}
+	for _, account := range current {
+		if identity := accountIdentity(account); !listed[identity] && accountSource.added[identity] {
+			merged = append(merged, account)
+		}
+	}
+	return merged
+}
+
+// diffRuntimeConfig 比较模型和客户端密钥的变化
+func diffRuntimeConfig(oldCfg, newCfg *RuntimeConfig) []string {
+	var changes []string
+
+	changes = append(changes, diffStringMaps("model", oldCfg.ModelsConfig.Models, newCfg.ModelsConfig.Models)...)
+	changes = append(changes, diffStringMaps("token estimator", oldCfg.ModelsConfig.Tokenizers, newCfg.ModelsConfig.Tokenizers)...)
+
+	for key, newKey := range newCfg.ClientKeys {
+		oldKey, ok := oldCfg.ClientKeys[key]
+		switch {
+		case !ok:
+			changes = append(changes, fmt.Sprintf("client key %s added", newKey.Name))
+		case !reflect.DeepEqual(oldKey, newKey):
+			changes = append(changes, fmt.Sprintf("client key %s updated", newKey.Name))
+		}
+	}
+	for key, oldKey := range oldCfg.ClientKeys {
+		if _, ok := newCfg.ClientKeys[key]; !ok {
+			changes = append(changes, fmt.Sprintf("client key %s removed", oldKey.Name))
+		}
+	}
+
+	if oldCfg.AdminAPIKey != newCfg.AdminAPIKey {
+		changes = append(changes, "admin API key changed")
+	}
+	if oldCfg.AccountSelector != nil && oldCfg.AccountSelector.Name() != newCfg.AccountSelector.Name() {
+		changes = append(changes, fmt.Sprintf("account selection strategy changed (%s -> %s)",
+			oldCfg.AccountSelector.Name(), newCfg.AccountSelector.Name()))
+	}
+	sort.Strings(changes)
+	return changes
+}
+
+// diffStringMaps 比较两个字符串映射，返回新增、删除和修改的条目
+func diffStringMaps(kind string, oldMap, newMap map[string]string) []string {
+	var changes []string
+	for key, value := range newMap {
+		oldValue, ok := oldMap[key]
+		switch {
+		case !ok:
+			changes = append(changes, fmt.Sprintf("%s %s added (%s)", kind, key, value))
+		case oldValue != value:
+			changes = append(changes, fmt.Sprintf("%s %s changed (%s -> %s)", kind, key, oldValue, value))
+		}
+	}
+	for key := range oldMap {
+		if _, ok := newMap[key]; !ok {
+			changes = append(changes, fmt.Sprintf("%s %s removed", kind, key))
+		}
+	}
+	return changes
+}
+
+// diffAccounts 比较账户列表的变化
+func diffAccounts(oldAccounts, newAccounts []*JetbrainsAccount) []string {
+	var changes []string
+	previous := make(map[string]*JetbrainsAccount, len(oldAccounts))
+	for _, account := range oldAccounts {
+		previous[accountIdentity(account)] = account
+	}
+
+	current := make(map[string]bool, len(newAccounts))
+	for _, account := range newAccounts {
+		identity := accountIdentity(account)
+		current[identity] = true
+		old, ok := previous[identity]
+		switch {
+		case !ok:
+			changes = append(changes, fmt.Sprintf("account %s added", getTokenDisplayName(account)))
+		case accountAuthorization(old) != accountAuthorization(account):
+			changes = append(changes, fmt.Sprintf("account %s authorization updated", getTokenDisplayName(account)))
+		case accountWeight(old) != accountWeight(account):
+			changes = append(changes, fmt.Sprintf("account %s weight changed (%d -> %d)",
+				getTokenDisplayName(account), accountWeight(old), accountWeight(account)))
+		}
+	}
+	for _, account := range oldAccounts {
+		if !current[accountIdentity(account)] {
+			changes = append(changes, fmt.Sprintf("account %s removed", getTokenDisplayName(account)))
+		}
+	}
+	sort.Strings(changes)
+	return changes
+}
+
+// setupReloadSignal 收到 SIGHUP 时重新加载配置
+func setupReloadSignal() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	go func() {
+		for range c {
+			reloadRuntimeConfig("SIGHUP")
+		}
+	}()
+}
+
+// watchedConfigFiles 轮询检查变化的配置文件
+func watchedConfigFiles() []string {
+	files := []string{"models.json", ".env"}
+	if keysFile := os.Getenv("CLIENT_KEYS_FILE"); keysFile != "" {
+		files = append(files, keysFile)
+	}
+	return files
+}
+
+// configFileState 文件的修改时间和大小，任一变化即视为文件已修改
+type configFileState struct {
+	modTime time.Time
+	size    int64
+}
+
+// statConfigFiles 读取被监视文件的状态，不存在的文件不记录
+func statConfigFiles() map[string]configFileState {
+	states := make(map[string]configFileState)
+	for _, file := range watchedConfigFiles() {
+		if info, err := os.Stat(file); err == nil {
+			states[file] = configFileState{modTime: info.ModTime(), size: info.Size()}
+		}
+	}
+	return states
+}
+
+// startConfigWatcher 按 CONFIG_RELOAD_INTERVAL 轮询配置文件，变化时自动重新加载 (0 表示关闭)
+func startConfigWatcher() {
+	value := getEnvWithDefault("CONFIG_RELOAD_INTERVAL", "30s")
+	interval, err := time.ParseDuration(value)
+	if err != nil {
+		Warn("Invalid CONFIG_RELOAD_INTERVAL=%q, config file polling disabled", value)
+		return
+	}
+	if interval <= 0 {
+		Info("Config file polling disabled")
+		return
+	}
+
+	Info("Polling configuration files for changes every %s", interval)
+	go func() {
+		previous := statConfigFiles()
+		for range time.Tick(interval) {
+			current := statConfigFiles()
+			if changed := changedConfigFiles(previous, current); len(changed) > 0 {
+				reloadRuntimeConfig(fmt.Sprintf("file change: %v", changed))
+			}
+			previous = current
+		}
+	}()
+}
+
+// changedConfigFiles 返回新增、删除或修改的文件
+func changedConfigFiles(previous, current map[string]configFileState) []string {
+	var changed []string
+	for file, state := range current {
+		if old, ok := previous[file]; !ok || old != state {
+			changed = append(changed, file)
+		}
+	}
+	for file := range previous {
+		if _, ok := current[file]; !ok {
+			changed = append(changed, file)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// setupReloadEnv 在临时目录中准备 models.json 和账户、密钥环境变量
+func setupReloadEnv(t *testing.T, models string) {
+	t.Helper()
+	wd, _ := os.Getwd()
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+	if err := os.WriteFile("models.json", []byte(models), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CLIENT_API_KEYS", "sk-new-client")
+	t.Setenv("CLIENT_KEYS_FILE", "")
+	t.Setenv("ADMIN_API_KEY", "admin-secret")
+	t.Setenv("JETBRAINS_LICENSE_IDS", "license-1,license-2")
+	t.Setenv("JETBRAINS_AUTHORIZATIONS", "auth-1,auth-2")
+	t.Setenv("JETBRAINS_JWTS", "")
+}
+
+func TestReloadRuntimeConfig_SwapsSnapshotAndAccounts(t *testing.T) {
+	setupFakeUpstream(t, DefaultFakeGrazieOptions())
+	setupReloadEnv(t, `{"models":{"new-model":"openai-new"}}`)
+
+	// 热更新前取出的账户和配置快照在请求结束前保持可用
+	oldConfig := currentConfig()
+	account, err := getNextJetbrainsAccount()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	jwt := account.JWT
+
+	changes, err := reloadRuntimeConfig("test")
+	if err != nil {
+		t.Fatalf("reload failed: %v", err)
+	}
+	for _, want := range []string{"model new-model added (openai-new)", "model test-model removed", "client key Key ...ient added", "client key test-client removed"} {
+		if !slices.Contains(changes, want) {
+			t.Errorf("missing change %q in %v", want, changes)
+		}
+	}
+
+	if getModelItem("new-model") == nil || getModelItem("test-model") != nil {
+		t.Error("models should be replaced")
+	}
+	if currentConfig().ClientKeys["sk-new-client"] == nil || currentConfig().ClientKeys[testClientKey] != nil {
+		t.Error("client keys should be replaced")
+	}
+	if oldConfig.ClientKeys[testClientKey] == nil || len(oldConfig.ModelsData.Data) != 1 {
+		t.Error("the previous snapshot must not be modified")
+	}
+
+	accounts := accountsSnapshot()
+	if len(accounts) != 2 {
+		t.Fatalf("expected 2 accounts after reload, got %d", len(accounts))
+	}
+	// 未变化的账户沿用原对象，保留 JWT 和正在处理的请求计数
+	if accounts[0] != account || accounts[0].JWT != jwt || accounts[0].InFlight != 1 || accounts[1].JWT != "" {
+		t.Errorf("runtime state should be kept for unchanged accounts, got %+v and %+v", accounts[0], accounts[1])
+	}
+	releaseJetbrainsAccount(account)
+}
+
+func TestReloadRuntimeConfig_InvalidConfigKeepsCurrent(t *testing.T) {
+	setupFakeUpstream(t, DefaultFakeGrazieOptions())
+	setupReloadEnv(t, `{"models":`)
+	oldConfig := currentConfig()
+
+	if _, err := reloadRuntimeConfig("test"); err == nil {
+		t.Fatal("invalid models.json should be rejected")
+	}
+	if currentConfig() != oldConfig || len(jetbrainsAccounts) != 1 {
+		t.Error("configuration should not change after a failed reload")
+	}
+
+	os.WriteFile("models.json", []byte(`{"models":{"a":"b"}}`), 0o644)
+	t.Setenv("JETBRAINS_LICENSE_IDS", "")
+	if _, err := reloadRuntimeConfig("test"); err == nil || !strings.Contains(err.Error(), "no JetBrains accounts") {
+		t.Errorf("configuration without accounts should be rejected, got %v", err)
+	}
+}
+
+func TestReloadRuntimeConfig_KeepsAdminAccountChanges(t *testing.T) {
+	_, router := setupFakeUpstream(t, DefaultFakeGrazieOptions())
+	setupReloadEnv(t, `{"models":{"test-model":"openai-test"}}`)
+	if _, err := reloadRuntimeConfig("test"); err != nil {
+		t.Fatalf("reload failed: %v", err)
+	}
+	currentConfig().AdminAPIKey = testAdminKey
+
+	licenseAccount := func(licenseID string) *JetbrainsAccount {
+		for _, account := range accountsSnapshot() {
+			if account.LicenseID == licenseID {
+				return account
+			}
+		}
+		return nil
+	}
+	if w := doAdminRequest(router, http.MethodPost, "/admin/accounts", `{"license_id":"license-3","authorization":"auth-3"}`); w.Code != http.StatusCreated {
+		t.Fatalf("add failed: %d %s", w.Code, w.Body.String())
+	}
+	if w := doAdminRequest(router, http.MethodDelete, "/admin/accounts/"+accountID(licenseAccount("license-2")), ""); w.Code != http.StatusOK {
+		t.Fatalf("delete failed: %d %s", w.Code, w.Body.String())
+	}
+	edited := licenseAccount("license-1")
+	if w := doAdminRequest(router, http.MethodPatch, "/admin/accounts/"+accountID(edited), `{"authorization":"auth-1-rotated"}`); w.Code != http.StatusOK {
+		t.Fatalf("update failed: %d %s", w.Code, w.Body.String())
+	}
+
+	assertAccounts := func(stage string, want ...string) {
+		t.Helper()
+		var got []string
+		for _, account := range accountsSnapshot() {
+			got = append(got, account.LicenseID+"="+account.Authorization)
+		}
+		slices.Sort(got)
+		if !slices.Equal(got, want) {
+			t.Errorf("%s: expected accounts %v, got %v", stage, want, got)
+		}
+	}
+
+	// 账户环境变量未变化：不重新读取账户
+	changes, err := reloadRuntimeConfig("test")
+	if err != nil || len(changes) != 0 {
+		t.Fatalf("reload without changes should report nothing, got %v (%v)", changes, err)
+	}
+	assertAccounts("unchanged env", "license-1=auth-1-rotated", "license-3=auth-3")
+	if licenseAccount("license-1") != edited {
+		t.Error("the edited account object should be kept")
+	}
+
+	// 账户环境变量变化：新增的环境变量账户加入，管理接口的修改仍然保留
+	t.Setenv("JETBRAINS_LICENSE_IDS", "license-1,license-2,license-4")
+	t.Setenv("JETBRAINS_AUTHORIZATIONS", "auth-1,auth-2,auth-4")
+	if _, err := reloadRuntimeConfig("test"); err != nil {
+		t.Fatalf("reload failed: %v", err)
+	}
+	assertAccounts("new env account", "license-1=auth-1-rotated", "license-3=auth-3", "license-4=auth-4")
+
+	// 环境变量修改了账户的授权信息时以环境变量为准；从环境变量中删除后不再保留删除标记
+	t.Setenv("JETBRAINS_LICENSE_IDS", "license-1,license-4")
+	t.Setenv("JETBRAINS_AUTHORIZATIONS", "auth-1-env,auth-4")
+	if _, err := reloadRuntimeConfig("test"); err != nil {
+		t.Fatalf("reload failed: %v", err)
+	}
+	assertAccounts("changed env account", "license-1=auth-1-env", "license-3=auth-3", "license-4=auth-4")
+	t.Setenv("JETBRAINS_LICENSE_IDS", "license-1,license-2,license-4")
+	t.Setenv("JETBRAINS_AUTHORIZATIONS", "auth-1-env,auth-2,auth-4")
+	if _, err := reloadRuntimeConfig("test"); err != nil {
+		t.Fatalf("reload failed: %v", err)
+	}
+	assertAccounts("re-added env account", "license-1=auth-1-env", "license-2=auth-2", "license-3=auth-3", "license-4=auth-4")
+}
+
+// 用 -race 运行：热更新修改权重时，请求并发按权重排序账户
+func TestReloadRuntimeConfig_WeightChangeConcurrentWithSelection(t *testing.T) {
+	setupFakeUpstream(t, DefaultFakeGrazieOptions())
+	setupReloadEnv(t, `{"models":{"test-model":"openai-test"}}`)
+	t.Setenv("ACCOUNT_SELECTION_STRATEGY", StrategyWeighted)
+	t.Setenv("JETBRAINS_LICENSE_WEIGHTS", "1,1")
+	if _, err := reloadRuntimeConfig("test"); err != nil {
+		t.Fatalf("reload failed: %v", err)
+	}
+	accounts := accountsSnapshot()
+	account := accounts[0]
+
+	var wg, started sync.WaitGroup
+	done := make(chan struct{})
+	for range 4 {
+		wg.Add(1)
+		started.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				weightedSelector{}.Order(accounts)
+				newAdminAccountView(account, nil)
+				if i == 0 {
+					started.Done()
+				}
+			}
+		}()
+	}
+	started.Wait()
+	for weight := 2; weight <= 20; weight++ {
+		os.Setenv("JETBRAINS_LICENSE_WEIGHTS", strconv.Itoa(weight)+",1")
+		if _, err := reloadRuntimeConfig("test"); err != nil {
+			t.Errorf("reload failed: %v", err)
+			break
+		}
+		runtime.Gosched()
+	}
+	close(done)
+	wg.Wait()
+
+	// 授权信息未变，沿用原对象并使用新权重
+	if accountsSnapshot()[0] != account || accountWeight(account) != 20 {
+		t.Errorf("expected the kept account to have weight 20, got %d", accountWeight(account))
+	}
+}
+
+func TestAdminReloadEndpoint(t *testing.T) {
+	_, router := setupFakeUpstream(t, DefaultFakeGrazieOptions())
+	setupReloadEnv(t, `{"models":{"test-model":"openai-test"}}`)
+
+	doAdmin := func(key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/admin/reload", nil)
+		if key != "" {
+			req.Header.Set("Authorization", "Bearer "+key)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := doAdmin("admin-secret"); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("admin API should be disabled without ADMIN_API_KEY, got %d", w.Code)
+	}
+	currentConfig().AdminAPIKey = "admin-secret"
+	if w := doAdmin(""); w.Code != http.StatusUnauthorized {
+		t.Errorf("missing admin key should be rejected with 401, got %d", w.Code)
+	}
+	if w := doAdmin(testClientKey); w.Code != http.StatusForbidden {
+		t.Errorf("client key must not grant admin access, got %d", w.Code)
+	}
+	w := doAdmin("admin-secret")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "client key Key ...ient added") {
+		t.Errorf("reload should succeed and report changes, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestChangedConfigFiles(t *testing.T) {
+	previous := map[string]configFileState{"a": {size: 1}, "b": {size: 2}}
+	current := map[string]configFileState{"a": {size: 1}, "b": {size: 3}, "c": {size: 1}}
+	if changed := changedConfigFiles(previous, current); !slices.Equal(changed, []string{"b", "c"}) {
+		t.Errorf("unexpected changed files: %v", changed)
+	}
+	if changed := changedConfigFiles(current, map[string]configFileState{"a": {size: 1}}); !slices.Equal(changed, []string{"b", "c"}) {
+		t.Errorf("removed files should be reported: %v", changed)
+	}
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/bytedance/sonic"
+)
+
+// replayOptions replay 子命令的参数
+type replayOptions struct {
+	target   string // proxy 或 upstream
+	proxyURL string
+	apiKey   string
+	jwt      string
+	client   *http.Client
+}
+
+// replayVolatileKeys 每次请求都会变化的字段，比较前替换为占位符
+var replayVolatileKeys = map[string]bool{
+	"id": true, "created": true, "created_at": true, "system_fingerprint": true,
+	"request_id": true, "responseId": true, "item_id": true, "call_id": true,
+}
+
+// replaySkippedHeaders 重放时不转发的请求头
+var replaySkippedHeaders = map[string]bool{
+	"Content-Length":  true,
+	"Accept-Encoding": true,
+	"Connection":      true,
+	"X-Request-Id":    true,
+	"Traceparent":     true,
+	"Tracestate":      true,
+}
+
+// maxReplayDiffLines 每条记录最多输出的差异行数
+const maxReplayDiffLines = 60
+
+// runReplay 重新发送审计记录并与记录的结果比较
+// jetbrainsai2api replay [flags] <audit.jsonl> [request-id...]
+func runReplay(args []string) {
+	opts := replayOptions{client: &http.Client{Timeout: DefaultRequestTimeout}}
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	fs.StringVar(&opts.target, "target", "proxy", "proxy: resend the client request to a running proxy; upstream: resend the JetBrains payload to the upstream API")
+	fs.StringVar(&opts.proxyURL, "proxy", "http://localhost:7860", "proxy base URL")
+	fs.StringVar(&opts.apiKey, "key", "", "client API key for the proxy (default: first CLIENT_API_KEYS entry)")
+	upstreamURL := fs.String("upstream", "", "JetBrains API base URL (default: JETBRAINS_API_BASE_URL)")
+	fs.StringVar(&opts.jwt, "jwt", "", "JWT for upstream replay (default: first JETBRAINS_JWTS entry)")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: jetbrainsai2api replay [flags] <audit.jsonl> [request-id...]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() < 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	loadDotenv()
+	InitializeLogger()
+	loadUpstreamConfig()
+	if *upstreamURL != "" {
+		jetbrainsAPIBaseURL = strings.TrimRight(*upstreamURL, "/")
+	}
+	if opts.apiKey == "" {
+		if keys := parseEnvList(os.Getenv("CLIENT_API_KEYS")); len(keys) > 0 {
+			opts.apiKey = keys[0]
+		}
+	}
+	if opts.jwt == "" {
+		if jwts := parseEnvList(os.Getenv("JETBRAINS_JWTS")); len(jwts) > 0 {
+			opts.jwt = jwts[0]
+		}
+	}
+
+	records, err := readAuditRecords(fs.Arg(0), fs.Args()[1:])
+	if err != nil {
+		Fatal("Failed to read audit records: %v", err)
+	}
+	if len(records) == 0 {
+		Fatal("No matching audit records in %s", fs.Arg(0))
+	}
+	differences, err := replayRecords(records, opts, os.Stdout)
+	if err != nil {
+		Fatal("Replay failed: %v", err)
+	}
+	if differences > 0 {
+		os.Exit(1)
+	}
+}
+
+// readAuditRecords 读取审计文件，ids 不为空时只返回指定请求ID的记录
+func readAuditRecords(path string, ids []string) ([]AuditRecord, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var records []AuditRecord
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 256<<20)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var record AuditRecord
+		if err := sonic.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		if len(ids) == 0 || slices.Contains(ids, record.ID) {
+			records = append(records, record)
+		}
+	}
+	return records, scanner.Err()
+}
+
+// replayRecords 依次重放记录并输出差异，返回结果不同的记录数
+func replayRecords(records []AuditRecord, opts replayOptions, out io.Writer) (int, error) {
+	differences := 0
+	for _, record := range records {
+		fmt.Fprintf(out, "== %s %s %s (%s)\n", record.ID, record.Method, record.Path, opts.target)
+		if record.Truncated {
+			fmt.Fprintln(out, "   note: the record was truncated (AUDIT_MAX_BODY_BYTES), results may differ")
+		}
+
+		var (
+			status   int
+			body     string
+			expected string
+			wantCode = record.Status
+			sent     []byte
+			err      error
+		)
+		switch opts.target {
+		case "proxy":
+			sent = auditText(record.Request)
+			expected = string(auditText(record.Response))
+			status, body, err = replayToProxy(record, sent, opts)
+		case "upstream":
+			if len(record.UpstreamPayload) == 0 {
+				fmt.Fprintln(out, "   skipped: no upstream payload was captured")
+				continue
+			}
+			sent = auditText(record.UpstreamPayload)
+			expected = strings.Join(record.UpstreamLines, "\n")
+			if n := len(record.UpstreamAttempts); n > 0 {
+				wantCode = record.UpstreamAttempts[n-1].Status
+			}
+			status, body, err = replayToUpstream(sent, opts)
+		default:
+			return differences, fmt.Errorf("unknown replay target %q (use proxy or upstream)", opts.target)
+		}
+		if err != nil {
+			return differences, err
+		}
+		if bytes.Contains(sent, []byte("[REDACTED")) {
+			fmt.Fprintln(out, "   note: the replayed request contains redacted content")
+		}
+
+		diff := diffLines(normalizeReplayOutput(expected), normalizeReplayOutput(body))
+		if status == wantCode && len(diff) == 0 {
+			fmt.Fprintf(out, "   identical (status %d)\n", status)
+			continue
+		}
+		differences++
+		if status != wantCode {
+			fmt.Fprintf(out, "   status: recorded %d, replayed %d\n", wantCode, status)
+		}
+		for i, line := range diff {
+			if i == maxReplayDiffLines {
+				fmt.Fprintf(out, "   ... %d more differing lines\n", len(diff)-i)
+				break
+			}
+			fmt.Fprintf(out, "   %s\n", line)
+		}
+	}
+	return differences, nil
+}
+
+// replayToProxy 把记录的客户端请求重新发送给运行中的代理
+func replayToProxy(record AuditRecord, body []byte, opts replayOptions) (int, string, error) {
+	url := strings.TrimRight(opts.proxyURL, "/") + record.Path
+	if record.Query != "" {
+		url += "?" + record.Query
+	}
+	req, err := http.NewRequest(record.Method, url, bytes.NewReader(body))
+	if err != nil {
+		return 0, "", err
+	}
+	for name, value := range record.Headers {
+		if !replaySkippedHeaders[http.CanonicalHeaderKey(name)] {
+			req.Header.Set(name, value)
+		}
+	}
+	if opts.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+opts.apiKey)
+	}
+	return doReplayRequest(opts.client, req)
+}
+
+// replayToUpstream 把记录的 JetBrains payload 直接发送给上游
+func replayToUpstream(payload []byte, opts replayOptions) (int, string, error) {
+	if opts.jwt == "" {
+		return 0, "", fmt.Errorf("upstream replay needs a JWT (-jwt or JETBRAINS_JWTS)")
+	}
+	req, err := createJetbrainsStreamRequest(payload, opts.jwt)
+	if err != nil {
+		return 0, "", err
+	}
+	return doReplayRequest(opts.client, req)
+}
+
+func doReplayRequest(client *http.Client, req *http.Request) (int, string, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(body), err
+}
+
+// auditText 返回记录中保存的原始内容：JSON 字符串还原为文本，其他 JSON 原样返回
+func auditText(raw []byte) []byte {
+	var text string
+	if len(raw) > 0 && raw[0] == '"' && sonic.Unmarshal(raw, &text) == nil {
+		return []byte(text)
+	}
+	return raw
+}
+
+// normalizeReplayOutput 将响应转换为便于比较的行：JSON 格式化输出，SSE 每个 data 行单独一行，
+// 并把每次都会变化的字段 (ID、时间戳) 替换为占位符
+func normalizeReplayOutput(text string) []string {
+	if text = strings.TrimSpace(text); text == "" {
+		return nil
+	}
+	var value any
+	if sonic.UnmarshalString(text, &value) == nil {
+		formatted, _ := sonic.ConfigStd.MarshalIndent(scrubVolatileFields(value), "", "  ")
+		return strings.Split(string(formatted), "\n")
+	}
+
+	var lines []string
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimRight(line, "\r")
+		if line == "" {
+			continue
+		}
+		if data, ok := strings.CutPrefix(line, "data: "); ok && sonic.UnmarshalString(data, &value) == nil {
+			compact, _ := sonic.ConfigStd.Marshal(scrubVolatileFields(value))
+			line = "data: " + string(compact)
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+func scrubVolatileFields(value any) any {
+	switch v := value.(type) {
+	case map[string]any:
+		for key, field := range v {
+			if replayVolatileKeys[key] {
+				v[key] = "<" + key + ">"
+			} else {
+				v[key] = scrubVolatileFields(field)
+			}
+		}
+	case []any:
+		for i, item := range v {
+			v[i] = scrubVolatileFields(item)
+		}
+	}
+	return value
+}
+
+// maxDiffCells 两侧行数乘积超过此值时不计算最长公共子序列，改为逐行比较
+const maxDiffCells = 4_000_000
+
+// diffLines 返回 "- 记录" / "+ 重放" 形式的差异行，相同时返回 nil
+func diffLines(expected, actual []string) []string {
+	if slices.Equal(expected, actual) {
+		return nil
+	}
+	n, m := len(expected), len(actual)
+	if n*m > maxDiffCells {
+		var diff []string
+		for i := 0; i < max(n, m); i++ {
+			if i < n && i < m && expected[i] == actual[i] {
+				continue
+			}
+			if i < n {
+				diff = append(diff, "- "+expected[i])
+			}
+			if i < m {
+				diff = append(diff, "+ "+actual[i])
+			}
+		}
+		return diff
+	}
+
+	// lcs[i][j] 为 expected[i:] 和 actual[j:] 的最长公共子序列长度
+	lcs := make([][]int, n+1)
+	for i := range lcs {
+		lcs[i] = make([]int, m+1)
+	}
+	for i := n - 1; i >= 0; i-- {
+		for j := m - 1; j >= 0; j-- {
+			if expected[i] == actual[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	var diff []string
+	i, j := 0, 0
+	for i < n || j < m {
+		switch {
+		case i < n && j < m && expected[i] == actual[j]:
+			i++
+			j++
+		case j < m && (i == n || lcs[i][j+1] >= lcs[i+1][j]):
+			diff = append(diff, "+ "+actual[j])
+			j++
+		default:
+			diff = append(diff, "- "+expected[i])
+			i++
+		}
+	}
+	return diff
+}
@@ -24,6 +24,36 @@ func generateShortToolCallID() string {
 	return fmt.Sprintf("toolu_%s", hex.EncodeToString(bytes))
 }
 
+// jetbrainsToolEvent is a ToolCall or legacy FunctionCall stream event in normalized form
+type jetbrainsToolEvent struct {
+	Start     bool   // true when the event opens a new tool call
+	ID        string // tool call ID (generated for FunctionCall events)
+	Name      string
+	Arguments string // argument fragment carried by the event
+}
+
+// parseJetbrainsToolEvent normalizes ToolCall and FunctionCall events.
+// A ToolCall event with an id and name starts a new call; later events with a null id carry argument fragments.
+func parseJetbrainsToolEvent(data map[string]any) (jetbrainsToolEvent, bool) {
+	eventType, _ := data["type"].(string)
+	name, _ := data["name"].(string)
+	content, _ := data["content"].(string)
+
+	switch eventType {
+	case "ToolCall":
+		if id, _ := data["id"].(string); id != "" && name != "" {
+			return jetbrainsToolEvent{Start: true, ID: id, Name: name, Arguments: content}, true
+		}
+		return jetbrainsToolEvent{Arguments: content}, true
+	case "FunctionCall":
+		if name != "" {
+			return jetbrainsToolEvent{Start: true, ID: generateShortToolCallID(), Name: name, Arguments: content}, true
+		}
+		return jetbrainsToolEvent{Arguments: content}, true
+	}
+	return jetbrainsToolEvent{}, false
+}
+
 // processJetbrainsStream processes the event stream from the JetBrains API.
 // It calls the provided onEvent function for each event in the stream.
 func processJetbrainsStream(resp *http.Response, onEvent func(event map[string]any) bool) {
@@ -48,15 +78,102 @@ func processJetbrainsStream(resp *http.Response, onEvent func(event map[string]a
 	}
 }
 
+// toolCallCollector accumulates streamed tool call events into complete OpenAI tool calls
+type toolCallCollector struct {
+	calls    []ToolCall
+	limit    int  // maximum number of tool calls, 0 means unlimited
+	dropping bool // true while discarding a call beyond the limit
+}
+
+// newToolCallCollector creates a collector honouring the request's parallel_tool_calls flag
+func newToolCallCollector(request ChatCompletionRequest) *toolCallCollector {
+	collector := &toolCallCollector{}
+	if request.ParallelToolCalls != nil && !*request.ParallelToolCalls {
+		collector.limit = 1
+	}
+	return collector
+}
+
+// add applies a tool event and returns the index of the affected call, or false if the event was discarded
+func (tc *toolCallCollector) add(event jetbrainsToolEvent) (int, bool) {
+	if event.Start {
+		if tc.limit > 0 && len(tc.calls) >= tc.limit {
+			tc.dropping = true
+			Debug("Discarding tool call %s: parallel_tool_calls is disabled", event.Name)
+			return -1, false
+		}
+		tc.dropping = false
+		tc.calls = append(tc.calls, ToolCall{
+			ID:   event.ID,
+			Type: "function",
+			Function: Function{
+				Name:      event.Name,
+				Arguments: event.Arguments,
+			},
+		})
+		Debug("Started tool call #%d with ID: %s, name: %s", len(tc.calls)-1, event.ID, event.Name)
+		return len(tc.calls) - 1, true
+	}
+
+	if tc.dropping || len(tc.calls) == 0 {
+		return -1, false
+	}
+	tc.calls[len(tc.calls)-1].Function.Arguments += event.Arguments
+	return len(tc.calls) - 1, true
+}
+
+// validate logs a warning for every malformed tool call
+func (tc *toolCallCollector) validate() {
+	for _, toolCall := range tc.calls {
+		if err := validateToolCallResponse(toolCall); err != nil {
+			Warn("Invalid tool call response: %v", err)
+		}
+		Debug("Completed tool call with ID: %s, args: %s", toolCall.ID, toolCall.Function.Arguments)
+	}
+}
+
+// mapJetbrainsFinishReasonToOpenAI maps a JetBrains finish reason to the OpenAI format
+func mapJetbrainsFinishReasonToOpenAI(jetbrainsReason string, hasToolCalls bool) string {
+	if hasToolCalls {
+		return "tool_calls"
+	}
+	switch jetbrainsReason {
+	case "length":
+		return "length"
+	default:
+		return "stop"
+	}
+}
+
 // handleStreamingResponse handles streaming responses from the JetBrains API
-func handleStreamingResponse(c *gin.Context, resp *http.Response, request ChatCompletionRequest, startTime time.Time, accountIdentifier string) {
+// promptTokens 为请求的估算值，用于 stream_options.include_usage 的用量块
+func handleStreamingResponse(c *gin.Context, resp *http.Response, request ChatCompletionRequest, promptTokens int, startTime time.Time, accountIdentifier string) {
 	c.Header("Content-Type", "text/event-stream")
 	c.Header("Cache-Control", "no-cache")
 	c.Header("Connection", "keep-alive")
 
 	streamID := "chatcmpl-" + uuid.New().String()
 	firstChunkSent := false
-	var currentTool *map[string]any
+	toolCalls := newToolCallCollector(request)
+	usage := newUsageTracker(request.Model, promptTokens)
+	finishReason := ""
+
+	writeChunk := func(deltaPayload map[string]any, finish *string) {
+		if !firstChunkSent {
+			deltaPayload["role"] = "assistant"
+			firstChunkSent = true
+		}
+		streamResp := StreamResponse{
+			ID:      streamID,
+			Object:  "chat.completion.chunk",
+			Created: time.Now().Unix(),
+			Model:   request.Model,
+			Choices: []StreamChoice{{Delta: deltaPayload, FinishReason: finish}},
+		}
+		respJSON, _ := marshalJSON(streamResp)
+		fmt.Fprintf(c.Writer, "data: %s\n\n", string(respJSON))
+		c.Writer.Flush()
+	}
 
 	processJetbrainsStream(resp, func(data map[string]any) bool {
 		eventType, _ := data["type"].(string)
@@ -67,137 +184,67 @@ func handleStreamingResponse(c *gin.Context, resp *http.Response, request ChatCo
 			if content == "" {
 				return true // Continue processing
 			}
-
-			var deltaPayload map[string]any
-			if !firstChunkSent {
-				deltaPayload = map[string]any{
-					"role":    "assistant",
-					"content": content,
-				}
-				firstChunkSent = true
-			} else {
-				deltaPayload = map[string]any{
-					"content": content,
-				}
+			usage.addCompletion(content)
+			writeChunk(map[string]any{"content": content}, nil)
+		case "ToolCall", "FunctionCall":
+			toolEvent, _ := parseJetbrainsToolEvent(data)
+			index, ok := toolCalls.add(toolEvent)
+			if !ok {
+				return true
 			}
+			usage.addCompletion(toolEvent.Name + toolEvent.Arguments)
 
-			streamResp := StreamResponse{
-				ID:      streamID,
-				Object:  "chat.completion.chunk",
-				Created: time.Now().Unix(),
-				Model:   request.Model,
-				Choices: []StreamChoice{{Delta: deltaPayload}},
+			// 每个工具调用使用独立的 index，首个增量携带 id 和名称，后续增量只携带参数片段
+			toolDelta := map[string]any{
+				"index":    index,
+				"function": map[string]any{"arguments": toolEvent.Arguments},
 			}
-
-			respJSON, _ := marshalJSON(streamResp)
-			fmt.Fprintf(c.Writer, "data: %s\n\n", string(respJSON))
-			c.Writer.Flush()
-		case "ToolCall":
-			// 处理新的ToolCall格式 - 使用上游提供的ID
-			if upstreamID, ok := data["id"].(string); ok && upstreamID != "" {
-				// 开始新的工具调用 - 使用上游提供的ID
-				if name, ok := data["name"].(string); ok && name != "" {
-					currentTool = &map[string]any{
-						"index": 0,
-						"id":    upstreamID, // 使用上游提供的ID
-						"function": map[string]any{
-							"arguments": "",
-							"name":      name,
-						},
-						"type": "function",
-					}
-					Debug("Started new tool call with upstream ID: %s, name: %s", upstreamID, name)
-				}
-			} else if currentTool != nil {
-				// 累积参数内容 (当ID为null时)
-				if content, ok := data["content"].(string); ok {
-					if funcMap, ok := (*currentTool)["function"].(map[string]any); ok {
-						currentArgs, _ := funcMap["arguments"].(string)
-						funcMap["arguments"] = currentArgs + content
-					}
-				}
-			}
-		case "FunctionCall":
-			funcNameInterface := data["name"]
-			funcArgs, _ := data["content"].(string)
-
-			var funcName string
-			if funcNameInterface == nil {
-				funcName = ""
-			} else {
-				funcName, _ = funcNameInterface.(string)
-			}
-
-			if funcName != "" {
-				currentTool = &map[string]any{
-					"index": 0,
-					"id":    generateShortToolCallID(),
-					"function": map[string]any{
-						"arguments": "",
-						"name":      funcName,
-					},
-					"type": "function",
-				}
-			} else if currentTool != nil {
-				if funcMap, ok := (*currentTool)["function"].(map[string]any); ok {
-					currentArgs, _ := funcMap["arguments"].(string)
-					funcMap["arguments"] = currentArgs + funcArgs
-				}
+			if toolEvent.Start {
+				toolDelta["id"] = toolEvent.ID
+				toolDelta["type"] = "function"
+				toolDelta["function"] = map[string]any{"name": toolEvent.Name, "arguments": toolEvent.Arguments}
+			} else if toolEvent.Arguments == "" {
+				return true
 			}
+			writeChunk(map[string]any{"tool_calls": []map[string]any{toolDelta}}, nil)
 		case "FinishMetadata":
-			if currentTool != nil {
-				// Validate the tool call arguments before sending
-				if funcMap, ok := (*currentTool)["function"].(map[string]any); ok {
-					if args, ok := funcMap["arguments"].(string); ok && args != "" {
-						// Try to validate JSON format
-						var argsTest map[string]any
-						if err := sonic.Unmarshal([]byte(args), &argsTest); err != nil {
-							Warn("Tool call arguments are not valid JSON: %v", err)
-						}
-					}
-				}
-
-				deltaPayload := map[string]any{
-					"tool_calls": []map[string]any{*currentTool},
-				}
-				streamResp := StreamResponse{
-					ID:      streamID,
-					Object:  "chat.completion.chunk",
-					Created: time.Now().Unix(),
-					Model:   request.Model,
-					Choices: []StreamChoice{{Delta: deltaPayload}},
-				}
-				respJSON, _ := marshalJSON(streamResp)
-				fmt.Fprintf(c.Writer, "data: %s\n\n", string(respJSON))
-				c.Writer.Flush()
-			}
-
-			finalResp := StreamResponse{
-				ID:      streamID,
-				Object:  "chat.completion.chunk",
-				Created: time.Now().Unix(),
-				Model:   request.Model,
-				Choices: []StreamChoice{{Delta: map[string]any{}, FinishReason: stringPtr("tool_calls")}},
-			}
-
-			respJSON, _ := marshalJSON(finalResp)
-			fmt.Fprintf(c.Writer, "data: %s\n\n", string(respJSON))
-			c.Writer.Write([]byte("data: [DONE]\n\n"))
-			c.Writer.Flush()
+			finishReason, _ = data["reason"].(string)
+			usage.observeFinishMetadata(data)
 			return false // Stop processing
 		}
 		return true // Continue processing
 	})
 
-	recordRequest(true, time.Since(startTime).Milliseconds(), request.Model, accountIdentifier)
+	toolCalls.validate()
+	writeChunk(map[string]any{}, stringPtr(mapJetbrainsFinishReasonToOpenAI(finishReason, len(toolCalls.calls) > 0)))
+	total := usage.usage()
+	chargeClientTokens(c, total)
+
+	// 按 OpenAI 约定，用量块的 choices 为空数组
+	if request.StreamOptions != nil && request.StreamOptions.IncludeUsage {
+		usageResp := StreamResponse{
+			ID:      streamID,
+			Object:  "chat.completion.chunk",
+			Created: time.Now().Unix(),
+			Model:   request.Model,
+			Choices: []StreamChoice{},
+			Usage:   total.openAI(),
+		}
+		respJSON, _ := marshalJSON(usageResp)
+		fmt.Fprintf(c.Writer, "data: %s\n\n", string(respJSON))
+	}
+	c.Writer.Write([]byte("data: [DONE]\n\n"))
+	c.Writer.Flush()
+
+	recordRequest(true, time.Since(startTime).Milliseconds(), request.Model, accountIdentifier, clientKeyName(c))
 }
 
 // handleNonStreamingResponse handles non-streaming responses from the JetBrains API
-func handleNonStreamingResponse(c *gin.Context, resp *http.Response, request ChatCompletionRequest, startTime time.Time, accountIdentifier string) {
+func handleNonStreamingResponse(c *gin.Context, resp *http.Response, request ChatCompletionRequest, promptTokens int, startTime time.Time, accountIdentifier string) {
 	var contentBuilder strings.Builder
-	var toolCalls []ToolCall
-	var currentFuncName string
-	var currentFuncArgs string
+	toolCalls := newToolCallCollector(request)
+	usage := newUsageTracker(request.Model, promptTokens)
+	finishReason := ""
 
 	processJetbrainsStream(resp, func(data map[string]any) bool {
 		eventType, _ := data["type"].(string)
@@ -207,87 +254,31 @@ func handleNonStreamingResponse(c *gin.Context, resp *http.Response, request Cha
 			if content, ok := data["content"].(string); ok {
 				contentBuilder.WriteString(content)
 			}
-		case "ToolCall":
-			// 处理新的ToolCall格式 - 使用上游提供的ID
-			if upstreamID, ok := data["id"].(string); ok && upstreamID != "" {
-				// 开始新的工具调用 - 记录上游ID
-				if name, ok := data["name"].(string); ok && name != "" {
-					currentFuncName = name
-					currentFuncArgs = ""
-					// 存储上游ID供后续使用
-					if len(toolCalls) == 0 {
-						toolCalls = append(toolCalls, ToolCall{
-							ID:   upstreamID, // 使用上游提供的ID
-							Type: "function",
-							Function: Function{
-								Name:      name,
-								Arguments: "",
-							},
-						})
-					}
-					Debug("Started new tool call with upstream ID: %s, name: %s", upstreamID, name)
-				}
-			} else if content, ok := data["content"].(string); ok {
-				// 累积参数内容 (当ID为null时)
-				currentFuncArgs += content
-				// 更新toolCalls中的参数
-				if len(toolCalls) > 0 {
-					toolCalls[len(toolCalls)-1].Function.Arguments += content
-				}
+		case "ToolCall", "FunctionCall":
+			toolEvent, _ := parseJetbrainsToolEvent(data)
+			if _, ok := toolCalls.add(toolEvent); ok {
+				usage.addCompletion(toolEvent.Name + toolEvent.Arguments)
 			}
-		case "FunctionCall":
-			funcNameInterface := data["name"]
-			funcArgs, _ := data["content"].(string)
-
-			var funcName string
-			if funcNameInterface == nil {
-				funcName = ""
-			} else {
-				funcName, _ = funcNameInterface.(string)
-			}
-
-			if funcName != "" {
-				currentFuncName = funcName
-				currentFuncArgs = ""
-			}
-			currentFuncArgs += funcArgs
 		case "FinishMetadata":
-			// 完成工具调用参数收集 - toolCalls已在ToolCall事件中创建
-			if len(toolCalls) > 0 {
-				// 验证最后一个工具调用
-				lastToolCall := &toolCalls[len(toolCalls)-1]
-				if err := validateToolCallResponse(*lastToolCall); err != nil {
-					Warn("Invalid tool call response: %v", err)
-				}
-				Debug("Completed tool call with ID: %s, args: %s", lastToolCall.ID, lastToolCall.Function.Arguments)
-			} else if currentFuncName != "" {
-				// 后备方案：如果没有通过ToolCall事件创建，则创建一个
-				toolCall := ToolCall{
-					ID:   generateShortToolCallID(), // 后备方案
-					Type: "function",
-					Function: Function{
-						Name:      currentFuncName,
-						Arguments: currentFuncArgs,
-					},
-				}
-				toolCalls = append(toolCalls, toolCall)
-				Warn("Used fallback tool ID generation for: %s", currentFuncName)
-			}
+			finishReason, _ = data["reason"].(string)
+			usage.observeFinishMetadata(data)
 			return false // Stop processing
 		}
 		return true // Continue processing
 	})
 
+	toolCalls.validate()
+
+	usage.addCompletion(contentBuilder.String())
 	message := ChatMessage{
 		Role:    "assistant",
 		Content: contentBuilder.String(),
 	}
-
-	finishReason := "stop"
-	if len(toolCalls) > 0 {
-		message.ToolCalls = toolCalls
-		finishReason = "tool_calls"
+	if len(toolCalls.calls) > 0 {
+		message.ToolCalls = toolCalls.calls
 	}
+	total := usage.usage()
+	chargeClientTokens(c, total)
 
 	response := ChatCompletionResponse{
 		ID:      "chatcmpl-" + uuid.New().String(),
@@ -297,16 +288,12 @@ func handleNonStreamingResponse(c *gin.Context, resp *http.Response, request Cha
 		Choices: []ChatCompletionChoice{{
 			Message:      message,
 			Index:        0,
-			FinishReason: finishReason,
+			FinishReason: mapJetbrainsFinishReasonToOpenAI(finishReason, len(toolCalls.calls) > 0),
 		}},
-		Usage: map[string]int{
-			"prompt_tokens":     0,
-			"completion_tokens": 0,
-			"total_tokens":      0,
-		},
+		Usage: total.openAI(),
 	}
 
-	recordRequest(true, time.Since(startTime).Milliseconds(), request.Model, accountIdentifier)
+	recordRequest(true, time.Since(startTime).Milliseconds(), request.Model, accountIdentifier, clientKeyName(c))
 	c.JSON(http.StatusOK, response)
 }
 
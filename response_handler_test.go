@@ -0,0 +1,155 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bytedance/sonic"
+	"github.com/gin-gonic/gin"
+)
+
+// twoToolCallStream returns an upstream stream with two tool calls split across several events
+func twoToolCallStream() *http.Response {
+	return jetbrainsStreamBody(
+		`{"type":"ToolCall","id":"call_1","name":"get_weather","content":""}`,
+		`{"type":"ToolCall","id":null,"name":null,"content":"{\"city\":"}`,
+		`{"type":"ToolCall","id":null,"name":null,"content":"\"Paris\"}"}`,
+		`{"type":"ToolCall","id":"call_2","name":"get_time","content":""}`,
+		`{"type":"ToolCall","id":null,"name":null,"content":"{}"}`,
+		`{"type":"FinishMetadata","reason":"tool_call"}`,
+	)
+}
+
+// parseOpenAIStreamChunks decodes every "data:" chunk of an OpenAI stream except [DONE]
+func parseOpenAIStreamChunks(t *testing.T, body string) []StreamResponse {
+	t.Helper()
+	var chunks []StreamResponse
+	for _, line := range strings.Split(body, "\n") {
+		data, ok := strings.CutPrefix(line, "data: ")
+		if !ok || data == "[DONE]" {
+			continue
+		}
+		var chunk StreamResponse
+		if err := sonic.UnmarshalString(data, &chunk); err != nil {
+			t.Fatalf("invalid chunk %q: %v", data, err)
+		}
+		chunks = append(chunks, chunk)
+	}
+	return chunks
+}
+
+func TestHandleStreamingResponse_MultipleToolCalls(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+
+	handleStreamingResponse(c, twoToolCallStream(), ChatCompletionRequest{Model: "test-model"}, 0, time.Now(), "test")
+
+	// 按 index 重组增量，验证两个工具调用互不干扰
+	ids := map[int]string{}
+	args := map[int]string{}
+	for _, chunk := range parseOpenAIStreamChunks(t, w.Body.String()) {
+		deltaToolCalls, _ := chunk.Choices[0].Delta["tool_calls"].([]any)
+		for _, raw := range deltaToolCalls {
+			toolCall := raw.(map[string]any)
+			index := int(toolCall["index"].(float64))
+			if id, ok := toolCall["id"].(string); ok {
+				ids[index] = id
+			}
+			args[index] += toolCall["function"].(map[string]any)["arguments"].(string)
+		}
+	}
+
+	if ids[0] != "call_1" || ids[1] != "call_2" {
+		t.Errorf("unexpected tool call ids by index: %v", ids)
+	}
+	if args[0] != `{"city":"Paris"}` || args[1] != "{}" {
+		t.Errorf("arguments should be reassembled per index, got %v", args)
+	}
+	if !strings.Contains(w.Body.String(), `"finish_reason":"tool_calls"`) {
+		t.Errorf("expected finish_reason tool_calls, got:\n%s", w.Body.String())
+	}
+}
+
+func TestHandleStreamingResponse_TextOnlyFinishReason(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+
+	resp := jetbrainsStreamBody(
+		`{"type":"Content","content":"Hello"}`,
+		`{"type":"FinishMetadata","reason":"stop"}`,
+	)
+	handleStreamingResponse(c, resp, ChatCompletionRequest{Model: "test-model"}, 0, time.Now(), "test")
+
+	chunks := parseOpenAIStreamChunks(t, w.Body.String())
+	last := chunks[len(chunks)-1].Choices[0]
+	if last.FinishReason == nil || *last.FinishReason != "stop" {
+		t.Errorf("text-only stream should finish with stop, got %v", last.FinishReason)
+	}
+}
+
+func TestHandleNonStreamingResponse_ParallelToolCallsDisabled(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	parallel := false
+
+	for _, tc := range []struct {
+		name     string
+		parallel *bool
+		expected int
+	}{
+		{"default", nil, 2},
+		{"disabled", &parallel, 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			request := ChatCompletionRequest{Model: "test-model", ParallelToolCalls: tc.parallel}
+
+			handleNonStreamingResponse(c, twoToolCallStream(), request, 0, time.Now(), "test")
+
+			var resp ChatCompletionResponse
+			if err := sonic.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("invalid response: %v", err)
+			}
+			toolCalls := resp.Choices[0].Message.ToolCalls
+			if len(toolCalls) != tc.expected {
+				t.Fatalf("expected %d tool calls, got %d: %+v", tc.expected, len(toolCalls), toolCalls)
+			}
+			if toolCalls[0].ID != "call_1" || toolCalls[0].Function.Arguments != `{"city":"Paris"}` {
+				t.Errorf("unexpected first tool call: %+v", toolCalls[0])
+			}
+			if resp.Choices[0].FinishReason != "tool_calls" {
+				t.Errorf("expected finish_reason tool_calls, got %s", resp.Choices[0].FinishReason)
+			}
+		})
+	}
+}
+
+func TestHandleStreamingResponse_IncludeUsage(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+
+	resp := jetbrainsStreamBody(
+		`{"type":"Content","content":"Hello world"}`,
+		`{"type":"FinishMetadata","reason":"stop"}`,
+	)
+	request := ChatCompletionRequest{Model: "test-model", Stream: true, StreamOptions: &StreamOptions{IncludeUsage: true}}
+	handleStreamingResponse(c, resp, request, 12, time.Now(), "test")
+
+	chunks := parseOpenAIStreamChunks(t, w.Body.String())
+	usageChunk := chunks[len(chunks)-1]
+	if len(usageChunk.Choices) != 0 {
+		t.Errorf("usage chunk should have empty choices, got %+v", usageChunk.Choices)
+	}
+	if usageChunk.Usage["prompt_tokens"] != 12 || usageChunk.Usage["completion_tokens"] != 2 || usageChunk.Usage["total_tokens"] != 14 {
+		t.Errorf("unexpected usage: %v", usageChunk.Usage)
+	}
+	if !strings.Contains(w.Body.String(), `"choices":[]`) {
+		t.Errorf("usage chunk should serialize choices as an empty array:\n%s", w.Body.String())
+	}
+}
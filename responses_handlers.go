@@ -0,0 +1,496 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// responses handles OpenAI Responses API requests
+// KISS: Responses 输入项转换为聊天消息，复用现有的账户池和 v8 转换路径
+func responses(c *gin.Context) {
+	startTime := time.Now()
+
+	// 记录性能指标开始
+	defer func() {
+		duration := time.Since(startTime)
+		RecordHTTPRequest(duration)
+	}()
+
+	var request ResponsesRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		recordFailureWithTimer(startTime, "", "", clientKeyName(c))
+		RecordHTTPError()
+		respondWithError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	inputMessages, err := responsesInputToChatMessages(request.Input)
+	if err != nil {
+		recordFailureWithTimer(startTime, request.Model, "", clientKeyName(c))
+		RecordHTTPError()
+		respondWithError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// previous_response_id: 在保存的对话之后追加本次输入 (instructions 不会被继承)
+	var conversation []ChatMessage
+	if request.PreviousResponseID != "" {
+		previous, err := loadOwnedResponse(c, request.PreviousResponseID)
+		if err != nil {
+			recordFailureWithTimer(startTime, request.Model, "", clientKeyName(c))
+			respondWithError(c, http.StatusInternalServerError, fmt.Sprintf("Failed to load previous response: %v", err))
+			return
+		}
+		if previous == nil {
+			recordFailureWithTimer(startTime, request.Model, "", clientKeyName(c))
+			respondWithError(c, http.StatusNotFound, fmt.Sprintf("Previous response with id '%s' not found", request.PreviousResponseID))
+			return
+		}
+		conversation = append(conversation, previous.Messages...)
+	}
+	conversation = append(conversation, inputMessages...)
+
+	if len(conversation) == 0 {
+		recordFailureWithTimer(startTime, request.Model, "", clientKeyName(c))
+		respondWithError(c, http.StatusBadRequest, "input is required")
+		return
+	}
+
+	chatRequest := responsesToChatRequest(request, conversation)
+	serveChatCompletion(c, chatRequest, startTime, func(c *gin.Context, resp *http.Response, _ ChatCompletionRequest, promptTokens int, startTime time.Time, accountIdentifier string) {
+		handleResponsesResponse(c, resp, request, conversation, promptTokens, startTime, accountIdentifier)
+	})
+}
+
+// loadOwnedResponse 读取当前客户端密钥保存的响应，属于其他密钥的响应视为不存在
+func loadOwnedResponse(c *gin.Context, id string) (*StoredResponse, error) {
+	stored, err := responseStore.LoadResponse(id)
+	if err != nil || stored == nil || stored.Owner != currentClientKeyID(c) {
+		return nil, err
+	}
+	return stored, nil
+}
+
+// getResponse returns a stored response
+func getResponse(c *gin.Context) {
+	stored, err := loadOwnedResponse(c, c.Param("id"))
+	if err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if stored == nil {
+		respondWithError(c, http.StatusNotFound, fmt.Sprintf("Response with id '%s' not found", c.Param("id")))
+		return
+	}
+	c.JSON(http.StatusOK, stored.Response)
+}
+
+// deleteResponse deletes a stored response
+func deleteResponse(c *gin.Context) {
+	id := c.Param("id")
+	stored, err := loadOwnedResponse(c, id)
+	if err == nil && stored != nil {
+		err = responseStore.DeleteResponse(id)
+	}
+	if err != nil {
+		respondWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if stored == nil {
+		respondWithError(c, http.StatusNotFound, fmt.Sprintf("Response with id '%s' not found", id))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"id": id, "object": "response", "deleted": true})
+}
+
+// newResponsesItemID generates an ID in the OpenAI style, e.g. resp_..., msg_..., fc_...
+func newResponsesItemID(prefix string) string {
+	return prefix + "_" + strings.ReplaceAll(uuid.New().String(), "-", "")
+}
+
+// responsesInputToChatMessages converts Responses API input (string or item list) to chat messages
+func responsesInputToChatMessages(input any) ([]ChatMessage, error) {
+	switch v := input.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []ChatMessage{{Role: "user", Content: v}}, nil
+	case []any:
+		var messages []ChatMessage
+		for _, raw := range v {
+			item, ok := raw.(map[string]any)
+			if !ok {
+				return nil, errors.New("input items must be objects")
+			}
+
+			switch itemType, _ := item["type"].(string); itemType {
+			case "", "message":
+				role, _ := item["role"].(string)
+				if role == "developer" {
+					role = "system"
+				}
+				messages = append(messages, ChatMessage{Role: role, Content: responsesContentToChat(item["content"])})
+			case "function_call":
+				callID, _ := item["call_id"].(string)
+				name, _ := item["name"].(string)
+				arguments, _ := item["arguments"].(string)
+				toolCall := ToolCall{ID: callID, Type: "function", Function: Function{Name: name, Arguments: arguments}}
+
+				// 连续的函数调用 (以及前面的助手文本) 合并为同一条助手消息
+				if last := len(messages) - 1; last >= 0 && messages[last].Role == "assistant" {
+					messages[last].ToolCalls = append(messages[last].ToolCalls, toolCall)
+				} else {
+					messages = append(messages, ChatMessage{Role: "assistant", ToolCalls: []ToolCall{toolCall}})
+				}
+			case "function_call_output":
+				callID, _ := item["call_id"].(string)
+				output, ok := item["output"].(string)
+				if !ok {
+					outputJSON, _ := marshalJSON(item["output"])
+					output = string(outputJSON)
+				}
+				messages = append(messages, ChatMessage{Role: "tool", ToolCallID: callID, Content: output})
+			case "reasoning", "item_reference":
+				Debug("Skipping Responses input item of type %s", itemType)
+			default:
+				Warn("Unsupported Responses input item type: %s", itemType)
+			}
+		}
+		return messages, nil
+	}
+	return nil, errors.New("input must be a string or an array of items")
+}
+
+// responsesContentToChat converts Responses content parts to chat content parts
+func responsesContentToChat(content any) any {
+	parts, ok := content.([]any)
+	if !ok {
+		return content
+	}
+
+	var chatParts []any
+	for _, raw := range parts {
+		part, ok := raw.(map[string]any)
+		if !ok {
+			continue
+		}
+		switch partType, _ := part["type"].(string); partType {
+		case "input_text", "output_text", "text":
+			chatParts = append(chatParts, map[string]any{"type": "text", "text": part["text"]})
+		case "input_image":
+			if url, ok := part["image_url"].(string); ok {
+				chatParts = append(chatParts, map[string]any{"type": "image_url", "image_url": map[string]any{"url": url}})
+			} else {
+				Warn("Only inline image_url input images are supported")
+			}
+		default:
+			Warn("Unsupported Responses content part type: %s", partType)
+		}
+	}
+	return chatParts
+}
+
+// responsesToChatRequest builds the chat request sent through the shared upstream path
+func responsesToChatRequest(request ResponsesRequest, conversation []ChatMessage) ChatCompletionRequest {
+	var messages []ChatMessage
+	if request.Instructions != "" {
+		messages = append(messages, ChatMessage{Role: "system", Content: request.Instructions})
+	}
+	messages = append(messages, conversation...)
+
+	var tools []Tool
+	for _, tool := range request.Tools {
+		if tool.Type != "function" {
+			Warn("Skipping unsupported Responses tool type: %s", tool.Type)
+			continue
+		}
+		tools = append(tools, Tool{
+			Type: "function",
+			Function: ToolFunction{
+				Name:        tool.Name,
+				Description: tool.Description,
+				Parameters:  tool.Parameters,
+			},
+		})
+	}
+
+	// Responses 的 {"type":"function","name":...} 对应聊天接口的 {"type":"function","function":{"name":...}}
+	toolChoice := request.ToolChoice
+	if choice, ok := toolChoice.(map[string]any); ok && choice["type"] == "function" {
+		toolChoice = map[string]any{"type": "function", "function": map[string]any{"name": choice["name"]}}
+	}
+
+	return ChatCompletionRequest{
+		Model:             request.Model,
+		Messages:          messages,
+		Stream:            request.Stream,
+		Temperature:       request.Temperature,
+		MaxTokens:         request.MaxOutputTokens,
+		TopP:              request.TopP,
+		Tools:             tools,
+		ToolChoice:        toolChoice,
+		ParallelToolCalls: request.ParallelToolCalls,
+	}
+}
+
+// responseBuilder assembles Responses API output items from upstream events
+// 流式模式下同时发送 response.* 类型化事件
+type responseBuilder struct {
+	c         *gin.Context
+	stream    bool
+	sequence  int
+	response  ResponseObject
+	message   *ResponseOutputMessage // 当前打开的消息项
+	call      *ResponseFunctionCall  // 当前打开的函数调用项
+	toolCalls *toolCallCollector
+}
+
+// newResponseBuilder creates a builder with an in-progress response
+func newResponseBuilder(c *gin.Context, request ResponsesRequest) *responseBuilder {
+	response := ResponseObject{
+		ID:                newResponsesItemID("resp"),
+		Object:            "response",
+		CreatedAt:         time.Now().Unix(),
+		Status:            "in_progress",
+		Model:             request.Model,
+		Output:            []any{},
+		Tools:             request.Tools,
+		ToolChoice:        request.ToolChoice,
+		ParallelToolCalls: request.ParallelToolCalls == nil || *request.ParallelToolCalls,
+		MaxOutputTokens:   request.MaxOutputTokens,
+		Store:             request.Store == nil || *request.Store,
+		Metadata:          request.Metadata,
+	}
+	if response.Tools == nil {
+		response.Tools = []ResponsesTool{}
+	}
+	if response.ToolChoice == nil {
+		response.ToolChoice = "auto"
+	}
+	if response.Metadata == nil {
+		response.Metadata = map[string]string{}
+	}
+	if request.Instructions != "" {
+		response.Instructions = stringPtr(request.Instructions)
+	}
+	if request.PreviousResponseID != "" {
+		response.PreviousResponseID = stringPtr(request.PreviousResponseID)
+	}
+
+	return &responseBuilder{
+		c:         c,
+		stream:    request.Stream,
+		response:  response,
+		toolCalls: newToolCallCollector(ChatCompletionRequest{ParallelToolCalls: request.ParallelToolCalls}),
+	}
+}
+
+// emit writes a typed streaming event
+func (b *responseBuilder) emit(eventType string, payload gin.H) {
+	if !b.stream {
+		return
+	}
+	payload["type"] = eventType
+	payload["sequence_number"] = b.sequence
+	b.sequence++
+
+	data, _ := marshalJSON(payload)
+	fmt.Fprintf(b.c.Writer, "event: %s\ndata: %s\n\n", eventType, string(data))
+	b.c.Writer.Flush()
+}
+
+// outputIndex returns the index of the currently open item
+func (b *responseBuilder) outputIndex() int {
+	return len(b.response.Output) - 1
+}
+
+// start emits response.created and response.in_progress
+func (b *responseBuilder) start() {
+	b.emit("response.created", gin.H{"response": b.response})
+	b.emit("response.in_progress", gin.H{"response": b.response})
+}
+
+// text appends assistant text, opening a message item if needed
+func (b *responseBuilder) text(delta string) {
+	if b.message == nil {
+		b.closeItem()
+		b.message = &ResponseOutputMessage{
+			Type:    "message",
+			ID:      newResponsesItemID("msg"),
+			Status:  "in_progress",
+			Role:    "assistant",
+			Content: []ResponseOutputText{},
+		}
+		b.response.Output = append(b.response.Output, b.message)
+		b.emit("response.output_item.added", gin.H{"output_index": b.outputIndex(), "item": b.message})
+
+		b.message.Content = append(b.message.Content, ResponseOutputText{Type: "output_text", Annotations: []any{}})
+		b.emit("response.content_part.added", gin.H{
+			"item_id": b.message.ID, "output_index": b.outputIndex(), "content_index": 0, "part": b.message.Content[0],
+		})
+	}
+
+	b.message.Content[0].Text += delta
+	b.emit("response.output_text.delta", gin.H{
+		"item_id": b.message.ID, "output_index": b.outputIndex(), "content_index": 0, "delta": delta, "logprobs": []any{},
+	})
+}
+
+// toolEvent applies an upstream tool call event; returns false if the event was discarded
+func (b *responseBuilder) toolEvent(event jetbrainsToolEvent) bool {
+	if _, ok := b.toolCalls.add(event); !ok {
+		return false
+	}
+
+	if event.Start {
+		b.closeItem()
+		b.call = &ResponseFunctionCall{
+			Type:   "function_call",
+			ID:     newResponsesItemID("fc"),
+			CallID: event.ID,
+			Name:   event.Name,
+			Status: "in_progress",
+		}
+		b.response.Output = append(b.response.Output, b.call)
+		b.emit("response.output_item.added", gin.H{"output_index": b.outputIndex(), "item": b.call})
+	}
+
+	if event.Arguments != "" && b.call != nil {
+		b.call.Arguments += event.Arguments
+		b.emit("response.function_call_arguments.delta", gin.H{
+			"item_id": b.call.ID, "output_index": b.outputIndex(), "delta": event.Arguments,
+		})
+	}
+	return true
+}
+
+// closeItem completes the currently open output item
+func (b *responseBuilder) closeItem() {
+	if b.message != nil {
+		part := b.message.Content[0]
+		b.emit("response.output_text.done", gin.H{
+			"item_id": b.message.ID, "output_index": b.outputIndex(), "content_index": 0, "text": part.Text, "logprobs": []any{},
+		})
+		b.emit("response.content_part.done", gin.H{
+			"item_id": b.message.ID, "output_index": b.outputIndex(), "content_index": 0, "part": part,
+		})
+		b.message.Status = "completed"
+		b.emit("response.output_item.done", gin.H{"output_index": b.outputIndex(), "item": b.message})
+		b.message = nil
+	}
+
+	if b.call != nil {
+		b.emit("response.function_call_arguments.done", gin.H{
+			"item_id": b.call.ID, "output_index": b.outputIndex(), "arguments": b.call.Arguments,
+		})
+		b.call.Status = "completed"
+		b.emit("response.output_item.done", gin.H{"output_index": b.outputIndex(), "item": b.call})
+		b.call = nil
+	}
+}
+
+// finish completes the response and emits response.completed (or response.incomplete)
+func (b *responseBuilder) finish(usage tokenUsage, upstreamReason string) {
+	b.closeItem()
+	b.toolCalls.validate()
+
+	b.response.Usage = &ResponseUsage{
+		InputTokens:  usage.PromptTokens,
+		OutputTokens: usage.CompletionTokens,
+		TotalTokens:  usage.PromptTokens + usage.CompletionTokens,
+	}
+
+	if upstreamReason == "length" {
+		b.response.Status = "incomplete"
+		b.response.IncompleteDetails = gin.H{"reason": "max_output_tokens"}
+		b.emit("response.incomplete", gin.H{"response": b.response})
+		return
+	}
+	b.response.Status = "completed"
+	b.emit("response.completed", gin.H{"response": b.response})
+}
+
+// assistantMessage converts the output items to a chat message for conversation storage
+func (b *responseBuilder) assistantMessage() ChatMessage {
+	var text strings.Builder
+	message := ChatMessage{Role: "assistant"}
+	for _, item := range b.response.Output {
+		switch v := item.(type) {
+		case *ResponseOutputMessage:
+			for _, part := range v.Content {
+				text.WriteString(part.Text)
+			}
+		case *ResponseFunctionCall:
+			message.ToolCalls = append(message.ToolCalls, ToolCall{
+				ID:       v.CallID,
+				Type:     "function",
+				Function: Function{Name: v.Name, Arguments: v.Arguments},
+			})
+		}
+	}
+	message.Content = text.String()
+	return message
+}
+
+// handleResponsesResponse writes the upstream response as a Responses API object or event stream
+func handleResponsesResponse(c *gin.Context, resp *http.Response, request ResponsesRequest, conversation []ChatMessage, promptTokens int, startTime time.Time, accountIdentifier string) {
+	if request.Stream {
+		c.Header("Content-Type", "text/event-stream")
+		c.Header("Cache-Control", "no-cache")
+		c.Header("Connection", "keep-alive")
+	}
+
+	builder := newResponseBuilder(c, request)
+	usage := newUsageTracker(request.Model, promptTokens)
+	upstreamReason := ""
+
+	builder.start()
+	processJetbrainsStream(resp, func(data map[string]any) bool {
+		eventType, _ := data["type"].(string)
+		switch eventType {
+		case "Content":
+			content, _ := data["content"].(string)
+			if content == "" {
+				return true
+			}
+			usage.addCompletion(content)
+			builder.text(content)
+		case "ToolCall", "FunctionCall":
+			toolEvent, _ := parseJetbrainsToolEvent(data)
+			if builder.toolEvent(toolEvent) {
+				usage.addCompletion(toolEvent.Name + toolEvent.Arguments)
+			}
+		case "FinishMetadata":
+			upstreamReason, _ = data["reason"].(string)
+			usage.observeFinishMetadata(data)
+			return false
+		}
+		return true
+	})
+	total := usage.usage()
+	chargeClientTokens(c, total)
+	builder.finish(total, upstreamReason)
+
+	if builder.response.Store {
+		stored := &StoredResponse{
+			Response: builder.response,
+			Messages: append(append([]ChatMessage{}, conversation...), builder.assistantMessage()),
+			Owner:    currentClientKeyID(c),
+		}
+		if err := responseStore.SaveResponse(stored); err != nil {
+			WarnContext(c, "Failed to store response %s: %v", builder.response.ID, err)
+		}
+	}
+
+	recordRequest(true, time.Since(startTime).Milliseconds(), request.Model, accountIdentifier, clientKeyName(c))
+
+	if !request.Stream {
+		c.JSON(http.StatusOK, builder.response)
+	}
+}
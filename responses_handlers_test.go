@@ -0,0 +1,168 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/bytedance/sonic"
+)
+
+// decodeResponseObject decodes a non-streaming Responses API reply
+func decodeResponseObject(t *testing.T, body []byte) map[string]any {
+	t.Helper()
+	var resp map[string]any
+	if err := sonic.Unmarshal(body, &resp); err != nil {
+		t.Fatalf("invalid response: %v", err)
+	}
+	return resp
+}
+
+func TestFakeGrazie_ResponsesText(t *testing.T) {
+	_, router := setupFakeUpstream(t, DefaultFakeGrazieOptions())
+
+	w := doProxyRequest(router, "/v1/responses", `{"model":"test-model","instructions":"Be brief.","input":"hello there"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	resp := decodeResponseObject(t, w.Body.Bytes())
+	if resp["object"] != "response" || resp["status"] != "completed" || !strings.HasPrefix(resp["id"].(string), "resp_") {
+		t.Errorf("unexpected response object: %v", resp)
+	}
+	output := resp["output"].([]any)
+	message := output[0].(map[string]any)
+	text := message["content"].([]any)[0].(map[string]any)["text"]
+	if message["type"] != "message" || text != "Echo: hello there" {
+		t.Errorf("unexpected output: %v", output)
+	}
+	if usage := resp["usage"].(map[string]any); usage["input_tokens"] == float64(0) || usage["output_tokens"] == float64(0) {
+		t.Errorf("usage should be estimated, got %v", usage)
+	}
+}
+
+func TestFakeGrazie_ResponsesFunctionCallChaining(t *testing.T) {
+	_, router := setupFakeUpstream(t, DefaultFakeGrazieOptions())
+
+	w := doProxyRequest(router, "/v1/responses", `{
+		"model":"test-model","input":"weather?",
+		"tools":[{"type":"function","name":"get_weather","parameters":{"type":"object","properties":{"location":{"type":"string"}}}}]
+	}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	first := decodeResponseObject(t, w.Body.Bytes())
+	call := first["output"].([]any)[0].(map[string]any)
+	if call["type"] != "function_call" || call["name"] != "get_weather" || call["call_id"] == "" {
+		t.Fatalf("expected a function_call output item, got %v", call)
+	}
+
+	// 只发送函数结果，之前的对话通过 previous_response_id 从服务端恢复
+	second := doProxyRequest(router, "/v1/responses", `{
+		"model":"test-model","previous_response_id":"`+first["id"].(string)+`",
+		"input":[{"type":"function_call_output","call_id":"`+call["call_id"].(string)+`","output":"sunny"}]
+	}`)
+	if second.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", second.Code, second.Body.String())
+	}
+	resp := decodeResponseObject(t, second.Body.Bytes())
+	text := resp["output"].([]any)[0].(map[string]any)["content"].([]any)[0].(map[string]any)["text"]
+	if text != "Tool get_weather returned: sunny" {
+		t.Errorf("function output should be paired with the stored call, got %v", text)
+	}
+	if resp["previous_response_id"] != first["id"] {
+		t.Errorf("previous_response_id should be echoed, got %v", resp["previous_response_id"])
+	}
+
+	// 保存的响应可以查询和删除
+	path := "/v1/responses/" + first["id"].(string)
+	if w := doProxyRequestWithMethod(router, http.MethodGet, path, ""); w.Code != http.StatusOK {
+		t.Errorf("stored response should be retrievable, got %d", w.Code)
+	}
+	if w := doProxyRequestWithMethod(router, http.MethodDelete, path, ""); w.Code != http.StatusOK {
+		t.Errorf("stored response should be deletable, got %d", w.Code)
+	}
+	if w := doProxyRequestWithMethod(router, http.MethodGet, path, ""); w.Code != http.StatusNotFound {
+		t.Errorf("deleted response should be gone, got %d", w.Code)
+	}
+}
+
+func TestFakeGrazie_ResponsesUnknownPreviousResponse(t *testing.T) {
+	_, router := setupFakeUpstream(t, DefaultFakeGrazieOptions())
+
+	w := doProxyRequest(router, "/v1/responses", `{"model":"test-model","previous_response_id":"resp_missing","input":"hi"}`)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for unknown previous_response_id, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestFakeGrazie_ResponsesOwnedByClientKey(t *testing.T) {
+	_, router := setupFakeUpstream(t, DefaultFakeGrazieOptions())
+	const otherKey = "sk-other"
+	// 显示名称相同也不能访问其他密钥的响应
+	currentConfig().ClientKeys[otherKey] = &ClientKey{Key: otherKey, Name: currentConfig().ClientKeys[testClientKey].Name}
+
+	w := doProxyRequest(router, "/v1/responses", `{"model":"test-model","input":"secret plans"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	id := decodeResponseObject(t, w.Body.Bytes())["id"].(string)
+
+	asOther := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+otherKey)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	if w := asOther(http.MethodGet, "/v1/responses/"+id, ""); w.Code != http.StatusNotFound {
+		t.Errorf("another client key should not read the response, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := asOther(http.MethodPost, "/v1/responses", `{"model":"test-model","previous_response_id":"`+id+`","input":"continue"}`); w.Code != http.StatusNotFound {
+		t.Errorf("another client key should not continue the response, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := asOther(http.MethodDelete, "/v1/responses/"+id, ""); w.Code != http.StatusNotFound {
+		t.Errorf("another client key should not delete the response, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := doProxyRequestWithMethod(router, http.MethodGet, "/v1/responses/"+id, ""); w.Code != http.StatusOK {
+		t.Errorf("the owner should still see the response, got %d", w.Code)
+	}
+}
+
+func TestFakeGrazie_ResponsesStreamingEvents(t *testing.T) {
+	_, router := setupFakeUpstream(t, DefaultFakeGrazieOptions())
+
+	w := doProxyRequest(router, "/v1/responses", `{"model":"test-model","input":"hello there","stream":true}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	events := parseSSEEvents(t, w.Body.String())
+	var names []string
+	var text string
+	for i, e := range events {
+		if e.Data["type"] != e.Name || e.Data["sequence_number"] != float64(i) {
+			t.Errorf("event %d has mismatched type or sequence number: %v", i, e.Data)
+		}
+		if e.Name == "response.output_text.delta" {
+			text += e.Data["delta"].(string)
+			continue
+		}
+		names = append(names, e.Name)
+	}
+
+	expected := []string{
+		"response.created", "response.in_progress",
+		"response.output_item.added", "response.content_part.added",
+		"response.output_text.done", "response.content_part.done", "response.output_item.done",
+		"response.completed",
+	}
+	if strings.Join(names, ",") != strings.Join(expected, ",") {
+		t.Fatalf("unexpected event sequence:\n got %v\nwant %v", names, expected)
+	}
+	if text != "Echo: hello there" {
+		t.Errorf("deltas should reassemble the text, got %q", text)
+	}
+}
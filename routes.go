@@ -23,6 +23,9 @@ func setupRoutes() *gin.Engine {
 	// 设置API路由（需要认证）
 	setupAPIRoutes(r)
 
+	// 设置管理路由（需要管理密钥）
+	setupAdminRoutes(r)
+
 	return r
 }
 
@@ -33,7 +36,8 @@ func getGinMode() string {
 
 // setupMiddleware 设置中间件
 func setupMiddleware(r *gin.Engine) {
-	r.Use(gin.Logger())
+	r.Use(requestIDMiddleware)
+	r.Use(accessLogMiddleware)
 	r.Use(gin.Recovery())
 
 	// 添加CORS中间件
@@ -60,30 +64,65 @@ func corsMiddleware() gin.HandlerFunc {
 // setupPublicRoutes 设置公共路由（无需认证）
 func setupPublicRoutes(r *gin.Engine) {
 	r.GET("/", showStatsPage)
-	r.GET("/log", streamLog)
 	r.GET("/api/stats", getStatsData)
 	r.GET("/health", healthCheck)
+	r.GET("/metrics", prometheusMetrics)
 }
 
 // setupAPIRoutes 设置API路由（需要认证）
 func setupAPIRoutes(r *gin.Engine) {
 	api := r.Group("/v1")
-	api.Use(authenticateClient)
+	api.Use(tracingMiddleware, metricsMiddleware, authenticateClient, rateLimitClient, auditMiddleware)
 	{
 		api.GET("/models", listModels)
 		api.POST("/chat/completions", chatCompletions)
+		api.POST("/completions", completions)
+		api.POST("/responses", responses)
+		api.GET("/responses/:id", getResponse)
+		api.DELETE("/responses/:id", deleteResponse)
 		// 新增 Anthropic Messages API 端点 (OCP: 开放扩展)
 		api.POST("/messages", anthropicMessages)
+		api.POST("/messages/count_tokens", anthropicCountTokens)
+	}
+
+	// Gemini generateContent 兼容端点: /v1beta/models/{model}:generateContent
+	gemini := r.Group("/v1beta")
+	gemini.Use(tracingMiddleware, metricsMiddleware, authenticateClient, rateLimitClient, auditMiddleware)
+	{
+		gemini.POST("/models/:modelAction", geminiModelAction)
+	}
+}
+
+// setupAdminRoutes 设置管理路由（需要 ADMIN_API_KEY）
+func setupAdminRoutes(r *gin.Engine) {
+	// 日志中可能包含请求内容，/log 需要管理密钥
+	r.GET("/log", authenticateAdmin, streamLog)
+
+	admin := r.Group("/admin")
+	admin.Use(authenticateAdmin)
+	{
+		admin.POST("/reload", reloadConfig)
+
+		admin.GET("/accounts", listAccounts)
+		admin.POST("/accounts", addAccount)
+		admin.POST("/accounts/refresh", refreshAccounts)
+		admin.GET("/accounts/:id", getAccount)
+		admin.PATCH("/accounts/:id", updateAccount)
+		admin.DELETE("/accounts/:id", deleteAccount)
+		admin.POST("/accounts/:id/disable", disableAccount)
+		admin.POST("/accounts/:id/enable", enableAccount)
+		admin.POST("/accounts/:id/drain", drainAccount)
 	}
 }
 
 // healthCheck 健康检查端点
 func healthCheck(c *gin.Context) {
+	accounts := accountsSnapshot()
 	c.JSON(200, gin.H{
 		"status":     "healthy",
 		"service":    "jetbrainsai2api",
 		"timestamp":  time.Now().Format("2006-01-02 15:04:05"),
-		"accounts":   len(jetbrainsAccounts),
-		"valid_keys": len(validClientKeys),
+		"accounts":   len(accounts),
+		"valid_keys": len(currentConfig().ClientKeys),
 	})
 }
@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"sort"
 	"strconv"
 	"sync"
 	"sync/atomic"
@@ -42,36 +43,32 @@ func showStatsPage(c *gin.Context) {
 
 // getStatsData 获取统计数据的JSON API端点
 func getStatsData(c *gin.Context) {
-	// 清除配额缓存，强制从上游重新获取配额信息
-	quotaCacheMutex.Lock()
-	for key := range accountQuotaCache {
-		delete(accountQuotaCache, key)
-	}
-	quotaCacheMutex.Unlock()
-
-	// 获取Token信息
+	// 获取Token信息 (配额来自后台监控的缓存，不访问上游)
+	accounts := accountsSnapshot()
 	var tokensInfo []gin.H
-	for i := range jetbrainsAccounts {
-		tokenInfo, err := getTokenInfoFromAccount(&jetbrainsAccounts[i])
+	for i := range accounts {
+		tokenInfo, err := getTokenInfoFromAccount(accounts[i])
 		if err != nil {
 			tokensInfo = append(tokensInfo, gin.H{
-				"name":       getTokenDisplayName(&jetbrainsAccounts[i]),
-				"license":    "",
-				"used":       0.0,
-				"total":      0.0,
-				"usageRate":  0.0,
-				"expiryDate": "",
-				"status":     "Error",
+				"name":         getTokenDisplayName(accounts[i]),
+				"license":      "",
+				"used":         0.0,
+				"total":        0.0,
+				"usageRate":    0.0,
+				"expiryDate":   "",
+				"quotaResetAt": "",
+				"status":       "Error",
 			})
 		} else {
 			tokensInfo = append(tokensInfo, gin.H{
-				"name":       tokenInfo.Name,
-				"license":    tokenInfo.License,
-				"used":       tokenInfo.Used,
-				"total":      tokenInfo.Total,
-				"usageRate":  tokenInfo.UsageRate,
-				"expiryDate": tokenInfo.ExpiryDate.Format("2006-01-02 15:04:05"),
-				"status":     tokenInfo.Status,
+				"name":         tokenInfo.Name,
+				"license":      tokenInfo.License,
+				"used":         tokenInfo.Used,
+				"total":        tokenInfo.Total,
+				"usageRate":    tokenInfo.UsageRate,
+				"expiryDate":   tokenInfo.ExpiryDate.Format("2006-01-02 15:04:05"),
+				"quotaResetAt": formatQuotaReset(tokenInfo.QuotaReset),
+				"status":       tokenInfo.Status,
 			})
 		}
 	}
@@ -84,48 +81,54 @@ func getStatsData(c *gin.Context) {
 
 	// 准备Token过期监控数据
 	var expiryInfo []gin.H
-	for i := range jetbrainsAccounts {
-		account := &jetbrainsAccounts[i]
-		expiryTime := account.ExpiryTime
+	for i := range accounts {
+		account := accounts[i]
+		_, expiryTime := accountJWT(account)
 
+		flags := accountFlagsState(account)
 		status := "Normal"
 		warning := "Normal"
-		if time.Now().Add(1 * time.Hour).After(expiryTime) {
+		if flags.Retired || isStaticJWTExpired(account) {
+			status = "Expired"
+			warning = "Expired, removed from pool"
+		} else if flags.Disabled {
+			status = "Disabled"
+			warning = "Disabled by admin"
+		} else if flags.Draining {
+			status = "Draining"
+			warning = "Draining, no new requests"
+		} else if time.Now().Add(1 * time.Hour).After(expiryTime) {
 			status = "About to expire"
 			warning = "About to expire"
 		}
 
 		expiryInfo = append(expiryInfo, gin.H{
 			"name":       getTokenDisplayName(account),
+			"type":       getAccountTypeName(account),
 			"expiryTime": expiryTime.Format("2006-01-02 15:04:05"),
 			"status":     status,
 			"warning":    warning,
 		})
 	}
 
+	accountHealth, accountEvents := getAccountHealthStats(accounts)
+
 	// 返回JSON数据
 	c.JSON(200, gin.H{
-		"currentTime":  time.Now().Format("2006-01-02 15:04:05"),
-		"currentQPS":   fmt.Sprintf("%.3f", currentQPS),
-		"totalRecords": len(requestStats.RequestHistory),
-		"stats24h":     stats24h,
-		"stats7d":      stats7d,
-		"stats30d":     stats30d,
-		"tokensInfo":   tokensInfo,
-		"expiryInfo":   expiryInfo,
+		"currentTime":   time.Now().Format("2006-01-02 15:04:05"),
+		"currentQPS":    fmt.Sprintf("%.3f", currentQPS),
+		"totalRecords":  len(requestStats.RequestHistory),
+		"stats24h":      stats24h,
+		"stats7d":       stats7d,
+		"stats30d":      stats30d,
+		"tokensInfo":    tokensInfo,
+		"expiryInfo":    expiryInfo,
+		"clientUsage":   getClientUsageStats(24),
+		"accountHealth": accountHealth,
+		"accountEvents": accountEvents,
 	})
 }
 
-// streamLog 流式日志输出
-func streamLog(c *gin.Context) {
-	c.Header("Content-Type", "text/event-stream")
-	c.Header("Cache-Control", "no-cache")
-	c.Header("Connection", "keep-alive")
-
-	// Keep the connection open
-	<-c.Request.Context().Done()
-}
-
 func truncateString(s string, prefixLen, suffixLen int, replacement string) string {
 	if len(s) > prefixLen+suffixLen {
 		return s[:prefixLen] + replacement + s[len(s)-suffixLen:]
@@ -134,8 +137,8 @@ func truncateString(s string, prefixLen, suffixLen int, replacement string) stri
 }
 
 func getTokenDisplayName(account *JetbrainsAccount) string {
-	if account.JWT != "" {
-		return truncateString(account.JWT, 0, 6, "Token ...")
+	if jwt, _ := accountJWT(account); jwt != "" {
+		return truncateString(jwt, 0, 6, "Token ...")
 	}
 	if account.LicenseID != "" {
 		return truncateString(account.LicenseID, 0, 6, "Token ...")
@@ -143,9 +146,17 @@ func getTokenDisplayName(account *JetbrainsAccount) string {
 	return "Token Unknown"
 }
 
+// getAccountTypeName returns how the account authenticates
+func getAccountTypeName(account *JetbrainsAccount) string {
+	if isStaticJWTAccount(account) {
+		return "Static JWT"
+	}
+	return "License"
+}
+
 func getLicenseDisplayName(account *JetbrainsAccount) string {
-	if account.Authorization != "" {
-		return truncateString(account.Authorization, 3, 3, "*")
+	if authorization := accountAuthorization(account); authorization != "" {
+		return truncateString(authorization, 3, 3, "*")
 	}
 	return "Unknown"
 }
@@ -195,7 +206,7 @@ func triggerAsyncSave() {
 }
 
 // Statistics functions
-func recordRequest(success bool, responseTime int64, model, account string) {
+func recordRequest(success bool, responseTime int64, model, account, client string) {
 	statsMutex.Lock()
 	defer statsMutex.Unlock()
 
@@ -216,6 +227,7 @@ func recordRequest(success bool, responseTime int64, model, account string) {
 		ResponseTime: responseTime,
 		Model:        model,
 		Account:      account,
+		Client:       client,
 	}
 
 	requestStats.RequestHistory = append(requestStats.RequestHistory, record)
@@ -261,6 +273,47 @@ func getPeriodStats(hours int) PeriodStats {
 	return stats
 }
 
+// getClientUsageStats 按客户端密钥和模型汇总时间段内的请求
+func getClientUsageStats(hours int) []ClientUsageStats {
+	statsMutex.Lock()
+	defer statsMutex.Unlock()
+
+	cutoff := time.Now().Add(-time.Duration(hours) * time.Hour)
+	type usageKey struct{ client, model string }
+	totals := make(map[usageKey]*ClientUsageStats)
+	successes := make(map[usageKey]int64)
+	var order []usageKey
+
+	for _, record := range requestStats.RequestHistory {
+		if !record.Timestamp.After(cutoff) || record.Client == "" {
+			continue
+		}
+		key := usageKey{record.Client, record.Model}
+		if totals[key] == nil {
+			totals[key] = &ClientUsageStats{Client: record.Client, Model: record.Model}
+			order = append(order, key)
+		}
+		totals[key].Requests++
+		if record.Success {
+			successes[key]++
+		}
+	}
+
+	result := make([]ClientUsageStats, 0, len(order))
+	for _, key := range order {
+		usage := *totals[key]
+		usage.SuccessRate = float64(successes[key]) / float64(usage.Requests) * 100
+		result = append(result, usage)
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		if result[i].Client != result[j].Client {
+			return result[i].Client < result[j].Client
+		}
+		return result[i].Requests > result[j].Requests
+	})
+	return result
+}
+
 func getCurrentQPS() float64 {
 	statsMutex.Lock()
 	defer statsMutex.Unlock()
@@ -279,13 +332,25 @@ func getCurrentQPS() float64 {
 }
 
 func getTokenInfoFromAccount(account *JetbrainsAccount) (*TokenInfo, error) {
-	quotaData, err := getQuotaData(account)
-	if err != nil {
+	_, expiryTime := accountJWT(account)
+	// 已过期的静态JWT无法查询配额
+	if accountFlagsState(account).Retired || isStaticJWTExpired(account) {
+		return &TokenInfo{
+			Name:       getTokenDisplayName(account),
+			License:    getLicenseDisplayName(account),
+			ExpiryDate: expiryTime,
+			Status:     "Expired",
+		}, nil
+	}
+
+	cached := getCachedQuota(account)
+	if cached == nil {
 		return &TokenInfo{
 			Name:   getTokenDisplayName(account),
 			Status: "Error",
-		}, err
+		}, fmt.Errorf("quota has not been checked yet")
 	}
+	quotaData := cached.QuotaData
 
 	dailyUsed, _ := strconv.ParseFloat(quotaData.Current.Current.Amount, 64)
 	dailyTotal, _ := strconv.ParseFloat(quotaData.Current.Maximum.Amount, 64)
@@ -295,21 +360,35 @@ func getTokenInfoFromAccount(account *JetbrainsAccount) (*TokenInfo, error) {
 		usageRate = (dailyUsed / dailyTotal) * 100
 	}
 
+	quota := accountQuotaState(account)
 	status := "Normal"
-	if !account.HasQuota {
+	if !quota.HasQuota {
 		status = "Insufficient quota"
-	} else if time.Now().Add(24 * time.Hour).After(account.ExpiryTime) {
+	} else if time.Now().Add(24 * time.Hour).After(expiryTime) {
 		status = "About to expire"
 	}
 
-	return &TokenInfo{
+	info := &TokenInfo{
 		Name:       getTokenDisplayName(account),
 		License:    getLicenseDisplayName(account),
 		Used:       dailyUsed,
 		Total:      dailyTotal,
 		UsageRate:  usageRate,
-		ExpiryDate: account.ExpiryTime,
+		ExpiryDate: expiryTime,
 		Status:     status,
-		HasQuota:   account.HasQuota,
-	}, nil
+		HasQuota:   quota.HasQuota,
+	}
+	// 配额用完的账户显示重置倒计时
+	if !quota.HasQuota && quota.ResetAt.After(time.Now()) {
+		info.QuotaReset = quota.ResetAt
+	}
+	return info, nil
+}
+
+// formatQuotaReset 配额重置时间 (RFC3339，由页面计算倒计时)，没有时返回空字符串
+func formatQuotaReset(resetAt time.Time) string {
+	if resetAt.IsZero() {
+		return ""
+	}
+	return resetAt.Format(time.RFC3339)
 }
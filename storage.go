@@ -9,13 +9,19 @@ import (
 )
 
 const (
-	statsRedisKey = "jetbrainsai2api:stats"
+	statsRedisKey          = "jetbrainsai2api:stats"
+	accountStateRedisKey   = "jetbrainsai2api:accounts"
+	responseRedisKeyPrefix = "jetbrainsai2api:response:"
 )
 
 // StorageInterface defines the interface for persistent storage
 type StorageInterface interface {
 	SaveStats(stats *RequestStats) error
 	LoadStats() (*RequestStats, error)
+	// SaveAccountStates 保存账户运行状态，JWT 已由调用方加密
+	SaveAccountStates(states []PersistedAccountState) error
+	// LoadAccountStates 没有保存过时返回空列表
+	LoadAccountStates() ([]PersistedAccountState, error)
 }
 
 // FileStorage implements persistence using JSON files
@@ -54,6 +60,31 @@ func (fs *FileStorage) LoadStats() (*RequestStats, error) {
 	return &stats, nil
 }
 
+func (fs *FileStorage) SaveAccountStates(states []PersistedAccountState) error {
+	data, err := sonic.MarshalIndent(states, "", "  ")
+	if err != nil {
+		return err
+	}
+	// 包含加密的 JWT，只允许当前用户读取
+	return os.WriteFile(accountStateFilePath, data, 0600)
+}
+
+func (fs *FileStorage) LoadAccountStates() ([]PersistedAccountState, error) {
+	data, err := os.ReadFile(accountStateFilePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var states []PersistedAccountState
+	if err := sonic.Unmarshal(data, &states); err != nil {
+		return nil, err
+	}
+	return states, nil
+}
+
 // RedisStorage implements persistence using Redis
 type RedisStorage struct {
 	client *redis.Client
@@ -116,13 +147,102 @@ func (rs *RedisStorage) LoadStats() (*RequestStats, error) {
 	return &stats, nil
 }
 
+func (rs *RedisStorage) SaveAccountStates(states []PersistedAccountState) error {
+	data, err := marshalJSON(states)
+	if err != nil {
+		return err
+	}
+	return rs.client.Set(rs.ctx, accountStateRedisKey, data, 0).Err()
+}
+
+func (rs *RedisStorage) LoadAccountStates() ([]PersistedAccountState, error) {
+	val, err := rs.client.Get(rs.ctx, accountStateRedisKey).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var states []PersistedAccountState
+	if err := sonic.Unmarshal([]byte(val), &states); err != nil {
+		return nil, err
+	}
+	return states, nil
+}
+
 func (rs *RedisStorage) Close() error {
 	return rs.client.Close()
 }
 
+// ResponseStore persists Responses API results for previous_response_id chaining
+type ResponseStore interface {
+	SaveResponse(stored *StoredResponse) error
+	// LoadResponse returns nil without error when the response does not exist
+	LoadResponse(id string) (*StoredResponse, error)
+	DeleteResponse(id string) error
+}
+
+// MemoryResponseStore keeps responses in an in-process LRU cache
+type MemoryResponseStore struct {
+	cache *LRUCache
+}
+
+func NewMemoryResponseStore() *MemoryResponseStore {
+	return &MemoryResponseStore{cache: NewCache()}
+}
+
+func (ms *MemoryResponseStore) SaveResponse(stored *StoredResponse) error {
+	ms.cache.Set(stored.Response.ID, stored, ResponseStoreTTL)
+	return nil
+}
+
+func (ms *MemoryResponseStore) LoadResponse(id string) (*StoredResponse, error) {
+	if value, found := ms.cache.Get(id); found {
+		return value.(*StoredResponse), nil
+	}
+	return nil, nil
+}
+
+func (ms *MemoryResponseStore) DeleteResponse(id string) error {
+	ms.cache.Delete(id)
+	return nil
+}
+
+func (rs *RedisStorage) SaveResponse(stored *StoredResponse) error {
+	data, err := marshalJSON(stored)
+	if err != nil {
+		return err
+	}
+	return rs.client.Set(rs.ctx, responseRedisKeyPrefix+stored.Response.ID, data, ResponseStoreTTL).Err()
+}
+
+func (rs *RedisStorage) LoadResponse(id string) (*StoredResponse, error) {
+	val, err := rs.client.Get(rs.ctx, responseRedisKeyPrefix+id).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var stored StoredResponse
+	if err := sonic.Unmarshal([]byte(val), &stored); err != nil {
+		return nil, err
+	}
+	return &stored, nil
+}
+
+func (rs *RedisStorage) DeleteResponse(id string) error {
+	return rs.client.Del(rs.ctx, responseRedisKeyPrefix+id).Err()
+}
+
 // Global storage instance
 var storage StorageInterface
 
+// responseStore 默认使用内存存储，配置 Redis 时切换为 Redis 以支持重启和多实例
+var responseStore ResponseStore = NewMemoryResponseStore()
+
 // initStorage initializes the storage based on environment configuration
 func initStorage() error {
 	redisURL := os.Getenv("REDIS_URL")
@@ -135,6 +255,8 @@ func initStorage() error {
 			storage = &FileStorage{}
 		} else {
 			storage = redisStorage
+			responseStore = redisStorage
+			rateLimiter = NewRedisRateLimiter(redisStorage)
 			Info("Using Redis storage")
 		}
 	} else {
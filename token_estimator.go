@@ -0,0 +1,321 @@
+package main
+
+import (
+	"math"
+	"path"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/tiktoken-go/tokenizer"
+)
+
+// tokenEstimator 一个模型家族的 token 计数方式
+// cl100k 和 o200k 使用内嵌的 tiktoken BPE 词表精确计数；
+// Claude、Gemini 等没有可离线使用的官方词表，按单词、数字、CJK 字符和符号分类后用各家族的平均长度估算，结果是近似值
+type tokenEstimator struct {
+	Name string
+	// 内嵌 BPE 词表的编码名称，为空时使用启发式估算
+	encoding tokenizer.Encoding
+	// 词表较大，首次使用时才加载
+	codecOnce sync.Once
+	codec     tokenizer.Codec
+	// 不超过该长度的单词通常被合并为单个 token
+	wholeWordRunes int
+	// 较长单词平均每个 token 覆盖的字节数
+	bytesPerToken float64
+	// 每个 CJK 字符平均占用的 token 数
+	tokensPerCJK float64
+	// 数字按多少位一组切分 (SentencePiece 系列逐位切分)
+	digitsPerToken int
+	// 每条消息的固定开销 (角色与分隔标记)
+	messageOverhead int
+}
+
+// imageTokenEstimate 单张图片的估算 token 数
+const imageTokenEstimate = 765
+
+// defaultTokenEstimator 未配置且无法推断时使用的估算参数
+const defaultTokenEstimator = "default"
+
+// tokenEstimators 已知的估算家族
+var tokenEstimators = map[string]*tokenEstimator{
+	"cl100k":  {Name: "cl100k", encoding: tokenizer.Cl100kBase, wholeWordRunes: 6, bytesPerToken: 4.0, tokensPerCJK: 1.2, digitsPerToken: 3, messageOverhead: 4},
+	"o200k":   {Name: "o200k", encoding: tokenizer.O200kBase, wholeWordRunes: 7, bytesPerToken: 4.5, tokensPerCJK: 0.8, digitsPerToken: 3, messageOverhead: 4},
+	"claude":  {Name: "claude", wholeWordRunes: 6, bytesPerToken: 3.8, tokensPerCJK: 1.1, digitsPerToken: 3, messageOverhead: 5},
+	"gemini":  {Name: "gemini", wholeWordRunes: 7, bytesPerToken: 4.5, tokensPerCJK: 0.7, digitsPerToken: 1, messageOverhead: 4},
+	"qwen":    {Name: "qwen", wholeWordRunes: 7, bytesPerToken: 4.2, tokensPerCJK: 0.7, digitsPerToken: 1, messageOverhead: 4},
+	"default": {Name: "default", wholeWordRunes: 6, bytesPerToken: 4.0, tokensPerCJK: 1.0, digitsPerToken: 3, messageOverhead: 4},
+}
+
+// getTokenEstimatorForModel 返回模型对应的估算参数
+// 优先使用 models.json 中的 tokenizers 配置 (精确匹配优先，其次最长的通配模式)，
+// 否则根据内部模型名称前缀推断
+func getTokenEstimatorForModel(model string) *tokenEstimator {
+	if name := configuredTokenEstimatorName(model); name != "" {
+		if family, ok := tokenEstimators[name]; ok {
+			return family
+		}
+		Warn("Unknown token estimator %q configured for model %s, using default", name, model)
+		return tokenEstimators[defaultTokenEstimator]
+	}
+	return tokenEstimators[inferTokenEstimatorName(getInternalModelName(model))]
+}
+
+// configuredTokenEstimatorName 在 models.json 的 tokenizers 配置中查找模型
+func configuredTokenEstimatorName(model string) string {
+	tokenizers := currentConfig().ModelsConfig.Tokenizers
+	if name, ok := tokenizers[model]; ok {
+		return name
+	}
+
+	bestPattern, bestName := "", ""
+	for pattern, name := range tokenizers {
+		if matched, _ := path.Match(pattern, model); matched && len(pattern) > len(bestPattern) {
+			bestPattern, bestName = pattern, name
+		}
+	}
+	return bestName
+}
+
+// inferTokenEstimatorName 根据 JetBrains 内部模型名称推断估算家族
+func inferTokenEstimatorName(internalModel string) string {
+	switch {
+	case strings.HasPrefix(internalModel, "anthropic-"):
+		return "claude"
+	case strings.HasPrefix(internalModel, "openai-gpt-4-"), strings.HasPrefix(internalModel, "openai-gpt-3"):
+		return "cl100k"
+	case strings.HasPrefix(internalModel, "openai-"):
+		return "o200k"
+	case strings.HasPrefix(internalModel, "google-"):
+		return "gemini"
+	case strings.HasPrefix(internalModel, "qwen"):
+		return "qwen"
+	default:
+		return defaultTokenEstimator
+	}
+}
+
+// isCJK 判断字符是否为中日韩文字
+func isCJK(r rune) bool {
+	return unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul)
+}
+
+// bpeCodec 返回家族的 BPE 编码器，没有内嵌词表时返回 nil
+func (f *tokenEstimator) bpeCodec() tokenizer.Codec {
+	if f.encoding == "" {
+		return nil
+	}
+	f.codecOnce.Do(func() {
+		codec, err := tokenizer.Get(f.encoding)
+		if err != nil {
+			Warn("Failed to load %s vocabulary, falling back to estimation: %v", f.encoding, err)
+			return
+		}
+		f.codec = codec
+	})
+	return f.codec
+}
+
+// CountTokens 计算文本的 token 数量，有 BPE 词表时精确计数，否则启发式估算
+func (f *tokenEstimator) CountTokens(text string) int {
+	if codec := f.bpeCodec(); codec != nil {
+		if n, err := codec.Count(text); err == nil {
+			return n
+		}
+	}
+	return f.estimateTokens(text)
+}
+
+// estimateTokens 启发式估算文本的 token 数量
+func (f *tokenEstimator) estimateTokens(text string) int {
+	var tokens float64
+	for i := 0; i < len(text); {
+		r, size := utf8.DecodeRuneInString(text[i:])
+
+		switch {
+		case isCJK(r):
+			tokens += f.tokensPerCJK
+			i += size
+		case unicode.IsLetter(r):
+			// 单词 (包括撇号缩写) 作为一个整体估算
+			start := i
+			runes := 0
+			for i < len(text) {
+				r, size = utf8.DecodeRuneInString(text[i:])
+				if !(unicode.IsLetter(r) || unicode.IsMark(r) || r == '\'') || isCJK(r) {
+					break
+				}
+				runes++
+				i += size
+			}
+			tokens += f.wordTokens(i-start, runes)
+		case unicode.IsDigit(r):
+			digits := 0
+			for i < len(text) {
+				r, size = utf8.DecodeRuneInString(text[i:])
+				if !unicode.IsDigit(r) {
+					break
+				}
+				digits++
+				i += size
+			}
+			tokens += math.Ceil(float64(digits) / float64(f.digitsPerToken))
+		case unicode.IsSpace(r):
+			// 单个空格并入后续单词，连续空白合并为一个 token
+			spaces, newline := 0, false
+			for i < len(text) {
+				r, size = utf8.DecodeRuneInString(text[i:])
+				if !unicode.IsSpace(r) {
+					break
+				}
+				newline = newline || r == '\n'
+				spaces++
+				i += size
+			}
+			if spaces > 1 || newline {
+				tokens++
+			}
+		default:
+			// 标点和符号：连续的符号大约每两个合并为一个 token
+			symbols := 0
+			for i < len(text) {
+				r, size = utf8.DecodeRuneInString(text[i:])
+				if unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.IsSpace(r) {
+					break
+				}
+				symbols++
+				i += size
+			}
+			tokens += math.Ceil(float64(symbols) / 2)
+		}
+	}
+	return int(math.Ceil(tokens))
+}
+
+// wordTokens 估算单个单词的 token 数量
+func (f *tokenEstimator) wordTokens(bytes, runes int) float64 {
+	if runes <= f.wholeWordRunes && bytes == runes {
+		return 1
+	}
+	return math.Max(1, math.Ceil(float64(bytes)/f.bytesPerToken))
+}
+
+// countTokens 使用模型对应的家族计算文本 token 数量
+func countTokens(model, text string) int {
+	if text == "" {
+		return 0
+	}
+	return getTokenEstimatorForModel(model).CountTokens(text)
+}
+
+// estimatePromptTokens 估算发送给上游的消息和参数 (工具定义等) 的 token 数量
+func estimatePromptTokens(model string, messages []JetbrainsMessage, data []JetbrainsData) int {
+	estimator := getTokenEstimatorForModel(model)
+
+	total := 3 // 回复起始标记
+	for _, msg := range messages {
+		total += estimator.messageOverhead
+		if msg.Type == "media_message" {
+			total += imageTokenEstimate
+			continue
+		}
+		total += estimator.CountTokens(msg.Content)
+		total += estimator.CountTokens(msg.ToolName)
+		total += estimator.CountTokens(msg.Result)
+	}
+	for _, item := range data {
+		total += estimator.CountTokens(item.Value)
+	}
+	return total
+}
+
+// tokenUsage 一次请求的 token 用量
+type tokenUsage struct {
+	PromptTokens     int
+	CompletionTokens int
+}
+
+// openAI 转换为 OpenAI usage 格式
+func (u tokenUsage) openAI() map[string]int {
+	return map[string]int{
+		"prompt_tokens":     u.PromptTokens,
+		"completion_tokens": u.CompletionTokens,
+		"total_tokens":      u.PromptTokens + u.CompletionTokens,
+	}
+}
+
+// anthropic 转换为 Anthropic usage 格式
+func (u tokenUsage) anthropic() AnthropicUsage {
+	return AnthropicUsage{
+		InputTokens:  u.PromptTokens,
+		OutputTokens: u.CompletionTokens,
+	}
+}
+
+// usageTracker 累积响应内容并计算最终用量
+// 上游 FinishMetadata 中如果带有真实的 token 计数，则优先使用
+type usageTracker struct {
+	model              string
+	promptTokens       int
+	completion         strings.Builder
+	upstreamPrompt     int
+	upstreamCompletion int
+}
+
+// newUsageTracker 创建用量跟踪器，promptTokens 为请求的估算值
+func newUsageTracker(model string, promptTokens int) *usageTracker {
+	return &usageTracker{model: model, promptTokens: promptTokens}
+}
+
+// addCompletion 记录一段输出内容 (文本或工具参数)
+func (t *usageTracker) addCompletion(text string) {
+	t.completion.WriteString(text)
+}
+
+// observeFinishMetadata 读取 FinishMetadata 事件中的 token 计数
+func (t *usageTracker) observeFinishMetadata(data map[string]any) {
+	sources := []map[string]any{data}
+	if usage, ok := data["usage"].(map[string]any); ok {
+		sources = append(sources, usage)
+	}
+	for _, source := range sources {
+		if n := firstIntField(source, "promptTokens", "prompt_tokens", "inputTokens", "input_tokens"); n > 0 {
+			t.upstreamPrompt = n
+		}
+		if n := firstIntField(source, "completionTokens", "completion_tokens", "outputTokens", "output_tokens"); n > 0 {
+			t.upstreamCompletion = n
+		}
+	}
+}
+
+// usage 返回最终用量
+func (t *usageTracker) usage() tokenUsage {
+	usage := tokenUsage{
+		PromptTokens:     t.promptTokens,
+		CompletionTokens: countTokens(t.model, t.completion.String()),
+	}
+	if t.upstreamPrompt > 0 {
+		usage.PromptTokens = t.upstreamPrompt
+	}
+	if t.upstreamCompletion > 0 {
+		usage.CompletionTokens = t.upstreamCompletion
+	}
+	return usage
+}
+
+// firstIntField 返回第一个存在的数值字段
+func firstIntField(data map[string]any, keys ...string) int {
+	for _, key := range keys {
+		switch v := data[key].(type) {
+		case float64:
+			return int(v)
+		case int:
+			return v
+		case int64:
+			return int(v)
+		}
+	}
+	return 0
+}
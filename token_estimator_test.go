@@ -0,0 +1,91 @@
+package main
+
+import "testing"
+
+func TestGetTokenEstimatorForModel(t *testing.T) {
+	oldConfig := currentConfig()
+	t.Cleanup(func() { setRuntimeConfig(oldConfig) })
+
+	setRuntimeConfig(&RuntimeConfig{ModelsConfig: ModelsConfig{
+		Models: map[string]string{
+			"claude-x":      "anthropic-claude-x",
+			"gpt-legacy":    "openai-gpt-4-turbo",
+			"gemini-custom": "google-gemini-custom",
+			"mystery":       "mystery-model",
+		},
+		Tokenizers: map[string]string{
+			"gemini-*":      "o200k",
+			"gemini-custom": "gemini",
+		},
+	}})
+
+	for model, expected := range map[string]string{
+		"gemini-custom": "gemini", // 精确匹配优先于通配模式
+		"gemini-other":  "o200k",  // 通配模式
+		"claude-x":      "claude", // 根据内部模型名称推断
+		"gpt-legacy":    "cl100k",
+		"mystery":       "default",
+	} {
+		if got := getTokenEstimatorForModel(model).Name; got != expected {
+			t.Errorf("model %s: expected estimator %s, got %s", model, expected, got)
+		}
+	}
+}
+
+func TestTokenEstimator_CountTokensBPE(t *testing.T) {
+	// 与 tiktoken 的参考编码一致
+	for _, tc := range []struct {
+		family string
+		text   string
+		tokens int
+	}{
+		{"cl100k", "tiktoken is great!", 6},
+		{"o200k", "tiktoken is great!", 6},
+		{"cl100k", "你好世界，今天天气很好", 14},
+		{"o200k", "你好世界，今天天气很好", 7},
+		{"cl100k", "", 0},
+	} {
+		if got := tokenEstimators[tc.family].CountTokens(tc.text); got != tc.tokens {
+			t.Errorf("%s %q: expected %d tokens, got %d", tc.family, tc.text, tc.tokens, got)
+		}
+	}
+}
+
+func TestTokenEstimator_CountTokensHeuristic(t *testing.T) {
+	claude := tokenEstimators["claude"]
+
+	if got := claude.CountTokens("Hello world"); got != 2 {
+		t.Errorf("expected 2 tokens for two short words, got %d", got)
+	}
+	if got := claude.CountTokens(""); got != 0 {
+		t.Errorf("expected 0 tokens for empty text, got %d", got)
+	}
+
+	// 长单词被切分为多个 token
+	if got := claude.CountTokens("internationalization"); got < 2 {
+		t.Errorf("long words should span several tokens, got %d", got)
+	}
+
+	// SentencePiece 家族逐位切分数字
+	if gemini := tokenEstimators["gemini"]; gemini.CountTokens("123456") <= claude.CountTokens("123456") {
+		t.Errorf("gemini should split digits individually")
+	}
+}
+
+func TestUsageTracker_UpstreamCountsWin(t *testing.T) {
+	tracker := newUsageTracker("test-model", 42)
+	tracker.addCompletion("Hello world")
+
+	if usage := tracker.usage(); usage.PromptTokens != 42 || usage.CompletionTokens == 0 {
+		t.Errorf("expected estimated usage, got %+v", usage)
+	}
+
+	tracker.observeFinishMetadata(map[string]any{
+		"type":   "FinishMetadata",
+		"reason": "stop",
+		"usage":  map[string]any{"promptTokens": float64(100), "completionTokens": float64(7)},
+	})
+	if usage := tracker.usage(); usage.PromptTokens != 100 || usage.CompletionTokens != 7 {
+		t.Errorf("upstream counts should win, got %+v", usage)
+	}
+}
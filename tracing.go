@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName 本服务创建 span 使用的 tracer 名称，也是默认的 service.name
+const tracerName = "jetbrainsai2api"
+
+// span 属性
+const (
+	attrModel     = attribute.Key("jetbrainsai2api.model")
+	attrAccount   = attribute.Key("jetbrainsai2api.account")
+	attrToolCount = attribute.Key("jetbrainsai2api.tool_count")
+	attrAttempt   = attribute.Key("jetbrainsai2api.attempt")
+	attrStatus    = attribute.Key("http.response.status_code")
+)
+
+// tracingEnabled 是否配置了 OTLP 导出地址
+// 未配置时使用 OpenTelemetry 默认的 no-op TracerProvider，创建 span 没有开销
+func tracingEnabled() bool {
+	if strings.EqualFold(os.Getenv("OTEL_SDK_DISABLED"), "true") {
+		return false
+	}
+	return os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != "" || os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") != ""
+}
+
+// initTracing 配置 OTLP/HTTP 导出和 W3C traceparent 传播，返回退出时调用的 shutdown (导出剩余的 span)
+// 导出地址、请求头和超时使用标准的 OTEL_EXPORTER_OTLP_* 环境变量，服务名使用 OTEL_SERVICE_NAME
+func initTracing(ctx context.Context) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	if !tracingEnabled() {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, err
+	}
+	res, err := resource.New(ctx,
+		resource.WithAttributes(attribute.String("service.name", tracerName)),
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK(),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(provider)
+	Info("OpenTelemetry tracing enabled, exporting spans over OTLP/HTTP")
+	return provider.Shutdown, nil
+}
+
+// startSpan 使用当前的全局 TracerProvider 创建 span (每次获取 tracer，以便测试替换 provider)
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// endSpan 结束 span，err 不为 nil 时记录错误
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// tracingMiddleware 为每个客户端请求创建服务端 span，继承请求头中的 traceparent
+func tracingMiddleware(c *gin.Context) {
+	ctx := otel.GetTextMapPropagator().Extract(c.Request.Context(), propagation.HeaderCarrier(c.Request.Header))
+	ctx, span := otel.Tracer(tracerName).Start(ctx, c.Request.Method+" "+c.FullPath(),
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("http.request.method", c.Request.Method),
+			attribute.String("http.route", c.FullPath()),
+		))
+	defer span.End()
+	c.Request = c.Request.WithContext(ctx)
+
+	c.Next()
+
+	status := c.Writer.Status()
+	span.SetAttributes(attrStatus.Int(status))
+	if status >= 500 {
+		span.SetStatus(codes.Error, "")
+	}
+}
+
+// setRequestSpanAttributes 在请求的服务端 span 上记录模型、账户和工具数量
+func setRequestSpanAttributes(ctx context.Context, attrs ...attribute.KeyValue) {
+	trace.SpanFromContext(ctx).SetAttributes(attrs...)
+}
+
+// tracedStreamBody 上游响应体，第一次读到数据时记录 first_byte 事件，关闭时结束 upstream.stream span
+type tracedStreamBody struct {
+	io.ReadCloser
+	span      trace.Span
+	firstByte sync.Once
+	end       sync.Once
+}
+
+func (b *tracedStreamBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		b.firstByte.Do(func() { b.span.AddEvent("first_byte") })
+	}
+	return n, err
+}
+
+func (b *tracedStreamBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.end.Do(func() { b.span.End() })
+	return err
+}
+
+// traceStreamBody 为上游响应体创建 upstream.stream span，覆盖从收到响应头到处理器关闭响应体的流式阶段
+func traceStreamBody(ctx context.Context, body io.ReadCloser, attrs ...attribute.KeyValue) io.ReadCloser {
+	_, span := startSpan(ctx, "upstream.stream", attrs...)
+	if !span.IsRecording() {
+		return body
+	}
+	return &tracedStreamBody{ReadCloser: body, span: span}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/trace/noop"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// fakeCollector 代替 OTLP/HTTP collector，保存收到的 span
+type fakeCollector struct {
+	mu    sync.Mutex
+	spans []*tracepb.Span
+}
+
+func (f *fakeCollector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	var req coltracepb.ExportTraceServiceRequest
+	if r.URL.Path != "/v1/traces" || proto.Unmarshal(body, &req) != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	f.mu.Lock()
+	for _, rs := range req.ResourceSpans {
+		for _, ss := range rs.ScopeSpans {
+			f.spans = append(f.spans, ss.Spans...)
+		}
+	}
+	f.mu.Unlock()
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	w.WriteHeader(http.StatusOK)
+}
+
+// span 返回指定名称的第一个 span
+func (f *fakeCollector) span(name string) *tracepb.Span {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, span := range f.spans {
+		if span.Name == name {
+			return span
+		}
+	}
+	return nil
+}
+
+// spanAttribute 返回 span 的属性值，不存在时返回 nil
+func spanAttribute(span *tracepb.Span, key string) *commonpb.AnyValue {
+	for _, kv := range span.Attributes {
+		if kv.Key == key {
+			return kv.Value
+		}
+	}
+	return nil
+}
+
+func TestTracing_ExportsRequestPhasesOverOTLP(t *testing.T) {
+	_, router := setupFakeUpstream(t, DefaultFakeGrazieOptions())
+	collector := &fakeCollector{}
+	server := httptest.NewServer(collector)
+	defer server.Close()
+
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", server.URL)
+	shutdown, err := initTracing(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { otel.SetTracerProvider(noop.NewTracerProvider()) })
+
+	const traceID, parentID = "4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7"
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions",
+		strings.NewReader(`{"model":"test-model","messages":[{"role":"user","content":"hi"}],"stream":true}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+testClientKey)
+	req.Header.Set("traceparent", "00-"+traceID+"-"+parentID+"-01")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("request failed: %d %s", w.Code, w.Body.String())
+	}
+	if err := shutdown(context.Background()); err != nil {
+		t.Fatalf("failed to flush spans: %v", err)
+	}
+
+	root := collector.span("POST /v1/chat/completions")
+	if root == nil {
+		t.Fatal("expected a server span for the request")
+	}
+	if hex.EncodeToString(root.TraceId) != traceID || hex.EncodeToString(root.ParentSpanId) != parentID {
+		t.Errorf("server span should continue the incoming traceparent, got trace %x parent %x", root.TraceId, root.ParentSpanId)
+	}
+	account := getTokenDisplayName(jetbrainsAccounts[0])
+	if spanAttribute(root, "jetbrainsai2api.model").GetStringValue() != "test-model" ||
+		spanAttribute(root, "jetbrainsai2api.account").GetStringValue() != account {
+		t.Errorf("server span should carry the model and account, got %v", root.Attributes)
+	}
+
+	for _, name := range []string{"convert", "account.select", "upstream.attempt", "upstream.stream"} {
+		span := collector.span(name)
+		if span == nil {
+			t.Errorf("expected a %s span", name)
+			continue
+		}
+		if hex.EncodeToString(span.TraceId) != traceID {
+			t.Errorf("%s span should belong to the incoming trace", name)
+		}
+	}
+	if attempt := collector.span("upstream.attempt"); attempt != nil {
+		if spanAttribute(attempt, "jetbrainsai2api.tool_count") == nil ||
+			spanAttribute(attempt, "jetbrainsai2api.account").GetStringValue() != account {
+			t.Errorf("upstream.attempt should carry the account and tool count, got %v", attempt.Attributes)
+		}
+	}
+	if stream := collector.span("upstream.stream"); stream != nil && (len(stream.Events) == 0 || stream.Events[0].Name != "first_byte") {
+		t.Errorf("upstream.stream should record the first byte, got %v", stream.Events)
+	}
+}
+
+func TestTracing_DisabledIsNoop(t *testing.T) {
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", "")
+	t.Setenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", "")
+	otel.SetTracerProvider(noop.NewTracerProvider())
+
+	shutdown, err := initTracing(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer shutdown(context.Background())
+	if _, span := startSpan(context.Background(), "convert"); span.IsRecording() {
+		t.Error("spans should not be recorded when tracing is disabled")
+	}
+}
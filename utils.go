@@ -11,12 +11,6 @@ import (
 	"github.com/gin-gonic/gin"
 )
 
-// IsDebug returns true if the application is running in debug mode
-// 保留此函数以维持向下兼容性
-func IsDebug() bool {
-	return gin.Mode() == gin.DebugMode
-}
-
 // InitLogger 初始化应用程序日志系统
 func InitLogger() {
 	// 日志系统已在logger.go中自动初始化
@@ -48,13 +42,13 @@ func extractTextContent(content any) string {
 }
 
 // recordFailureWithTimer records a failed request with elapsed time
-func recordFailureWithTimer(startTime time.Time, model, account string) {
-	recordRequest(false, time.Since(startTime).Milliseconds(), model, account)
+func recordFailureWithTimer(startTime time.Time, model, account, client string) {
+	recordRequest(false, time.Since(startTime).Milliseconds(), model, account, client)
 }
 
 // recordSuccess records a successful request with elapsed time
-func recordSuccess(startTime time.Time, model, account string) {
-	recordRequest(true, time.Since(startTime).Milliseconds(), model, account)
+func recordSuccess(startTime time.Time, model, account, client string) {
+	recordRequest(true, time.Since(startTime).Milliseconds(), model, account, client)
 }
 
 // parseEnvList parses comma-separated environment variable into trimmed slice
@@ -73,8 +67,13 @@ func parseEnvList(envVar string) []string {
 }
 
 // respondWithError sends a JSON error response
+// 错误响应包含 request_id，方便客户端反馈问题时对应日志；Gemini 端点 (包括认证和共享的转发逻辑) 使用 Google API 错误格式
 func respondWithError(c *gin.Context, code int, message string) {
-	c.JSON(code, gin.H{"error": message})
+	if isGeminiRoute(c) {
+		respondWithGeminiError(c, code, message)
+		return
+	}
+	c.JSON(code, gin.H{"error": message, "request_id": requestIDFromContext(c)})
 }
 
 // getEnvWithDefault gets environment variable with default value